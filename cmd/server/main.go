@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/NicolasHaas/gospeak/pkg/logging"
 	"github.com/NicolasHaas/gospeak/pkg/server"
@@ -22,7 +23,15 @@ func main() {
 	flag.StringVar(&cfg.DataDir, "data", ".", "Data directory for generated files")
 	flag.BoolVar(&cfg.AllowNoToken, "open", false, "Allow users to join without a token (open server)")
 	flag.StringVar(&cfg.ChannelsFile, "channels-file", "", "YAML file defining channels to create on startup")
+	flag.StringVar(&cfg.RolesFile, "roles-file", "", "YAML file defining custom roles and their permissions")
 	flag.StringVar(&cfg.MetricsAddr, "metrics", cfg.MetricsAddr, "HTTP bind address for Prometheus /metrics (empty to disable)")
+	flag.DurationVar(&cfg.ResumeWindow, "resume-window", cfg.ResumeWindow, "How long a dropped client can resume its session (0 to disable)")
+	flag.DurationVar(&cfg.ChatRetention, "chat-retention", cfg.ChatRetention, "How long channel chat history is kept unless a channel sets its own (0 to keep none)")
+	flag.StringVar(&cfg.MOTD, "motd", "", "Message of the day shown to users when they connect")
+	motdFile := flag.String("motd-file", "", "File holding the message of the day (overrides -motd)")
+	flag.DurationVar(&cfg.ShutdownGrace, "shutdown-grace", cfg.ShutdownGrace, "How long to keep serving after SIGINT/SIGTERM while users are warned (0 to stop at once)")
+	flag.IntVar(&cfg.SendQueueSize, "send-queue", cfg.SendQueueSize, "Control messages queued per client")
+	flag.StringVar(&cfg.SendQueueOverflow, "send-queue-overflow", cfg.SendQueueOverflow, "What to do when a client's queue is full: disconnect, or drop state deltas (other messages still disconnect)")
 	flag.BoolVar(&cfg.ExportUsers, "export-users", false, "Export all users as YAML and exit")
 	flag.BoolVar(&cfg.ExportChannels, "export-channels", false, "Export all channels as YAML and exit")
 
@@ -39,6 +48,19 @@ func main() {
 		fmt.Fprintf(os.Stderr, "invalid logging config: %v\n", err)
 		os.Exit(1)
 	}
+	if cfg.SendQueueOverflow != server.OverflowDisconnect && cfg.SendQueueOverflow != server.OverflowDrop {
+		fmt.Fprintf(os.Stderr, "invalid -send-queue-overflow %q: must be %s or %s\n", cfg.SendQueueOverflow, server.OverflowDisconnect, server.OverflowDrop)
+		os.Exit(1)
+	}
+
+	if *motdFile != "" {
+		data, err := os.ReadFile(*motdFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read -motd-file: %v\n", err)
+			os.Exit(1)
+		}
+		cfg.MOTD = strings.TrimSpace(string(data))
+	}
 
 	// Handle export commands (run and exit)
 	if cfg.ExportUsers || cfg.ExportChannels {
@@ -49,6 +71,11 @@ func main() {
 		}
 		defer st.Close()
 
+		if err := server.RegisterStoredRoles(st); err != nil {
+			slog.Error("load roles", "err", err)
+			os.Exit(1)
+		}
+
 		if cfg.ExportUsers {
 			data, err := server.ExportUsersYAML(st)
 			if err != nil {
@@ -14,6 +14,7 @@ type CaptureDevice struct {
 	stream     *portaudio.Stream
 	sampleRate float64
 	frameSize  int
+	channels   int
 	buffer     []int16
 	deviceName string // empty = default
 	mu         sync.Mutex
@@ -34,11 +35,21 @@ func NewCaptureDevice(sampleRate float64, frameSize int, deviceName ...string) (
 	return &CaptureDevice{
 		sampleRate: sampleRate,
 		frameSize:  frameSize,
+		channels:   1,
 		buffer:     make([]int16, frameSize),
 		deviceName: dn,
 	}, nil
 }
 
+// SetChannels sets the number of captured channels (1 = mono, 2 = stereo).
+// Frames are interleaved. Must be called before Start.
+func (c *CaptureDevice) SetChannels(channels int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channels = channels
+	c.buffer = make([]int16, c.frameSize*channels)
+}
+
 // Start begins audio capture. Call ReadFrame() to get captured audio.
 func (c *CaptureDevice) Start() error {
 	c.mu.Lock()
@@ -59,7 +70,7 @@ func (c *CaptureDevice) Start() error {
 
 	// Build input-only stream parameters
 	params := portaudio.LowLatencyParameters(defaultInput, nil)
-	params.Input.Channels = 1
+	params.Input.Channels = c.channels
 	params.Output.Device = nil
 	params.Output.Channels = 0
 	params.SampleRate = c.sampleRate
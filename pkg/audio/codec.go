@@ -7,12 +7,33 @@ import (
 )
 
 const (
-	opusSampleRate = 48000
-	opusChannels   = 1
-	opusBitrate    = 64000 // 64 kbps - good quality for voice
-	opusFrameSize  = 960   // 20ms at 48kHz
+	opusSampleRate   = 48000
+	opusChannels     = 1
+	opusBitrate      = 64000 // 64 kbps - good quality for voice
+	opusFrameSize    = 960   // 20ms at 48kHz
+	opusMaxFrameSize = 2880  // 60ms at 48kHz, the longest Opus frame
+	opusMaxPacket    = 1275  // bytes, the largest Opus frame (RFC 6716)
 )
 
+// EncoderConfig selects the Opus stream parameters.
+type EncoderConfig struct {
+	Bitrate   int  // bits per second
+	FrameSize int  // samples per channel per frame (480, 960, 1920 or 2880)
+	Channels  int  // 1 = mono, 2 = stereo (interleaved PCM)
+	Music     bool // tune for music (OPUS_APPLICATION_AUDIO) instead of speech
+	MaxPacket int  // bytes per encoded frame, 0 = 1275; the encoder lowers quality to stay within it
+}
+
+// DefaultEncoderConfig returns the settings used when a channel does not
+// override them: 64 kbps mono speech in 20ms frames.
+func DefaultEncoderConfig() EncoderConfig {
+	return EncoderConfig{
+		Bitrate:   opusBitrate,
+		FrameSize: opusFrameSize,
+		Channels:  opusChannels,
+	}
+}
+
 // Encoder wraps an Opus encoder.
 type Encoder struct {
 	enc *opus.Encoder
@@ -21,19 +42,32 @@ type Encoder struct {
 
 // NewEncoder creates a new Opus encoder optimized for voice.
 func NewEncoder() (*Encoder, error) {
-	enc, err := opus.NewEncoder(opusSampleRate, opusChannels, opus.AppVoIP)
+	return NewEncoderWithConfig(DefaultEncoderConfig())
+}
+
+// NewEncoderWithConfig creates a new Opus encoder with the given parameters.
+func NewEncoderWithConfig(cfg EncoderConfig) (*Encoder, error) {
+	app := opus.AppVoIP
+	if cfg.Music {
+		app = opus.AppAudio
+	}
+	enc, err := opus.NewEncoder(opusSampleRate, cfg.Channels, app)
 	if err != nil {
 		return nil, fmt.Errorf("audio: new encoder: %w", err)
 	}
 
-	_ = enc.SetBitrate(opusBitrate)
+	_ = enc.SetBitrate(cfg.Bitrate)
 	_ = enc.SetInBandFEC(true)    // Forward error correction
 	_ = enc.SetPacketLossPerc(10) // Optimize FEC for up to 10% packet loss
 	_ = enc.SetDTX(true)          // Discontinuous transmission (saves bandwidth on silence)
 
+	maxPacket := cfg.MaxPacket
+	if maxPacket <= 0 {
+		maxPacket = opusMaxPacket
+	}
 	return &Encoder{
 		enc: enc,
-		buf: make([]byte, 1024), // max Opus frame size
+		buf: make([]byte, maxPacket), // Opus never writes more than fits
 	}, nil
 }
 
@@ -50,34 +84,60 @@ func (e *Encoder) Encode(pcm []int16) ([]byte, error) {
 
 // Decoder wraps an Opus decoder.
 type Decoder struct {
-	dec *opus.Decoder
+	dec      *opus.Decoder
+	channels int
+	last     int // samples per channel of the last decoded frame, sizes PLC
 }
 
-// NewDecoder creates a new Opus decoder.
+// NewDecoder creates a new mono Opus decoder.
 func NewDecoder() (*Decoder, error) {
-	dec, err := opus.NewDecoder(opusSampleRate, opusChannels)
+	return NewDecoderWithChannels(opusChannels)
+}
+
+// NewDecoderWithChannels creates an Opus decoder producing interleaved PCM
+// with the given channel count. Opus up- or downmixes streams that were
+// encoded with a different channel count.
+func NewDecoderWithChannels(channels int) (*Decoder, error) {
+	dec, err := opus.NewDecoder(opusSampleRate, channels)
 	if err != nil {
 		return nil, fmt.Errorf("audio: new decoder: %w", err)
 	}
-	return &Decoder{dec: dec}, nil
+	return &Decoder{dec: dec, channels: channels, last: opusFrameSize}, nil
 }
 
 // Decode decodes an Opus frame to PCM.
 func (d *Decoder) Decode(opusData []byte) ([]int16, error) {
-	pcm := make([]int16, opusFrameSize)
+	pcm := make([]int16, opusMaxFrameSize*d.channels)
 	n, err := d.dec.Decode(opusData, pcm)
 	if err != nil {
 		return nil, fmt.Errorf("audio: decode: %w", err)
 	}
-	return pcm[:n], nil
+	d.last = n
+	return pcm[:n*d.channels], nil
+}
+
+// DecodeFEC recovers a lost frame from the in-band FEC data of the packet
+// that follows it. The decoder must not have seen next yet; decode it
+// normally afterwards.
+func (d *Decoder) DecodeFEC(next []byte) ([]int16, error) {
+	// The lost frame is assumed to be as long as the one carrying its FEC data
+	size := PacketSamples(next)
+	if size == 0 {
+		size = d.last
+	}
+	pcm := make([]int16, size*d.channels)
+	if err := d.dec.DecodeFEC(next, pcm); err != nil {
+		return nil, fmt.Errorf("audio: decode fec: %w", err)
+	}
+	return pcm, nil
 }
 
 // DecodePLC performs Packet Loss Concealment (generates audio to fill a gap).
 func (d *Decoder) DecodePLC() ([]int16, error) {
-	pcm := make([]int16, opusFrameSize)
+	pcm := make([]int16, d.last*d.channels)
 	n, err := d.dec.Decode(nil, pcm)
 	if err != nil {
 		return nil, fmt.Errorf("audio: decode plc: %w", err)
 	}
-	return pcm[:n], nil
+	return pcm[:n*d.channels], nil
 }
@@ -34,6 +34,9 @@ type AudioEncoder interface {
 type AudioDecoder interface {
 	// Decode decodes compressed audio bytes to a PCM frame.
 	Decode(data []byte) ([]int16, error)
+	// DecodeFEC recovers the lost frame preceding next from the forward
+	// error correction data carried in next.
+	DecodeFEC(next []byte) ([]int16, error)
 	// DecodePLC performs Packet Loss Concealment.
 	DecodePLC() ([]int16, error)
 }
@@ -0,0 +1,45 @@
+package audio
+
+// opusConfigSamples maps the TOC configuration number (RFC 6716, section
+// 3.1) to the frame duration in samples at 48kHz.
+var opusConfigSamples = [32]int{
+	480, 960, 1920, 2880, // SILK NB 10/20/40/60ms
+	480, 960, 1920, 2880, // SILK MB
+	480, 960, 1920, 2880, // SILK WB
+	480, 960, // Hybrid SWB 10/20ms
+	480, 960, // Hybrid FB
+	120, 240, 480, 960, // CELT NB 2.5/5/10/20ms
+	120, 240, 480, 960, // CELT WB
+	120, 240, 480, 960, // CELT SWB
+	120, 240, 480, 960, // CELT FB
+}
+
+// PacketSamples returns the audio duration of an Opus packet in samples per
+// channel at 48kHz, read from its TOC byte. It returns 0 for packets that
+// are empty or malformed.
+func PacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	frame := opusConfigSamples[toc>>3]
+
+	var frames int
+	switch toc & 0x03 {
+	case 0:
+		frames = 1
+	case 1, 2:
+		frames = 2
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3F)
+	}
+
+	// A packet carries at most 120ms of audio
+	if n := frames * frame; n <= 5760 {
+		return n
+	}
+	return 0
+}
@@ -13,6 +13,7 @@ type PlaybackDevice struct {
 	stream     *portaudio.Stream
 	sampleRate float64
 	frameSize  int
+	channels   int
 	buffer     []int16
 	deviceName string // empty = default
 	mu         sync.Mutex
@@ -29,11 +30,21 @@ func NewPlaybackDevice(sampleRate float64, frameSize int, deviceName ...string)
 	return &PlaybackDevice{
 		sampleRate: sampleRate,
 		frameSize:  frameSize,
+		channels:   1,
 		buffer:     make([]int16, frameSize),
 		deviceName: dn,
 	}, nil
 }
 
+// SetChannels sets the number of output channels (1 = mono, 2 = stereo).
+// Frames are interleaved. Must be called before Start.
+func (p *PlaybackDevice) SetChannels(channels int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.channels = channels
+	p.buffer = make([]int16, p.frameSize*channels)
+}
+
 // Start begins audio playback.
 func (p *PlaybackDevice) Start() error {
 	p.mu.Lock()
@@ -53,7 +64,7 @@ func (p *PlaybackDevice) Start() error {
 
 	// Build output-only stream parameters
 	params := portaudio.LowLatencyParameters(nil, defaultOutput)
-	params.Output.Channels = 1
+	params.Output.Channels = p.channels
 	params.Input.Device = nil
 	params.Input.Channels = 0
 	params.SampleRate = p.sampleRate
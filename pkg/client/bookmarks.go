@@ -14,6 +14,7 @@ type Bookmark struct {
 	VoiceAddr   string `yaml:"voice_addr"`
 	Username    string `yaml:"username"`
 	Token       string `yaml:"token"`
+	Fingerprint string `yaml:"fingerprint,omitempty"` // pinned server certificate (SHA-256), recorded on first connect
 }
 
 // BookmarkStore manages server bookmarks stored next to the binary.
@@ -68,6 +69,19 @@ func (bs *BookmarkStore) Add(b Bookmark) bool {
 	return true
 }
 
+// SetFingerprint pins a server certificate fingerprint on every bookmark for
+// controlAddr. Returns true if a bookmark changed.
+func (bs *BookmarkStore) SetFingerprint(controlAddr, fingerprint string) bool {
+	changed := false
+	for i := range bs.Bookmarks {
+		if bs.Bookmarks[i].ControlAddr == controlAddr && bs.Bookmarks[i].Fingerprint != fingerprint {
+			bs.Bookmarks[i].Fingerprint = fingerprint
+			changed = true
+		}
+	}
+	return changed
+}
+
 // FindByAddr returns a bookmark matching the given control address, or nil.
 func (bs *BookmarkStore) FindByAddr(controlAddr string) *Bookmark {
 	for _, b := range bs.Bookmarks {
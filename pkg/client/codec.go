@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/NicolasHaas/gospeak/pkg/audio"
+	"github.com/NicolasHaas/gospeak/pkg/protocol"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+// codecApplicationMusic selects the Opus music tuning (model.CodecApplicationMusic).
+const codecApplicationMusic = "music"
+
+// encoderConfig converts a channel's codec settings into encoder
+// parameters, filling in defaults for zero values.
+func encoderConfig(c pb.CodecSettings) audio.EncoderConfig {
+	cfg := audio.DefaultEncoderConfig()
+	cfg.MaxPacket = protocol.MaxOpusFrame // each frame must fit in one voice packet
+	if c.Bitrate > 0 {
+		cfg.Bitrate = int(c.Bitrate)
+	}
+	if c.FrameMs > 0 {
+		cfg.FrameSize = sampleRate * int(c.FrameMs) / 1000
+	}
+	if c.Stereo {
+		cfg.Channels = 2
+	}
+	cfg.Music = c.Application == codecApplicationMusic
+	return cfg
+}
+
+// applyChannelCodec switches the audio pipeline to the codec of the channel
+// we are in. The devices are rebuilt in the background when it changed.
+func (e *Engine) applyChannelCodec() {
+	e.mu.Lock()
+	codec := e.channelCodecLocked()
+	changed := codec != e.codec
+	e.codec = codec
+	e.mu.Unlock()
+
+	if changed {
+		slog.Info("channel codec changed", "bitrate", codec.Bitrate, "frame_ms", codec.FrameMs,
+			"application", codec.Application, "stereo", codec.Stereo)
+		go e.restartAudio()
+	}
+}
+
+// channelCodecLocked returns the codec of the channel we are in. Caller holds e.mu.
+func (e *Engine) channelCodecLocked() pb.CodecSettings {
+	for _, ch := range e.channels {
+		if ch.ID == e.channelID {
+			return ch.Codec
+		}
+	}
+	return pb.CodecSettings{}
+}
+
+// startAudio initializes the audio devices for the current codec and starts
+// the capture and playback pipelines.
+func (e *Engine) startAudio() {
+	e.audioMu.Lock()
+	defer e.audioMu.Unlock()
+
+	e.mu.Lock()
+	if e.state != StateConnected {
+		e.mu.Unlock()
+		return
+	}
+	codec := e.codec
+	ctx, cancel := context.WithCancel(e.ctx)
+	e.audioCancel = cancel
+	e.mu.Unlock()
+
+	if err := e.initAudioFn(); err != nil {
+		slog.Error("audio init failed (continuing without audio)", "err", err)
+	}
+
+	e.mu.Lock()
+	e.audioCodec = codec
+	e.mu.Unlock()
+
+	// Start audio pipelines
+	go e.captureLoop(ctx)
+	go e.playbackLoop(ctx)
+}
+
+// restartAudio rebuilds the audio pipeline if the current codec differs
+// from the one the running devices were opened with.
+func (e *Engine) restartAudio() {
+	e.audioMu.Lock()
+	e.mu.Lock()
+	if e.state != StateConnected || e.codec == e.audioCodec || (e.capture == nil && e.playback == nil) {
+		e.mu.Unlock()
+		e.audioMu.Unlock()
+		return
+	}
+	capture := e.capture
+	playback := e.playback
+	cancel := e.audioCancel
+	e.capture = nil
+	e.playback = nil
+	e.encoder = nil
+	e.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	// Stop, not Close: Close also terminates PortAudio
+	if capture != nil {
+		_ = capture.Stop()
+	}
+	if playback != nil {
+		_ = playback.Stop()
+	}
+	e.audioMu.Unlock()
+
+	e.startAudio()
+}
@@ -4,6 +4,7 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -14,21 +15,38 @@ import (
 	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
 )
 
+// ErrAuthFailed is returned by Authenticate when the server rejected the
+// credentials (as opposed to a network failure).
+var ErrAuthFailed = errors.New("auth failed")
+
 // EventHandler is a callback for incoming control events.
 type EventHandler func(msg *pb.ControlMessage)
 
 // ControlClient manages the TCP/TLS control plane connection.
 type ControlClient struct {
 	conn    net.Conn
+	trust   serverTrust
 	mu      sync.Mutex
 	handler EventHandler
 	done    chan struct{}
 }
 
-// NewControlClient connects to the server's control plane via TLS.
-func NewControlClient(addr string) (*ControlClient, error) {
+// NewControlClient connects to the server's control plane via TLS. A
+// certificate chain signed by a trusted CA is always accepted. Otherwise the
+// certificate must match the pinned fingerprint; an empty pin trusts it on
+// first use. A mismatch fails with *CertMismatchError.
+func NewControlClient(addr, pin string) (*ControlClient, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	c := &ControlClient{done: make(chan struct{})}
 	tlsCfg := &tls.Config{
-		InsecureSkipVerify: true, // MVP: accept self-signed certs (TOFU model)
+		ServerName: host,
+		// Verification is done by VerifyConnection, which falls back to the pin
+		InsecureSkipVerify: true, //nolint:gosec // see verifyServerCert
+		VerifyConnection:   verifyServerCert(host, pin, nil, &c.trust),
 		MinVersion:         tls.VersionTLS13,
 	}
 
@@ -37,11 +55,19 @@ func NewControlClient(addr string) (*ControlClient, error) {
 	if err != nil {
 		return nil, fmt.Errorf("client: connect control: %w", err)
 	}
+	c.conn = conn
+	return c, nil
+}
 
-	return &ControlClient{
-		conn: conn,
-		done: make(chan struct{}),
-	}, nil
+// Fingerprint returns the SHA-256 fingerprint of the server certificate.
+func (c *ControlClient) Fingerprint() string {
+	return c.trust.fingerprint
+}
+
+// CAVerified reports whether the server certificate was verified against
+// the system's trusted CAs rather than the pinned fingerprint.
+func (c *ControlClient) CAVerified() bool {
+	return c.trust.caVerified
 }
 
 // SetEventHandler sets the callback for incoming control messages.
@@ -56,12 +82,18 @@ func (c *ControlClient) Send(msg *pb.ControlMessage) error {
 	return protocol.WriteControlMessage(c.conn, msg)
 }
 
-// Authenticate sends an auth request and returns the auth response.
-func (c *ControlClient) Authenticate(token, username string) (*pb.AuthResponse, error) {
+// Authenticate sends an auth request and returns the auth response. A
+// non-empty resumeToken asks the server to resume a dropped session;
+// identityKey is our X25519 public key for end-to-end encrypted channels.
+func (c *ControlClient) Authenticate(token, username, resumeToken string, identityKey []byte) (*pb.AuthResponse, error) {
 	if err := c.Send(&pb.ControlMessage{
 		AuthRequest: &pb.AuthRequest{
-			Token:    token,
-			Username: username,
+			Token:       token,
+			Username:    username,
+			ResumeToken: resumeToken,
+			IdentityKey: identityKey,
+			Encodings:   []string{protocol.EncodingProtobuf.String()},
+			Features:    []string{pb.FeatureStateDeltas},
 		},
 	}); err != nil {
 		return nil, fmt.Errorf("client: send auth: %w", err)
@@ -73,13 +105,22 @@ func (c *ControlClient) Authenticate(token, username string) (*pb.AuthResponse,
 	}
 
 	if msg.ErrorResponse != nil {
-		return nil, fmt.Errorf("auth failed: %s", msg.ErrorResponse.Message)
+		return nil, fmt.Errorf("%w: %s", ErrAuthFailed, msg.ErrorResponse.Message)
 	}
 
 	if msg.AuthResponse == nil {
 		return nil, fmt.Errorf("client: unexpected response type")
 	}
 
+	// Everything after the response uses the encoding the server chose
+	enc, ok := protocol.ParseEncoding(msg.AuthResponse.Encoding)
+	if !ok {
+		return nil, fmt.Errorf("client: server chose unknown encoding %q", msg.AuthResponse.Encoding)
+	}
+	c.mu.Lock()
+	c.conn = protocol.WithEncoding(c.conn, enc)
+	c.mu.Unlock()
+
 	return msg.AuthResponse, nil
 }
 
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+const (
+	// DefaultDuckingDB is the default attenuation of other speakers while a
+	// priority speaker talks.
+	DefaultDuckingDB = 12.0
+
+	// maxDuckingDB caps the attenuation; beyond this other voices are inaudible anyway.
+	maxDuckingDB = 60.0
+
+	// duckHold keeps other speakers ducked briefly after the priority
+	// speaker's last packet so short pauses don't cause pumping.
+	duckHold = 300 * time.Millisecond
+)
+
+// Ducker attenuates regular speakers while a priority speaker is talking.
+type Ducker struct {
+	mu         sync.Mutex
+	priority   map[uint32]bool // session IDs flagged as priority speakers
+	gain       float64         // linear gain applied to ducked speakers
+	lastActive time.Time       // arrival of the latest priority speaker packet
+}
+
+// NewDucker creates a ducker with the default attenuation.
+func NewDucker() *Ducker {
+	d := &Ducker{priority: make(map[uint32]bool)}
+	d.SetAttenuation(DefaultDuckingDB)
+	return d
+}
+
+// SetAttenuation sets how much other speakers are attenuated, in dB (0 disables ducking).
+func (d *Ducker) SetAttenuation(db float64) {
+	db = math.Max(0, math.Min(db, maxDuckingDB))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gain = math.Pow(10, -db/20)
+}
+
+// UpdateSpeakers refreshes the set of priority speakers from the server state.
+func (d *Ducker) UpdateSpeakers(channels []pb.ChannelInfo) {
+	priority := make(map[uint32]bool)
+	for _, ch := range channels {
+		for _, u := range ch.Users {
+			if u.PrioritySpeaker && u.SessionID != 0 {
+				priority[u.SessionID] = true
+			}
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.priority = priority
+}
+
+// isPriority reports whether sessionID is currently a priority speaker.
+func (d *Ducker) isPriority(sessionID uint32) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.priority[sessionID]
+}
+
+// Process applies ducking to a decoded frame from sessionID, received at now.
+// Frames from priority speakers are left untouched and (re)start the duck.
+func (d *Ducker) Process(sessionID uint32, pcm []int16, now time.Time) {
+	d.mu.Lock()
+	if d.priority[sessionID] {
+		d.lastActive = now
+		d.mu.Unlock()
+		return
+	}
+	ducked := !d.lastActive.IsZero() && now.Sub(d.lastActive) < duckHold
+	gain := d.gain
+	d.mu.Unlock()
+
+	if !ducked || gain >= 1 {
+		return
+	}
+	for i, s := range pcm {
+		pcm[i] = int16(float64(s) * gain)
+	}
+}
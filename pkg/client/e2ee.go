@@ -0,0 +1,198 @@
+package client
+
+import (
+	"crypto/ecdh"
+	"log/slog"
+
+	gospeakCrypto "github.com/NicolasHaas/gospeak/pkg/crypto"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+// e2eeEpoch is the key agreement of one epoch of an end-to-end encrypted
+// channel, as announced by the server.
+type e2eeEpoch struct {
+	channelID int64
+	epoch     uint32
+	leader    uint32
+	members   []pb.GroupMember
+	early     *pb.GroupKeyMessage // key that overtook its VoiceKeyEvent
+	serverKey *pb.VoiceKeyEvent   // server key held back until the state shows E2EE off
+}
+
+// E2EEMember is a holder of the key of an end-to-end encrypted channel.
+type E2EEMember struct {
+	SessionID    uint32
+	Username     string
+	SafetyNumber string // compare out of band to rule out a man in the middle
+	Self         bool
+}
+
+// SetIdentity sets the X25519 identity key used in end-to-end encrypted
+// channels (see LoadIdentity). Takes effect on the next connect.
+func (e *Engine) SetIdentity(key *ecdh.PrivateKey) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.identity = key
+}
+
+// E2EEMembers returns who holds the key of an end-to-end encrypted channel,
+// with the safety number we share with each of them. Only the members of
+// our own channel are known; for any other channel it returns nil.
+func (e *Engine) E2EEMembers(channelID int64) []E2EEMember {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.e2ee == nil || e.e2ee.channelID != channelID || channelID != e.channelID || e.identity == nil {
+		return nil
+	}
+	own := e.identity.PublicKey().Bytes()
+	members := make([]E2EEMember, 0, len(e.e2ee.members))
+	for _, m := range e.e2ee.members {
+		members = append(members, E2EEMember{
+			SessionID:    m.SessionID,
+			Username:     m.Username,
+			SafetyNumber: gospeakCrypto.SafetyNumber(own, m.IdentityKey),
+			Self:         m.SessionID == e.sessionID,
+		})
+	}
+	return members
+}
+
+// handleE2EERekey starts a new epoch of an end-to-end encrypted channel. If
+// we are its leader we generate the key and send it, wrapped, to every other
+// member; otherwise we wait for the leader's GroupKeyMessage.
+func (e *Engine) handleE2EERekey(ev *pb.VoiceKeyEvent) {
+	e.mu.Lock()
+	var early *pb.GroupKeyMessage
+	if e.e2ee != nil && e.e2ee.early != nil && e.e2ee.early.ChannelID == ev.ChannelID && e.e2ee.early.Epoch == ev.Epoch {
+		early = e.e2ee.early
+	}
+	e.e2ee = &e2eeEpoch{channelID: ev.ChannelID, epoch: ev.Epoch, leader: ev.Leader, members: ev.Members}
+	leader := ev.Leader == e.sessionID
+	identity, keys, ctrl := e.identity, e.keys, e.control
+	e.mu.Unlock()
+
+	if early != nil {
+		e.handleGroupKey(early)
+	}
+	if !leader || identity == nil || ctrl == nil {
+		return
+	}
+
+	key, err := gospeakCrypto.GenerateKey()
+	if err != nil {
+		slog.Error("e2ee key generation failed", "channel", ev.ChannelID, "err", err)
+		return
+	}
+	msg := &pb.GroupKeyMessage{ChannelID: ev.ChannelID, Epoch: ev.Epoch}
+	for _, m := range ev.Members {
+		if m.SessionID == ev.Leader {
+			continue
+		}
+		wrapped, err := gospeakCrypto.WrapGroupKey(identity, m.IdentityKey, ev.ChannelID, ev.Epoch, key)
+		if err != nil {
+			slog.Warn("e2ee key wrap failed", "user", m.Username, "err", err)
+			continue
+		}
+		msg.Keys = append(msg.Keys, pb.WrappedKey{SessionID: m.SessionID, Key: wrapped})
+	}
+	if err := keys.SetKey(ev.ChannelID, ev.Epoch, key); err != nil {
+		slog.Error("invalid e2ee key", "channel", ev.ChannelID, "err", err)
+		return
+	}
+	if len(msg.Keys) > 0 {
+		if err := ctrl.Send(&pb.ControlMessage{GroupKeyMsg: msg}); err != nil {
+			slog.Error("send e2ee key", "err", err)
+		}
+	}
+}
+
+// handleGroupKey installs the channel key the leader of the current epoch
+// wrapped for us. A key for an epoch not yet announced is kept until its
+// VoiceKeyEvent arrives.
+func (e *Engine) handleGroupKey(msg *pb.GroupKeyMessage) {
+	e.mu.Lock()
+	state := e.e2ee
+	if state == nil || state.channelID != msg.ChannelID || state.epoch < msg.Epoch {
+		if state == nil {
+			state = &e2eeEpoch{}
+			e.e2ee = state
+		}
+		state.early = msg
+		e.mu.Unlock()
+		return
+	}
+	identity, keys, sessionID := e.identity, e.keys, e.sessionID
+	e.mu.Unlock()
+
+	if state.epoch != msg.Epoch || msg.Sender != state.leader || identity == nil {
+		return // stale, or not from the leader the server announced
+	}
+	var sender []byte
+	for _, m := range state.members {
+		if m.SessionID == msg.Sender {
+			sender = m.IdentityKey
+		}
+	}
+	for _, wk := range msg.Keys {
+		if wk.SessionID != sessionID {
+			continue
+		}
+		key, err := gospeakCrypto.UnwrapGroupKey(identity, sender, msg.ChannelID, msg.Epoch, wk.Key)
+		if err == nil {
+			err = keys.SetKey(msg.ChannelID, msg.Epoch, key)
+		}
+		if err != nil {
+			slog.Warn("e2ee key rejected", "channel", msg.ChannelID, "sender", msg.Sender, "err", err)
+		}
+	}
+}
+
+// handleChannelKey installs a channel key generated by the server. While
+// the channel runs an E2EE epoch the server could use such a key to listen
+// in, so it is refused, and the user warned, unless the server state
+// already shows the channel no longer end-to-end encrypted. A refused key
+// is kept in case the state says so later (see leaveE2EE).
+func (e *Engine) handleChannelKey(ev *pb.VoiceKeyEvent) {
+	e.mu.Lock()
+	keys := e.keys
+	if state := e.e2ee; state != nil && state.channelID == ev.ChannelID {
+		if ch, ok := e.srvState.channels[ev.ChannelID]; !ok || ch.E2EE {
+			state.serverKey = ev
+			e.mu.Unlock()
+			slog.Warn("server key for an end-to-end encrypted channel refused", "channel", ev.ChannelID)
+			if e.OnE2EEDowngrade != nil {
+				e.OnE2EEDowngrade(ev.ChannelID)
+			}
+			return
+		}
+		e.e2ee = nil
+	}
+	e.mu.Unlock()
+	if err := keys.SetKey(ev.ChannelID, ev.Epoch, ev.Key); err != nil {
+		slog.Error("invalid voice key", "channel", ev.ChannelID, "err", err)
+	}
+}
+
+// leaveE2EE ends the E2EE epoch once the server state shows its channel
+// no longer end-to-end encrypted, and installs the server key that may
+// have arrived before the state did.
+func (e *Engine) leaveE2EE() {
+	e.mu.Lock()
+	state := e.e2ee
+	if state == nil || state.channelID == 0 {
+		e.mu.Unlock()
+		return
+	}
+	if ch, ok := e.srvState.channels[state.channelID]; !ok || ch.E2EE {
+		e.mu.Unlock()
+		return
+	}
+	e.e2ee = nil
+	keys := e.keys
+	e.mu.Unlock()
+	if ev := state.serverKey; ev != nil {
+		if err := keys.SetKey(ev.ChannelID, ev.Epoch, ev.Key); err != nil {
+			slog.Error("invalid voice key", "channel", ev.ChannelID, "err", err)
+		}
+	}
+}
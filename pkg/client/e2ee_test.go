@@ -0,0 +1,111 @@
+package client
+
+import (
+	"testing"
+
+	gospeakCrypto "github.com/NicolasHaas/gospeak/pkg/crypto"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+func TestE2EEKeyFromLeader(t *testing.T) {
+	leader, err := gospeakCrypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity: %v", err)
+	}
+	self, err := gospeakCrypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity: %v", err)
+	}
+	key, err := gospeakCrypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	e := NewEngine()
+	e.sessionID = 20
+	e.channelID = 7
+	e.identity = self
+	e.keys = NewKeyRing()
+
+	rekey := &pb.VoiceKeyEvent{ChannelID: 7, Epoch: 3, Leader: 10, Members: []pb.GroupMember{
+		{SessionID: 10, Username: "leader", IdentityKey: leader.PublicKey().Bytes()},
+		{SessionID: 20, Username: "self", IdentityKey: self.PublicKey().Bytes()},
+	}}
+	wrapped, err := gospeakCrypto.WrapGroupKey(leader, self.PublicKey().Bytes(), 7, 3, key)
+	if err != nil {
+		t.Fatalf("WrapGroupKey: %v", err)
+	}
+	msg := &pb.GroupKeyMessage{ChannelID: 7, Epoch: 3, Sender: 10, Keys: []pb.WrappedKey{{SessionID: 20, Key: wrapped}}}
+
+	// The key may overtake the rekey announcing its epoch
+	e.handleGroupKey(msg)
+	if e.keys.Cipher(7, 0, 0) != nil {
+		t.Fatalf("key installed before its epoch was announced")
+	}
+	e.handleE2EERekey(rekey)
+	if e.keys.Cipher(7, 0, 0) == nil {
+		t.Fatalf("key not installed after the rekey")
+	}
+
+	members := e.E2EEMembers(7)
+	if len(members) != 2 || !members[1].Self ||
+		members[0].SafetyNumber != gospeakCrypto.SafetyNumber(leader.PublicKey().Bytes(), self.PublicKey().Bytes()) {
+		t.Fatalf("E2EEMembers: unexpected %+v", members)
+	}
+
+	// A key from anyone but the announced leader is ignored
+	e2 := NewEngine()
+	e2.sessionID, e2.channelID, e2.identity, e2.keys = 20, 7, self, NewKeyRing()
+	e2.handleE2EERekey(rekey)
+	forged := *msg
+	forged.Sender = 30
+	e2.handleGroupKey(&forged)
+	if e2.keys.Cipher(7, 0, 0) != nil {
+		t.Fatalf("key accepted from a non-leader")
+	}
+}
+
+func TestE2EEServerKeyRefused(t *testing.T) {
+	e := NewEngine()
+	e.sessionID, e.channelID, e.keys = 20, 7, NewKeyRing()
+	var warned []int64
+	e.OnE2EEDowngrade = func(channelID int64) { warned = append(warned, channelID) }
+
+	e.handleEvent(&pb.ControlMessage{ServerStateEvent: &pb.ServerStateEvent{Version: 1, Channels: []pb.ChannelInfo{
+		{ID: 7, Name: "Secret", E2EE: true},
+	}}})
+	e.handleEvent(&pb.ControlMessage{VoiceKeyEvent: &pb.VoiceKeyEvent{ChannelID: 7, Epoch: 3, Leader: 10, Members: []pb.GroupMember{
+		{SessionID: 10, Username: "leader"},
+		{SessionID: 20, Username: "self"},
+	}}})
+
+	// A plain server key during the epoch is refused and the user warned
+	serverKey, err := gospeakCrypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	e.handleEvent(&pb.ControlMessage{VoiceKeyEvent: &pb.VoiceKeyEvent{ChannelID: 7, Epoch: 4, Key: serverKey}})
+	if e.keys.Cipher(7, 0, 0) != nil {
+		t.Fatalf("server key installed for an end-to-end encrypted channel")
+	}
+	if len(warned) != 1 || warned[0] != 7 {
+		t.Fatalf("OnE2EEDowngrade: got %v, want [7]", warned)
+	}
+	if e.e2ee == nil || e.e2ee.channelID != 7 {
+		t.Fatalf("E2EE epoch ended by a server key")
+	}
+
+	// Once the state shows E2EE off, the held key is installed
+	e.handleEvent(&pb.ControlMessage{ServerStateDelta: &pb.ServerStateDelta{Version: 2, ChannelUpdates: []pb.ChannelInfo{
+		{ID: 7, Name: "Secret"},
+	}}})
+	if e.e2ee != nil {
+		t.Fatalf("E2EE epoch kept after the state turned E2EE off")
+	}
+	if e.keys.Cipher(7, 0, 0) == nil {
+		t.Fatalf("held server key not installed after the state turned E2EE off")
+	}
+	if len(warned) != 1 {
+		t.Fatalf("OnE2EEDowngrade: unexpected warnings %v", warned)
+	}
+}
@@ -2,9 +2,11 @@ package client
 
 import (
 	"context"
+	"crypto/ecdh"
 	"fmt"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/NicolasHaas/gospeak/pkg/audio"
 	gospeakCrypto "github.com/NicolasHaas/gospeak/pkg/crypto"
@@ -19,6 +21,7 @@ const (
 	StateDisconnected State = iota
 	StateConnecting
 	StateConnected
+	StateReconnecting // connection lost, retrying with backoff
 )
 
 // Engine is the main client engine that wires together audio, networking, and state.
@@ -27,29 +30,57 @@ type Engine struct {
 
 	state     State
 	sessionID uint32
+	userID    int64
 	username  string
 	role      string
+	roles     []string // role names offered by the server, lowest priority first
 	channelID int64
 	muted     bool
 	deafened  bool
+	whisper   uint8 // active whisper target, 0 = talking to the channel
 
 	control *ControlClient
 	voice   *VoiceClient
-	cipher  *gospeakCrypto.VoiceCipher
+	keys    *KeyRing
+
+	// End-to-end encryption: our identity key and the key agreement of the
+	// current E2EE channel epoch
+	identity *ecdh.PrivateKey
+	e2ee     *e2eeEpoch
+
+	// Login parameters, kept for reconnecting
+	controlAddr     string
+	voiceAddr       string
+	token           string
+	fingerprint     string // pinned server certificate fingerprint (empty = trust on first use)
+	resumeToken     string // lets the server hand back our session after a drop
+	channelPassword string // password of the current channel, for rejoining
 
 	capture  audio.Capturer
 	playback audio.Player
 	encoder  audio.AudioEncoder
 	vad      audio.VoiceDetector
 
-	// Per-speaker decoders and jitter buffers
-	decoders       map[uint32]audio.AudioDecoder
-	jitterBufs     map[uint32]*JitterBuffer
-	decoderMu      sync.Mutex
-	decoderFactory audio.DecoderFactory
+	// Channel codec: codec is the one our channel asks for, audioCodec the
+	// one the running devices were opened with. audioMu serializes rebuilds.
+	codec        pb.CodecSettings
+	audioCodec   pb.CodecSettings
+	captureFrame int // samples per channel per captured frame
+	audioCancel  context.CancelFunc
+	audioMu      sync.Mutex
 
+	// Per-speaker decoders and jitter buffers live in the mixer
+	mixer  *Mixer
+	ducker *Ducker
+
+	// Server state as deltas left it, and the channel list built from it
+	srvState serverState
 	channels []pb.ChannelInfo
 
+	// Channel whose chat history was last requested; a new one is fetched
+	// whenever the server state shows us somewhere else
+	historyChannel int64
+
 	ctx    context.Context
 	cancel context.CancelFunc
 
@@ -63,8 +94,20 @@ type Engine struct {
 	OnVoiceActivity  func(active bool)
 	OnRMSLevel       func(level float64)
 	OnDisconnect     func(reason string)
-	OnChatMessage    func(channelID int64, sender, text string, ts int64)
+	OnChatMessage    func(msg pb.ChatMessage)
+	OnChatHistory    func(channelID int64, msgs []pb.ChatMessage, nextBefore int64) // msgs oldest first; nextBefore 0 = no older page
+	OnChatEdit       func(msg pb.ChatMessage)                                       // msg replaces the message with the same ID
+	OnChatDelete     func(channelID, id int64, deletedBy string)                    // deletedBy is the moderator, empty = the sender
+	OnDirectMessage  func(peerID int64, msg pb.DirectMessage)                       // peerID is the other user of the conversation
+	OnUnreadMessages func(unread []pb.UnreadCount)                                  // direct messages stored while we were offline
+	OnMOTD           func(text string)                                              // the server's message of the day, once per connect
+	OnBroadcast      func(msg pb.ServerBroadcastEvent)                              // SenderName empty = from the server itself
 	OnTokenCreated   func(token string)
+	OnTokenList      func(tokens []pb.TokenInfo)
+	OnBanList        func(bans []pb.BanInfo)
+	OnChannelACL     func(channelID int64, entries []pb.ChannelACLEntry)
+	OnMoved          func(channelID int64) // called when a moderator moved us to another channel
+	OnE2EEDowngrade  func(channelID int64) // the server sent its own key for an end-to-end encrypted channel; it was refused
 	OnRoleChanged    func(success bool, message string)
 	OnAutoToken      func(token string) // called when server auto-generates a token for this user
 	OnExportData     func(dataType, data string)
@@ -74,89 +117,163 @@ type Engine struct {
 // NewEngine creates a new client engine.
 func NewEngine() *Engine {
 	ctx, cancel := context.WithCancel(context.Background())
+	ducker := NewDucker()
 	e := &Engine{
-		state:          StateDisconnected,
-		decoders:       make(map[uint32]audio.AudioDecoder),
-		jitterBufs:     make(map[uint32]*JitterBuffer),
-		ctx:            ctx,
-		cancel:         cancel,
-		vad:            audio.NewVAD(200, 15, 3), // threshold=200, hold=300ms, prebuf=60ms
-		decoderFactory: &defaultDecoderFactory{},
+		state:  StateDisconnected,
+		ctx:    ctx,
+		cancel: cancel,
+		vad:    audio.NewVAD(200, 15, 3), // threshold=200, hold=300ms, prebuf=60ms
+		mixer:  NewMixer(&defaultDecoderFactory{channels: 1}, ducker),
+		ducker: ducker,
 	}
 	e.initAudioFn = e.initAudioDefault
 	return e
 }
 
 // defaultDecoderFactory creates Opus decoders (the default audio backend).
-type defaultDecoderFactory struct{}
+type defaultDecoderFactory struct {
+	channels int
+}
 
 func (f *defaultDecoderFactory) NewDecoder() (audio.AudioDecoder, error) {
-	return audio.NewDecoder()
+	return audio.NewDecoderWithChannels(f.channels)
 }
 
 // Connect authenticates to the server and starts audio/voice pipelines.
-func (e *Engine) Connect(controlAddr, voiceAddr, token, username string) error {
+// fingerprint pins the server certificate recorded on an earlier connect;
+// leave it empty to trust the certificate on first use. Certificates signed
+// by a trusted CA are accepted either way. Use ServerFingerprint to record
+// the certificate after connecting.
+func (e *Engine) Connect(controlAddr, voiceAddr, token, username, fingerprint string) error {
 	e.mu.Lock()
 	if e.state != StateDisconnected {
 		e.mu.Unlock()
 		return fmt.Errorf("already connected")
 	}
 	e.state = StateConnecting
+	e.controlAddr = controlAddr
+	e.voiceAddr = voiceAddr
+	e.token = token
+	e.username = username
+	e.fingerprint = fingerprint
+	e.resumeToken = ""
+	if e.identity == nil {
+		// Without a stored identity, E2EE channels still work, but safety
+		// numbers change with every connect
+		id, err := gospeakCrypto.GenerateIdentity()
+		if err != nil {
+			e.state = StateDisconnected
+			e.mu.Unlock()
+			return err
+		}
+		e.identity = id
+	}
 	e.mu.Unlock()
 
 	e.notifyStateChange(StateConnecting)
 
-	// Connect control plane
-	ctrl, err := NewControlClient(controlAddr)
+	authResp, err := e.dial(StateConnecting)
 	if err != nil {
 		e.setState(StateDisconnected)
 		return err
 	}
 
+	// Notify if server auto-generated a token for this user
+	if authResp.AutoToken != "" && e.OnAutoToken != nil {
+		e.OnAutoToken(authResp.AutoToken)
+	}
+
+	return nil
+}
+
+// dial connects and authenticates with the remembered login parameters and
+// starts the voice and audio pipelines. The engine must still be in state
+// from when the connection is ready, otherwise the connection is dropped.
+// Reconnects restore the previous channel and mute/deafen state.
+func (e *Engine) dial(from State) (*pb.AuthResponse, error) {
+	e.mu.RLock()
+	controlAddr, voiceAddr, fingerprint := e.controlAddr, e.voiceAddr, e.fingerprint
+	token, username, resumeToken := e.token, e.username, e.resumeToken
+	identityKey := e.identity.PublicKey().Bytes()
+	e.mu.RUnlock()
+
+	// Connect control plane
+	ctrl, err := NewControlClient(controlAddr, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("server certificate", "fingerprint", ctrl.Fingerprint(), "ca_verified", ctrl.CAVerified())
+
 	// Authenticate
-	authResp, err := ctrl.Authenticate(token, username)
+	authResp, err := ctrl.Authenticate(token, username, resumeToken, identityKey)
 	if err != nil {
 		_ = ctrl.Close()
-		e.setState(StateDisconnected)
-		return err
+		return nil, err
 	}
 
 	slog.Info("authenticated",
 		"session", authResp.SessionID,
 		"user", authResp.Username,
 		"role", authResp.Role,
+		"resumed", authResp.Resumed,
 	)
 
+	// Channel and whisper keys follow as VoiceKeyEvents
+	keys := NewKeyRing()
+
 	// Set up voice connection
-	voice, err := NewVoiceClient(voiceAddr, authResp.SessionID, authResp.EncryptionKey)
+	voice, err := NewVoiceClient(voiceAddr, authResp.SessionID, keys)
 	if err != nil {
 		_ = ctrl.Close()
-		e.setState(StateDisconnected)
-		return err
+		return nil, err
 	}
 
-	cipher, err := gospeakCrypto.NewVoiceCipher(authResp.EncryptionKey)
-	if err != nil {
+	e.mu.Lock()
+	if e.state != from {
+		// Disconnect was called while we were dialing
+		e.mu.Unlock()
 		_ = ctrl.Close()
 		_ = voice.Close()
-		e.setState(StateDisconnected)
-		return err
+		return nil, fmt.Errorf("connection cancelled")
 	}
-
-	e.mu.Lock()
 	e.control = ctrl
 	e.voice = voice
-	e.cipher = cipher
+	e.keys = keys
+	e.e2ee = nil
 	e.sessionID = authResp.SessionID
+	e.userID = authResp.UserID
 	e.username = authResp.Username
 	e.role = authResp.Role
-	e.channels = authResp.Channels
+	e.roles = authResp.Roles
+	e.srvState.reset(authResp.StateVersion, authResp.Channels)
+	e.channels = e.srvState.channelList()
+	e.historyChannel = 0 // fetch again; we may have missed messages
+	e.resumeToken = authResp.ResumeToken
+	e.fingerprint = ctrl.Fingerprint() // reconnects must reach the same server
+	if e.token == "" && authResp.AutoToken != "" {
+		// Reconnect under the identity the server just created for us
+		e.token = authResp.AutoToken
+	}
+	var rejoin int64
+	if authResp.Resumed {
+		e.channelID = authResp.ChannelID
+	} else {
+		rejoin = e.channelID
+		e.channelID = 0
+		e.whisper = protocol.TargetChannel // targets died with the old session
+	}
+	whisper := e.whisper
+	e.codec = e.channelCodecLocked()
+	password := e.channelPassword
+	muted, deafened := e.muted, e.deafened
 	e.state = StateConnected
 	e.mu.Unlock()
 
 	// Set up event handling
 	ctrl.SetEventHandler(e.handleEvent)
 	ctrl.StartReceiving()
+	voice.SetChannel(authResp.ChannelID)
+	voice.SetTarget(whisper)
 	voice.StartReceiving()
 
 	// Report connected immediately — audio init happens in background
@@ -164,74 +281,109 @@ func (e *Engine) Connect(controlAddr, voiceAddr, token, username string) error {
 	if e.OnChannelsUpdate != nil {
 		e.OnChannelsUpdate(authResp.Channels)
 	}
+	e.fetchChatHistory()
+	if len(authResp.Unread) > 0 && e.OnUnreadMessages != nil {
+		e.OnUnreadMessages(authResp.Unread)
+	}
+	if authResp.MOTD != "" && from != StateReconnecting && e.OnMOTD != nil {
+		e.OnMOTD(authResp.MOTD)
+	}
 
-	// Notify if server auto-generated a token for this user
-	if authResp.AutoToken != "" && e.OnAutoToken != nil {
-		e.OnAutoToken(authResp.AutoToken)
+	if from == StateReconnecting {
+		// A resumed session kept its channel; otherwise join it again
+		if rejoin != 0 {
+			if err := e.JoinChannelWithPassword(rejoin, password); err != nil {
+				slog.Warn("rejoin channel failed", "channel", rejoin, "err", err)
+			}
+		}
+		_ = ctrl.Send(&pb.ControlMessage{
+			UserStateUpdate: &pb.UserStateUpdate{Muted: muted, Deafened: deafened},
+		})
 	}
 
 	// Initialize audio devices asynchronously (PortAudio init is slow on Windows)
-	go func() {
-		if err := e.initAudioFn(); err != nil {
-			slog.Error("audio init failed (continuing without audio)", "err", err)
-		}
-		// Start audio pipelines
-		go e.captureLoop()
-		go e.playbackLoop()
-	}()
+	go e.startAudio()
 
 	// Monitor for disconnect
 	go func() {
 		<-ctrl.Done()
-		e.handleDisconnect("connection lost")
+		e.connectionLost(ctrl)
 	}()
 
-	return nil
+	return authResp, nil
 }
 
-// initAudioDefault initializes PortAudio devices and Opus codec (the default backend).
+// initAudioDefault initializes PortAudio devices and Opus codec (the default
+// backend) for the current channel codec.
 func (e *Engine) initAudioDefault() error {
-	capture, err := audio.NewCaptureDevice(48000, 960)
+	e.mu.RLock()
+	cfg := encoderConfig(e.codec)
+	e.mu.RUnlock()
+	outChannels := cfg.Channels
+
+	capture, err := audio.NewCaptureDevice(sampleRate, cfg.FrameSize)
 	if err != nil {
 		return fmt.Errorf("capture device: %w", err)
 	}
+	capture.SetChannels(cfg.Channels)
 	if err := capture.Start(); err != nil {
-		return fmt.Errorf("start capture: %w", err)
+		if cfg.Channels == 1 {
+			return fmt.Errorf("start capture: %w", err)
+		}
+		// Most microphones are mono; send a mono stream in stereo channels
+		slog.Warn("stereo capture unavailable, capturing mono", "err", err)
+		cfg.Channels = 1
+		capture.SetChannels(1)
+		if err := capture.Start(); err != nil {
+			return fmt.Errorf("start capture: %w", err)
+		}
 	}
 
-	playback, err := audio.NewPlaybackDevice(48000, 960)
+	// Playback runs on the mixer's 20ms clock whatever the codec frame size
+	playback, err := audio.NewPlaybackDevice(sampleRate, frameSamples)
 	if err != nil {
-		_ = capture.Close()
+		_ = capture.Stop()
 		return fmt.Errorf("playback device: %w", err)
 	}
+	playback.SetChannels(outChannels)
 	if err := playback.Start(); err != nil {
-		_ = capture.Close()
+		_ = capture.Stop()
 		return fmt.Errorf("start playback: %w", err)
 	}
 
-	encoder, err := audio.NewEncoder()
+	encoder, err := audio.NewEncoderWithConfig(cfg)
 	if err != nil {
-		_ = capture.Close()
+		_ = capture.Stop()
 		_ = playback.Stop()
 		return fmt.Errorf("encoder: %w", err)
 	}
 
+	e.mixer.Configure(&defaultDecoderFactory{channels: outChannels}, outChannels)
+
 	e.mu.Lock()
 	e.capture = capture
 	e.playback = playback
 	e.encoder = encoder
+	e.captureFrame = cfg.FrameSize
 	e.mu.Unlock()
 
 	return nil
 }
 
 // captureLoop reads audio from the mic, runs VAD, encodes, and sends.
-func (e *Engine) captureLoop() {
+func (e *Engine) captureLoop(ctx context.Context) {
 	var timestamp uint32
 
+	e.mu.RLock()
+	frameSize := uint32(e.captureFrame) //nolint:gosec // at most 2880 samples
+	e.mu.RUnlock()
+	if frameSize == 0 {
+		frameSize = frameSamples
+	}
+
 	for {
 		select {
-		case <-e.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 		}
@@ -242,6 +394,7 @@ func (e *Engine) captureLoop() {
 		voice := e.voice
 		muted := e.muted
 		channelID := e.channelID
+		whispering := e.whisper != protocol.TargetChannel
 		e.mu.RUnlock()
 
 		if capture == nil || encoder == nil || voice == nil {
@@ -266,16 +419,16 @@ func (e *Engine) captureLoop() {
 			e.OnVoiceActivity(active)
 		}
 
-		// Only send if VAD active, not muted, and in a channel
-		if !active || muted || channelID == 0 {
-			timestamp += 960
+		// Only send if VAD active (or whisper key held), not muted, and in a channel
+		if (!active && !whispering) || muted || channelID == 0 {
+			timestamp += frameSize
 			continue
 		}
 
 		opusData, err := encoder.Encode(pcm)
 		if err != nil {
 			slog.Debug("encode error", "err", err)
-			timestamp += 960
+			timestamp += frameSize
 			continue
 		}
 
@@ -283,15 +436,23 @@ func (e *Engine) captureLoop() {
 			slog.Debug("voice send error", "err", err)
 		}
 
-		timestamp += 960
+		timestamp += frameSize
 	}
 }
 
-// playbackLoop receives voice packets, decodes, and plays them.
-func (e *Engine) playbackLoop() {
+// playbackLoop receives voice packets and queues them in the mixer, which
+// plays the mixed result on its own 20 ms clock.
+func (e *Engine) playbackLoop(ctx context.Context) {
+	e.mu.RLock()
+	playback := e.playback
+	e.mu.RUnlock()
+	if playback != nil {
+		go e.mixer.Run(ctx, playback)
+	}
+
 	for {
 		select {
-		case <-e.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 		}
@@ -311,65 +472,34 @@ func (e *Engine) playbackLoop() {
 			if deafened {
 				continue
 			}
-			e.processIncomingVoice(pkt, playback)
-		case <-e.ctx.Done():
+			e.processIncomingVoice(pkt)
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// processIncomingVoice decrypts and plays a received voice packet.
-func (e *Engine) processIncomingVoice(pkt *protocol.VoicePacket, playback audio.Player) {
-	// Get or create decoder for this speaker
-	e.decoderMu.Lock()
-	dec, ok := e.decoders[pkt.SessionID]
-	if !ok {
-		var err error
-		dec, err = e.decoderFactory.NewDecoder()
-		if err != nil {
-			e.decoderMu.Unlock()
-			slog.Error("create decoder failed", "err", err)
-			return
-		}
-		e.decoders[pkt.SessionID] = dec
-		e.jitterBufs[pkt.SessionID] = NewJitterBuffer()
+// processIncomingVoice decrypts a received voice packet and hands it to the mixer.
+func (e *Engine) processIncomingVoice(pkt *protocol.VoicePacket) {
+	e.mu.RLock()
+	keys := e.keys
+	e.mu.RUnlock()
+	cipher := keys.Cipher(int64(pkt.ChannelID), pkt.SessionID, pkt.Target)
+	if cipher == nil {
+		slog.Debug("voice packet without key", "session", pkt.SessionID, "channel", pkt.ChannelID)
+		return
 	}
-	jb := e.jitterBufs[pkt.SessionID]
-	e.decoderMu.Unlock()
 
 	// Decrypt the voice data
 	header := pkt.MarshalHeader()
-	opusData, err := e.cipher.Decrypt(pkt.SessionID, pkt.SeqNum, header, pkt.Payload)
+	opusData, err := cipher.Decrypt(pkt.KeyEpoch, pkt.SessionID, pkt.SeqNum, header, pkt.Payload)
 	if err != nil {
 		slog.Debug("voice decrypt failed", "session", pkt.SessionID, "err", err)
 		return
 	}
 
-	// Push to jitter buffer
-	jb.Push(pkt.SeqNum, opusData)
-
-	// Pop and play
-	for {
-		data, _, ok := jb.Pop()
-		if !ok {
-			break
-		}
-
-		var pcm []int16
-		if data == nil {
-			// Packet lost — use PLC
-			pcm, err = dec.DecodePLC()
-		} else {
-			pcm, err = dec.Decode(data)
-		}
-		if err != nil {
-			slog.Debug("decode error", "err", err)
-			continue
-		}
-
-		if err := playback.WriteFrame(pcm); err != nil {
-			slog.Debug("playback error", "err", err)
-		}
+	if err := e.mixer.Push(pkt.SessionID, pkt.SeqNum, pkt.Timestamp, opusData, time.Now()); err != nil {
+		slog.Error("create decoder failed", "err", err)
 	}
 }
 
@@ -378,29 +508,75 @@ func (e *Engine) handleEvent(msg *pb.ControlMessage) {
 	switch {
 	case msg.ServerStateEvent != nil:
 		e.mu.Lock()
-		e.channels = msg.ServerStateEvent.Channels
+		e.srvState.reset(msg.ServerStateEvent.Version, msg.ServerStateEvent.Channels)
 		e.mu.Unlock()
-		if e.OnChannelsUpdate != nil {
-			e.OnChannelsUpdate(msg.ServerStateEvent.Channels)
+		e.leaveE2EE()
+		e.channelsChanged()
+
+	case msg.ServerStateDelta != nil:
+		e.mu.Lock()
+		changed, resync := e.srvState.apply(msg.ServerStateDelta)
+		ctrl := e.control
+		e.mu.Unlock()
+		if resync && ctrl != nil {
+			slog.Warn("missed a server state update, requesting full state", "version", msg.ServerStateDelta.Version)
+			if err := ctrl.Send(&pb.ControlMessage{ServerStateReq: &pb.ServerStateRequest{}}); err != nil {
+				slog.Error("send server state request", "err", err)
+			}
+		}
+		if changed {
+			e.leaveE2EE()
+			e.channelsChanged()
+		}
+
+	case msg.VoiceKeyEvent != nil && len(msg.VoiceKeyEvent.Key) == 0 && msg.VoiceKeyEvent.ChannelID != 0:
+		e.handleE2EERekey(msg.VoiceKeyEvent)
+
+	case msg.GroupKeyMsg != nil:
+		e.handleGroupKey(msg.GroupKeyMsg)
+
+	case msg.VoiceKeyEvent != nil && msg.VoiceKeyEvent.Target != 0:
+		ev := msg.VoiceKeyEvent
+		e.mu.RLock()
+		keys := e.keys
+		e.mu.RUnlock()
+		if err := keys.SetWhisperKey(ev.Sender, uint8(ev.Target), ev.Epoch, ev.Key); err != nil { //nolint:gosec // target IDs fit in a byte
+			slog.Error("invalid whisper key", "sender", ev.Sender, "target", ev.Target, "err", err)
 		}
 
+	case msg.VoiceKeyEvent != nil:
+		e.handleChannelKey(msg.VoiceKeyEvent)
+
 	case msg.ChannelJoinedEvent != nil:
-		// Refresh will come via ServerStateEvent
+		// Refresh will come via the server state update
 		slog.Info("user joined channel",
 			"user", msg.ChannelJoinedEvent.User.Username,
 			"channel", msg.ChannelJoinedEvent.ChannelID,
 		)
+		// Our own join is only announced when a moderator moved us
+		e.mu.Lock()
+		moved := msg.ChannelJoinedEvent.User.Username == e.username && msg.ChannelJoinedEvent.ChannelID != e.channelID
+		if moved {
+			e.channelID = msg.ChannelJoinedEvent.ChannelID
+			e.channelPassword = ""
+		}
+		voice := e.voice
+		e.mu.Unlock()
+		if moved {
+			if voice != nil {
+				voice.SetChannel(msg.ChannelJoinedEvent.ChannelID)
+			}
+			if e.OnMoved != nil {
+				e.OnMoved(msg.ChannelJoinedEvent.ChannelID)
+			}
+		}
 
 	case msg.ChannelLeftEvent != nil:
 		slog.Info("user left channel",
 			"user", msg.ChannelLeftEvent.Username,
 			"channel", msg.ChannelLeftEvent.ChannelID,
 		)
-		// Clean up decoder for departed user
-		e.decoderMu.Lock()
-		// We'd need to map userID→sessionID; for MVP just leave decoders
-
-		e.decoderMu.Unlock()
+		// The mixer drops the departed speaker's decoder once it goes idle
 
 	case msg.ErrorResponse != nil:
 		slog.Error("server error", "code", msg.ErrorResponse.Code, "msg", msg.ErrorResponse.Message)
@@ -421,9 +597,75 @@ func (e *Engine) handleEvent(msg *pb.ControlMessage) {
 			e.OnTokenCreated(msg.CreateTokenResp.Token)
 		}
 
+	case msg.ListTokensResp != nil:
+		if e.OnTokenList != nil {
+			e.OnTokenList(msg.ListTokensResp.Tokens)
+		}
+
+	case msg.ListBansResp != nil:
+		if e.OnBanList != nil {
+			e.OnBanList(msg.ListBansResp.Bans)
+		}
+
+	case msg.ListChannelACLResp != nil:
+		if e.OnChannelACL != nil {
+			e.OnChannelACL(msg.ListChannelACLResp.ChannelID, msg.ListChannelACLResp.Entries)
+		}
+
 	case msg.ChatEvent != nil:
 		if e.OnChatMessage != nil {
-			e.OnChatMessage(msg.ChatEvent.ChannelID, msg.ChatEvent.SenderName, msg.ChatEvent.Text, msg.ChatEvent.Timestamp)
+			e.OnChatMessage(*msg.ChatEvent)
+		}
+
+	case msg.ChatEditEvent != nil:
+		if e.OnChatEdit != nil {
+			e.OnChatEdit(*msg.ChatEditEvent)
+		}
+
+	case msg.ChatDeleteEvent != nil:
+		if e.OnChatDelete != nil {
+			e.OnChatDelete(msg.ChatDeleteEvent.ChannelID, msg.ChatDeleteEvent.ID, msg.ChatDeleteEvent.DeletedBy)
+		}
+
+	case msg.ChatHistoryResp != nil:
+		if e.OnChatHistory != nil {
+			e.OnChatHistory(msg.ChatHistoryResp.ChannelID, msg.ChatHistoryResp.Messages, msg.ChatHistoryResp.NextBefore)
+		}
+
+	case msg.DirectMsgEvent != nil:
+		e.mu.RLock()
+		peer := msg.DirectMsgEvent.SenderID
+		if peer == e.userID {
+			peer = msg.DirectMsgEvent.RecipientID // our own message, echoed back
+		}
+		e.mu.RUnlock()
+		if e.OnDirectMessage != nil {
+			e.OnDirectMessage(peer, *msg.DirectMsgEvent)
+		}
+
+	case msg.UnreadMsgsResp != nil:
+		resp := msg.UnreadMsgsResp
+		if e.OnDirectMessage != nil {
+			for _, dm := range resp.Messages {
+				e.OnDirectMessage(resp.UserID, dm)
+			}
+		}
+		// Tell the server it can forget what we just got
+		if n := len(resp.Messages); n > 0 {
+			e.mu.RLock()
+			ctrl := e.control
+			e.mu.RUnlock()
+			if ctrl != nil {
+				ack := &pb.UnreadMessagesRequest{UserID: resp.UserID, Ack: resp.Messages[n-1].ID}
+				if err := ctrl.Send(&pb.ControlMessage{UnreadMsgsReq: ack}); err != nil {
+					slog.Error("send unread messages ack", "err", err)
+				}
+			}
+		}
+
+	case msg.BroadcastEvent != nil:
+		if e.OnBroadcast != nil {
+			e.OnBroadcast(*msg.BroadcastEvent)
 		}
 
 	case msg.SetUserRoleResp != nil:
@@ -445,6 +687,11 @@ func (e *Engine) handleEvent(msg *pb.ControlMessage) {
 
 // JoinChannel sends a request to join a channel.
 func (e *Engine) JoinChannel(channelID int64) error {
+	return e.JoinChannelWithPassword(channelID, "")
+}
+
+// JoinChannelWithPassword sends a request to join a password-protected channel.
+func (e *Engine) JoinChannelWithPassword(channelID int64, password string) error {
 	e.mu.RLock()
 	ctrl := e.control
 	voice := e.voice
@@ -455,13 +702,14 @@ func (e *Engine) JoinChannel(channelID int64) error {
 	}
 
 	if err := ctrl.Send(&pb.ControlMessage{
-		JoinChannelRequest: &pb.JoinChannelRequest{ChannelID: channelID},
+		JoinChannelRequest: &pb.JoinChannelRequest{ChannelID: channelID, Password: password},
 	}); err != nil {
 		return err
 	}
 
 	e.mu.Lock()
 	e.channelID = channelID
+	e.channelPassword = password
 	e.mu.Unlock()
 
 	if voice != nil {
@@ -489,6 +737,7 @@ func (e *Engine) LeaveChannel() error {
 
 	e.mu.Lock()
 	e.channelID = 0
+	e.channelPassword = ""
 	e.mu.Unlock()
 
 	return nil
@@ -527,13 +776,43 @@ func (e *Engine) SetVADThreshold(threshold float64) {
 	e.vad.SetThreshold(threshold)
 }
 
+// JitterStats returns the receive statistics (playout delay, jitter, late,
+// lost and concealed frames) of every speaker currently heard, keyed by
+// voice session ID.
+func (e *Engine) JitterStats() map[uint32]JitterStats {
+	return e.mixer.Stats()
+}
+
+// SetDuckingAttenuation sets how much other speakers are attenuated, in dB,
+// while a priority speaker is talking. 0 disables ducking.
+func (e *Engine) SetDuckingAttenuation(db float64) {
+	e.ducker.SetAttenuation(db)
+}
+
+// SetPrioritySpeaker flags a user as priority speaker in their current channel (moderator only).
+func (e *Engine) SetPrioritySpeaker(userID int64, enabled bool) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		PrioritySpeakerReq: &pb.PrioritySpeakerRequest{UserID: userID, Enabled: enabled},
+	})
+}
+
 // CreateChannel sends a create channel request (admin only).
 func (e *Engine) CreateChannel(name, description string, maxUsers int) error {
-	return e.CreateChannelAdvanced(name, description, maxUsers, 0, false, false)
+	return e.CreateChannelAdvanced(name, description, maxUsers, 0, false, false, false, 0, pb.CodecSettings{})
 }
 
 // CreateChannelAdvanced sends a create channel request with all options.
-func (e *Engine) CreateChannelAdvanced(name, description string, maxUsers int, parentID int64, isTemp bool, allowSubChannels bool) error {
+// Zero codec fields use the server defaults. e2ee makes the channel end-to-end
+// encrypted.
+func (e *Engine) CreateChannelAdvanced(name, description string, maxUsers int, parentID int64, isTemp bool, allowSubChannels bool, e2ee bool, chatRetention int64, codec pb.CodecSettings) error {
 	e.mu.RLock()
 	ctrl := e.control
 	e.mu.RUnlock()
@@ -550,6 +829,9 @@ func (e *Engine) CreateChannelAdvanced(name, description string, maxUsers int, p
 			ParentID:         parentID,
 			IsTemp:           isTemp,
 			AllowSubChannels: allowSubChannels,
+			E2EE:             e2ee,
+			ChatRetention:    chatRetention,
+			Codec:            codec,
 		},
 	})
 }
@@ -588,6 +870,35 @@ func (e *Engine) DeleteChannel(channelID int64) error {
 	})
 }
 
+// EditChannel sends an edit channel request (admin only). All properties are
+// replaced, so callers pass the current value for fields they do not change.
+// A non-empty password sets a new join password; clearPassword removes it.
+func (e *Engine) EditChannel(channelID int64, name, description string, maxUsers int, parentID int64, allowSubChannels bool, password string, clearPassword bool, e2ee bool, chatRetention int64, codec pb.CodecSettings) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		EditChannelReq: &pb.EditChannelRequest{
+			ChannelID:        channelID,
+			Name:             name,
+			Description:      description,
+			MaxUsers:         int32(maxUsers), //nolint:gosec // channel limits fit int32
+			ParentID:         parentID,
+			AllowSubChannels: allowSubChannels,
+			Password:         password,
+			ClearPassword:    clearPassword,
+			E2EE:             e2ee,
+			ChatRetention:    chatRetention,
+			Codec:            codec,
+		},
+	})
+}
+
 // ExportData requests the server to export data ("channels" or "users") as YAML.
 func (e *Engine) ExportData(dataType string) error {
 	e.mu.RLock()
@@ -619,7 +930,8 @@ func (e *Engine) ImportChannels(yamlData string) error {
 }
 
 // CreateToken sends a create token request (admin only).
-func (e *Engine) CreateToken(role string, maxUses int, expiresInSeconds int64) error {
+// The label is an optional human-readable note shown in the token list.
+func (e *Engine) CreateToken(role, label string, maxUses int, expiresInSeconds int64) error {
 	e.mu.RLock()
 	ctrl := e.control
 	e.mu.RUnlock()
@@ -633,10 +945,41 @@ func (e *Engine) CreateToken(role string, maxUses int, expiresInSeconds int64) e
 			Role:             role,
 			MaxUses:          int32(maxUses), //nolint:gosec // practical token limits fit int32
 			ExpiresInSeconds: expiresInSeconds,
+			Label:            label,
 		},
 	})
 }
 
+// ListTokens requests the invite token list (admin only).
+func (e *Engine) ListTokens() error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		ListTokensReq: &pb.ListTokensRequest{},
+	})
+}
+
+// RevokeToken revokes an invite token by ID (admin only).
+func (e *Engine) RevokeToken(tokenID int64) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		RevokeTokenReq: &pb.RevokeTokenRequest{TokenID: tokenID},
+	})
+}
+
 // SendChat sends a text message to the current channel.
 func (e *Engine) SendChat(text string) error {
 	e.mu.RLock()
@@ -659,6 +1002,121 @@ func (e *Engine) SendChat(text string) error {
 	})
 }
 
+// SendDirectMessage sends a private message to a user. If they are offline
+// the server keeps it for them. The message comes back through
+// OnDirectMessage once sent.
+func (e *Engine) SendDirectMessage(userID int64, text string) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		DirectMsg: &pb.DirectMessage{RecipientID: userID, Text: text},
+	})
+}
+
+// SendBroadcast sends an announcement to everybody on the server. It needs
+// the broadcast permission.
+func (e *Engine) SendBroadcast(text string) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		BroadcastReq: &pb.ServerBroadcastRequest{Text: text},
+	})
+}
+
+// FetchUnreadMessages asks for the direct messages a user sent while we
+// were offline (see OnUnreadMessages). They arrive through OnDirectMessage;
+// the engine then acknowledges them so the server forgets them.
+func (e *Engine) FetchUnreadMessages(userID int64) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		UnreadMsgsReq: &pb.UnreadMessagesRequest{UserID: userID},
+	})
+}
+
+// EditChatMessage replaces the text of one of our chat messages. Everybody
+// in the channel gets the new text through OnChatEdit.
+func (e *Engine) EditChatMessage(channelID, id int64, text string) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		EditChatReq: &pb.EditChatRequest{ChannelID: channelID, ID: id, Text: text},
+	})
+}
+
+// DeleteChatMessage removes one of our chat messages, or anybody's with the
+// manage_chat permission. The removal arrives through OnChatDelete.
+func (e *Engine) DeleteChatMessage(channelID, id int64) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		DeleteChatReq: &pb.DeleteChatRequest{ChannelID: channelID, ID: id},
+	})
+}
+
+// RequestChatHistory asks for the messages of our channel older than
+// before (0 = the newest). The page arrives through OnChatHistory. History
+// of a newly joined channel is fetched without asking.
+func (e *Engine) RequestChatHistory(channelID, before int64) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		ChatHistoryReq: &pb.ChatHistoryRequest{ChannelID: channelID, Before: before},
+	})
+}
+
+// fetchChatHistory requests the recent chat of our channel once the server
+// state shows us in a channel we have no history of yet.
+func (e *Engine) fetchChatHistory() {
+	e.mu.Lock()
+	channelID := e.srvState.users[e.sessionID].ChannelID
+	fetch := channelID != e.historyChannel && channelID != 0
+	e.historyChannel = channelID
+	e.mu.Unlock()
+	if !fetch {
+		return
+	}
+	if err := e.RequestChatHistory(channelID, 0); err != nil {
+		slog.Warn("request chat history", "channel", channelID, "err", err)
+	}
+}
+
 // SetUserRole sends a role change request (admin only).
 func (e *Engine) SetUserRole(targetUserID int64, newRole string) error {
 	e.mu.RLock()
@@ -692,8 +1150,54 @@ func (e *Engine) KickUser(userID int64, reason string) error {
 	})
 }
 
-// BanUser sends a ban request (admin only).
-func (e *Engine) BanUser(userID int64, reason string, durationSeconds int64) error {
+// BanUser sends a ban request (admin only). If banIP is set, the user's
+// current address is banned as well.
+func (e *Engine) BanUser(userID int64, reason string, durationSeconds int64, banIP bool) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		BanUserReq: &pb.BanUserRequest{UserID: userID, Reason: reason, DurationSeconds: durationSeconds, BanIP: banIP},
+	})
+}
+
+// BanIP bans an IP address or CIDR range (admin only).
+func (e *Engine) BanIP(ip, reason string, durationSeconds int64) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		BanUserReq: &pb.BanUserRequest{IP: ip, Reason: reason, DurationSeconds: durationSeconds},
+	})
+}
+
+// ListBans requests the list of active bans (admin only).
+func (e *Engine) ListBans() error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		ListBansReq: &pb.ListBansRequest{},
+	})
+}
+
+// Unban lifts a ban by ID (admin only).
+func (e *Engine) Unban(banID int64) error {
 	e.mu.RLock()
 	ctrl := e.control
 	e.mu.RUnlock()
@@ -703,12 +1207,161 @@ func (e *Engine) BanUser(userID int64, reason string, durationSeconds int64) err
 	}
 
 	return ctrl.Send(&pb.ControlMessage{
-		BanUserReq: &pb.BanUserRequest{UserID: userID, Reason: reason, DurationSeconds: durationSeconds},
+		UnbanReq: &pb.UnbanRequest{BanID: banID},
 	})
 }
 
-// Disconnect disconnects from the server.
+// ServerMute sets the server-side mute and deafen of another user (requires mute permission).
+func (e *Engine) ServerMute(userID int64, muted, deafened bool) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		ServerMuteReq: &pb.ServerMuteRequest{UserID: userID, Muted: muted, Deafened: deafened},
+	})
+}
+
+// MoveUser moves another user into a channel (requires move permission).
+func (e *Engine) MoveUser(userID, channelID int64) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		MoveUserReq: &pb.MoveUserRequest{UserID: userID, ChannelID: channelID},
+	})
+}
+
+// SetWhisperTarget registers the users and channels reached while whispering
+// with targetID (1..protocol.MaxWhisperTarget). Sub-channels of the given
+// channels are included if includeSubChannels is set.
+func (e *Engine) SetWhisperTarget(targetID uint8, userIDs, channelIDs []int64, includeSubChannels bool) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+	if targetID == protocol.TargetChannel || targetID > protocol.MaxWhisperTarget {
+		return fmt.Errorf("whisper target must be between 1 and %d", protocol.MaxWhisperTarget)
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		WhisperTargetReq: &pb.WhisperTargetRequest{
+			TargetID:           uint32(targetID),
+			UserIDs:            userIDs,
+			ChannelIDs:         channelIDs,
+			IncludeSubChannels: includeSubChannels,
+		},
+	})
+}
+
+// ClearWhisperTarget removes a registered whisper target.
+func (e *Engine) ClearWhisperTarget(targetID uint8) error {
+	return e.SetWhisperTarget(targetID, nil, nil, false)
+}
+
+// StartWhisper starts sending voice to a registered whisper target instead of
+// the current channel. It is meant to be called on whisper key press; while
+// whispering, voice is sent regardless of voice activity detection.
+func (e *Engine) StartWhisper(targetID uint8) {
+	e.setWhisper(targetID)
+}
+
+// StopWhisper returns to normal channel talk, typically on whisper key release.
+func (e *Engine) StopWhisper() {
+	e.setWhisper(protocol.TargetChannel)
+}
+
+// IsWhispering reports whether a whisper target is active.
+func (e *Engine) IsWhispering() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.whisper != protocol.TargetChannel
+}
+
+func (e *Engine) setWhisper(targetID uint8) {
+	e.mu.Lock()
+	e.whisper = targetID
+	voice := e.voice
+	e.mu.Unlock()
+
+	if voice != nil {
+		voice.SetTarget(targetID)
+	}
+}
+
+// ListChannelACL requests the permission overrides of a channel.
+func (e *Engine) ListChannelACL(channelID int64) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		ListChannelACLReq: &pb.ListChannelACLRequest{ChannelID: channelID},
+	})
+}
+
+// SetChannelACL allows or denies a permission in a channel for a role, or for
+// a single user when userID is non-zero.
+func (e *Engine) SetChannelACL(channelID, userID int64, role, permission string, allow bool) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		SetChannelACLReq: &pb.SetChannelACLRequest{
+			ChannelID:  channelID,
+			UserID:     userID,
+			Role:       role,
+			Permission: permission,
+			Allow:      allow,
+		},
+	})
+}
+
+// DeleteChannelACL removes a permission override by ID.
+func (e *Engine) DeleteChannelACL(entryID int64) error {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+
+	if ctrl == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	return ctrl.Send(&pb.ControlMessage{
+		DeleteChannelACLReq: &pb.DeleteChannelACLRequest{EntryID: entryID},
+	})
+}
+
+// Disconnect disconnects from the server, or stops reconnecting.
 func (e *Engine) Disconnect() {
+	e.mu.RLock()
+	ctrl := e.control
+	e.mu.RUnlock()
+	if ctrl != nil {
+		// Tell the server not to keep our session around for a resume
+		_ = ctrl.Send(&pb.ControlMessage{DisconnectReq: &pb.DisconnectRequest{}})
+	}
 	e.handleDisconnect("user disconnected")
 }
 
@@ -726,6 +1379,14 @@ func (e *Engine) GetUsername() string {
 	return e.username
 }
 
+// ServerFingerprint returns the SHA-256 fingerprint of the connected
+// server's certificate, for pinning on later connects.
+func (e *Engine) ServerFingerprint() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.fingerprint
+}
+
 // GetRole returns the user's role.
 func (e *Engine) GetRole() string {
 	e.mu.RLock()
@@ -733,6 +1394,33 @@ func (e *Engine) GetRole() string {
 	return e.role
 }
 
+// GetRoles returns the role names known to the server, lowest priority first.
+// Servers without custom roles may not send the list; the built-in roles are
+// returned then.
+func (e *Engine) GetRoles() []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if len(e.roles) == 0 {
+		return []string{"user", "moderator", "admin"}
+	}
+	return append([]string(nil), e.roles...)
+}
+
+// channelsChanged rebuilds the channel list after the server state changed
+// and passes it on.
+func (e *Engine) channelsChanged() {
+	e.mu.Lock()
+	channels := e.srvState.channelList()
+	e.channels = channels
+	e.mu.Unlock()
+	e.ducker.UpdateSpeakers(channels)
+	e.applyChannelCodec()
+	if e.OnChannelsUpdate != nil {
+		e.OnChannelsUpdate(channels)
+	}
+	e.fetchChatHistory()
+}
+
 // GetChannels returns the current channel list.
 func (e *Engine) GetChannels() []pb.ChannelInfo {
 	e.mu.RLock()
@@ -764,6 +1452,16 @@ func (e *Engine) handleDisconnect(reason string) {
 	}
 	e.state = StateDisconnected
 	e.channelID = 0
+	e.channelPassword = ""
+	e.resumeToken = ""
+	e.whisper = protocol.TargetChannel // targets die with the session
+	e.e2ee = nil
+	e.codec = pb.CodecSettings{}
+	e.audioCodec = pb.CodecSettings{}
+
+	// Stops the pipelines and any reconnect loop; reset for the next connect
+	cancel := e.cancel
+	e.ctx, e.cancel = context.WithCancel(context.Background())
 
 	ctrl := e.control
 	voice := e.voice
@@ -790,15 +1488,10 @@ func (e *Engine) handleDisconnect(reason string) {
 		_ = ctrl.Close()
 	}
 
-	e.cancel()
-	// Reset context for reconnection
-	e.ctx, e.cancel = context.WithCancel(context.Background())
+	cancel()
 
 	// Clean up decoders
-	e.decoderMu.Lock()
-	e.decoders = make(map[uint32]audio.AudioDecoder)
-	e.jitterBufs = make(map[uint32]*JitterBuffer)
-	e.decoderMu.Unlock()
+	e.mixer.Reset()
 
 	slog.Info("disconnected", "reason", reason)
 	e.notifyStateChange(StateDisconnected)
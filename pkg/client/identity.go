@@ -0,0 +1,40 @@
+package client
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	gospeakCrypto "github.com/NicolasHaas/gospeak/pkg/crypto"
+)
+
+func identityPath() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return "identity.key"
+	}
+	return filepath.Join(filepath.Dir(exe), "identity.key")
+}
+
+// LoadIdentity loads the X25519 identity key stored next to the binary,
+// creating it on first use. Other users verify this key through safety
+// numbers, so it must survive restarts.
+func LoadIdentity() (*ecdh.PrivateKey, error) {
+	data, err := os.ReadFile(identityPath())
+	if err == nil {
+		return gospeakCrypto.ParseIdentity(data)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	key, err := gospeakCrypto.GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(identityPath(), key.Bytes(), 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
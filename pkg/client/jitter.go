@@ -2,30 +2,95 @@ package client
 
 import (
 	"sync"
+	"time"
+
+	"github.com/NicolasHaas/gospeak/pkg/audio"
 )
 
 const (
-	jitterBufSize  = 5  // frames (~100ms at 20ms/frame)
-	maxJitterDelay = 10 // max frames to wait before considering packet lost
+	sampleRate   = 48000 // VoicePacket.Timestamp clock rate
+	frameSamples = 960   // samples per 20ms playout slot
+
+	minJitterDelay     = 2  // frames (40ms) — lower bound of the target delay
+	maxJitterDelay     = 10 // frames (200ms) — upper bound of the target delay
+	initialJitterDelay = 3  // frames used until there is a jitter estimate
+	maxBufferedFrames  = 50 // hard cap (~1s) to prevent memory growth
+
+	// jitterMultiplier scales the jitter estimate into a target delay that
+	// covers most arrivals, not just the average deviation.
+	jitterMultiplier = 3
 )
 
-// JitterBuffer orders incoming voice packets and handles packet loss.
+// JitterStats is a snapshot of a jitter buffer's state and counters.
+type JitterStats struct {
+	Delay     time.Duration // current target playout delay
+	Jitter    time.Duration // estimated inter-arrival jitter
+	Buffered  int           // frames currently queued
+	Late      uint64        // frames that arrived after their playout slot
+	Lost      uint64        // frames never received
+	Recovered uint64        // lost frames rebuilt from the next packet's FEC data
+	Concealed uint64        // lost frames replaced by packet loss concealment
+}
+
+// Frame is one playout slot handed out by the jitter buffer.
+type Frame struct {
+	SeqNum  uint32
+	Payload []byte // Opus data, or nil if the frame was lost
+	// FEC is set for a lost frame whose following packet is already queued;
+	// its in-band FEC data can recover the lost frame.
+	FEC []byte
+}
+
+type jitterFrame struct {
+	payload   []byte
+	timestamp uint32
+	samples   uint32 // duration, read from the Opus TOC
+	arrival   time.Time
+}
+
+// JitterBuffer orders incoming voice packets and adapts its playout delay to
+// the measured network jitter. The mixer pulls from it every 20ms; frames
+// may be 10 to 60ms long, so delays are tracked in samples, not packets.
+//
+// Sequence numbers only advance for packets that were actually sent, while
+// timestamps advance for every captured frame. A sequence gap is therefore a
+// real loss (concealed with PLC), whereas a timestamp gap between consecutive
+// sequence numbers is a DTX/VAD silence that is played out as silence.
 type JitterBuffer struct {
 	mu      sync.Mutex
-	frames  map[uint32][]byte // seqNum -> encrypted payload
+	frames  map[uint32]jitterFrame // seqNum -> frame
 	nextSeq uint32
-	ready   bool
+	nextTS  uint32 // timestamp of the next playout slot
+	ready   bool   // nextSeq is initialized
+	started bool   // at least one frame was played out
+	playing bool   // false while (re)buffering up to the target delay
+
+	// Jitter estimation (RFC 3550 style, in samples)
+	jitter      float64
+	lastArrival time.Time
+	lastTS      uint32
+	lastSeq     uint32
+	hasLast     bool
+
+	target      int    // target delay in 20ms slots
+	waited      int    // ticks spent waiting for a missing frame
+	queued      uint32 // samples of audio in frames
+	lastSamples uint32 // duration of the last played frame, used for lost ones
+
+	late, lost, recovered, concealed uint64
 }
 
 // NewJitterBuffer creates a new jitter buffer.
 func NewJitterBuffer() *JitterBuffer {
 	return &JitterBuffer{
-		frames: make(map[uint32][]byte),
+		frames:      make(map[uint32]jitterFrame),
+		target:      initialJitterDelay,
+		lastSamples: frameSamples,
 	}
 }
 
-// Push adds a packet to the jitter buffer.
-func (jb *JitterBuffer) Push(seqNum uint32, payload []byte) {
+// Push adds a packet received at now to the jitter buffer.
+func (jb *JitterBuffer) Push(seqNum, timestamp uint32, payload []byte, now time.Time) {
 	jb.mu.Lock()
 	defer jb.mu.Unlock()
 
@@ -34,72 +99,196 @@ func (jb *JitterBuffer) Push(seqNum uint32, payload []byte) {
 		jb.ready = true
 	}
 
+	if jb.started && seqBefore(seqNum, jb.nextSeq) {
+		jb.late++
+		return
+	}
+	if _, dup := jb.frames[seqNum]; dup {
+		return
+	}
+
+	jb.updateJitter(seqNum, timestamp, now)
+
+	samples := uint32(audio.PacketSamples(payload)) //nolint:gosec // at most 5760
+	if samples == 0 {
+		samples = frameSamples
+	}
+
 	// Store the frame
 	data := make([]byte, len(payload))
 	copy(data, payload)
-	jb.frames[seqNum] = data
+	jb.frames[seqNum] = jitterFrame{payload: data, timestamp: timestamp, samples: samples, arrival: now}
+	jb.queued += samples
+
+	if len(jb.frames) > maxBufferedFrames {
+		jb.dropOldest()
+	}
+}
+
+// updateJitter folds the transit time difference of an in-order packet into
+// the running jitter estimate and recomputes the target delay.
+func (jb *JitterBuffer) updateJitter(seqNum, timestamp uint32, now time.Time) {
+	if jb.hasLast && !seqBefore(jb.lastSeq, seqNum) {
+		return // reordered packet; its transit says little about the path
+	}
+	if jb.hasLast {
+		arrival := now.Sub(jb.lastArrival).Seconds() * sampleRate
+		d := arrival - float64(int32(timestamp-jb.lastTS)) //nolint:gosec // wraparound difference
+		if d < 0 {
+			d = -d
+		}
+		jb.jitter += (d - jb.jitter) / 16
 
-	// Limit buffer size to prevent memory growth
-	if len(jb.frames) > jitterBufSize*3 {
-		jb.cleanup()
+		target := 1 + int(jitterMultiplier*jb.jitter/frameSamples+0.999)
+		jb.target = max(minJitterDelay, min(target, maxJitterDelay))
 	}
+	jb.lastArrival = now
+	jb.lastTS = timestamp
+	jb.lastSeq = seqNum
+	jb.hasLast = true
 }
 
-// Pop returns the next frame in sequence order.
-// Returns (payload, seqNum, ok). If the next frame isn't available,
-// checks if we should skip it (lost packet).
-func (jb *JitterBuffer) Pop() ([]byte, uint32, bool) {
+// Pop returns the frame for the current 20ms playout slot. A frame with a
+// nil Payload was lost: decode its FEC packet if present, otherwise conceal
+// it (PLC). ok=false means there is nothing to play in this slot: the buffer
+// is filling, or the speaker is silent.
+func (jb *JitterBuffer) Pop(now time.Time) (Frame, bool) {
 	jb.mu.Lock()
 	defer jb.mu.Unlock()
 
-	if !jb.ready {
-		return nil, 0, false
+	if !jb.ready || len(jb.frames) == 0 {
+		// Underrun or end of talk spurt: rebuffer before playing again
+		jb.playing = false
+		jb.waited = 0
+		return Frame{}, false
+	}
+
+	if !jb.playing {
+		first, f := jb.oldest()
+		if jb.queued < jb.targetSamples() && now.Sub(f.arrival) < time.Duration(jb.target)*mixInterval {
+			return Frame{}, false
+		}
+		if jb.started && seqBefore(jb.nextSeq, first) {
+			// Frames skipped while not playing are gone for good
+			jb.lost += uint64(first - jb.nextSeq)
+		}
+		jb.nextSeq = first
+		jb.nextTS = f.timestamp
+		jb.playing = true
+		jb.started = true
 	}
 
-	// Check if we have the next expected frame
-	if frame, ok := jb.frames[jb.nextSeq]; ok {
+	if f, ok := jb.frames[jb.nextSeq]; ok {
+		if tsBefore(jb.nextTS, f.timestamp) {
+			// Silence gap (DTX/VAD) before this frame. Shorten it when
+			// more than the target delay is queued, otherwise play silence.
+			if jb.queued <= jb.targetSamples() {
+				jb.nextTS += frameSamples
+				return Frame{}, false
+			}
+		}
 		seq := jb.nextSeq
-		delete(jb.frames, jb.nextSeq)
+		delete(jb.frames, seq)
+		jb.queued -= f.samples
 		jb.nextSeq++
-		return frame, seq, true
+		jb.nextTS = f.timestamp + f.samples
+		jb.lastSamples = f.samples
+		jb.waited = 0
+		return Frame{SeqNum: seq, Payload: f.payload}, true
 	}
 
-	// Check if we've waited too long (packet lost)
-	// Look ahead to see if later packets exist
-	for i := uint32(1); i <= maxJitterDelay; i++ {
-		if _, ok := jb.frames[jb.nextSeq+i]; ok {
-			// Later packet exists, the current one is likely lost
-			seq := jb.nextSeq
-			jb.nextSeq++
-			return nil, seq, true // nil payload = packet lost, use PLC
-		}
+	// The next frame is missing but later ones exist. Wait for it as long
+	// as the target delay allows, then declare it lost.
+	jb.waited++
+	if jb.queued < jb.targetSamples() && jb.waited < jb.target {
+		return Frame{}, false
+	}
+	lost := Frame{SeqNum: jb.nextSeq}
+	jb.nextSeq++
+	jb.nextTS += jb.lastSamples
+	jb.waited = 0
+	jb.lost++
+	// Hand over the following packet so its FEC data can rebuild this frame
+	if next, ok := jb.frames[jb.nextSeq]; ok {
+		lost.FEC = next.payload
+		jb.recovered++
+	} else {
+		jb.concealed++
 	}
+	return lost, true
+}
 
-	return nil, 0, false // not enough data yet
+// targetSamples returns the target delay in samples.
+func (jb *JitterBuffer) targetSamples() uint32 {
+	return uint32(jb.target) * frameSamples //nolint:gosec // target is at most maxJitterDelay
+}
+
+// fecFailed records that FEC recovery of a handed-out frame failed and the
+// frame was concealed instead.
+func (jb *JitterBuffer) fecFailed() {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	jb.recovered--
+	jb.concealed++
+}
+
+// Stats returns the current delay, jitter estimate and loss counters.
+func (jb *JitterBuffer) Stats() JitterStats {
+	jb.mu.Lock()
+	defer jb.mu.Unlock()
+	return JitterStats{
+		Delay:     time.Duration(jb.target) * mixInterval,
+		Jitter:    time.Duration(jb.jitter / frameSamples * float64(mixInterval)),
+		Buffered:  len(jb.frames),
+		Late:      jb.late,
+		Lost:      jb.lost,
+		Recovered: jb.recovered,
+		Concealed: jb.concealed,
+	}
 }
 
 // Reset clears the jitter buffer.
 func (jb *JitterBuffer) Reset() {
 	jb.mu.Lock()
 	defer jb.mu.Unlock()
-	jb.frames = make(map[uint32][]byte)
+	jb.frames = make(map[uint32]jitterFrame)
+	jb.queued = 0
 	jb.ready = false
+	jb.started = false
+	jb.playing = false
+	jb.hasLast = false
 }
 
-func (jb *JitterBuffer) cleanup() {
-	// Remove frames that are too old
-	for seq := range jb.frames {
-		if seqDiff(seq, jb.nextSeq) > jitterBufSize*3 {
-			delete(jb.frames, seq)
+// oldest returns the queued frame with the lowest sequence number.
+func (jb *JitterBuffer) oldest() (uint32, jitterFrame) {
+	var seq uint32
+	var frame jitterFrame
+	first := true
+	for s, f := range jb.frames {
+		if first || seqBefore(s, seq) {
+			seq, frame, first = s, f, false
 		}
 	}
+	return seq, frame
 }
 
-// seqDiff computes the distance between two sequence numbers,
-// handling uint32 wraparound.
-func seqDiff(a, b uint32) uint32 {
-	if a >= b {
-		return a - b
+func (jb *JitterBuffer) dropOldest() {
+	seq, f := jb.oldest()
+	delete(jb.frames, seq)
+	jb.queued -= f.samples
+	if seq == jb.nextSeq {
+		jb.nextSeq++
+		jb.lost++
 	}
-	return b - a
+}
+
+// seqBefore reports whether sequence number a precedes b, handling uint32
+// wraparound.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0 //nolint:gosec // wraparound comparison
+}
+
+// tsBefore reports whether timestamp a precedes b, handling uint32 wraparound.
+func tsBefore(a, b uint32) bool {
+	return int32(a-b) < 0 //nolint:gosec // wraparound comparison
 }
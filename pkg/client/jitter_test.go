@@ -0,0 +1,122 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// pushRun pushes frames with consecutive sequence numbers and timestamps
+// starting at seq/ts, arriving every 20ms from start.
+func pushRun(jb *JitterBuffer, seq, ts, n uint32, start time.Time) {
+	for i := uint32(0); i < n; i++ {
+		jb.Push(seq+i, ts+i*frameSamples, opusPacket(byte(seq+i)), start.Add(time.Duration(i)*mixInterval))
+	}
+}
+
+func TestJitterBufferReorder(t *testing.T) {
+	jb := NewJitterBuffer()
+	now := time.Now()
+	for _, seq := range []uint32{1, 0, 2} {
+		jb.Push(10+seq, seq*frameSamples, opusPacket(byte(seq)), now)
+	}
+	for want := uint32(10); want < 13; want++ {
+		frame, ok := jb.Pop(now)
+		if !ok || frame.Payload == nil || frame.SeqNum != want {
+			t.Fatalf("Pop: want seq %d, got %+v ok=%v", want, frame, ok)
+		}
+	}
+	if _, ok := jb.Pop(now); ok {
+		t.Fatalf("Pop: want empty buffer")
+	}
+
+	// A frame arriving after its slot was played is counted late
+	jb.Push(11, frameSamples, opusPacket(1), now)
+	if st := jb.Stats(); st.Late != 1 {
+		t.Fatalf("Stats: want 1 late frame, got %+v", st)
+	}
+}
+
+func TestJitterBufferLoss(t *testing.T) {
+	jb := NewJitterBuffer()
+	now := time.Now()
+	// Sequence 1 never arrives: its successor carries FEC data for it.
+	// Sequences 4 and 5 are lost back to back: 4 has no successor to recover from.
+	for _, seq := range []uint32{0, 2, 3, 6, 7} {
+		jb.Push(seq, seq*frameSamples, opusPacket(byte(seq)), now)
+	}
+
+	var lost []Frame
+	for i := 0; i < 12; i++ {
+		frame, ok := jb.Pop(now)
+		if ok && frame.Payload == nil {
+			lost = append(lost, frame)
+		}
+	}
+	if len(lost) != 3 {
+		t.Fatalf("Pop: want 3 lost frames, got %+v", lost)
+	}
+	if lost[0].SeqNum != 1 || len(lost[0].FEC) != 2 || lost[0].FEC[1] != 2 {
+		t.Fatalf("Pop: want seq 1 handed over with the next packet, got %+v", lost[0])
+	}
+	if lost[1].SeqNum != 4 || lost[1].FEC != nil {
+		t.Fatalf("Pop: want seq 4 without FEC, got %+v", lost[1])
+	}
+	if lost[2].SeqNum != 5 || lost[2].FEC == nil {
+		t.Fatalf("Pop: want seq 5 with FEC from seq 6, got %+v", lost[2])
+	}
+	st := jb.Stats()
+	if st.Lost != 3 || st.Recovered != 2 || st.Concealed != 1 {
+		t.Fatalf("Stats: want 3 lost, 2 recovered, 1 concealed, got %+v", st)
+	}
+}
+
+func TestJitterBufferDTXGap(t *testing.T) {
+	jb := NewJitterBuffer()
+	now := time.Now()
+	// Consecutive sequence numbers with a 5-frame timestamp gap: silence, not loss
+	pushRun(jb, 0, 0, 1, now)
+	pushRun(jb, 1, 6*frameSamples, 1, now)
+
+	var frames, silent int
+	for i := 0; i < 10; i++ {
+		frame, ok := jb.Pop(now.Add(time.Second))
+		switch {
+		case ok && frame.Payload == nil:
+			t.Fatalf("Pop: DTX gap was concealed as loss")
+		case ok:
+			frames++
+		case frames == 1:
+			silent++
+		}
+	}
+	if frames != 2 || silent != 5 {
+		t.Fatalf("Pop: want 2 frames around 5 silent slots, got %d frames, %d silent", frames, silent)
+	}
+	if st := jb.Stats(); st.Lost != 0 || st.Concealed != 0 {
+		t.Fatalf("Stats: want no loss, got %+v", st)
+	}
+}
+
+func TestJitterBufferAdaptiveDelay(t *testing.T) {
+	// Steady 20ms arrivals shrink the delay to the minimum
+	steady := NewJitterBuffer()
+	pushRun(steady, 0, 0, 100, time.Now())
+	if d := steady.Stats().Delay; d != minJitterDelay*mixInterval {
+		t.Fatalf("Stats: want minimum delay on a steady path, got %v", d)
+	}
+
+	// Alternating 0ms/40ms arrivals (20ms jitter) grow it
+	jittery := NewJitterBuffer()
+	start := time.Now()
+	for seq := uint32(0); seq < 100; seq++ {
+		arrival := start.Add(time.Duration(seq/2*2) * mixInterval)
+		jittery.Push(seq, seq*frameSamples, opusPacket(0), arrival)
+	}
+	st := jittery.Stats()
+	if st.Delay <= minJitterDelay*mixInterval || st.Delay > maxJitterDelay*mixInterval {
+		t.Fatalf("Stats: want delay above minimum for a jittery path, got %+v", st)
+	}
+	if st.Jitter < 10*time.Millisecond {
+		t.Fatalf("Stats: want ~20ms jitter estimate, got %v", st.Jitter)
+	}
+}
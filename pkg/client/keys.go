@@ -0,0 +1,99 @@
+package client
+
+import (
+	"sync"
+
+	gospeakCrypto "github.com/NicolasHaas/gospeak/pkg/crypto"
+	"github.com/NicolasHaas/gospeak/pkg/protocol"
+)
+
+// keyEntry is the cipher of one key ID with the epoch of its newest key.
+type keyEntry struct {
+	cipher *gospeakCrypto.VoiceCipher
+	epoch  uint32
+}
+
+// whisperKeyID names the key of one whisper target of a sending session.
+type whisperKeyID struct {
+	sender uint32
+	target uint8
+}
+
+// KeyRing holds the voice keys a session knows: the key of its current
+// channel and the keys of the whisper targets it sends to or is reached by.
+// The server only sends a channel key to members, so a key for another
+// channel means we changed channels and the old one is dropped.
+type KeyRing struct {
+	mu        sync.RWMutex
+	channelID int64
+	channel   keyEntry
+	whispers  map[whisperKeyID]*keyEntry
+}
+
+// NewKeyRing creates an empty key ring.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{whispers: make(map[whisperKeyID]*keyEntry)}
+}
+
+// SetKey installs the key of a channel from the server. Keys older than the
+// one already held are ignored; they arrive late when rotations race.
+func (r *KeyRing) SetKey(channelID int64, epoch uint32, key []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if channelID != r.channelID {
+		r.channelID = channelID
+		r.channel = keyEntry{}
+	}
+	return r.channel.set(epoch, key)
+}
+
+// SetWhisperKey installs the key of a sender's whisper target. An empty key
+// means we are no longer reached by the target, and the key is dropped.
+func (r *KeyRing) SetWhisperKey(sender uint32, target uint8, epoch uint32, key []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := whisperKeyID{sender: sender, target: target}
+	if len(key) == 0 {
+		delete(r.whispers, id)
+		return nil
+	}
+	entry, ok := r.whispers[id]
+	if !ok {
+		entry = &keyEntry{}
+		r.whispers[id] = entry
+	}
+	return entry.set(epoch, key)
+}
+
+// set adds a key unless it is older than the newest one held.
+func (k *keyEntry) set(epoch uint32, key []byte) error {
+	if k.cipher == nil {
+		k.cipher = &gospeakCrypto.VoiceCipher{}
+	} else if epoch <= k.epoch {
+		return nil
+	}
+	if err := k.cipher.AddKey(uint8(epoch), key); err != nil { //nolint:gosec // packets carry the low byte
+		return err
+	}
+	k.epoch = epoch
+	return nil
+}
+
+// Cipher returns the cipher for a packet sender sent in channelID to
+// target, or nil if the key is not known (yet).
+func (r *KeyRing) Cipher(channelID int64, sender uint32, target uint8) *gospeakCrypto.VoiceCipher {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if target != protocol.TargetChannel {
+		if entry, ok := r.whispers[whisperKeyID{sender: sender, target: target}]; ok {
+			return entry.cipher
+		}
+		return nil
+	}
+	if channelID == 0 || channelID != r.channelID {
+		return nil
+	}
+	return r.channel.cipher
+}
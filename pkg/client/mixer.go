@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/NicolasHaas/gospeak/pkg/audio"
+)
+
+const (
+	mixInterval = 20 * time.Millisecond // one Opus frame per tick
+
+	// speakerIdleTimeout drops a speaker's decoder and jitter buffer after
+	// this long without packets, so departed users don't leak state.
+	speakerIdleTimeout = 5 * time.Second
+)
+
+// speakerStream is the per-speaker decode state owned by the Mixer.
+type speakerStream struct {
+	dec      audio.AudioDecoder
+	jb       *JitterBuffer
+	pending  []int16 // decoded samples not mixed yet (frames longer than a tick)
+	lastPush time.Time
+}
+
+// speakerFrame is one decoded frame contributed to a mix.
+type speakerFrame struct {
+	sessionID uint32
+	pcm       []int16
+}
+
+// Mixer buffers decoded voice per speaker and sums all active speakers into
+// a single output frame on every tick, so simultaneous talkers are heard
+// together instead of being serialized onto the output device.
+//
+// Speakers may use any Opus frame duration; decoded audio is queued per
+// speaker and the output is always one 20 ms frame per tick.
+type Mixer struct {
+	mu       sync.Mutex
+	streams  map[uint32]*speakerStream
+	factory  audio.DecoderFactory
+	channels int // interleaved output channels
+	ducker   *Ducker
+}
+
+// NewMixer creates a mono mixer that creates one decoder per speaker from
+// factory. ducker may be nil to disable priority speaker ducking.
+func NewMixer(factory audio.DecoderFactory, ducker *Ducker) *Mixer {
+	return &Mixer{
+		streams:  make(map[uint32]*speakerStream),
+		factory:  factory,
+		channels: 1,
+		ducker:   ducker,
+	}
+}
+
+// Configure switches the decoder factory and output channel count. All
+// per-speaker state is dropped; decoders must produce that many channels.
+func (m *Mixer) Configure(factory audio.DecoderFactory, channels int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.factory = factory
+	m.channels = channels
+	m.streams = make(map[uint32]*speakerStream)
+}
+
+// Push queues a decrypted Opus payload from a speaker.
+func (m *Mixer) Push(sessionID, seqNum, timestamp uint32, payload []byte, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.streams[sessionID]
+	if !ok {
+		dec, err := m.factory.NewDecoder()
+		if err != nil {
+			return err
+		}
+		s = &speakerStream{dec: dec, jb: NewJitterBuffer()}
+		m.streams[sessionID] = s
+	}
+	s.lastPush = now
+	s.jb.Push(seqNum, timestamp, payload, now)
+	return nil
+}
+
+// Mix takes 20 ms of audio from every speaker, pulling frames from their
+// jitter buffers as needed, applies ducking and returns the sum. It returns
+// nil when no speaker had audio.
+func (m *Mixer) Mix(now time.Time) []int16 {
+	m.mu.Lock()
+	size := frameSamples * m.channels
+	frames := make([]speakerFrame, 0, len(m.streams))
+	for id, s := range m.streams {
+		for len(s.pending) < size {
+			frame, ok := s.jb.Pop(now)
+			if !ok {
+				break
+			}
+			pcm, err := s.decode(frame)
+			if err != nil {
+				slog.Debug("decode error", "session", id, "err", err)
+				continue
+			}
+			s.pending = append(s.pending, pcm...)
+		}
+		if len(s.pending) == 0 {
+			if now.Sub(s.lastPush) > speakerIdleTimeout {
+				delete(m.streams, id)
+			}
+			continue
+		}
+
+		// A short tail (end of a talk spurt) is padded with silence
+		pcm := make([]int16, size)
+		n := copy(pcm, s.pending)
+		s.pending = s.pending[n:]
+		frames = append(frames, speakerFrame{sessionID: id, pcm: pcm})
+	}
+	m.mu.Unlock()
+
+	if len(frames) == 0 {
+		return nil
+	}
+
+	if m.ducker != nil {
+		// Priority speakers first, so they duck the others within the same tick
+		sort.SliceStable(frames, func(i, j int) bool {
+			return m.ducker.isPriority(frames[i].sessionID) && !m.ducker.isPriority(frames[j].sessionID)
+		})
+		for _, f := range frames {
+			m.ducker.Process(f.sessionID, f.pcm, now)
+		}
+	}
+
+	return mixFrames(frames)
+}
+
+// decode turns a jitter buffer frame into PCM. Lost frames are recovered
+// from the next packet's FEC data when available, otherwise concealed.
+func (s *speakerStream) decode(frame Frame) ([]int16, error) {
+	if frame.Payload != nil {
+		return s.dec.Decode(frame.Payload)
+	}
+	if frame.FEC != nil {
+		pcm, err := s.dec.DecodeFEC(frame.FEC)
+		if err == nil {
+			return pcm, nil
+		}
+		slog.Debug("fec decode failed, concealing", "seq", frame.SeqNum, "err", err)
+		s.jb.fecFailed()
+	}
+	// Packet lost — use PLC
+	return s.dec.DecodePLC()
+}
+
+// Run mixes on a 20 ms clock and writes one frame per tick to player until
+// ctx is cancelled. Ticks without any speaker write nothing.
+func (m *Mixer) Run(ctx context.Context, player audio.Player) {
+	ticker := time.NewTicker(mixInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			frame := m.Mix(now)
+			if frame == nil {
+				continue
+			}
+			if err := player.WriteFrame(frame); err != nil {
+				slog.Debug("playback error", "err", err)
+			}
+		}
+	}
+}
+
+// Stats returns the jitter buffer statistics of every active speaker, keyed by session ID.
+func (m *Mixer) Stats() map[uint32]JitterStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[uint32]JitterStats, len(m.streams))
+	for id, s := range m.streams {
+		stats[id] = s.jb.Stats()
+	}
+	return stats
+}
+
+// Reset drops all per-speaker state.
+func (m *Mixer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streams = make(map[uint32]*speakerStream)
+}
+
+// mixFrames sums the frames into a new buffer. If the sum would clip, the
+// whole frame is scaled down to full scale instead of hard-clipping peaks.
+func mixFrames(frames []speakerFrame) []int16 {
+	if len(frames) == 1 {
+		return frames[0].pcm
+	}
+
+	n := 0
+	for _, f := range frames {
+		n = max(n, len(f.pcm))
+	}
+	sum := make([]int32, n)
+	var peak int32
+	for _, f := range frames {
+		for i, s := range f.pcm {
+			sum[i] += int32(s)
+		}
+	}
+	for _, v := range sum {
+		if v < 0 {
+			v = -v
+		}
+		peak = max(peak, v)
+	}
+
+	out := make([]int16, n)
+	if peak <= math.MaxInt16 {
+		for i, v := range sum {
+			out[i] = int16(v)
+		}
+		return out
+	}
+	scale := float64(math.MaxInt16) / float64(peak)
+	for i, v := range sum {
+		out[i] = int16(float64(v) * scale)
+	}
+	return out
+}
@@ -0,0 +1,260 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NicolasHaas/gospeak/pkg/audio"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+const testFrameSize = 960
+
+// opusPacket builds a 20ms Opus packet (CELT fullband TOC) whose single
+// data byte is the value the fake decoder fills its frame with.
+func opusPacket(v byte) []byte {
+	return []byte{0xF8, v}
+}
+
+// fakeDecoder "decodes" a packet into a 20ms frame filled with its data byte
+// times 100, so the mix of two speakers is easy to predict. It counts the
+// frames rebuilt from FEC and concealed with PLC.
+type fakeDecoder struct {
+	noFEC    bool // reject FEC like a stream encoded without it
+	fec, plc int
+}
+
+func (d *fakeDecoder) Decode(data []byte) ([]int16, error) {
+	pcm := make([]int16, audio.PacketSamples(data))
+	for i := range pcm {
+		pcm[i] = int16(data[1]) * 100
+	}
+	return pcm, nil
+}
+
+func (d *fakeDecoder) DecodeFEC(next []byte) ([]int16, error) {
+	if d.noFEC {
+		return nil, errors.New("no fec data")
+	}
+	d.fec++
+	return constFrame(int16(next[1]) * 100), nil
+}
+
+func (d *fakeDecoder) DecodePLC() ([]int16, error) {
+	d.plc++
+	return constFrame(0), nil
+}
+
+// fakeDecoderFactory hands out fakeDecoders and keeps them for inspection.
+type fakeDecoderFactory struct {
+	noFEC    bool
+	decoders []*fakeDecoder
+}
+
+func (f *fakeDecoderFactory) NewDecoder() (audio.AudioDecoder, error) {
+	d := &fakeDecoder{noFEC: f.noFEC}
+	f.decoders = append(f.decoders, d)
+	return d, nil
+}
+
+// fakePlayer records written frames.
+type fakePlayer struct {
+	mu     sync.Mutex
+	frames [][]int16
+}
+
+func (p *fakePlayer) Start() error { return nil }
+func (p *fakePlayer) Stop() error  { return nil }
+
+func (p *fakePlayer) WriteFrame(frame []int16) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.frames = append(p.frames, frame)
+	return nil
+}
+
+func (p *fakePlayer) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.frames)
+}
+
+func constFrame(v int16) []int16 {
+	pcm := make([]int16, testFrameSize)
+	for i := range pcm {
+		pcm[i] = v
+	}
+	return pcm
+}
+
+func TestMixerSumsSpeakers(t *testing.T) {
+	m := NewMixer(&fakeDecoderFactory{}, nil)
+	now := time.Now()
+
+	if frame := m.Mix(now); frame != nil {
+		t.Fatalf("Mix: want nil without speakers, got %d samples", len(frame))
+	}
+
+	// Two speakers talking at once are summed into a single frame per tick
+	for seq := uint32(0); seq < initialJitterDelay; seq++ {
+		if err := m.Push(1, seq, seq*frameSamples, opusPacket(1), now); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+		if err := m.Push(2, 100+seq, seq*frameSamples, opusPacket(2), now); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+	for tick := 0; tick < initialJitterDelay; tick++ {
+		frame := m.Mix(now)
+		if len(frame) != testFrameSize || frame[0] != 300 {
+			t.Fatalf("Mix tick %d: want %d samples of 300, got %d samples of %v", tick, testFrameSize, len(frame), frame)
+		}
+	}
+	if frame := m.Mix(now); frame != nil {
+		t.Fatalf("Mix: want nil once buffers are drained")
+	}
+
+	// Idle speakers are dropped
+	m.Mix(now.Add(speakerIdleTimeout + time.Second))
+	if n := len(m.streams); n != 0 {
+		t.Fatalf("Mix: want idle speakers dropped, %d left", n)
+	}
+}
+
+func TestMixerClipping(t *testing.T) {
+	frames := []speakerFrame{
+		{sessionID: 1, pcm: constFrame(30000)},
+		{sessionID: 2, pcm: constFrame(20000)},
+		{sessionID: 3, pcm: constFrame(-5000)},
+	}
+	out := mixFrames(frames)
+	// 45000 exceeds full scale, so the frame is scaled rather than wrapped
+	if out[0] != math.MaxInt16 {
+		t.Fatalf("mixFrames: want %d, got %d", math.MaxInt16, out[0])
+	}
+
+	out = mixFrames([]speakerFrame{
+		{sessionID: 1, pcm: constFrame(1000)},
+		{sessionID: 2, pcm: constFrame(-400)},
+	})
+	if out[0] != 600 {
+		t.Fatalf("mixFrames: want 600, got %d", out[0])
+	}
+}
+
+func TestMixerDucking(t *testing.T) {
+	ducker := NewDucker()
+	ducker.SetAttenuation(20) // gain 0.1
+	ducker.UpdateSpeakers([]pb.ChannelInfo{{
+		Users: []pb.UserInfo{{SessionID: 2, PrioritySpeaker: true}},
+	}})
+	m := NewMixer(&fakeDecoderFactory{}, ducker)
+	now := time.Now()
+
+	for seq := uint32(0); seq < initialJitterDelay; seq++ {
+		_ = m.Push(1, seq, seq*frameSamples, opusPacket(10), now) // 1000
+		_ = m.Push(2, seq, seq*frameSamples, opusPacket(1), now)  // 100, priority
+	}
+	frame := m.Mix(now)
+	if frame[0] != 200 {
+		t.Fatalf("Mix: want regular speaker ducked to 100 plus priority 100, got %d", frame[0])
+	}
+}
+
+func TestMixerRun(t *testing.T) {
+	m := NewMixer(&fakeDecoderFactory{}, nil)
+	player := &fakePlayer{}
+	for seq := uint32(0); seq < 3; seq++ {
+		_ = m.Push(1, seq, seq*frameSamples, opusPacket(1), time.Now())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx, player)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for player.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(mixInterval)
+	}
+	cancel()
+	<-done
+	if n := player.count(); n != 3 {
+		t.Fatalf("Run: want 3 frames written, got %d", n)
+	}
+}
+
+func TestMixerFECRecoversLoss(t *testing.T) {
+	// Simulate 10% isolated packet loss over 200 frames
+	simulate := func(factory *fakeDecoderFactory) (*fakeDecoder, JitterStats) {
+		m := NewMixer(factory, nil)
+		start := time.Now()
+		for seq := uint32(0); seq < 200; seq++ {
+			now := start.Add(time.Duration(seq) * mixInterval)
+			if seq%10 != 5 {
+				_ = m.Push(1, seq, seq*frameSamples, opusPacket(1), now)
+			}
+			m.Mix(now)
+		}
+		// Drain what is still buffered
+		end := start.Add(200 * mixInterval)
+		for i := 0; i < maxJitterDelay; i++ {
+			m.Mix(end.Add(time.Duration(i) * mixInterval))
+		}
+		return factory.decoders[0], m.Stats()[1]
+	}
+
+	plcOnly, plcStats := simulate(&fakeDecoderFactory{noFEC: true})
+	withFEC, fecStats := simulate(&fakeDecoderFactory{})
+
+	if plcOnly.plc != 20 || plcStats.Concealed != 20 {
+		t.Fatalf("without FEC: want 20 concealed frames, got %d (stats %+v)", plcOnly.plc, plcStats)
+	}
+	if withFEC.plc >= plcOnly.plc {
+		t.Fatalf("with FEC: want fewer PLC frames than %d, got %d", plcOnly.plc, withFEC.plc)
+	}
+	if withFEC.fec != 20 || fecStats.Recovered != 20 || fecStats.Concealed != 0 {
+		t.Fatalf("with FEC: want all 20 losses recovered, got %d (stats %+v)", withFEC.fec, fecStats)
+	}
+}
+
+func TestMixerFrameDurations(t *testing.T) {
+	m := NewMixer(&fakeDecoderFactory{}, nil)
+	now := time.Now()
+
+	// 60ms SILK packets are spread over three ticks each
+	long := func(v byte) []byte { return []byte{0x58, v} }
+	_ = m.Push(1, 0, 0, long(1), now)
+	_ = m.Push(1, 1, 3*frameSamples, long(2), now)
+	for tick := 0; tick < 6; tick++ {
+		frame := m.Mix(now)
+		want := int16(100)
+		if tick >= 3 {
+			want = 200
+		}
+		if len(frame) != testFrameSize || frame[0] != want || frame[testFrameSize-1] != want {
+			t.Fatalf("Mix tick %d: want %d samples of %d, got %d samples", tick, testFrameSize, want, len(frame))
+		}
+	}
+	if frame := m.Mix(now); frame != nil {
+		t.Fatalf("Mix: want nil after 120ms of audio")
+	}
+
+	// 10ms CELT packets are combined two per tick
+	short := func(v byte) []byte { return []byte{0xF0, v} }
+	for seq := uint32(0); seq < 6; seq++ {
+		_ = m.Push(2, seq, seq*frameSamples/2, short(3), now)
+	}
+	for tick := 0; tick < 3; tick++ {
+		frame := m.Mix(now)
+		if len(frame) != testFrameSize || frame[0] != 300 || frame[testFrameSize-1] != 300 {
+			t.Fatalf("Mix tick %d: want a full frame of two 10ms packets", tick)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+const (
+	reconnectMinDelay = 1 * time.Second  // delay before the first attempt
+	reconnectMaxDelay = 30 * time.Second // backoff cap
+)
+
+// connectionLost handles an unexpected drop of ctrl: the connection and the
+// audio devices are released, but the channel and mute/deafen state are kept
+// and a reconnect loop is started. Drops of connections we closed ourselves
+// are ignored.
+func (e *Engine) connectionLost(ctrl *ControlClient) {
+	e.audioMu.Lock()
+	e.mu.Lock()
+	if e.control != ctrl || e.state != StateConnected {
+		e.mu.Unlock()
+		e.audioMu.Unlock()
+		return
+	}
+	e.state = StateReconnecting
+	voice := e.voice
+	capture := e.capture
+	playback := e.playback
+	cancelAudio := e.audioCancel
+	e.control = nil
+	e.voice = nil
+	e.capture = nil
+	e.playback = nil
+	e.encoder = nil
+	e.audioCodec = pb.CodecSettings{}
+	ctx := e.ctx
+	e.mu.Unlock()
+
+	if cancelAudio != nil {
+		cancelAudio()
+	}
+	// Stop, not Close: the devices are reopened after reconnecting
+	if capture != nil {
+		_ = capture.Stop()
+	}
+	if playback != nil {
+		_ = playback.Stop()
+	}
+	e.audioMu.Unlock()
+	if voice != nil {
+		_ = voice.Close()
+	}
+	_ = ctrl.Close()
+	e.mixer.Reset()
+
+	slog.Warn("connection lost, reconnecting")
+	e.notifyStateChange(StateReconnecting)
+	go e.reconnectLoop(ctx)
+}
+
+// reconnectLoop retries the connection with exponential backoff until it
+// succeeds, the server rejects our credentials, or ctx is cancelled by
+// Disconnect.
+func (e *Engine) reconnectLoop(ctx context.Context) {
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		_, err := e.dial(StateReconnecting)
+		if err == nil {
+			slog.Info("reconnected", "attempts", attempt)
+			return
+		}
+		var mismatch *CertMismatchError
+		if errors.Is(err, ErrAuthFailed) || errors.As(err, &mismatch) {
+			// Banned, token revoked or a different server: retrying will not help
+			e.handleDisconnect(err.Error())
+			return
+		}
+		delay = min(delay*2, reconnectMaxDelay)
+		slog.Warn("reconnect failed", "attempt", attempt, "retry_in", delay, "err", err)
+	}
+}
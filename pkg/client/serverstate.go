@@ -0,0 +1,94 @@
+package client
+
+import (
+	"cmp"
+	"slices"
+
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+// serverState is our copy of the server state: the channel tree and who is
+// in which channel. A full ServerStateEvent resets it; ServerStateDelta
+// events keep it current in between.
+type serverState struct {
+	version  uint64
+	channels map[int64]pb.ChannelInfo // without users
+	users    map[uint32]pb.UserPresence
+	stale    bool // a delta went missing; waiting for the full state
+}
+
+// reset replaces the state with a full snapshot.
+func (s *serverState) reset(version uint64, channels []pb.ChannelInfo) {
+	s.version = version
+	s.stale = false
+	s.channels = make(map[int64]pb.ChannelInfo, len(channels))
+	s.users = make(map[uint32]pb.UserPresence)
+	for _, ch := range channels {
+		for _, u := range ch.Users {
+			s.users[u.SessionID] = pb.UserPresence{ChannelID: ch.ID, User: u}
+		}
+		ch.Users = nil
+		s.channels[ch.ID] = ch
+	}
+}
+
+// apply applies the next delta and reports whether the state changed.
+// Deltas the state already covers are ignored. On a gap in the versions the
+// state goes stale and resync is true: the caller asks for the full state,
+// and until it arrives further deltas are dropped.
+func (s *serverState) apply(d *pb.ServerStateDelta) (changed, resync bool) {
+	if d.Version <= s.version || s.stale {
+		return false, false
+	}
+	if d.Version != s.version+1 {
+		s.stale = true
+		return false, true
+	}
+	s.version = d.Version
+	if s.channels == nil {
+		s.reset(s.version, nil)
+	}
+	for _, id := range d.ChannelRemovals {
+		delete(s.channels, id)
+	}
+	for _, ch := range d.ChannelUpdates {
+		ch.Users = nil
+		s.channels[ch.ID] = ch
+	}
+	for _, sid := range d.UserRemovals {
+		delete(s.users, sid)
+	}
+	for _, p := range d.UserUpdates {
+		s.users[p.User.SessionID] = p
+	}
+	changed = len(d.ChannelRemovals)+len(d.ChannelUpdates)+len(d.UserRemovals)+len(d.UserUpdates) > 0
+	return changed, false
+}
+
+// channelList returns the state in the form of a ServerStateEvent: channels
+// ordered by parent and ID, each with its users ordered by name.
+func (s *serverState) channelList() []pb.ChannelInfo {
+	infos := make([]pb.ChannelInfo, 0, len(s.channels))
+	for _, ch := range s.channels {
+		ch.Users = []pb.UserInfo{}
+		infos = append(infos, ch)
+	}
+	slices.SortFunc(infos, func(a, b pb.ChannelInfo) int {
+		return cmp.Or(cmp.Compare(a.ParentID, b.ParentID), cmp.Compare(a.ID, b.ID))
+	})
+	index := make(map[int64]int, len(infos))
+	for i, ch := range infos {
+		index[ch.ID] = i
+	}
+	for _, p := range s.users {
+		if i, ok := index[p.ChannelID]; ok {
+			infos[i].Users = append(infos[i].Users, p.User)
+		}
+	}
+	for i := range infos {
+		slices.SortFunc(infos[i].Users, func(a, b pb.UserInfo) int {
+			return cmp.Or(cmp.Compare(a.Username, b.Username), cmp.Compare(a.SessionID, b.SessionID))
+		})
+	}
+	return infos
+}
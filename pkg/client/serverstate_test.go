@@ -0,0 +1,57 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+func TestServerStateApply(t *testing.T) {
+	alice := pb.UserInfo{Username: "alice", SessionID: 10}
+	bob := pb.UserInfo{Username: "bob", SessionID: 20}
+
+	var s serverState
+	s.reset(4, []pb.ChannelInfo{
+		{ID: 2, Name: "Music", ParentID: 1, Users: []pb.UserInfo{bob}},
+		{ID: 1, Name: "Lobby"},
+	})
+
+	// bob moves, alice arrives, Music is renamed
+	changed, resync := s.apply(&pb.ServerStateDelta{
+		Version:        5,
+		ChannelUpdates: []pb.ChannelInfo{{ID: 2, Name: "Jazz", ParentID: 1}},
+		UserUpdates:    []pb.UserPresence{{ChannelID: 1, User: bob}, {ChannelID: 1, User: alice}},
+	})
+	if !changed || resync {
+		t.Fatalf("apply: changed=%v resync=%v", changed, resync)
+	}
+	want := []pb.ChannelInfo{
+		{ID: 1, Name: "Lobby", Users: []pb.UserInfo{alice, bob}},
+		{ID: 2, Name: "Jazz", ParentID: 1, Users: []pb.UserInfo{}},
+	}
+	if diff := cmp.Diff(want, s.channelList()); diff != "" {
+		t.Fatalf("channelList mismatch (-want +got):\n%s", diff)
+	}
+
+	// A delta already applied is ignored
+	if changed, resync := s.apply(&pb.ServerStateDelta{Version: 5, UserRemovals: []uint32{10}}); changed || resync {
+		t.Fatalf("stale delta: changed=%v resync=%v", changed, resync)
+	}
+
+	// A gap asks for the full state once and drops deltas until it arrives
+	if changed, resync := s.apply(&pb.ServerStateDelta{Version: 7, ChannelRemovals: []int64{2}}); changed || !resync {
+		t.Fatalf("gap: changed=%v resync=%v", changed, resync)
+	}
+	if changed, resync := s.apply(&pb.ServerStateDelta{Version: 8, ChannelRemovals: []int64{2}}); changed || resync {
+		t.Fatalf("after gap: changed=%v resync=%v", changed, resync)
+	}
+	s.reset(8, []pb.ChannelInfo{{ID: 1, Name: "Lobby", Users: []pb.UserInfo{alice}}})
+	if changed, _ := s.apply(&pb.ServerStateDelta{Version: 9, UserRemovals: []uint32{10}}); !changed {
+		t.Fatalf("delta after resync not applied")
+	}
+	if got := s.channelList(); len(got) != 1 || len(got[0].Users) != 0 {
+		t.Fatalf("channelList after removal: %+v", got)
+	}
+}
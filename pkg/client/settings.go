@@ -13,6 +13,7 @@ type Settings struct {
 	MuteKey      string  `yaml:"mute_key"`
 	DeafenKey    string  `yaml:"deafen_key"`
 	VADThreshold float64 `yaml:"vad_threshold"`
+	DuckingDB    float64 `yaml:"ducking_db"` // attenuation of others while a priority speaker talks
 	AudioInput   string  `yaml:"audio_input,omitempty"`
 	AudioOutput  string  `yaml:"audio_output,omitempty"`
 }
@@ -23,6 +24,7 @@ func DefaultSettings() *Settings {
 		MuteKey:      "F11",
 		DeafenKey:    "F12",
 		VADThreshold: 200,
+		DuckingDB:    DefaultDuckingDB,
 	}
 }
 
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	gospeakCrypto "github.com/NicolasHaas/gospeak/pkg/crypto"
+)
+
+// CertMismatchError is returned when a server presents a certificate that is
+// neither signed by a trusted CA nor the one pinned on an earlier connect.
+// This is what a man-in-the-middle attack looks like, but also what a
+// server whose self-signed certificate was regenerated looks like.
+type CertMismatchError struct {
+	Pinned string // fingerprint recorded on an earlier connect
+	Got    string // fingerprint presented now
+}
+
+func (e *CertMismatchError) Error() string {
+	return fmt.Sprintf("server certificate changed: expected fingerprint %s, got %s", e.Pinned, e.Got)
+}
+
+// serverTrust is the outcome of verifying a server certificate.
+type serverTrust struct {
+	fingerprint string
+	caVerified  bool // chain verified against the trusted roots
+}
+
+// verifyServerCert returns a tls.Config.VerifyConnection callback that
+// accepts a certificate chain valid for host under roots (nil = system
+// roots). Other certificates are trusted on first use: accepted if pin is
+// empty or matches their fingerprint. The result is stored in trust.
+func verifyServerCert(host, pin string, roots *x509.CertPool, trust *serverTrust) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("client: server sent no certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		trust.fingerprint = gospeakCrypto.CertFingerprint(leaf.Raw)
+
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, c := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		if _, err := leaf.Verify(opts); err == nil {
+			trust.caVerified = true
+			return nil
+		}
+
+		if pin != "" && !strings.EqualFold(pin, trust.fingerprint) {
+			return &CertMismatchError{Pinned: pin, Got: trust.fingerprint}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	gospeakCrypto "github.com/NicolasHaas/gospeak/pkg/crypto"
+)
+
+// newTestCert creates a certificate for localhost signed by parent, or a
+// self-signed one if parent is nil.
+func newTestCert(t *testing.T, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "gospeak test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestVerifyServerCert(t *testing.T) {
+	selfSigned, _ := newTestCert(t, false, nil, nil)
+	other, _ := newTestCert(t, false, nil, nil)
+	ca, caKey := newTestCert(t, true, nil, nil)
+	signed, _ := newTestCert(t, false, ca, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	state := func(certs ...*x509.Certificate) tls.ConnectionState {
+		return tls.ConnectionState{PeerCertificates: certs}
+	}
+	pin := gospeakCrypto.CertFingerprint(selfSigned.Raw)
+
+	// First use: any certificate is accepted and its fingerprint recorded
+	var trust serverTrust
+	if err := verifyServerCert("localhost", "", roots, &trust)(state(selfSigned)); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if trust.fingerprint != pin || trust.caVerified {
+		t.Fatalf("first use: got %+v, want fingerprint %s", trust, pin)
+	}
+
+	// The pinned certificate is accepted, case-insensitively
+	trust = serverTrust{}
+	if err := verifyServerCert("localhost", strings.ToLower(pin), roots, &trust)(state(selfSigned)); err != nil {
+		t.Fatalf("pinned: %v", err)
+	}
+
+	// A different self-signed certificate is rejected
+	err := verifyServerCert("localhost", pin, roots, &trust)(state(other))
+	var mismatch *CertMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("mismatch: want *CertMismatchError, got %v", err)
+	}
+	if mismatch.Pinned != pin || mismatch.Got != gospeakCrypto.CertFingerprint(other.Raw) {
+		t.Fatalf("mismatch: got %+v", mismatch)
+	}
+
+	// A CA-signed chain is accepted even if it differs from the pin
+	trust = serverTrust{}
+	if err := verifyServerCert("localhost", pin, roots, &trust)(state(signed, ca)); err != nil {
+		t.Fatalf("CA-signed: %v", err)
+	}
+	if !trust.caVerified {
+		t.Fatalf("CA-signed: chain not reported as verified")
+	}
+
+	// ...but not for another host name
+	if err := verifyServerCert("example.com", pin, roots, &trust)(state(signed, ca)); !errors.As(err, &mismatch) {
+		t.Fatalf("CA-signed, wrong host: want *CertMismatchError, got %v", err)
+	}
+}
@@ -1,22 +1,27 @@
 package client
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"sync"
 
-	gospeakCrypto "github.com/NicolasHaas/gospeak/pkg/crypto"
 	"github.com/NicolasHaas/gospeak/pkg/protocol"
 )
 
+// errNoVoiceKey is returned by SendVoice while the key for the current
+// channel has not arrived yet, e.g. right after joining.
+var errNoVoiceKey = errors.New("client: no voice key")
+
 // VoiceClient manages the UDP voice connection.
 type VoiceClient struct {
 	conn       *net.UDPConn
 	serverAddr *net.UDPAddr
 	sessionID  uint32
 	channelID  uint16
-	cipher     *gospeakCrypto.VoiceCipher
+	target     uint8 // protocol.TargetChannel or a whisper target ID
+	keys       *KeyRing
 	seqNum     uint32
 	mu         sync.Mutex
 
@@ -26,8 +31,9 @@ type VoiceClient struct {
 	done chan struct{}
 }
 
-// NewVoiceClient creates a new UDP voice client.
-func NewVoiceClient(serverAddr string, sessionID uint32, encKey []byte) (*VoiceClient, error) {
+// NewVoiceClient creates a new UDP voice client that encrypts with the
+// keys in keys.
+func NewVoiceClient(serverAddr string, sessionID uint32, keys *KeyRing) (*VoiceClient, error) {
 	addr, err := net.ResolveUDPAddr("udp", serverAddr)
 	if err != nil {
 		return nil, fmt.Errorf("client: resolve voice addr: %w", err)
@@ -38,12 +44,6 @@ func NewVoiceClient(serverAddr string, sessionID uint32, encKey []byte) (*VoiceC
 		return nil, fmt.Errorf("client: dial voice: %w", err)
 	}
 
-	cipher, err := gospeakCrypto.NewVoiceCipher(encKey)
-	if err != nil {
-		_ = conn.Close()
-		return nil, fmt.Errorf("client: voice cipher: %w", err)
-	}
-
 	// Increase buffer sizes
 	_ = conn.SetReadBuffer(512 * 1024)
 	_ = conn.SetWriteBuffer(512 * 1024)
@@ -52,7 +52,7 @@ func NewVoiceClient(serverAddr string, sessionID uint32, encKey []byte) (*VoiceC
 		conn:            conn,
 		serverAddr:      addr,
 		sessionID:       sessionID,
-		cipher:          cipher,
+		keys:            keys,
 		IncomingPackets: make(chan *protocol.VoicePacket, 100),
 		done:            make(chan struct{}),
 	}, nil
@@ -65,25 +65,49 @@ func (v *VoiceClient) SetChannel(channelID int64) {
 	v.channelID = uint16(channelID) //nolint:gosec // channel IDs fit in uint16
 }
 
+// SetTarget selects normal channel talk (protocol.TargetChannel) or a
+// registered whisper target for outgoing packets.
+func (v *VoiceClient) SetTarget(target uint8) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.target = target
+}
+
 // SendVoice encrypts and sends an Opus frame over UDP.
 func (v *VoiceClient) SendVoice(opusData []byte, timestamp uint32) error {
 	v.mu.Lock()
 	v.seqNum++
 	seqNum := v.seqNum
 	channelID := v.channelID
+	target := v.target
 	v.mu.Unlock()
 
+	cipher := v.keys.Cipher(int64(channelID), v.sessionID, target)
+	if cipher == nil {
+		return errNoVoiceKey
+	}
+	epoch, ok := cipher.Epoch()
+	if !ok {
+		return errNoVoiceKey
+	}
+
 	pkt := &protocol.VoicePacket{
 		SessionID: v.sessionID,
 		SeqNum:    seqNum,
 		Timestamp: timestamp,
 		ChannelID: channelID,
+		Target:    target,
+		KeyEpoch:  epoch,
 	}
 
 	header := pkt.MarshalHeader()
-	pkt.Payload = v.cipher.Encrypt(v.sessionID, seqNum, header, opusData)
+	payload, err := cipher.Encrypt(epoch, v.sessionID, seqNum, header, opusData)
+	if err != nil {
+		return err
+	}
+	pkt.Payload = payload
 
-	_, err := v.conn.Write(pkt.Marshal())
+	_, err = v.conn.Write(pkt.Marshal())
 	return err
 }
 
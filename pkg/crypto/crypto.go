@@ -6,10 +6,15 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"slices"
+	"strings"
+	"sync"
 
 	"golang.org/x/crypto/argon2"
 )
@@ -17,6 +22,7 @@ import (
 var (
 	ErrInvalidCiphertext = errors.New("crypto: invalid ciphertext")
 	ErrDecryptionFailed  = errors.New("crypto: decryption failed")
+	ErrUnknownKey        = errors.New("crypto: unknown key epoch")
 )
 
 // GenerateKey generates a random AES-128 key (16 bytes).
@@ -43,27 +49,126 @@ func HashToken(token string) string {
 	return fmt.Sprintf("%x", h[:])
 }
 
+// CertFingerprint returns the SHA-256 fingerprint of a DER-encoded
+// certificate as colon-separated uppercase hex, the format openssl prints.
+func CertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
 // HashPassword hashes a password using Argon2id.
 func HashPassword(password string, salt []byte) []byte {
 	return argon2.IDKey([]byte(password), salt, 1, 64*1024, 4, 32)
 }
 
-// VoiceCipher handles AES-128-GCM encryption for voice packets.
+// passwordSaltSize is the random salt length used by EncodePassword.
+const passwordSaltSize = 16
+
+// EncodePassword hashes a password with a fresh random salt and returns a
+// self-contained "argon2id$<salt hex>$<hash hex>" string for storage.
+func EncodePassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", fmt.Errorf("crypto: generate salt: %w", err)
+	}
+	return fmt.Sprintf("argon2id$%x$%x", salt, HashPassword(password, salt)), nil
+}
+
+// VerifyPassword checks a password against a string produced by EncodePassword
+// using a constant-time comparison.
+func VerifyPassword(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 3 || parts[0] != "argon2id" {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(HashPassword(password, salt), want) == 1
+}
+
+// voiceKeyHistory is the number of key epochs a VoiceCipher keeps, so
+// packets encrypted just before a key rotation still decrypt afterwards.
+const voiceKeyHistory = 4
+
+// gcmTagSize is the size of the auth tag appended by AES-GCM.
+const gcmTagSize = 16
+
+// VoiceCipher handles AES-128-GCM encryption for voice packets. It holds
+// several keys, each identified by an epoch carried in the packet header;
+// the most recently added key is the current one used for sending. The
+// zero value holds no keys.
 type VoiceCipher struct {
-	aead cipher.AEAD
+	mu    sync.RWMutex
+	keys  map[uint8]cipher.AEAD
+	order []uint8 // epochs, oldest first; the last one is current
 }
 
-// NewVoiceCipher creates a new voice cipher from a 16-byte AES key.
+// NewVoiceCipher creates a new voice cipher from a 16-byte AES key, which
+// becomes the current key with epoch 0.
 func NewVoiceCipher(key []byte) (*VoiceCipher, error) {
+	vc := &VoiceCipher{}
+	if err := vc.AddKey(0, key); err != nil {
+		return nil, err
+	}
+	return vc, nil
+}
+
+// AddKey installs a 16-byte AES key for epoch and makes it the current key.
+// Only the last few epochs are kept; older keys are forgotten.
+func (vc *VoiceCipher) AddKey(epoch uint8, key []byte) error {
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		return nil, fmt.Errorf("crypto: new cipher: %w", err)
+		return fmt.Errorf("crypto: new cipher: %w", err)
 	}
 	aead, err := cipher.NewGCM(block)
 	if err != nil {
-		return nil, fmt.Errorf("crypto: new gcm: %w", err)
+		return fmt.Errorf("crypto: new gcm: %w", err)
+	}
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if vc.keys == nil {
+		vc.keys = make(map[uint8]cipher.AEAD)
+	}
+	vc.order = slices.DeleteFunc(vc.order, func(e uint8) bool { return e == epoch })
+	vc.order = append(vc.order, epoch)
+	vc.keys[epoch] = aead
+	for len(vc.order) > voiceKeyHistory {
+		delete(vc.keys, vc.order[0])
+		vc.order = vc.order[1:]
+	}
+	return nil
+}
+
+// Epoch returns the epoch of the current key; ok is false if there is none.
+func (vc *VoiceCipher) Epoch() (epoch uint8, ok bool) {
+	vc.mu.RLock()
+	defer vc.mu.RUnlock()
+	if len(vc.order) == 0 {
+		return 0, false
+	}
+	return vc.order[len(vc.order)-1], true
+}
+
+// key returns the AEAD of an epoch.
+func (vc *VoiceCipher) key(epoch uint8) (cipher.AEAD, error) {
+	vc.mu.RLock()
+	defer vc.mu.RUnlock()
+	aead, ok := vc.keys[epoch]
+	if !ok {
+		return nil, ErrUnknownKey
 	}
-	return &VoiceCipher{aead: aead}, nil
+	return aead, nil
 }
 
 // buildNonce constructs a 12-byte nonce from sessionID and seqNum.
@@ -76,17 +181,26 @@ func buildNonce(sessionID uint32, seqNum uint32) []byte {
 	return nonce
 }
 
-// Encrypt encrypts an Opus frame, authenticating the header as additional data.
-// Returns ciphertext with appended auth tag.
-func (vc *VoiceCipher) Encrypt(sessionID uint32, seqNum uint32, header, opus []byte) []byte {
+// Encrypt encrypts an Opus frame with the key of epoch, authenticating the
+// header as additional data. Returns ciphertext with appended auth tag.
+func (vc *VoiceCipher) Encrypt(epoch uint8, sessionID uint32, seqNum uint32, header, opus []byte) ([]byte, error) {
+	aead, err := vc.key(epoch)
+	if err != nil {
+		return nil, err
+	}
 	nonce := buildNonce(sessionID, seqNum)
-	return vc.aead.Seal(nil, nonce, opus, header)
+	return aead.Seal(nil, nonce, opus, header), nil
 }
 
-// Decrypt decrypts an encrypted Opus frame, verifying the header as additional data.
-func (vc *VoiceCipher) Decrypt(sessionID uint32, seqNum uint32, header, ciphertext []byte) ([]byte, error) {
+// Decrypt decrypts an encrypted Opus frame with the key of epoch, verifying
+// the header as additional data.
+func (vc *VoiceCipher) Decrypt(epoch uint8, sessionID uint32, seqNum uint32, header, ciphertext []byte) ([]byte, error) {
+	aead, err := vc.key(epoch)
+	if err != nil {
+		return nil, err
+	}
 	nonce := buildNonce(sessionID, seqNum)
-	plaintext, err := vc.aead.Open(nil, nonce, ciphertext, header)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, header)
 	if err != nil {
 		return nil, ErrDecryptionFailed
 	}
@@ -95,5 +209,5 @@ func (vc *VoiceCipher) Decrypt(sessionID uint32, seqNum uint32, header, cipherte
 
 // Overhead returns the number of bytes the AEAD adds to the plaintext (GCM auth tag).
 func (vc *VoiceCipher) Overhead() int {
-	return vc.aead.Overhead()
+	return gcmTagSize
 }
@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestVoiceCipherEpochs(t *testing.T) {
+	key := func() []byte {
+		k, err := GenerateKey()
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		return k
+	}
+
+	vc, err := NewVoiceCipher(key())
+	if err != nil {
+		t.Fatalf("NewVoiceCipher: %v", err)
+	}
+	header := []byte{1, 2, 3}
+	opus := []byte("opus frame")
+
+	old, err := vc.Encrypt(0, 7, 1, header, opus)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	// A rotation makes the new key current; the old one still decrypts
+	if err := vc.AddKey(1, key()); err != nil {
+		t.Fatalf("AddKey: %v", err)
+	}
+	if epoch, ok := vc.Epoch(); !ok || epoch != 1 {
+		t.Fatalf("Epoch: want 1, got %d (ok=%v)", epoch, ok)
+	}
+	if got, err := vc.Decrypt(0, 7, 1, header, old); err != nil || !bytes.Equal(got, opus) {
+		t.Fatalf("Decrypt old epoch: got %q, %v", got, err)
+	}
+	if _, err := vc.Decrypt(1, 7, 1, header, old); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("Decrypt with wrong epoch: want ErrDecryptionFailed, got %v", err)
+	}
+
+	// Old epochs are forgotten after a few rotations
+	for epoch := uint8(2); epoch < 2+voiceKeyHistory; epoch++ {
+		if err := vc.AddKey(epoch, key()); err != nil {
+			t.Fatalf("AddKey: %v", err)
+		}
+	}
+	if _, err := vc.Decrypt(0, 7, 1, header, old); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Decrypt expired epoch: want ErrUnknownKey, got %v", err)
+	}
+
+	// The zero value has no keys
+	var empty VoiceCipher
+	if _, ok := empty.Epoch(); ok {
+		t.Fatalf("Epoch: zero value reports a key")
+	}
+	if _, err := empty.Encrypt(0, 7, 2, header, opus); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Encrypt without keys: want ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestGroupKeyWrap(t *testing.T) {
+	alice, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity: %v", err)
+	}
+	bob, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity: %v", err)
+	}
+	mallory, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("GenerateIdentity: %v", err)
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	wrapped, err := WrapGroupKey(alice, bob.PublicKey().Bytes(), 5, 3, key)
+	if err != nil {
+		t.Fatalf("WrapGroupKey: %v", err)
+	}
+	got, err := UnwrapGroupKey(bob, alice.PublicKey().Bytes(), 5, 3, wrapped)
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("UnwrapGroupKey: got %x, %v", got, err)
+	}
+
+	// The wrap is bound to recipient, sender, channel and epoch
+	if _, err := UnwrapGroupKey(mallory, alice.PublicKey().Bytes(), 5, 3, wrapped); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("wrong recipient: want ErrDecryptionFailed, got %v", err)
+	}
+	if _, err := UnwrapGroupKey(bob, mallory.PublicKey().Bytes(), 5, 3, wrapped); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("wrong sender: want ErrDecryptionFailed, got %v", err)
+	}
+	if _, err := UnwrapGroupKey(bob, alice.PublicKey().Bytes(), 5, 4, wrapped); !errors.Is(err, ErrDecryptionFailed) {
+		t.Fatalf("wrong epoch: want ErrDecryptionFailed, got %v", err)
+	}
+
+	// Both sides compute the same safety number, which differs per pair
+	ab := SafetyNumber(alice.PublicKey().Bytes(), bob.PublicKey().Bytes())
+	if ab != SafetyNumber(bob.PublicKey().Bytes(), alice.PublicKey().Bytes()) {
+		t.Fatalf("SafetyNumber: not symmetric")
+	}
+	if ab == SafetyNumber(alice.PublicKey().Bytes(), mallory.PublicKey().Bytes()) {
+		t.Fatalf("SafetyNumber: same number for different pairs")
+	}
+	if len(ab) != 12*5+11 {
+		t.Fatalf("SafetyNumber: unexpected format %q", ab)
+	}
+}
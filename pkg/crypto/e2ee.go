@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// groupKeyInfo labels the HKDF output that wraps channel keys, binding it
+// to this protocol version.
+const groupKeyInfo = "gospeak e2ee group key v1"
+
+// GenerateIdentity creates a new X25519 identity key for end-to-end
+// encrypted channels.
+func GenerateIdentity() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: generate identity: %w", err)
+	}
+	return key, nil
+}
+
+// ParseIdentity decodes an X25519 private key stored by Bytes().
+func ParseIdentity(b []byte) (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: parse identity: %w", err)
+	}
+	return key, nil
+}
+
+// wrapKey derives the key that wraps a channel key between two identities.
+// Both sides derive the same key; channelID and epoch make it unique per
+// wrapped key, and the public keys bind it to the pair.
+func wrapKey(priv *ecdh.PrivateKey, peer []byte, senderPub, recipientPub []byte, channelID int64, epoch uint32) (cipher.AEAD, error) {
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: peer identity: %w", err)
+	}
+	shared, err := priv.ECDH(peerKey)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: key agreement: %w", err)
+	}
+
+	info := make([]byte, 0, len(groupKeyInfo)+12+len(senderPub)+len(recipientPub))
+	info = append(info, groupKeyInfo...)
+	info = binary.BigEndian.AppendUint64(info, uint64(channelID)) //nolint:gosec // channel IDs are positive
+	info = binary.BigEndian.AppendUint32(info, epoch)
+	info = append(info, senderPub...)
+	info = append(info, recipientPub...)
+	key, err := hkdf.Key(sha256.New, shared, nil, string(info), 16)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: derive wrap key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("crypto: new cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapGroupKey encrypts a channel key of an epoch for the holder of the
+// X25519 public key recipient. Returns nonce || ciphertext.
+func WrapGroupKey(sender *ecdh.PrivateKey, recipient []byte, channelID int64, epoch uint32, key []byte) ([]byte, error) {
+	aead, err := wrapKey(sender, recipient, sender.PublicKey().Bytes(), recipient, channelID, epoch)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("crypto: generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapGroupKey decrypts a channel key wrapped by WrapGroupKey for us by
+// the holder of the X25519 public key sender.
+func UnwrapGroupKey(recipient *ecdh.PrivateKey, sender []byte, channelID int64, epoch uint32, wrapped []byte) ([]byte, error) {
+	aead, err := wrapKey(recipient, sender, sender, recipient.PublicKey().Bytes(), channelID, epoch)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidCiphertext
+	}
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return key, nil
+}
+
+// SafetyNumber returns the number two users compare to verify each other's
+// identity keys: 60 digits in groups of five. Both sides get the same
+// number, whatever the argument order.
+func SafetyNumber(a, b []byte) string {
+	if string(a) > string(b) {
+		a, b = b, a
+	}
+	h := sha512.New()
+	h.Write(a)
+	h.Write(b)
+	sum := h.Sum(nil)
+
+	groups := make([]string, 12)
+	for i := range groups {
+		chunk := sum[i*5 : i*5+5]
+		v := uint64(chunk[0])<<32 | uint64(chunk[1])<<24 | uint64(chunk[2])<<16 | uint64(chunk[3])<<8 | uint64(chunk[4])
+		groups[i] = fmt.Sprintf("%05d", v%100000)
+	}
+	return strings.Join(groups, " ")
+}
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 )
@@ -19,6 +21,17 @@ const (
 	RoleAdmin                 // Full control: create/delete channels, manage tokens, kick, ban
 )
 
+// RoleCustomBase is the first value assigned to operator-defined roles.
+// Values below it are reserved for built-in roles.
+const RoleCustomBase Role = 100
+
+// Built-in role priorities. Custom roles must rank below admin.
+const (
+	PriorityUser      = 0
+	PriorityModerator = 50
+	PriorityAdmin     = 100
+)
+
 func (r Role) String() string {
 	switch r {
 	case RoleUser:
@@ -27,26 +40,148 @@ func (r Role) String() string {
 		return "moderator"
 	case RoleAdmin:
 		return "admin"
-	default:
-		return "unknown"
 	}
+	if def, ok := LookupCustomRole(r); ok {
+		return def.Name
+	}
+	return "unknown"
 }
 
-// ParseRole converts a string to a Role.
-func ParseRole(s string) Role {
+// ParseRole converts a role name to a Role. An empty name means RoleUser;
+// unknown names are rejected.
+func ParseRole(s string) (Role, bool) {
 	switch s {
 	case "admin":
-		return RoleAdmin
+		return RoleAdmin, true
 	case "moderator":
-		return RoleModerator
-	default:
-		return RoleUser
+		return RoleModerator, true
+	case "user", "":
+		return RoleUser, true
+	}
+	customRolesMu.RLock()
+	defer customRolesMu.RUnlock()
+	for _, def := range customRoles {
+		if def.Name == s {
+			return def.ID, true
+		}
 	}
+	return RoleUser, false
 }
 
-// Valid returns true if the role is a recognised value (User, Moderator, or Admin).
+// Valid returns true if the role is a built-in role or a registered custom role.
 func (r Role) Valid() bool {
-	return r >= RoleUser && r <= RoleAdmin
+	if r >= RoleUser && r <= RoleAdmin {
+		return true
+	}
+	_, ok := LookupCustomRole(r)
+	return ok
+}
+
+// Priority ranks roles for escalation checks: a role may only grant roles
+// whose priority does not exceed its own.
+func (r Role) Priority() int {
+	switch r {
+	case RoleUser:
+		return PriorityUser
+	case RoleModerator:
+		return PriorityModerator
+	case RoleAdmin:
+		return PriorityAdmin
+	}
+	if def, ok := LookupCustomRole(r); ok {
+		return def.Priority
+	}
+	return PriorityUser
+}
+
+// RoleDefinition is an operator-defined role with its own permission set.
+type RoleDefinition struct {
+	ID          Role         `json:"id"`
+	Name        string       `json:"name"`
+	Priority    int          `json:"priority"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// MaxRoleNameLength is the maximum allowed length for a custom role name.
+const MaxRoleNameLength = 32
+
+// ErrRoleNameInvalid is returned when a custom role name is empty, too long,
+// not lowercase alphanumeric/underscore/hyphen, or clashes with a built-in role.
+var ErrRoleNameInvalid = fmt.Errorf("role name must be 1-%d lowercase letters, digits, underscores or hyphens and not a built-in role", MaxRoleNameLength)
+
+// ErrRolePriorityInvalid is returned when a custom role would not rank below admin.
+var ErrRolePriorityInvalid = fmt.Errorf("role priority must be between %d and %d", PriorityUser, PriorityAdmin-1)
+
+// Validate checks the role's name and priority.
+func (d *RoleDefinition) Validate() error {
+	if d.Name == "" || len(d.Name) > MaxRoleNameLength {
+		return ErrRoleNameInvalid
+	}
+	for _, r := range d.Name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '-' {
+			return ErrRoleNameInvalid
+		}
+	}
+	switch d.Name {
+	case "user", "moderator", "admin", "unknown":
+		return ErrRoleNameInvalid
+	}
+	if d.Priority < PriorityUser || d.Priority >= PriorityAdmin {
+		return ErrRolePriorityInvalid
+	}
+	return nil
+}
+
+// HasPermission reports whether the role grants perm.
+func (d *RoleDefinition) HasPermission(perm Permission) bool {
+	for _, p := range d.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	customRolesMu sync.RWMutex
+	customRoles   map[Role]RoleDefinition
+)
+
+// RegisterCustomRoles replaces the set of known custom roles. The server calls
+// it at startup with the roles loaded from the store.
+func RegisterCustomRoles(defs []RoleDefinition) {
+	m := make(map[Role]RoleDefinition, len(defs))
+	for _, def := range defs {
+		m[def.ID] = def
+	}
+	customRolesMu.Lock()
+	customRoles = m
+	customRolesMu.Unlock()
+}
+
+// LookupCustomRole returns the definition of a registered custom role.
+func LookupCustomRole(r Role) (RoleDefinition, bool) {
+	customRolesMu.RLock()
+	defer customRolesMu.RUnlock()
+	def, ok := customRoles[r]
+	return def, ok
+}
+
+// CustomRoles returns all registered custom roles, ordered by priority then name.
+func CustomRoles() []RoleDefinition {
+	customRolesMu.RLock()
+	defs := make([]RoleDefinition, 0, len(customRoles))
+	for _, def := range customRoles {
+		defs = append(defs, def)
+	}
+	customRolesMu.RUnlock()
+	sort.Slice(defs, func(i, j int) bool {
+		if defs[i].Priority != defs[j].Priority {
+			return defs[i].Priority < defs[j].Priority
+		}
+		return defs[i].Name < defs[j].Name
+	})
+	return defs
 }
 
 // MaxUsernameLength is the maximum allowed length for a username in bytes.
@@ -62,7 +197,7 @@ var ErrUsernameTooLong = fmt.Errorf("username must not exceed %d characters", Ma
 var ErrUsernameInvalidChars = errors.New("username must contain only alphanumeric characters, underscores, or hyphens")
 
 // ErrInvalidRole is returned when a role value is not recognised.
-var ErrInvalidRole = errors.New("invalid role: must be user (0), moderator (1), or admin (2)")
+var ErrInvalidRole = errors.New("invalid role: must be user, moderator, admin or a configured custom role")
 
 // ValidateUsername checks that a username is 1-32 ASCII alphanumeric, underscore,
 // or hyphen characters. Returns nil on success or a descriptive error.
@@ -92,8 +227,74 @@ const (
 	PermManageTokens
 	PermEditChannel
 	PermManageRoles
+	PermJoinChannel
+	PermSpeak
+	PermTextChat
+	PermCreateSubChannel
+	PermMuteUser
+	PermMoveUser
+	PermWhisper
+	PermPrioritySpeaker
+	PermBroadcast
+	PermManageChat
 )
 
+// permissionNames maps permissions to their stable wire/config names.
+var permissionNames = map[Permission]string{
+	PermCreateChannel:    "create_channel",
+	PermDeleteChannel:    "delete_channel",
+	PermKickUser:         "kick_user",
+	PermBanUser:          "ban_user",
+	PermManageTokens:     "manage_tokens",
+	PermEditChannel:      "edit_channel",
+	PermManageRoles:      "manage_roles",
+	PermJoinChannel:      "join_channel",
+	PermSpeak:            "speak",
+	PermTextChat:         "text_chat",
+	PermCreateSubChannel: "create_sub_channel",
+	PermMuteUser:         "mute_user",
+	PermMoveUser:         "move_user",
+	PermWhisper:          "whisper",
+	PermPrioritySpeaker:  "priority_speaker",
+	PermBroadcast:        "broadcast",
+	PermManageChat:       "manage_chat",
+}
+
+// String returns the permission's wire/config name.
+func (p Permission) String() string {
+	if name, ok := permissionNames[p]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParsePermission converts a permission name to a Permission.
+func ParsePermission(s string) (Permission, bool) {
+	for p, name := range permissionNames {
+		if name == s {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+// ChannelACL is a per-channel permission override for a role or a single user.
+// Entries apply to the channel and, unless overridden further down, to all of
+// its sub-channels.
+type ChannelACL struct {
+	ID         int64      `json:"id"`
+	ChannelID  int64      `json:"channel_id"`
+	UserID     int64      `json:"user_id"` // non-zero = user entry, Role is ignored
+	Role       Role       `json:"role"`
+	Permission Permission `json:"permission"`
+	Allow      bool       `json:"allow"` // false = deny
+}
+
+// IsUserEntry reports whether the entry targets a single user rather than a role.
+func (a *ChannelACL) IsUserEntry() bool {
+	return a.UserID != 0
+}
+
 // User represents a registered user.
 type User struct {
 	ID        int64     `json:"id"`
@@ -110,9 +311,10 @@ const (
 	ChannelDefaultIsTemp             = false
 	ChannelDefaultAllowedSubChannels = false
 
-	MaxChannelNameLength = 64
-	MaxChannelDescLength = 256
-	MaxChannelUsers      = 256
+	MaxChannelNameLength     = 64
+	MaxChannelDescLength     = 256
+	MaxChannelUsers          = 256
+	MaxChannelPasswordLength = 128
 )
 
 var ErrChannelNameEmpty = errors.New("channel name must not be empty")
@@ -120,17 +322,92 @@ var ErrChannelNameTooLong = errors.New("channel name too long")
 var ErrChannelDescTooLong = errors.New("channel description too long")
 var ErrChannelMaxUsers = errors.New("channel max users out of range")
 var ErrChannelParentID = errors.New("channel parent id out of range")
+var ErrChannelNotFound = errors.New("channel not found")
+var ErrChannelParentNotFound = errors.New("parent channel not found")
+var ErrChannelCycle = errors.New("channel cannot be moved under itself or one of its sub-channels")
+var ErrChannelCodec = errors.New("channel codec settings out of range")
+
+// Codec applications: tune the Opus encoder for speech or for music.
+const (
+	CodecApplicationVoice = "voice"
+	CodecApplicationMusic = "music"
+)
+
+const (
+	CodecDefaultBitrate = 64000 // bits per second
+	CodecDefaultFrameMs = 20
+	CodecMinBitrate     = 6000
+	CodecMaxBitrate     = 510000
+
+	// CodecMaxFrameBytes is protocol.MaxOpusFrame, the most one encoded
+	// frame may take up in a voice packet. It bounds the bitrate of long
+	// frames: 60 ms frames allow up to 184 kbps.
+	CodecMaxFrameBytes = 1384
+)
+
+// CodecSettings are the Opus parameters clients use while in a channel.
+// Zero values select the defaults (64 kbps, 20 ms, voice, mono).
+type CodecSettings struct {
+	Bitrate     int    `json:"bitrate"`     // bits per second
+	FrameMs     int    `json:"frame_ms"`    // 10, 20, 40 or 60
+	Application string `json:"application"` // CodecApplicationVoice or CodecApplicationMusic
+	Stereo      bool   `json:"stereo"`
+}
+
+// Validate checks the settings against what Opus supports.
+func (c CodecSettings) Validate() error {
+	if c.Bitrate != 0 && (c.Bitrate < CodecMinBitrate || c.Bitrate > CodecMaxBitrate) {
+		return ErrChannelCodec
+	}
+	switch c.FrameMs {
+	case 0, 10, 20, 40, 60:
+	default:
+		return ErrChannelCodec
+	}
+	if d := c.WithDefaults(); d.Bitrate*d.FrameMs/8000 > CodecMaxFrameBytes {
+		return ErrChannelCodec // frames would not fit in a voice packet
+	}
+	switch c.Application {
+	case "", CodecApplicationVoice, CodecApplicationMusic:
+	default:
+		return ErrChannelCodec
+	}
+	return nil
+}
+
+// WithDefaults returns the settings with zero values replaced by defaults.
+func (c CodecSettings) WithDefaults() CodecSettings {
+	if c.Bitrate == 0 {
+		c.Bitrate = CodecDefaultBitrate
+	}
+	if c.FrameMs == 0 {
+		c.FrameMs = CodecDefaultFrameMs
+	}
+	if c.Application == "" {
+		c.Application = CodecApplicationVoice
+	}
+	return c
+}
 
 // Channel represents a voice channel on the server.
 type Channel struct {
-	ID               int64     `json:"id"`
-	Name             string    `json:"name"`
-	Description      string    `json:"description"`
-	MaxUsers         int       `json:"max_users"`          // 0 = unlimited
-	ParentID         int64     `json:"parent_id"`          // 0 = root channel
-	IsTemp           bool      `json:"is_temp"`            // temp channels auto-delete when empty
-	AllowSubChannels bool      `json:"allow_sub_channels"` // users can create temp sub-channels here
-	CreatedAt        time.Time `json:"created_at"`
+	ID               int64         `json:"id"`
+	Name             string        `json:"name"`
+	Description      string        `json:"description"`
+	MaxUsers         int           `json:"max_users"`          // 0 = unlimited
+	ParentID         int64         `json:"parent_id"`          // 0 = root channel
+	IsTemp           bool          `json:"is_temp"`            // temp channels auto-delete when empty
+	AllowSubChannels bool          `json:"allow_sub_channels"` // users can create temp sub-channels here
+	PasswordHash     string        `json:"-"`                  // encoded Argon2id hash, empty = no password
+	Codec            CodecSettings `json:"codec"`              // voice codec used by clients in this channel
+	E2EE             bool          `json:"e2ee"`               // members agree on the voice key; the server never sees it
+	ChatRetention    time.Duration `json:"chat_retention"`     // how long chat history is kept: 0 = server default, negative = not kept
+	CreatedAt        time.Time     `json:"created_at"`
+}
+
+// HasPassword reports whether joining the channel requires a password.
+func (ch *Channel) HasPassword() bool {
+	return ch.PasswordHash != ""
 }
 
 // Creates and returns a new channel using default values
@@ -171,12 +448,48 @@ func (ch *Channel) Validate() error {
 		return ErrChannelParentID
 	}
 
+	return ch.Codec.Validate()
+}
+
+// CheckReparent verifies that moving channelID under newParentID keeps the
+// channel tree acyclic. A newParentID of 0 (root) is always allowed.
+func CheckReparent(channels []Channel, channelID, newParentID int64) error {
+	if newParentID == 0 {
+		return nil
+	}
+	parents := make(map[int64]int64, len(channels))
+	for _, ch := range channels {
+		parents[ch.ID] = ch.ParentID
+	}
+	if _, ok := parents[newParentID]; !ok {
+		return ErrChannelParentNotFound
+	}
+	// Walk up from the new parent; reaching channelID means a cycle.
+	// The depth bound guards against trees that are already corrupt.
+	id := newParentID
+	for depth := 0; id != 0 && depth <= len(channels); depth++ {
+		if id == channelID {
+			return ErrChannelCycle
+		}
+		id = parents[id]
+	}
+	if id != 0 {
+		return ErrChannelCycle
+	}
 	return nil
 }
 
+// TokenShortIDLength is the number of hash characters used as a token's public identifier.
+const TokenShortIDLength = 8
+
+// MaxTokenLabelLength is the maximum allowed length for a token label.
+const MaxTokenLabelLength = 64
+
 // Token represents an invite/auth token.
 type Token struct {
 	ID           int64     `json:"id"`
+	ShortID      string    `json:"short_id"`      // non-secret identifier derived from the hash
+	Label        string    `json:"label"`         // optional admin-facing description
 	Value        string    `json:"-"`             // raw token value (only shown on creation)
 	Hash         string    `json:"-"`             // SHA-256 hash stored in DB
 	Role         Role      `json:"role"`          // role granted to user of this token
@@ -185,9 +498,23 @@ type Token struct {
 	MaxUses      int       `json:"max_uses"` // 0 = unlimited
 	UseCount     int       `json:"use_count"`
 	ExpiresAt    time.Time `json:"expires_at"`
+	RevokedAt    time.Time `json:"revoked_at"` // zero = not revoked
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// TokenShortID returns the public identifier for a token hash.
+func TokenShortID(hash string) string {
+	if len(hash) <= TokenShortIDLength {
+		return hash
+	}
+	return hash[:TokenShortIDLength]
+}
+
+// IsRevoked returns true if the token has been revoked.
+func (t *Token) IsRevoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
 // IsExpired returns true if the token has expired.
 func (t *Token) IsExpired() bool {
 	if t.ExpiresAt.IsZero() {
@@ -208,21 +535,97 @@ func (t *Token) IsExhausted() bool {
 type Ban struct {
 	ID        int64     `json:"id"`
 	UserID    int64     `json:"user_id"` // 0 if IP ban
-	IP        string    `json:"ip"`      // empty if user ban
+	IP        string    `json:"ip"`      // single address or CIDR range, empty if user ban
 	Reason    string    `json:"reason"`
 	BannedBy  int64     `json:"banned_by"`
 	ExpiresAt time.Time `json:"expires_at"` // zero = permanent
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// ErrBanIPInvalid is returned when a ban target is neither an IP address nor a CIDR range.
+var ErrBanIPInvalid = errors.New("ban ip must be an IP address or CIDR range")
+
+// NormalizeBanIP validates an IP or CIDR ban target and returns its canonical form.
+// An empty string is returned unchanged (no IP component).
+func NormalizeBanIP(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", nil
+	}
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", ErrBanIPInvalid
+		}
+		return ipNet.String(), nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", ErrBanIPInvalid
+	}
+	return ip.String(), nil
+}
+
+// IsActive reports whether the ban is still in effect at the given time.
+func (b *Ban) IsActive(now time.Time) bool {
+	return b.ExpiresAt.IsZero() || b.ExpiresAt.After(now)
+}
+
+// MatchesIP reports whether the ban's IP or CIDR range covers ip.
+func (b *Ban) MatchesIP(ip net.IP) bool {
+	if b.IP == "" || ip == nil {
+		return false
+	}
+	if strings.Contains(b.IP, "/") {
+		_, ipNet, err := net.ParseCIDR(b.IP)
+		return err == nil && ipNet.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(b.IP))
+}
+
+// ChatMessage is a channel chat message kept for the channel's history.
+type ChatMessage struct {
+	ID        int64     `json:"id"` // increases with every message, across channels
+	ChannelID int64     `json:"channel_id"`
+	UserID    int64     `json:"user_id"`
+	Username  string    `json:"username"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+	EditedAt  time.Time `json:"edited_at"` // zero if never edited
+}
+
+// DirectMessage is a private message kept until its offline recipient has
+// read it.
+type DirectMessage struct {
+	ID          int64     `json:"id"`
+	SenderID    int64     `json:"sender_id"`
+	SenderName  string    `json:"sender_name"`
+	RecipientID int64     `json:"recipient_id"`
+	Text        string    `json:"text"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
 // Session represents an active client session (in-memory only).
 type Session struct {
-	ID        uint32
-	UserID    int64
-	Username  string
-	Role      Role
-	ChannelID int64
-	UDPAddr   *net.UDPAddr
-	Muted     bool
-	Deafened  bool
+	ID           uint32
+	UserID       int64
+	Username     string
+	Role         Role
+	ChannelScope int64 // 0 = server-wide, otherwise the root channel this session is limited to
+	ChannelID    int64
+	IdentityKey  []byte // client's X25519 public key for end-to-end encrypted channels
+	StateDeltas  bool   // client takes incremental state updates
+	UDPAddr      *net.UDPAddr
+	Muted        bool
+	Deafened     bool
+	SpeakDenied  bool // channel ACLs deny speaking in the current channel
+
+	// Server-side mute/deafen set by a moderator. Unlike Muted/Deafened they
+	// cannot be changed by the user.
+	ServerMuted    bool
+	ServerDeafened bool
+
+	// PrioritySpeaker ducks other voices on receivers. It applies to the
+	// current channel only and is cleared when the session changes channel.
+	PrioritySpeaker bool
 }
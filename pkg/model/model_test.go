@@ -1,6 +1,8 @@
 package model
 
 import (
+	"errors"
+	"net"
 	"strings"
 	"testing"
 )
@@ -84,21 +86,190 @@ func TestRoleString(t *testing.T) {
 
 func TestParseRole(t *testing.T) {
 	tests := []struct {
-		input string
-		want  Role
+		input  string
+		want   Role
+		wantOK bool
 	}{
-		{"admin", RoleAdmin},
-		{"moderator", RoleModerator},
-		{"user", RoleUser},
-		{"", RoleUser},
-		{"unknown", RoleUser},
+		{"admin", RoleAdmin, true},
+		{"moderator", RoleModerator, true},
+		{"user", RoleUser, true},
+		{"", RoleUser, true},
+		{"unknown", RoleUser, false},
+		{"Admin", RoleUser, false},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
-			if got := ParseRole(tt.input); got != tt.want {
-				t.Errorf("ParseRole(%q) = %d, want %d", tt.input, got, tt.want)
+			got, ok := ParseRole(tt.input)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("ParseRole(%q) = %d, %v, want %d, %v", tt.input, got, ok, tt.want, tt.wantOK)
 			}
 		})
 	}
 }
+
+func TestCustomRoles(t *testing.T) {
+	dj := RoleDefinition{ID: RoleCustomBase, Name: "dj", Priority: 10, Permissions: []Permission{PermSpeak}}
+	RegisterCustomRoles([]RoleDefinition{dj})
+	t.Cleanup(func() { RegisterCustomRoles(nil) })
+
+	if got, ok := ParseRole("dj"); !ok || got != dj.ID {
+		t.Errorf("ParseRole(dj) = %d, %v, want %d, true", got, ok, dj.ID)
+	}
+	if got := dj.ID.String(); got != "dj" {
+		t.Errorf("String() = %q, want dj", got)
+	}
+	if !dj.ID.Valid() || (dj.ID + 1).Valid() {
+		t.Errorf("Valid(): registered role must be valid, unregistered must not")
+	}
+	if got := dj.ID.Priority(); got != 10 {
+		t.Errorf("Priority() = %d, want 10", got)
+	}
+	if !dj.HasPermission(PermSpeak) || dj.HasPermission(PermKickUser) {
+		t.Errorf("HasPermission: unexpected result for %v", dj.Permissions)
+	}
+}
+
+func TestRoleDefinitionValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		def     RoleDefinition
+		wantErr error
+	}{
+		{"valid", RoleDefinition{Name: "stream-er_2", Priority: 99}, nil},
+		{"empty name", RoleDefinition{}, ErrRoleNameInvalid},
+		{"uppercase", RoleDefinition{Name: "DJ"}, ErrRoleNameInvalid},
+		{"built-in", RoleDefinition{Name: "moderator"}, ErrRoleNameInvalid},
+		{"too long", RoleDefinition{Name: strings.Repeat("r", MaxRoleNameLength+1)}, ErrRoleNameInvalid},
+		{"negative priority", RoleDefinition{Name: "dj", Priority: -1}, ErrRolePriorityInvalid},
+		{"admin priority", RoleDefinition{Name: "dj", Priority: PriorityAdmin}, ErrRolePriorityInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.def.Validate(); err != tt.wantErr {
+				t.Errorf("Validate() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeBanIP(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{" 192.0.2.1 ", "192.0.2.1", false},
+		{"192.0.2.77/24", "192.0.2.0/24", false},
+		{"2001:db8::1", "2001:db8::1", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"not-an-ip", "", true},
+		{"10.0.0.0/33", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := NormalizeBanIP(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NormalizeBanIP(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeBanIP(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBanMatchesIP(t *testing.T) {
+	tests := []struct {
+		ban  string
+		ip   string
+		want bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1", "192.0.2.2", false},
+		{"192.0.2.0/24", "192.0.2.200", true},
+		{"192.0.2.0/24", "198.51.100.1", false},
+		{"192.0.2.1", "::ffff:192.0.2.1", true},
+		{"2001:db8::/32", "2001:db8:1::5", true},
+		{"", "192.0.2.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ban+"_"+tt.ip, func(t *testing.T) {
+			b := &Ban{IP: tt.ban}
+			if got := b.MatchesIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Ban{IP: %q}.MatchesIP(%q) = %v, want %v", tt.ban, tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckReparent(t *testing.T) {
+	// 1 ── 2 ── 3
+	// 4
+	channels := []Channel{
+		{ID: 1, ParentID: 0},
+		{ID: 2, ParentID: 1},
+		{ID: 3, ParentID: 2},
+		{ID: 4, ParentID: 0},
+	}
+
+	tests := []struct {
+		name      string
+		channelID int64
+		parentID  int64
+		want      error
+	}{
+		{"move_to_root", 3, 0, nil},
+		{"move_to_sibling_tree", 2, 4, nil},
+		{"move_under_self", 2, 2, ErrChannelCycle},
+		{"move_under_child", 1, 2, ErrChannelCycle},
+		{"move_under_grandchild", 1, 3, ErrChannelCycle},
+		{"missing_parent", 4, 99, ErrChannelParentNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckReparent(channels, tt.channelID, tt.parentID); !errors.Is(got, tt.want) {
+				t.Errorf("CheckReparent(%d, %d) = %v, want %v", tt.channelID, tt.parentID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodecSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec CodecSettings
+		want  error
+	}{
+		{"defaults", CodecSettings{}, nil},
+		{"music_stereo", CodecSettings{Bitrate: 128000, FrameMs: 20, Application: CodecApplicationMusic, Stereo: true}, nil},
+		{"low_bandwidth", CodecSettings{Bitrate: 8000, FrameMs: 60}, nil},
+		{"bitrate_too_low", CodecSettings{Bitrate: 1000}, ErrChannelCodec},
+		{"bitrate_too_high", CodecSettings{Bitrate: 600000}, ErrChannelCodec},
+		{"max_bitrate_short_frames", CodecSettings{Bitrate: CodecMaxBitrate, FrameMs: 20}, nil},
+		{"max_frame_60ms", CodecSettings{Bitrate: 184000, FrameMs: 60}, nil},
+		{"frame_too_large_60ms", CodecSettings{Bitrate: 192000, FrameMs: 60}, ErrChannelCodec},
+		{"frame_too_large_40ms", CodecSettings{Bitrate: 320000, FrameMs: 40}, ErrChannelCodec},
+		{"odd_frame", CodecSettings{FrameMs: 30}, ErrChannelCodec},
+		{"unknown_application", CodecSettings{Application: "lowdelay"}, ErrChannelCodec},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.codec.Validate(); !errors.Is(got, tt.want) {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	got := CodecSettings{Stereo: true}.WithDefaults()
+	want := CodecSettings{Bitrate: CodecDefaultBitrate, FrameMs: CodecDefaultFrameMs, Application: CodecApplicationVoice, Stereo: true}
+	if got != want {
+		t.Errorf("WithDefaults() = %+v, want %+v", got, want)
+	}
+}
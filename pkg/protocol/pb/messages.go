@@ -1,85 +1,162 @@
-// Code generated from proto/control.proto. DO NOT EDIT.
-// To regenerate: protoc --go_out=. --go_opt=paths=source_relative proto/control.proto
-
+// Package pb holds the control plane messages defined in proto/control.proto.
+//
+// The structs are maintained by hand. The pb tags carry the protobuf field
+// numbers used by Marshal and Unmarshal and must match the .proto file;
+// TestProtoFieldNumbers checks that they do. The json tags define the JSON
+// encoding, which stays the default for clients that do not negotiate
+// protobuf.
 package pb
 
 // ControlMessage wraps all control plane messages.
 type ControlMessage struct {
 	// Only one of these fields should be set.
-	AuthRequest         *AuthRequest            `json:"auth_request,omitempty"`
-	AuthResponse        *AuthResponse           `json:"auth_response,omitempty"`
-	ChannelListRequest  *ChannelListRequest     `json:"channel_list_request,omitempty"`
-	ChannelListResponse *ChannelListResponse    `json:"channel_list_response,omitempty"`
-	JoinChannelRequest  *JoinChannelRequest     `json:"join_channel_request,omitempty"`
-	LeaveChannelRequest *LeaveChannelRequest    `json:"leave_channel_request,omitempty"`
-	ChannelJoinedEvent  *ChannelJoinedEvent     `json:"channel_joined_event,omitempty"`
-	ChannelLeftEvent    *ChannelLeftEvent       `json:"channel_left_event,omitempty"`
-	UserStateUpdate     *UserStateUpdate        `json:"user_state_update,omitempty"`
-	ServerStateEvent    *ServerStateEvent       `json:"server_state_event,omitempty"`
-	CreateChannelReq    *CreateChannelRequest   `json:"create_channel_request,omitempty"`
-	DeleteChannelReq    *DeleteChannelRequest   `json:"delete_channel_request,omitempty"`
-	CreateTokenReq      *CreateTokenRequest     `json:"create_token_request,omitempty"`
-	CreateTokenResp     *CreateTokenResponse    `json:"create_token_response,omitempty"`
-	KickUserReq         *KickUserRequest        `json:"kick_user_request,omitempty"`
-	BanUserReq          *BanUserRequest         `json:"ban_user_request,omitempty"`
-	ChatMsg             *ChatMessage            `json:"chat_message,omitempty"`
-	ChatEvent           *ChatMessage            `json:"chat_event,omitempty"`
-	SetUserRoleReq      *SetUserRoleRequest     `json:"set_user_role_request,omitempty"`
-	SetUserRoleResp     *SetUserRoleResponse    `json:"set_user_role_response,omitempty"`
-	ExportDataReq       *ExportDataRequest      `json:"export_data_request,omitempty"`
-	ExportDataResp      *ExportDataResponse     `json:"export_data_response,omitempty"`
-	ImportChannelsReq   *ImportChannelsRequest  `json:"import_channels_request,omitempty"`
-	ImportChannelsResp  *ImportChannelsResponse `json:"import_channels_response,omitempty"`
-	ErrorResponse       *ErrorResponse          `json:"error_response,omitempty"`
-	Ping                *Ping                   `json:"ping,omitempty"`
-	Pong                *Pong                   `json:"pong,omitempty"`
+	AuthRequest         *AuthRequest             `json:"auth_request,omitempty" pb:"1"`
+	AuthResponse        *AuthResponse            `json:"auth_response,omitempty" pb:"2"`
+	DisconnectReq       *DisconnectRequest       `json:"disconnect_request,omitempty" pb:"54"`
+	ChannelListRequest  *ChannelListRequest      `json:"channel_list_request,omitempty" pb:"10"`
+	ChannelListResponse *ChannelListResponse     `json:"channel_list_response,omitempty" pb:"11"`
+	JoinChannelRequest  *JoinChannelRequest      `json:"join_channel_request,omitempty" pb:"12"`
+	LeaveChannelRequest *LeaveChannelRequest     `json:"leave_channel_request,omitempty" pb:"13"`
+	ChannelJoinedEvent  *ChannelJoinedEvent      `json:"channel_joined_event,omitempty" pb:"20"`
+	ChannelLeftEvent    *ChannelLeftEvent        `json:"channel_left_event,omitempty" pb:"21"`
+	UserStateUpdate     *UserStateUpdate         `json:"user_state_update,omitempty" pb:"22"`
+	ServerStateEvent    *ServerStateEvent        `json:"server_state_event,omitempty" pb:"23"`
+	VoiceKeyEvent       *VoiceKeyEvent           `json:"voice_key_event,omitempty" pb:"24"`
+	ServerStateDelta    *ServerStateDelta        `json:"server_state_delta,omitempty" pb:"25"`
+	ServerStateReq      *ServerStateRequest      `json:"server_state_request,omitempty" pb:"26"`
+	CreateChannelReq    *CreateChannelRequest    `json:"create_channel_request,omitempty" pb:"30"`
+	DeleteChannelReq    *DeleteChannelRequest    `json:"delete_channel_request,omitempty" pb:"31"`
+	EditChannelReq      *EditChannelRequest      `json:"edit_channel_request,omitempty" pb:"42"`
+	CreateTokenReq      *CreateTokenRequest      `json:"create_token_request,omitempty" pb:"32"`
+	CreateTokenResp     *CreateTokenResponse     `json:"create_token_response,omitempty" pb:"33"`
+	ListTokensReq       *ListTokensRequest       `json:"list_tokens_request,omitempty" pb:"36"`
+	ListTokensResp      *ListTokensResponse      `json:"list_tokens_response,omitempty" pb:"37"`
+	RevokeTokenReq      *RevokeTokenRequest      `json:"revoke_token_request,omitempty" pb:"38"`
+	KickUserReq         *KickUserRequest         `json:"kick_user_request,omitempty" pb:"34"`
+	BanUserReq          *BanUserRequest          `json:"ban_user_request,omitempty" pb:"35"`
+	ListBansReq         *ListBansRequest         `json:"list_bans_request,omitempty" pb:"39"`
+	ListBansResp        *ListBansResponse        `json:"list_bans_response,omitempty" pb:"40"`
+	UnbanReq            *UnbanRequest            `json:"unban_request,omitempty" pb:"41"`
+	ListChannelACLReq   *ListChannelACLRequest   `json:"list_channel_acl_request,omitempty" pb:"43"`
+	ListChannelACLResp  *ListChannelACLResponse  `json:"list_channel_acl_response,omitempty" pb:"44"`
+	SetChannelACLReq    *SetChannelACLRequest    `json:"set_channel_acl_request,omitempty" pb:"45"`
+	DeleteChannelACLReq *DeleteChannelACLRequest `json:"delete_channel_acl_request,omitempty" pb:"46"`
+	ServerMuteReq       *ServerMuteRequest       `json:"server_mute_request,omitempty" pb:"47"`
+	MoveUserReq         *MoveUserRequest         `json:"move_user_request,omitempty" pb:"48"`
+	WhisperTargetReq    *WhisperTargetRequest    `json:"whisper_target_request,omitempty" pb:"53"`
+	GroupKeyMsg         *GroupKeyMessage         `json:"group_key_message,omitempty" pb:"55"`
+	PrioritySpeakerReq  *PrioritySpeakerRequest  `json:"priority_speaker_request,omitempty" pb:"49"`
+	ChatMsg             *ChatMessage             `json:"chat_message,omitempty" pb:"56"`
+	ChatEvent           *ChatMessage             `json:"chat_event,omitempty" pb:"57"`
+	ChatHistoryReq      *ChatHistoryRequest      `json:"chat_history_request,omitempty" pb:"64"`
+	ChatHistoryResp     *ChatHistoryResponse     `json:"chat_history_response,omitempty" pb:"65"`
+	EditChatReq         *EditChatRequest         `json:"edit_chat_request,omitempty" pb:"72"`
+	DeleteChatReq       *DeleteChatRequest       `json:"delete_chat_request,omitempty" pb:"73"`
+	ChatEditEvent       *ChatMessage             `json:"chat_edit_event,omitempty" pb:"74"`
+	ChatDeleteEvent     *ChatDeleteEvent         `json:"chat_delete_event,omitempty" pb:"75"`
+	DirectMsg           *DirectMessage           `json:"direct_message,omitempty" pb:"66"`
+	DirectMsgEvent      *DirectMessage           `json:"direct_message_event,omitempty" pb:"67"`
+	UnreadMsgsReq       *UnreadMessagesRequest   `json:"unread_messages_request,omitempty" pb:"68"`
+	UnreadMsgsResp      *UnreadMessagesResponse  `json:"unread_messages_response,omitempty" pb:"69"`
+	BroadcastReq        *ServerBroadcastRequest  `json:"server_broadcast_request,omitempty" pb:"70"`
+	BroadcastEvent      *ServerBroadcastEvent    `json:"server_broadcast_event,omitempty" pb:"71"`
+	SetUserRoleReq      *SetUserRoleRequest      `json:"set_user_role_request,omitempty" pb:"58"`
+	SetUserRoleResp     *SetUserRoleResponse     `json:"set_user_role_response,omitempty" pb:"59"`
+	ExportDataReq       *ExportDataRequest       `json:"export_data_request,omitempty" pb:"60"`
+	ExportDataResp      *ExportDataResponse      `json:"export_data_response,omitempty" pb:"61"`
+	ImportChannelsReq   *ImportChannelsRequest   `json:"import_channels_request,omitempty" pb:"62"`
+	ImportChannelsResp  *ImportChannelsResponse  `json:"import_channels_response,omitempty" pb:"63"`
+	ErrorResponse       *ErrorResponse           `json:"error_response,omitempty" pb:"50"`
+	Ping                *Ping                    `json:"ping,omitempty" pb:"51"`
+	Pong                *Pong                    `json:"pong,omitempty" pb:"52"`
 }
 
 // ----- Auth -----
 
 type AuthRequest struct {
-	Token    string `json:"token"` // empty = token-less join (if server allows)
-	Username string `json:"username"`
+	Token       string   `json:"token" pb:"1"` // empty = token-less join (if server allows)
+	Username    string   `json:"username" pb:"2"`
+	ResumeToken string   `json:"resume_token,omitempty" pb:"3"` // resume a dropped session (from AuthResponse)
+	IdentityKey []byte   `json:"identity_key,omitempty" pb:"4"` // X25519 public key, required for E2EE channels
+	Encodings   []string `json:"encodings,omitempty" pb:"5"`    // control encodings supported besides "json", preferred first
+	Features    []string `json:"features,omitempty" pb:"6"`     // optional protocol features, e.g. FeatureStateDeltas
 }
 
+// FeatureStateDeltas in AuthRequest.Features asks for ServerStateDelta
+// events instead of a full ServerStateEvent on every change.
+const FeatureStateDeltas = "state_deltas"
+
 type AuthResponse struct {
-	SessionID     uint32        `json:"session_id"`
-	Username      string        `json:"username"`
-	Role          string        `json:"role"`
-	EncryptionKey []byte        `json:"encryption_key"`
-	Channels      []ChannelInfo `json:"channels"`
-	AutoToken     string        `json:"auto_token,omitempty"` // set when server generated a token for this user
+	SessionID     uint32        `json:"session_id" pb:"1"`
+	Username      string        `json:"username" pb:"2"`
+	Role          string        `json:"role" pb:"3"`
+	EncryptionKey []byte        `json:"encryption_key" pb:"4"` // unused; whisper keys come per target, see VoiceKeyEvent
+	KeyEpoch      uint32        `json:"key_epoch,omitempty" pb:"11"`
+	Channels      []ChannelInfo `json:"channels" pb:"5"`
+	AutoToken     string        `json:"auto_token,omitempty" pb:"6"`     // set when server generated a token for this user
+	Roles         []string      `json:"roles,omitempty" pb:"7"`          // all role names, lowest priority first
+	ResumeToken   string        `json:"resume_token,omitempty" pb:"8"`   // secret for resuming this session after a drop
+	Resumed       bool          `json:"resumed,omitempty" pb:"9"`        // the dropped session named in the request was resumed
+	ChannelID     int64         `json:"channel_id,omitempty" pb:"10"`    // channel of the resumed session
+	Encoding      string        `json:"encoding,omitempty" pb:"12"`      // encoding of all later messages, empty = "json"
+	StateVersion  uint64        `json:"state_version,omitempty" pb:"13"` // version of the state in Channels
+	UserID        int64         `json:"user_id,omitempty" pb:"14"`
+	Unread        []UnreadCount `json:"unread_direct_messages,omitempty" pb:"15"` // direct messages stored while offline
+	MOTD          string        `json:"motd,omitempty" pb:"16"`                   // message of the day, empty = none
 }
 
+// DisconnectRequest ends the session immediately instead of keeping it
+// resumable after the connection closes.
+type DisconnectRequest struct{}
+
 // ----- Channels -----
 
 type ChannelInfo struct {
-	ID               int64      `json:"id"`
-	Name             string     `json:"name"`
-	Description      string     `json:"description"`
-	MaxUsers         int32      `json:"max_users"`
-	ParentID         int64      `json:"parent_id"`
-	IsTemp           bool       `json:"is_temp"`
-	AllowSubChannels bool       `json:"allow_sub_channels"`
-	Users            []UserInfo `json:"users"`
+	ID               int64         `json:"id" pb:"1"`
+	Name             string        `json:"name" pb:"2"`
+	Description      string        `json:"description" pb:"3"`
+	MaxUsers         int32         `json:"max_users" pb:"4"`
+	ParentID         int64         `json:"parent_id" pb:"6"`
+	IsTemp           bool          `json:"is_temp" pb:"7"`
+	AllowSubChannels bool          `json:"allow_sub_channels" pb:"8"`
+	HasPassword      bool          `json:"has_password" pb:"9"`
+	Codec            CodecSettings `json:"codec" pb:"10"`                    // voice codec clients use in this channel
+	E2EE             bool          `json:"e2ee,omitempty" pb:"11"`           // members agree on the voice key among themselves
+	ChatRetention    int64         `json:"chat_retention,omitempty" pb:"12"` // seconds: 0 = server default, -1 = no history
+	Users            []UserInfo    `json:"users" pb:"5"`
+}
+
+// CodecSettings are a channel's Opus parameters. Zero values mean the
+// defaults: 64 kbps, 20 ms frames, voice application, mono.
+type CodecSettings struct {
+	Bitrate     int32  `json:"bitrate,omitempty" pb:"1"`     // bits per second
+	FrameMs     int32  `json:"frame_ms,omitempty" pb:"2"`    // 10, 20, 40 or 60
+	Application string `json:"application,omitempty" pb:"3"` // "voice" or "music"
+	Stereo      bool   `json:"stereo,omitempty" pb:"4"`
 }
 
 type UserInfo struct {
-	ID       int64  `json:"id"`
-	Username string `json:"username"`
-	Role     string `json:"role"`
-	Muted    bool   `json:"muted"`
-	Deafened bool   `json:"deafened"`
+	ID       int64  `json:"id" pb:"1"`
+	Username string `json:"username" pb:"2"`
+	Role     string `json:"role" pb:"3"`
+	Muted    bool   `json:"muted" pb:"4"`
+	Deafened bool   `json:"deafened" pb:"5"`
+
+	ServerMuted     bool   `json:"server_muted,omitempty" pb:"6"`     // muted by a moderator
+	ServerDeafened  bool   `json:"server_deafened,omitempty" pb:"7"`  // deafened by a moderator
+	PrioritySpeaker bool   `json:"priority_speaker,omitempty" pb:"8"` // other voices are ducked while this user talks
+	SessionID       uint32 `json:"session_id,omitempty" pb:"9"`       // matches VoicePacket.SessionID
 }
 
 type ChannelListRequest struct{}
 
 type ChannelListResponse struct {
-	Channels []ChannelInfo `json:"channels"`
+	Channels []ChannelInfo `json:"channels" pb:"1"`
 }
 
 type JoinChannelRequest struct {
-	ChannelID int64 `json:"channel_id"`
+	ChannelID int64  `json:"channel_id" pb:"1"`
+	Password  string `json:"password,omitempty" pb:"2"` // required for password-protected channels
 }
 
 type LeaveChannelRequest struct{}
@@ -87,115 +164,400 @@ type LeaveChannelRequest struct{}
 // ----- Events -----
 
 type ChannelJoinedEvent struct {
-	ChannelID int64    `json:"channel_id"`
-	User      UserInfo `json:"user"`
+	ChannelID int64    `json:"channel_id" pb:"1"`
+	User      UserInfo `json:"user" pb:"2"`
 }
 
 type ChannelLeftEvent struct {
-	ChannelID int64  `json:"channel_id"`
-	UserID    int64  `json:"user_id"`
-	Username  string `json:"username"`
+	ChannelID int64  `json:"channel_id" pb:"1"`
+	UserID    int64  `json:"user_id" pb:"2"`
+	Username  string `json:"username" pb:"3"`
 }
 
 type UserStateUpdate struct {
-	Muted    bool `json:"muted"`
-	Deafened bool `json:"deafened"`
+	Muted    bool `json:"muted" pb:"1"`
+	Deafened bool `json:"deafened" pb:"2"`
 }
 
+// ServerStateEvent is the full server state. Clients without
+// FeatureStateDeltas get it on every change, the others on request.
 type ServerStateEvent struct {
-	Channels []ChannelInfo `json:"channels"`
+	Channels []ChannelInfo `json:"channels" pb:"1"`
+	Version  uint64        `json:"version,omitempty" pb:"2"`
+}
+
+// ServerStateDelta turns server state Version-1 into Version. A client that
+// sees any other version has missed a delta and asks for the full state
+// with a ServerStateRequest.
+type ServerStateDelta struct {
+	Version         uint64         `json:"version" pb:"1"`
+	ChannelUpdates  []ChannelInfo  `json:"channel_updates,omitempty" pb:"2"`  // added or changed channels, Users empty
+	ChannelRemovals []int64        `json:"channel_removals,omitempty" pb:"3"` // deleted channels
+	UserUpdates     []UserPresence `json:"user_updates,omitempty" pb:"4"`     // users that appeared, moved or changed state
+	UserRemovals    []uint32       `json:"user_removals,omitempty" pb:"5"`    // session IDs of users that left
+}
+
+// UserPresence places a user in a channel.
+type UserPresence struct {
+	ChannelID int64    `json:"channel_id" pb:"1"`
+	User      UserInfo `json:"user" pb:"2"`
+}
+
+// ServerStateRequest asks for a full ServerStateEvent.
+type ServerStateRequest struct{}
+
+// VoiceKeyEvent delivers a voice key: the key of the channel the session is
+// in (on join and on every rotation), or with ChannelID 0 the server-wide
+// key used for whispers. Voice packets name the key by the low byte of Epoch.
+//
+// In end-to-end encrypted channels Key is empty: the event starts a new
+// epoch, and Leader generates its key and sends it to Members in a
+// GroupKeyMessage.
+type VoiceKeyEvent struct {
+	ChannelID int64         `json:"channel_id" pb:"1"`
+	Epoch     uint32        `json:"epoch" pb:"2"`
+	Key       []byte        `json:"key,omitempty" pb:"3"`
+	Leader    uint32        `json:"leader,omitempty" pb:"4"`  // session ID
+	Members   []GroupMember `json:"members,omitempty" pb:"5"` // everyone who gets the key, leader included
+	Sender    uint32        `json:"sender,omitempty" pb:"6"`  // whisper key: sending session
+	Target    uint32        `json:"target,omitempty" pb:"7"`  // whisper key: the sender's target ID
+}
+
+// GroupMember is a holder of an end-to-end encrypted channel key.
+type GroupMember struct {
+	SessionID   uint32 `json:"session_id" pb:"1"`
+	Username    string `json:"username" pb:"2"`
+	IdentityKey []byte `json:"identity_key" pb:"3"` // X25519 public key
+}
+
+// GroupKeyMessage carries an end-to-end encrypted channel key from the epoch
+// leader, wrapped for each member with their identity key. The server
+// relays each member its own entry and fills in Sender.
+type GroupKeyMessage struct {
+	ChannelID int64        `json:"channel_id" pb:"1"`
+	Epoch     uint32       `json:"epoch" pb:"2"`
+	Sender    uint32       `json:"sender,omitempty" pb:"3"` // session ID, set by the server
+	Keys      []WrappedKey `json:"keys" pb:"4"`
+}
+
+// WrappedKey is a channel key encrypted for one member.
+type WrappedKey struct {
+	SessionID uint32 `json:"session_id" pb:"1"`
+	Key       []byte `json:"key" pb:"2"`
 }
 
 // ----- Admin -----
 
 type CreateChannelRequest struct {
-	Name             string `json:"name"`
-	Description      string `json:"description"`
-	MaxUsers         int32  `json:"max_users"`
-	ParentID         int64  `json:"parent_id"`          // 0 = root channel
-	IsTemp           bool   `json:"is_temp"`            // create as temporary
-	AllowSubChannels bool   `json:"allow_sub_channels"` // allow sub-channel creation
+	Name             string        `json:"name" pb:"1"`
+	Description      string        `json:"description" pb:"2"`
+	MaxUsers         int32         `json:"max_users" pb:"3"`
+	ParentID         int64         `json:"parent_id" pb:"4"`                 // 0 = root channel
+	IsTemp           bool          `json:"is_temp" pb:"5"`                   // create as temporary
+	AllowSubChannels bool          `json:"allow_sub_channels" pb:"6"`        // allow sub-channel creation
+	Password         string        `json:"password,omitempty" pb:"7"`        // optional join password
+	Codec            CodecSettings `json:"codec" pb:"8"`                     // temp sub-channels inherit the parent's codec instead
+	E2EE             bool          `json:"e2ee,omitempty" pb:"9"`            // temp sub-channels inherit the parent's setting instead
+	ChatRetention    int64         `json:"chat_retention,omitempty" pb:"10"` // seconds: 0 = server default, -1 = no history
 }
 
 type DeleteChannelRequest struct {
-	ChannelID int64 `json:"channel_id"`
+	ChannelID int64 `json:"channel_id" pb:"1"`
+}
+
+// EditChannelRequest replaces a channel's editable properties in place.
+// All fields are applied; clients send the current value for unchanged ones.
+type EditChannelRequest struct {
+	ChannelID        int64         `json:"channel_id" pb:"1"`
+	Name             string        `json:"name" pb:"2"`
+	Description      string        `json:"description" pb:"3"`
+	MaxUsers         int32         `json:"max_users" pb:"4"`
+	ParentID         int64         `json:"parent_id" pb:"5"` // 0 = root channel
+	AllowSubChannels bool          `json:"allow_sub_channels" pb:"6"`
+	Password         string        `json:"password,omitempty" pb:"7"`       // non-empty sets a new password
+	ClearPassword    bool          `json:"clear_password,omitempty" pb:"8"` // removes the password
+	Codec            CodecSettings `json:"codec" pb:"9"`
+	E2EE             bool          `json:"e2ee,omitempty" pb:"10"`
+	ChatRetention    int64         `json:"chat_retention,omitempty" pb:"11"`
 }
 
 type CreateTokenRequest struct {
-	Role             string `json:"role"`
-	ChannelScope     int64  `json:"channel_scope"`
-	MaxUses          int32  `json:"max_uses"`
-	ExpiresInSeconds int64  `json:"expires_in_seconds"`
+	Role             string `json:"role" pb:"1"`
+	ChannelScope     int64  `json:"channel_scope" pb:"2"`
+	MaxUses          int32  `json:"max_uses" pb:"3"`
+	ExpiresInSeconds int64  `json:"expires_in_seconds" pb:"4"`
+	Label            string `json:"label,omitempty" pb:"5"`
 }
 
 type CreateTokenResponse struct {
-	Token string `json:"token"`
+	Token   string `json:"token" pb:"1"`
+	ShortID string `json:"short_id" pb:"2"`
+}
+
+type TokenInfo struct {
+	ID            int64  `json:"id" pb:"1"`
+	ShortID       string `json:"short_id" pb:"2"` // non-secret identifier (hash prefix)
+	Label         string `json:"label" pb:"3"`
+	Role          string `json:"role" pb:"4"`
+	ChannelScope  int64  `json:"channel_scope" pb:"5"`
+	CreatedBy     int64  `json:"created_by" pb:"6"`
+	CreatedByName string `json:"created_by_name" pb:"7"`
+	MaxUses       int32  `json:"max_uses" pb:"8"` // 0 = unlimited
+	UseCount      int32  `json:"use_count" pb:"9"`
+	ExpiresAt     int64  `json:"expires_at" pb:"10"` // unix seconds, 0 = never
+	RevokedAt     int64  `json:"revoked_at" pb:"11"` // unix seconds, 0 = active
+	CreatedAt     int64  `json:"created_at" pb:"12"` // unix seconds
+}
+
+type ListTokensRequest struct{}
+
+type ListTokensResponse struct {
+	Tokens []TokenInfo `json:"tokens" pb:"1"`
+}
+
+type RevokeTokenRequest struct {
+	TokenID int64 `json:"token_id" pb:"1"`
 }
 
 type KickUserRequest struct {
-	UserID int64  `json:"user_id"`
-	Reason string `json:"reason"`
+	UserID int64  `json:"user_id" pb:"1"`
+	Reason string `json:"reason" pb:"2"`
 }
 
 type BanUserRequest struct {
-	UserID          int64  `json:"user_id"`
-	Reason          string `json:"reason"`
-	DurationSeconds int64  `json:"duration_seconds"`
+	UserID          int64  `json:"user_id" pb:"1"` // 0 for a pure IP ban
+	Reason          string `json:"reason" pb:"2"`
+	DurationSeconds int64  `json:"duration_seconds" pb:"3"`
+	IP              string `json:"ip,omitempty" pb:"4"`     // explicit IP or CIDR range to ban
+	BanIP           bool   `json:"ban_ip,omitempty" pb:"5"` // also ban the target's current address
+}
+
+type BanInfo struct {
+	ID           int64  `json:"id" pb:"1"`
+	UserID       int64  `json:"user_id" pb:"2"` // 0 = IP ban only
+	Username     string `json:"username" pb:"3"`
+	IP           string `json:"ip" pb:"4"` // address or CIDR range, empty = user ban only
+	Reason       string `json:"reason" pb:"5"`
+	BannedBy     int64  `json:"banned_by" pb:"6"`
+	BannedByName string `json:"banned_by_name" pb:"7"`
+	ExpiresAt    int64  `json:"expires_at" pb:"8"` // unix seconds, 0 = permanent
+	CreatedAt    int64  `json:"created_at" pb:"9"` // unix seconds
+}
+
+type ListBansRequest struct{}
+
+type ListBansResponse struct {
+	Bans []BanInfo `json:"bans" pb:"1"`
+}
+
+type UnbanRequest struct {
+	BanID int64 `json:"ban_id" pb:"1"`
+}
+
+// ServerMuteRequest sets the server-side mute/deafen of an online user.
+// Both flags are applied; clients send the current value for the unchanged one.
+type ServerMuteRequest struct {
+	UserID   int64 `json:"user_id" pb:"1"`
+	Muted    bool  `json:"muted" pb:"2"`
+	Deafened bool  `json:"deafened" pb:"3"`
+}
+
+// PrioritySpeakerRequest sets or clears the priority speaker flag of a user
+// for the channel they are currently in.
+type PrioritySpeakerRequest struct {
+	UserID  int64 `json:"user_id" pb:"1"`
+	Enabled bool  `json:"enabled" pb:"2"`
+}
+
+// MoveUserRequest moves an online user into another channel.
+type MoveUserRequest struct {
+	UserID    int64 `json:"user_id" pb:"1"`
+	ChannelID int64 `json:"channel_id" pb:"2"`
+}
+
+// ----- Whisper -----
+
+// WhisperTargetRequest registers the users and channels reached when the
+// client sends voice with the given target ID in the packet header. Empty
+// lists remove the target.
+type WhisperTargetRequest struct {
+	TargetID           uint32  `json:"target_id" pb:"1"` // 1..protocol.MaxWhisperTarget
+	UserIDs            []int64 `json:"user_ids,omitempty" pb:"2"`
+	ChannelIDs         []int64 `json:"channel_ids,omitempty" pb:"3"`
+	IncludeSubChannels bool    `json:"include_sub_channels,omitempty" pb:"4"`
+}
+
+// ----- Channel ACLs -----
+
+// ChannelACLEntry is a per-channel permission override. Exactly one of
+// UserID and Role identifies the subject.
+type ChannelACLEntry struct {
+	ID         int64  `json:"id" pb:"1"`
+	ChannelID  int64  `json:"channel_id" pb:"2"`
+	UserID     int64  `json:"user_id" pb:"3"` // 0 = role entry
+	Username   string `json:"username,omitempty" pb:"4"`
+	Role       string `json:"role,omitempty" pb:"5"`
+	Permission string `json:"permission" pb:"6"` // e.g. "join_channel", "speak"
+	Allow      bool   `json:"allow" pb:"7"`      // false = deny
+}
+
+type ListChannelACLRequest struct {
+	ChannelID int64 `json:"channel_id" pb:"1"`
+}
+
+type ListChannelACLResponse struct {
+	ChannelID int64             `json:"channel_id" pb:"1"`
+	Entries   []ChannelACLEntry `json:"entries" pb:"2"`
+}
+
+// SetChannelACLRequest creates or replaces the override for a subject and permission.
+type SetChannelACLRequest struct {
+	ChannelID  int64  `json:"channel_id" pb:"1"`
+	UserID     int64  `json:"user_id" pb:"2"` // 0 = role entry
+	Role       string `json:"role,omitempty" pb:"3"`
+	Permission string `json:"permission" pb:"4"`
+	Allow      bool   `json:"allow" pb:"5"`
+}
+
+type DeleteChannelACLRequest struct {
+	EntryID int64 `json:"entry_id" pb:"1"`
 }
 
 // ----- Generic -----
 
 type ErrorResponse struct {
-	Code    int32  `json:"code"`
-	Message string `json:"message"`
+	Code    int32  `json:"code" pb:"1"`
+	Message string `json:"message" pb:"2"`
 }
 
 type Ping struct {
-	Timestamp int64 `json:"timestamp"`
+	Timestamp int64 `json:"timestamp" pb:"1"`
 }
 
 type Pong struct {
-	Timestamp int64 `json:"timestamp"`
+	Timestamp int64 `json:"timestamp" pb:"1"`
 }
 
 // ----- Chat -----
 
 type ChatMessage struct {
-	ChannelID  int64  `json:"channel_id"`
-	SenderID   int64  `json:"sender_id"`
-	SenderName string `json:"sender_name"`
-	Text       string `json:"text"`
-	Timestamp  int64  `json:"timestamp"`
+	ChannelID  int64  `json:"channel_id" pb:"1"`
+	SenderID   int64  `json:"sender_id" pb:"2"`
+	SenderName string `json:"sender_name" pb:"3"`
+	Text       string `json:"text" pb:"4"`
+	Timestamp  int64  `json:"timestamp" pb:"5"`
+	ID         int64  `json:"id,omitempty" pb:"6"`     // set by the server; unique within the channel
+	Edited     int64  `json:"edited,omitempty" pb:"7"` // unix seconds of the last edit, 0 = never
+}
+
+// EditChatRequest replaces the text of one of your own chat messages.
+type EditChatRequest struct {
+	ChannelID int64  `json:"channel_id" pb:"1"`
+	ID        int64  `json:"id" pb:"2"`
+	Text      string `json:"text" pb:"3"`
+}
+
+// DeleteChatRequest removes one of your own chat messages, or anybody's
+// with the manage_chat permission.
+type DeleteChatRequest struct {
+	ChannelID int64 `json:"channel_id" pb:"1"`
+	ID        int64 `json:"id" pb:"2"`
+}
+
+type ChatDeleteEvent struct {
+	ChannelID int64  `json:"channel_id" pb:"1"`
+	ID        int64  `json:"id" pb:"2"`
+	DeletedBy string `json:"deleted_by,omitempty" pb:"3"` // the moderator; empty = the sender
+}
+
+// ChatHistoryRequest asks for a page of a channel's chat history, going
+// back from Before. Only channel members may ask.
+type ChatHistoryRequest struct {
+	ChannelID int64 `json:"channel_id" pb:"1"`
+	Before    int64 `json:"before,omitempty" pb:"2"` // messages with a lower ID; 0 = the newest
+	Limit     int32 `json:"limit,omitempty" pb:"3"`  // 0 = 50, at most 100
+}
+
+type ChatHistoryResponse struct {
+	ChannelID  int64         `json:"channel_id" pb:"1"`
+	Messages   []ChatMessage `json:"messages" pb:"2"`              // oldest first
+	NextBefore int64         `json:"next_before,omitempty" pb:"3"` // Before for the next older page; 0 = no more
+}
+
+// DirectMessage is a private message to one user, delivered to all of their
+// sessions. To an offline user it is stored until they read it.
+type DirectMessage struct {
+	ID          int64  `json:"id,omitempty" pb:"1"` // set by the server for stored messages
+	SenderID    int64  `json:"sender_id" pb:"2"`
+	SenderName  string `json:"sender_name" pb:"3"`
+	RecipientID int64  `json:"recipient_id" pb:"4"`
+	Text        string `json:"text" pb:"5"`
+	Timestamp   int64  `json:"timestamp" pb:"6"`
+	Stored      bool   `json:"stored,omitempty" pb:"7"` // the recipient was offline; it waits for them
+}
+
+// UnreadCount is the number of stored direct messages from one user.
+type UnreadCount struct {
+	UserID   int64  `json:"user_id" pb:"1"`
+	Username string `json:"username" pb:"2"`
+	Count    int32  `json:"count" pb:"3"`
+}
+
+// UnreadMessagesRequest asks for the stored direct messages from a user.
+// Ack is the ID of the last stored message the client received; the server
+// removes that message and every older one before answering.
+type UnreadMessagesRequest struct {
+	UserID int64 `json:"user_id" pb:"1"`
+	Ack    int64 `json:"ack,omitempty" pb:"2"`
+}
+
+type UnreadMessagesResponse struct {
+	UserID   int64           `json:"user_id" pb:"1"`
+	Messages []DirectMessage `json:"messages" pb:"2"` // oldest first
+}
+
+// ServerBroadcastRequest sends an announcement to every session on the
+// server. It needs the broadcast permission.
+type ServerBroadcastRequest struct {
+	Text string `json:"text" pb:"1"`
+}
+
+// ServerBroadcastEvent is an announcement to everybody, from an admin or
+// from the server itself (SenderName empty), e.g. before a shutdown.
+type ServerBroadcastEvent struct {
+	Text       string `json:"text" pb:"1"`
+	SenderName string `json:"sender_name,omitempty" pb:"2"`
+	Timestamp  int64  `json:"timestamp" pb:"3"`
 }
 
 // ----- Role Management -----
 
 type SetUserRoleRequest struct {
-	TargetUserID int64  `json:"target_user_id"`
-	NewRole      string `json:"new_role"`
+	TargetUserID int64  `json:"target_user_id" pb:"1"`
+	NewRole      string `json:"new_role" pb:"2"`
 }
 
 type SetUserRoleResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success bool   `json:"success" pb:"1"`
+	Message string `json:"message" pb:"2"`
 }
 
 // ----- Export / Import -----
 
 type ExportDataRequest struct {
-	Type string `json:"type"` // "channels" or "users"
+	Type string `json:"type" pb:"1"` // "channels" or "users"
 }
 
 type ExportDataResponse struct {
-	Type string `json:"type"`
-	Data string `json:"data"` // YAML content
+	Type string `json:"type" pb:"1"`
+	Data string `json:"data" pb:"2"` // YAML content
 }
 
 type ImportChannelsRequest struct {
-	YAML string `json:"yaml"`
+	YAML string `json:"yaml" pb:"1"`
 }
 
 type ImportChannelsResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success bool   `json:"success" pb:"1"`
+	Message string `json:"message" pb:"2"`
 }
@@ -0,0 +1,351 @@
+package pb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// ErrMalformed is returned by Unmarshal for input that is not a valid
+// encoding of the message.
+var ErrMalformed = errors.New("pb: malformed message")
+
+// messageInfo maps the pb-tagged fields of a message struct.
+type messageInfo struct {
+	fields []fieldInfo
+	byNum  map[uint64]int // field number -> struct field index
+}
+
+type fieldInfo struct {
+	num   uint64
+	index int
+}
+
+var messageInfos sync.Map // reflect.Type -> *messageInfo
+
+func infoOf(t reflect.Type) (*messageInfo, error) {
+	if mi, ok := messageInfos.Load(t); ok {
+		return mi.(*messageInfo), nil
+	}
+	mi := &messageInfo{byNum: make(map[uint64]int)}
+	for i := range t.NumField() {
+		tag, ok := t.Field(i).Tag.Lookup("pb")
+		if !ok {
+			continue
+		}
+		num, err := strconv.ParseUint(tag, 10, 29)
+		if err != nil || num == 0 {
+			return nil, fmt.Errorf("pb: %s.%s: bad field number %q", t.Name(), t.Field(i).Name, tag)
+		}
+		mi.fields = append(mi.fields, fieldInfo{num: num, index: i})
+		mi.byNum[num] = i
+	}
+	messageInfos.Store(t, mi)
+	return mi, nil
+}
+
+// Marshal encodes a message in the protobuf wire format. m must be a
+// pointer to one of the message structs of this package. As in proto3,
+// zero scalars are left out.
+func Marshal(m any) ([]byte, error) {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("pb: marshal %T: not a message pointer", m)
+	}
+	return appendMessage(nil, v.Elem())
+}
+
+func appendMessage(b []byte, v reflect.Value) ([]byte, error) {
+	mi, err := infoOf(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range mi.fields {
+		if b, err = appendField(b, f.num, v.Field(f.index)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func appendTag(b []byte, num uint64, wireType int) []byte {
+	return binary.AppendUvarint(b, num<<3|uint64(wireType))
+}
+
+func appendBytes(b []byte, num uint64, data []byte) []byte {
+	b = appendTag(b, num, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// appendEmbedded encodes v as a length-delimited sub-message.
+func appendEmbedded(b []byte, num uint64, v reflect.Value) ([]byte, error) {
+	data, err := appendMessage(nil, v)
+	if err != nil {
+		return nil, err
+	}
+	return appendBytes(b, num, data), nil
+}
+
+// scalarVarint returns the varint encoding of a bool or integer. Negative
+// int32 values are sign-extended, as protobuf requires.
+func scalarVarint(v reflect.Value) (uint64, bool) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	case reflect.Int32, reflect.Int64:
+		return uint64(v.Int()), true //nolint:gosec // two's complement is the wire format
+	case reflect.Uint32, reflect.Uint64:
+		return v.Uint(), true
+	}
+	return 0, false
+}
+
+func appendField(b []byte, num uint64, v reflect.Value) ([]byte, error) {
+	if x, ok := scalarVarint(v); ok {
+		if x != 0 {
+			b = appendTag(b, num, wireVarint)
+			b = binary.AppendUvarint(b, x)
+		}
+		return b, nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() > 0 {
+			b = appendBytes(b, num, []byte(v.String()))
+		}
+		return b, nil
+	case reflect.Struct:
+		if v.IsZero() {
+			return b, nil
+		}
+		return appendEmbedded(b, num, v)
+	case reflect.Pointer:
+		// Set pointers are sent even when empty: oneof members such as
+		// LeaveChannelRequest have no fields
+		if v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return b, nil
+		}
+		return appendEmbedded(b, num, v.Elem())
+	case reflect.Slice:
+		return appendRepeated(b, num, v)
+	}
+	return nil, fmt.Errorf("pb: unsupported field type %s", v.Type())
+}
+
+func appendRepeated(b []byte, num uint64, v reflect.Value) ([]byte, error) {
+	if v.Len() == 0 {
+		return b, nil
+	}
+	elem := v.Type().Elem()
+	switch elem.Kind() {
+	case reflect.Uint8:
+		return appendBytes(b, num, v.Bytes()), nil
+	case reflect.String:
+		for i := range v.Len() {
+			b = appendBytes(b, num, []byte(v.Index(i).String()))
+		}
+		return b, nil
+	case reflect.Struct:
+		var err error
+		for i := range v.Len() {
+			if b, err = appendEmbedded(b, num, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+
+	// Repeated scalars are packed
+	var packed []byte
+	for i := range v.Len() {
+		x, ok := scalarVarint(v.Index(i))
+		if !ok {
+			return nil, fmt.Errorf("pb: unsupported field type %s", v.Type())
+		}
+		packed = binary.AppendUvarint(packed, x)
+	}
+	return appendBytes(b, num, packed), nil
+}
+
+// Unmarshal decodes a message in the protobuf wire format into m, a pointer
+// to one of the message structs of this package. Unknown fields are
+// skipped, so older peers can read messages with fields added later.
+func Unmarshal(data []byte, m any) error {
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("pb: unmarshal %T: not a message pointer", m)
+	}
+	return decodeMessage(data, v.Elem())
+}
+
+func decodeMessage(b []byte, v reflect.Value) error {
+	mi, err := infoOf(v.Type())
+	if err != nil {
+		return err
+	}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 || tag>>3 == 0 {
+			return ErrMalformed
+		}
+		b = b[n:]
+		num, wireType := tag>>3, int(tag&7)
+
+		x, payload, n, err := readValue(b, wireType)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+		if index, ok := mi.byNum[num]; ok {
+			if err := decodeField(v.Field(index), wireType, x, payload); err != nil {
+				return fmt.Errorf("pb: %s field %d: %w", v.Type().Name(), num, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readValue reads one value of the given wire type. Varints are returned
+// in x, length-delimited data in payload; n is the number of bytes read.
+func readValue(b []byte, wireType int) (x uint64, payload []byte, n int, err error) {
+	switch wireType {
+	case wireVarint:
+		x, n = binary.Uvarint(b)
+		if n <= 0 {
+			return 0, nil, 0, ErrMalformed
+		}
+		return x, nil, n, nil
+	case wireBytes:
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return 0, nil, 0, ErrMalformed
+		}
+		end := n + int(length) //nolint:gosec // bounded by len(b) above
+		return 0, b[n:end], end, nil
+	case wireFixed64:
+		if len(b) < 8 {
+			return 0, nil, 0, ErrMalformed
+		}
+		return binary.LittleEndian.Uint64(b), nil, 8, nil
+	case wireFixed32:
+		if len(b) < 4 {
+			return 0, nil, 0, ErrMalformed
+		}
+		return uint64(binary.LittleEndian.Uint32(b)), nil, 4, nil
+	}
+	return 0, nil, 0, ErrMalformed // groups are not used
+}
+
+// setScalar stores a decoded varint in a bool or integer field.
+func setScalar(v reflect.Value, x uint64) bool {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(x != 0)
+	case reflect.Int32:
+		v.SetInt(int64(int32(x))) //nolint:gosec // int32 fields truncate, as in protobuf
+	case reflect.Int64:
+		v.SetInt(int64(x)) //nolint:gosec // two's complement is the wire format
+	case reflect.Uint32:
+		v.SetUint(uint64(uint32(x))) //nolint:gosec // uint32 fields truncate, as in protobuf
+	case reflect.Uint64:
+		v.SetUint(x)
+	default:
+		return false
+	}
+	return true
+}
+
+func decodeField(v reflect.Value, wireType int, x uint64, payload []byte) error {
+	if wireType == wireVarint {
+		if v.Kind() == reflect.Slice {
+			// Repeated scalar sent unpacked
+			e := reflect.New(v.Type().Elem()).Elem()
+			if !setScalar(e, x) {
+				return ErrMalformed
+			}
+			v.Set(reflect.Append(v, e))
+			return nil
+		}
+		if !setScalar(v, x) {
+			return ErrMalformed
+		}
+		return nil
+	}
+	if wireType != wireBytes {
+		return ErrMalformed
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		if !utf8.Valid(payload) {
+			return ErrMalformed
+		}
+		v.SetString(string(payload))
+		return nil
+	case reflect.Struct:
+		return decodeMessage(payload, v)
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeMessage(payload, v.Elem())
+	case reflect.Slice:
+		return decodeRepeated(v, payload)
+	}
+	return ErrMalformed
+}
+
+// decodeRepeated appends one length-delimited record to a slice field:
+// bytes, a string, a message, or a packed run of scalars.
+func decodeRepeated(v reflect.Value, payload []byte) error {
+	elem := v.Type().Elem()
+	switch elem.Kind() {
+	case reflect.Uint8:
+		v.SetBytes(append([]byte(nil), payload...))
+		return nil
+	case reflect.String:
+		if !utf8.Valid(payload) {
+			return ErrMalformed
+		}
+		v.Set(reflect.Append(v, reflect.ValueOf(string(payload))))
+		return nil
+	case reflect.Struct:
+		e := reflect.New(elem).Elem()
+		if err := decodeMessage(payload, e); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, e))
+		return nil
+	}
+
+	for len(payload) > 0 {
+		x, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return ErrMalformed
+		}
+		payload = payload[n:]
+		e := reflect.New(elem).Elem()
+		if !setScalar(e, x) {
+			return ErrMalformed
+		}
+		v.Set(reflect.Append(v, e))
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package pb
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	msgs := []*ControlMessage{
+		{ServerStateEvent: &ServerStateEvent{Channels: []ChannelInfo{
+			{ID: 1, Name: "Lobby", Users: []UserInfo{{ID: 7, Username: "alice", Role: "admin", Muted: true, SessionID: 4000000000}, {}}},
+			{ID: 2, Name: "Music", ParentID: 1, MaxUsers: 5, Codec: CodecSettings{Bitrate: 128000, Application: "music", Stereo: true}, E2EE: true},
+		}}},
+		{LeaveChannelRequest: &LeaveChannelRequest{}},
+		{ErrorResponse: &ErrorResponse{Code: -1, Message: "négatif"}},
+		{WhisperTargetReq: &WhisperTargetRequest{TargetID: 3, UserIDs: []int64{1, 300, -2}, ChannelIDs: []int64{0, 9}}},
+		{VoiceKeyEvent: &VoiceKeyEvent{ChannelID: 4, Epoch: 2, Leader: 9, Members: []GroupMember{{SessionID: 9, IdentityKey: bytes.Repeat([]byte{0xab}, 32)}}}},
+		{AuthRequest: &AuthRequest{Username: "bob", Encodings: []string{"protobuf", "json"}}},
+		{ServerStateDelta: &ServerStateDelta{Version: 9, ChannelRemovals: []int64{3}, UserUpdates: []UserPresence{{ChannelID: 1, User: UserInfo{Username: "carol", SessionID: 5}}}, UserRemovals: []uint32{6, 7}}},
+		{ChatHistoryResp: &ChatHistoryResponse{ChannelID: 1, Messages: []ChatMessage{{ChannelID: 1, SenderName: "alice", Text: "hi", Timestamp: 1767225600, ID: 41}}, NextBefore: 41}},
+		{ChatDeleteEvent: &ChatDeleteEvent{ChannelID: 1, ID: 41, DeletedBy: "mod"}},
+	}
+	for _, msg := range msgs {
+		data, err := Marshal(msg)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		got := &ControlMessage{}
+		if err := Unmarshal(data, got); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		if diff := cmp.Diff(msg, got, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("round trip mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestMarshalWireFormat(t *testing.T) {
+	cases := []struct {
+		msg  any
+		want string
+	}{
+		{&JoinChannelRequest{ChannelID: 150}, "089601"},
+		{&ErrorResponse{Code: -1}, "08ffffffffffffffffff01"},
+		{&ExportDataRequest{Type: "users"}, "0a057573657273"},
+		{&WhisperTargetRequest{UserIDs: []int64{3, 270}}, "1203038e02"},
+		{&ControlMessage{LeaveChannelRequest: &LeaveChannelRequest{}}, "6a00"},
+		{&ChannelInfo{}, ""},
+	}
+	for _, c := range cases {
+		data, err := Marshal(c.msg)
+		if err != nil {
+			t.Fatalf("Marshal(%T): %v", c.msg, err)
+		}
+		if got := hex.EncodeToString(data); got != c.want {
+			t.Errorf("Marshal(%+v) = %s, want %s", c.msg, got, c.want)
+		}
+	}
+}
+
+func TestUnmarshalCompat(t *testing.T) {
+	// Unknown fields of every wire type are skipped
+	data, _ := hex.DecodeString("0896019801" + "05" + "a2060161" + "f90600000000000000ff" + "fd0601020304")
+	var req JoinChannelRequest
+	if err := Unmarshal(data, &req); err != nil || req.ChannelID != 150 {
+		t.Fatalf("Unmarshal with unknown fields: got %+v, %v", req, err)
+	}
+
+	// Repeated scalars are accepted unpacked as well
+	data, _ = hex.DecodeString("1003108e02")
+	var wt WhisperTargetRequest
+	if err := Unmarshal(data, &wt); err != nil || !reflect.DeepEqual(wt.UserIDs, []int64{3, 270}) {
+		t.Fatalf("Unmarshal unpacked: got %+v, %v", wt, err)
+	}
+
+	for _, bad := range []string{"08", "0a05757365", "0aff", "0b", "0a02c328", "00"} {
+		data, _ := hex.DecodeString(bad)
+		if err := Unmarshal(data, &ExportDataRequest{}); !errors.Is(err, ErrMalformed) {
+			t.Errorf("Unmarshal(%s): want ErrMalformed, got %v", bad, err)
+		}
+	}
+}
+
+// TestProtoFieldNumbers checks that every message struct reachable from
+// ControlMessage matches its definition in proto/control.proto.
+func TestProtoFieldNumbers(t *testing.T) {
+	src, err := os.ReadFile("../../../proto/control.proto")
+	if err != nil {
+		t.Fatalf("read proto: %v", err)
+	}
+	messageRe := regexp.MustCompile(`^\s*message (\w+)\s*\{`)
+	fieldRe := regexp.MustCompile(`^\s*(repeated\s+)?(\w+)\s+(\w+)\s*=\s*(\d+);`)
+	type protoField struct {
+		name     string
+		typ      string
+		repeated bool
+	}
+	proto := map[string]map[int]protoField{}
+	var current string
+	for _, line := range strings.Split(string(src), "\n") {
+		if m := messageRe.FindStringSubmatch(line); m != nil {
+			current = m[1]
+			proto[current] = map[int]protoField{}
+		} else if m := fieldRe.FindStringSubmatch(line); m != nil && current != "" {
+			num, _ := strconv.Atoi(m[4])
+			proto[current][num] = protoField{name: m[3], typ: m[2], repeated: m[1] != ""}
+		}
+	}
+
+	scalars := map[reflect.Kind]string{
+		reflect.Bool: "bool", reflect.Int32: "int32", reflect.Int64: "int64",
+		reflect.Uint32: "uint32", reflect.Uint64: "uint64", reflect.String: "string",
+	}
+	seen := map[reflect.Type]bool{}
+	var check func(reflect.Type)
+	check = func(typ reflect.Type) {
+		if seen[typ] {
+			return
+		}
+		seen[typ] = true
+		fields, ok := proto[typ.Name()]
+		if !ok {
+			t.Errorf("%s: no message in control.proto", typ.Name())
+			return
+		}
+		tagged := map[int]bool{}
+		for i := range typ.NumField() {
+			f := typ.Field(i)
+			tag, ok := f.Tag.Lookup("pb")
+			if !ok {
+				t.Errorf("%s.%s: no pb tag", typ.Name(), f.Name)
+				continue
+			}
+			num, _ := strconv.Atoi(tag)
+			tagged[num] = true
+			pf, ok := fields[num]
+			jsonName, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !ok || pf.name != jsonName {
+				t.Errorf("%s.%s: field %d is %q in control.proto, want %q", typ.Name(), f.Name, num, pf.name, jsonName)
+				continue
+			}
+
+			ft := f.Type
+			repeated := ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8
+			if repeated {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			want := scalars[ft.Kind()]
+			switch {
+			case ft.Kind() == reflect.Slice:
+				want = "bytes"
+			case ft.Kind() == reflect.Struct:
+				want = ft.Name()
+				check(ft)
+			}
+			if pf.typ != want || pf.repeated != repeated {
+				t.Errorf("%s.%s: control.proto has %s (repeated=%v), Go has %s (repeated=%v)",
+					typ.Name(), f.Name, pf.typ, pf.repeated, want, repeated)
+			}
+		}
+		for num, pf := range fields {
+			if !tagged[num] {
+				t.Errorf("%s: control.proto field %s = %d missing in Go", typ.Name(), pf.name, num)
+			}
+		}
+	}
+	check(reflect.TypeOf(ControlMessage{}))
+}
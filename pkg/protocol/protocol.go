@@ -7,18 +7,30 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 
 	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
 )
 
 const (
 	// VoiceHeaderSize is the byte size of the voice packet header.
-	// [sessionID(4) | seqNum(4) | timestamp(4) | channelID(2)] = 14 bytes
-	VoiceHeaderSize = 14
+	// [sessionID(4) | seqNum(4) | timestamp(4) | channelID(2) | target(1) | keyEpoch(1)] = 16 bytes
+	VoiceHeaderSize = 16
+
+	// TargetChannel is the voice target for normal talk to the current channel.
+	// Values 1..MaxWhisperTarget select a whisper target registered by the sender.
+	TargetChannel = 0
+
+	// MaxWhisperTarget is the highest whisper target ID a session can register.
+	MaxWhisperTarget = 30
 
 	// MaxVoicePayload is the maximum encrypted Opus payload size.
 	MaxVoicePayload = 1400
 
+	// MaxOpusFrame is the largest Opus frame that fits in a voice packet
+	// once encrypted: MaxVoicePayload less the 16-byte GCM tag.
+	MaxOpusFrame = MaxVoicePayload - 16
+
 	// MaxControlMessage is the maximum control message size (64KB).
 	MaxControlMessage = 65536
 
@@ -40,17 +52,21 @@ type VoicePacket struct {
 	SessionID uint32 // 4 bytes: identifies the sender session
 	SeqNum    uint32 // 4 bytes: sequence number for ordering (prevents AES-GCM nonce reuse)
 	Timestamp uint32 // 4 bytes: RTP-style timestamp
-	ChannelID uint16 // 2 bytes: target channel
+	ChannelID uint16 // 2 bytes: sender's current channel
+	Target    uint8  // 1 byte: TargetChannel or a whisper target ID
+	KeyEpoch  uint8  // 1 byte: epoch of the voice key the payload is encrypted with
 	Payload   []byte // encrypted Opus frame + GCM auth tag
 }
 
-// MarshalHeader marshals only the header portion (14 bytes).
+// MarshalHeader marshals only the header portion (16 bytes).
 func (p *VoicePacket) MarshalHeader() []byte {
 	h := make([]byte, VoiceHeaderSize)
 	binary.BigEndian.PutUint32(h[0:4], p.SessionID)
 	binary.BigEndian.PutUint32(h[4:8], p.SeqNum)
 	binary.BigEndian.PutUint32(h[8:12], p.Timestamp)
 	binary.BigEndian.PutUint16(h[12:14], p.ChannelID)
+	h[14] = p.Target
+	h[15] = p.KeyEpoch
 	return h
 }
 
@@ -73,16 +89,117 @@ func UnmarshalVoicePacket(data []byte) (*VoicePacket, error) {
 		SeqNum:    binary.BigEndian.Uint32(data[4:8]),
 		Timestamp: binary.BigEndian.Uint32(data[8:12]),
 		ChannelID: binary.BigEndian.Uint16(data[12:14]),
+		Target:    data[14],
+		KeyEpoch:  data[15],
 		Payload:   make([]byte, len(data)-VoiceHeaderSize),
 	}
 	copy(pkt.Payload, data[VoiceHeaderSize:])
 	return pkt, nil
 }
 
-// WriteControlMessage writes a length-prefixed JSON control message to a writer.
-// Format: [4-byte big-endian length][JSON payload]
+// Encoding is a serialization of control messages. Connections start with
+// EncodingJSON; the client offers others in AuthRequest.Encodings and the
+// server names its choice in AuthResponse.Encoding.
+type Encoding uint8
+
+const (
+	EncodingJSON     Encoding = iota // JSON, understood by every peer
+	EncodingProtobuf                 // protobuf wire format of proto/control.proto
+)
+
+var encodingNames = map[Encoding]string{
+	EncodingJSON:     "json",
+	EncodingProtobuf: "protobuf",
+}
+
+func (e Encoding) String() string {
+	if name, ok := encodingNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("encoding(%d)", uint8(e))
+}
+
+// ParseEncoding returns the encoding with the given name. The empty name
+// is JSON.
+func ParseEncoding(name string) (Encoding, bool) {
+	if name == "" {
+		return EncodingJSON, true
+	}
+	for e, n := range encodingNames {
+		if n == name {
+			return e, true
+		}
+	}
+	return EncodingJSON, false
+}
+
+// EncodedConn is a connection whose control messages use a negotiated
+// encoding. WriteControlMessage and ReadControlMessage pick it up from the
+// connection; plain connections use JSON.
+type EncodedConn struct {
+	net.Conn
+	Encoding Encoding
+}
+
+// WithEncoding wraps conn so its control messages use enc.
+func WithEncoding(conn net.Conn, enc Encoding) net.Conn {
+	if ec, ok := conn.(*EncodedConn); ok {
+		conn = ec.Conn
+	}
+	if enc == EncodingJSON {
+		return conn
+	}
+	return &EncodedConn{Conn: conn, Encoding: enc}
+}
+
+func encodingOf(rw any) Encoding {
+	if ec, ok := rw.(*EncodedConn); ok {
+		return ec.Encoding
+	}
+	return EncodingJSON
+}
+
+// MarshalControlMessage serializes a control message without framing.
+func MarshalControlMessage(msg *pb.ControlMessage, enc Encoding) ([]byte, error) {
+	switch enc {
+	case EncodingJSON:
+		return json.Marshal(msg)
+	case EncodingProtobuf:
+		return pb.Marshal(msg)
+	}
+	return nil, fmt.Errorf("protocol: unknown encoding %s", enc)
+}
+
+// UnmarshalControlMessage parses a control message without framing.
+func UnmarshalControlMessage(data []byte, enc Encoding) (*pb.ControlMessage, error) {
+	msg := &pb.ControlMessage{}
+	var err error
+	switch enc {
+	case EncodingJSON:
+		err = json.Unmarshal(data, msg)
+	case EncodingProtobuf:
+		err = pb.Unmarshal(data, msg)
+	default:
+		err = fmt.Errorf("unknown encoding %s", enc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteControlMessage writes a length-prefixed control message to a writer,
+// in the connection's negotiated encoding (JSON unless w is an EncodedConn).
+// Format: [4-byte big-endian length][payload]
 func WriteControlMessage(w io.Writer, msg *pb.ControlMessage) error {
-	data, err := json.Marshal(msg)
+	return WriteControlMessageAs(w, msg, encodingOf(w))
+}
+
+// WriteControlMessageAs writes a length-prefixed control message in the
+// given encoding. The frame goes out in a single Write, so writers that
+// queue each Write as a unit keep frames whole.
+func WriteControlMessageAs(w io.Writer, msg *pb.ControlMessage, enc Encoding) error {
+	data, err := MarshalControlMessage(msg, enc)
 	if err != nil {
 		return fmt.Errorf("protocol: marshal: %w", err)
 	}
@@ -90,20 +207,24 @@ func WriteControlMessage(w io.Writer, msg *pb.ControlMessage) error {
 		return fmt.Errorf("protocol: message too large: %d bytes", len(data))
 	}
 
-	// Write length prefix
-	lenBuf := make([]byte, 4)
-	binary.BigEndian.PutUint32(lenBuf, uint32(len(data))) //nolint:gosec // length already bounds-checked above
-	if _, err := w.Write(lenBuf); err != nil {
-		return fmt.Errorf("protocol: write length: %w", err)
-	}
-	if _, err := w.Write(data); err != nil {
-		return fmt.Errorf("protocol: write payload: %w", err)
+	frame := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data))) //nolint:gosec // length already bounds-checked above
+	frame = append(frame, data...)
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("protocol: write: %w", err)
 	}
 	return nil
 }
 
-// ReadControlMessage reads a length-prefixed JSON control message from a reader.
+// ReadControlMessage reads a length-prefixed control message from a reader,
+// in the connection's negotiated encoding (JSON unless r is an EncodedConn).
 func ReadControlMessage(r io.Reader) (*pb.ControlMessage, error) {
+	return ReadControlMessageAs(r, encodingOf(r))
+}
+
+// ReadControlMessageAs reads a length-prefixed control message in the given
+// encoding.
+func ReadControlMessageAs(r io.Reader, enc Encoding) (*pb.ControlMessage, error) {
 	// Read length prefix
 	lenBuf := make([]byte, 4)
 	if _, err := io.ReadFull(r, lenBuf); err != nil {
@@ -120,8 +241,8 @@ func ReadControlMessage(r io.Reader) (*pb.ControlMessage, error) {
 		return nil, fmt.Errorf("protocol: read payload: %w", err)
 	}
 
-	msg := &pb.ControlMessage{}
-	if err := json.Unmarshal(data, msg); err != nil {
+	msg, err := UnmarshalControlMessage(data, enc)
+	if err != nil {
 		return nil, fmt.Errorf("protocol: unmarshal: %w", err)
 	}
 	return msg, nil
@@ -4,33 +4,67 @@ package rbac
 import "github.com/NicolasHaas/gospeak/pkg/model"
 
 // permissionMatrix maps roles to their allowed permissions.
+// Channel ACL overrides (see Check) are evaluated on top of this matrix.
 var permissionMatrix = map[model.Role]map[model.Permission]bool{
 	model.RoleAdmin: {
-		model.PermCreateChannel: true,
-		model.PermDeleteChannel: true,
-		model.PermKickUser:      true,
-		model.PermBanUser:       true,
-		model.PermManageTokens:  true,
-		model.PermEditChannel:   true,
-		model.PermManageRoles:   true,
+		model.PermCreateChannel:    true,
+		model.PermDeleteChannel:    true,
+		model.PermKickUser:         true,
+		model.PermBanUser:          true,
+		model.PermManageTokens:     true,
+		model.PermEditChannel:      true,
+		model.PermManageRoles:      true,
+		model.PermJoinChannel:      true,
+		model.PermSpeak:            true,
+		model.PermTextChat:         true,
+		model.PermCreateSubChannel: true,
+		model.PermWhisper:          true,
+		model.PermMuteUser:         true,
+		model.PermMoveUser:         true,
+		model.PermPrioritySpeaker:  true,
+		model.PermBroadcast:        true,
+		model.PermManageChat:       true,
 	},
 	model.RoleModerator: {
-		model.PermKickUser: true,
+		model.PermKickUser:         true,
+		model.PermManageChat:       true,
+		model.PermMuteUser:         true,
+		model.PermMoveUser:         true,
+		model.PermPrioritySpeaker:  true,
+		model.PermJoinChannel:      true,
+		model.PermSpeak:            true,
+		model.PermTextChat:         true,
+		model.PermCreateSubChannel: true,
+		model.PermWhisper:          true,
 	},
 	model.RoleUser: {
 		// No special permissions — can only join channels and talk
+		model.PermJoinChannel:      true,
+		model.PermSpeak:            true,
+		model.PermTextChat:         true,
+		model.PermCreateSubChannel: true,
+		model.PermWhisper:          true,
 	},
 }
 
-// HasPermission checks if a role has a specific permission.
+// HasPermission checks if a role has a specific permission. Custom roles
+// grant exactly the permissions listed in their definition.
 func HasPermission(role model.Role, perm model.Permission) bool {
 	perms, ok := permissionMatrix[role]
 	if !ok {
-		return false
+		def, ok := model.LookupCustomRole(role)
+		return ok && def.HasPermission(perm)
 	}
 	return perms[perm]
 }
 
+// CanGrant reports whether a session with role granter may hand out role
+// target, via SetUserRole or an invite token. Roles cannot grant a role that
+// outranks their own.
+func CanGrant(granter, target model.Role) bool {
+	return target.Priority() <= granter.Priority()
+}
+
 // RequirePermission returns an error message if the role lacks the permission, or empty string if allowed.
 func RequirePermission(role model.Role, perm model.Permission) string {
 	if HasPermission(role, perm) {
@@ -40,22 +74,103 @@ func RequirePermission(role model.Role, perm model.Permission) string {
 }
 
 func permName(p model.Permission) string {
-	switch p {
-	case model.PermCreateChannel:
-		return "create_channel"
-	case model.PermDeleteChannel:
-		return "delete_channel"
-	case model.PermKickUser:
-		return "kick_user"
-	case model.PermBanUser:
-		return "ban_user"
-	case model.PermManageTokens:
-		return "manage_tokens"
-	case model.PermEditChannel:
-		return "edit_channel"
-	case model.PermManageRoles:
-		return "manage_roles"
-	default:
-		return "unknown"
+	return p.String()
+}
+
+// Subject identifies who a channel permission is checked for.
+type Subject struct {
+	UserID int64
+	Role   model.Role
+}
+
+// ChannelTree indexes the channel hierarchy and its ACL entries so that
+// overrides can be inherited down the ParentID chain.
+type ChannelTree struct {
+	parents map[int64]int64
+	entries map[int64][]model.ChannelACL
+}
+
+// NewChannelTree builds a tree from the channel list and all ACL entries.
+func NewChannelTree(channels []model.Channel, acls []model.ChannelACL) *ChannelTree {
+	t := &ChannelTree{
+		parents: make(map[int64]int64, len(channels)),
+		entries: make(map[int64][]model.ChannelACL),
+	}
+	for _, ch := range channels {
+		t.parents[ch.ID] = ch.ParentID
+	}
+	for _, acl := range acls {
+		t.entries[acl.ChannelID] = append(t.entries[acl.ChannelID], acl)
+	}
+	return t
+}
+
+// Channel returns the ACL view of a channel. A nil tree or a channel ID of 0
+// yields a view without overrides, so checks fall back to the role matrix.
+func (t *ChannelTree) Channel(id int64) Channel {
+	return Channel{ID: id, tree: t}
+}
+
+// Channel is a channel as seen by Check: its ID plus the tree it lives in.
+type Channel struct {
+	ID   int64
+	tree *ChannelTree
+}
+
+// Check reports whether the subject may perform perm in the channel.
+//
+// Overrides are looked up from the channel towards the root; the nearest
+// channel with a matching entry decides. At the same level a user entry beats
+// a role entry, and deny beats allow. Without any matching entry the global
+// role matrix applies. Admins are never restricted by overrides so they
+// cannot lock themselves out of channel management.
+func Check(session Subject, channel Channel, perm model.Permission) bool {
+	if session.Role == model.RoleAdmin {
+		return HasPermission(session.Role, perm)
+	}
+	if allow, found := channel.resolve(session, perm); found {
+		return allow
+	}
+	return HasPermission(session.Role, perm)
+}
+
+// RequireChannelPermission is the channel-aware counterpart of RequirePermission.
+func RequireChannelPermission(session Subject, channel Channel, perm model.Permission) string {
+	if Check(session, channel, perm) {
+		return ""
+	}
+	return "permission denied: " + permName(perm) + " not allowed in this channel"
+}
+
+func (c Channel) resolve(session Subject, perm model.Permission) (allow, found bool) {
+	if c.tree == nil {
+		return false, false
+	}
+	id := c.ID
+	// The depth bound guards against a corrupt (cyclic) hierarchy.
+	for depth := 0; id != 0 && depth <= len(c.tree.parents); depth++ {
+		userFound, userAllow := false, true
+		roleFound, roleAllow := false, true
+		for _, e := range c.tree.entries[id] {
+			if e.Permission != perm {
+				continue
+			}
+			switch {
+			case e.IsUserEntry() && e.UserID == session.UserID:
+				userFound = true
+				userAllow = userAllow && e.Allow
+			case !e.IsUserEntry() && e.Role == session.Role:
+				roleFound = true
+				roleAllow = roleAllow && e.Allow
+			}
+		}
+		if userFound {
+			return userAllow, true
+		}
+		if roleFound {
+			return roleAllow, true
+		}
+		id = c.tree.parents[id]
 	}
+	return false, false
 }
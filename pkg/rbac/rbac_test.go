@@ -0,0 +1,55 @@
+package rbac
+
+import (
+	"testing"
+
+	"github.com/NicolasHaas/gospeak/pkg/model"
+)
+
+func TestCheck(t *testing.T) {
+	// 1 (Lobby) ── 2 (Stage) ── 3 (Backstage)
+	channels := []model.Channel{
+		{ID: 1, ParentID: 0},
+		{ID: 2, ParentID: 1},
+		{ID: 3, ParentID: 2},
+	}
+	acls := []model.ChannelACL{
+		{ChannelID: 2, Role: model.RoleUser, Permission: model.PermSpeak, Allow: false},
+		{ChannelID: 2, UserID: 42, Permission: model.PermSpeak, Allow: true},
+		{ChannelID: 3, Role: model.RoleUser, Permission: model.PermSpeak, Allow: true},
+		{ChannelID: 1, Role: model.RoleModerator, Permission: model.PermDeleteChannel, Allow: true},
+		{ChannelID: 1, Role: model.RoleAdmin, Permission: model.PermJoinChannel, Allow: false},
+	}
+	tree := NewChannelTree(channels, acls)
+
+	user := Subject{UserID: 7, Role: model.RoleUser}
+	speaker := Subject{UserID: 42, Role: model.RoleUser}
+	mod := Subject{UserID: 8, Role: model.RoleModerator}
+	admin := Subject{UserID: 1, Role: model.RoleAdmin}
+
+	tests := []struct {
+		name    string
+		subject Subject
+		channel int64
+		perm    model.Permission
+		want    bool
+	}{
+		{"default_without_overrides", user, 1, model.PermSpeak, true},
+		{"role_deny", user, 2, model.PermSpeak, false},
+		{"user_allow_beats_role_deny", speaker, 2, model.PermSpeak, true},
+		{"nearest_level_wins", user, 3, model.PermSpeak, true},
+		{"inherited_by_children", mod, 3, model.PermDeleteChannel, true},
+		{"other_permission_untouched", user, 2, model.PermTextChat, true},
+		{"default_matrix_deny", user, 1, model.PermDeleteChannel, false},
+		{"admin_ignores_overrides", admin, 1, model.PermJoinChannel, true},
+		{"no_channel_falls_back", mod, 0, model.PermDeleteChannel, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Check(tt.subject, tree.Channel(tt.channel), tt.perm); got != tt.want {
+				t.Errorf("Check(%+v, %d, %s) = %v, want %v", tt.subject, tt.channel, tt.perm, got, tt.want)
+			}
+		})
+	}
+}
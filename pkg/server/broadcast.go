@@ -0,0 +1,66 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/NicolasHaas/gospeak/pkg/model"
+	"github.com/NicolasHaas/gospeak/pkg/protocol"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+	"github.com/NicolasHaas/gospeak/pkg/rbac"
+)
+
+// maxBroadcastLength caps the text of an announcement.
+const maxBroadcastLength = 2000
+
+// broadcastAll sends a control message to every connected session,
+// regardless of channel, and returns how many there were.
+func (ch *ControlHandler) broadcastAll(msg *pb.ControlMessage) int {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	for sid, conn := range ch.connMap {
+		if err := protocol.WriteControlMessage(conn, msg); err != nil {
+			slog.Error("broadcast write failed", "session", sid, "err", err)
+		}
+	}
+	return len(ch.connMap)
+}
+
+// handleServerBroadcast sends an admin's announcement to everybody.
+func (s *Server) handleServerBroadcast(handler *ControlHandler, sessionID uint32, req *pb.ServerBroadcastRequest, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermBroadcast); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+	text := sanitizeText(strings.TrimSpace(req.Text))
+	if len(text) == 0 || len(text) > maxBroadcastLength {
+		sendError(conn, 31, "announcement must be 1-2000 characters")
+		return
+	}
+	n := handler.broadcastAll(&pb.ControlMessage{BroadcastEvent: &pb.ServerBroadcastEvent{
+		Text:       text,
+		SenderName: session.Username,
+		Timestamp:  time.Now().Unix(),
+	}})
+	slog.Info("server broadcast", "from", session.Username, "sessions", n)
+}
+
+// Broadcast sends an announcement from the server itself to every connected
+// session and returns how many sessions it went to. It does nothing before
+// the control plane is started.
+func (s *Server) Broadcast(text string) int {
+	if s.control == nil {
+		return 0
+	}
+	return s.control.broadcastAll(&pb.ControlMessage{BroadcastEvent: &pb.ServerBroadcastEvent{
+		Text:      text,
+		Timestamp: time.Now().Unix(),
+	}})
+}
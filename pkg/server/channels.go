@@ -63,6 +63,21 @@ func (cm *ChannelManager) Leave(sessionID uint32) (channelID int64) {
 	return current
 }
 
+// Replace moves a session's channel membership to a new session ID.
+func (cm *ChannelManager) Replace(oldID, newID uint32) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	current, ok := cm.sessionToChannel[oldID]
+	if !ok {
+		return
+	}
+	delete(cm.sessionToChannel, oldID)
+	delete(cm.members[current], oldID)
+	cm.members[current][newID] = true
+	cm.sessionToChannel[newID] = current
+}
+
 // Members returns all session IDs in a channel.
 func (cm *ChannelManager) Members(channelID int64) []uint32 {
 	cm.mu.RLock()
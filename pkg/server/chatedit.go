@@ -0,0 +1,220 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NicolasHaas/gospeak/pkg/model"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+	"github.com/NicolasHaas/gospeak/pkg/rbac"
+	"github.com/NicolasHaas/gospeak/pkg/store"
+)
+
+// chatWindowSize is how many messages the server remembers per channel that
+// keeps no history, so they can still be edited and deleted for a while.
+const chatWindowSize = 100
+
+// recentChat is the recent-message window of channels without history. It
+// also hands out their message IDs, above every stored message ID seen so
+// far.
+type recentChat struct {
+	mu       sync.Mutex
+	lastID   int64
+	channels map[int64][]pb.ChatMessage // oldest first
+}
+
+func newRecentChat() *recentChat {
+	return &recentChat{channels: make(map[int64][]pb.ChatMessage)}
+}
+
+// seen notes the ID of a stored message.
+func (r *recentChat) seen(id int64) {
+	r.mu.Lock()
+	r.lastID = max(r.lastID, id)
+	r.mu.Unlock()
+}
+
+// add gives msg an ID and remembers it, forgetting the channel's oldest
+// message once the window is full.
+func (r *recentChat) add(msg *pb.ChatMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastID++
+	msg.ID = r.lastID
+	msgs := append(r.channels[msg.ChannelID], *msg)
+	if len(msgs) > chatWindowSize {
+		msgs = msgs[len(msgs)-chatWindowSize:]
+	}
+	r.channels[msg.ChannelID] = msgs
+}
+
+// get returns a remembered message.
+func (r *recentChat) get(channelID, id int64) (pb.ChatMessage, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.channels[channelID] {
+		if m.ID == id {
+			return m, true
+		}
+	}
+	return pb.ChatMessage{}, false
+}
+
+// update replaces a remembered message with its edited version.
+func (r *recentChat) update(msg pb.ChatMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, m := range r.channels[msg.ChannelID] {
+		if m.ID == msg.ID {
+			r.channels[msg.ChannelID][i] = msg
+		}
+	}
+}
+
+// remove forgets a message.
+func (r *recentChat) remove(channelID, id int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.channels[channelID]
+	for i, m := range msgs {
+		if m.ID == id {
+			r.channels[channelID] = append(msgs[:i], msgs[i+1:]...)
+			return
+		}
+	}
+}
+
+// forget drops the window of a deleted channel.
+func (r *recentChat) forget(channelID int64) {
+	r.mu.Lock()
+	delete(r.channels, channelID)
+	r.mu.Unlock()
+}
+
+// findChatMessage looks a message up in the recent window, then in the
+// channel's history. stored tells where it was found.
+func (s *Server) findChatMessage(st store.DataStore, ch *model.Channel, id int64) (msg pb.ChatMessage, stored, ok bool) {
+	if m, ok := s.chat.get(ch.ID, id); ok {
+		return m, false, true
+	}
+	if s.chatRetention(ch) == 0 {
+		return pb.ChatMessage{}, false, false
+	}
+	m, err := st.GetChatMessage(ch.ID, id)
+	if err != nil {
+		slog.Error("get chat message failed", "channel", ch.ID, "id", id, "err", err)
+	}
+	if m == nil {
+		return pb.ChatMessage{}, false, false
+	}
+	return chatMessageToPB(*m), true, true
+}
+
+// chatChannel looks up the channel of an edit or delete. Scoped sessions are
+// refused channels outside their scope before any message is looked up, so
+// they cannot probe message IDs there.
+func (s *Server) chatChannel(st store.DataStore, session SessionSnapshot, channelID int64, conn net.Conn) (*model.Channel, bool) {
+	ch, err := st.GetChannel(channelID)
+	if err != nil || ch == nil {
+		sendError(conn, 10, "channel not found")
+		return nil, false
+	}
+	if session.ChannelScope != 0 {
+		channels, _ := st.ListChannels()
+		if !parentsOf(channels).inScope(session.ChannelScope, ch.ID) {
+			sendError(conn, 12, "channel is outside your token scope")
+			return nil, false
+		}
+	}
+	return ch, true
+}
+
+// handleEditChat replaces the text of one of the sender's own messages and
+// tells the channel.
+func (s *Server) handleEditChat(handler *ControlHandler, sessionID uint32, req *pb.EditChatRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	ch, ok := s.chatChannel(st, session, req.ChannelID, conn)
+	if !ok {
+		return
+	}
+	if errMsg := rbac.RequireChannelPermission(session.Subject(), s.channelTree(st).Channel(ch.ID), model.PermTextChat); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+	msg, stored, ok := s.findChatMessage(st, ch, req.ID)
+	if !ok {
+		sendError(conn, 31, "message not found")
+		return
+	}
+	if msg.SenderID != session.UserID {
+		sendError(conn, 30, "permission denied: you can only edit your own messages")
+		return
+	}
+	text := sanitizeText(strings.TrimSpace(req.Text))
+	if len(text) == 0 || len(text) > 2000 {
+		sendError(conn, 31, "message must be 1-2000 characters")
+		return
+	}
+
+	now := time.Now()
+	msg.Text = text
+	msg.Edited = now.Unix()
+	if stored {
+		if err := st.UpdateChatMessage(ch.ID, msg.ID, text, now); err != nil {
+			slog.Error("update chat message failed", "channel", ch.ID, "id", msg.ID, "err", err)
+			sendError(conn, 31, "failed to edit message")
+			return
+		}
+	} else {
+		s.chat.update(msg)
+	}
+	handler.broadcastToChannel(ch.ID, &pb.ControlMessage{ChatEditEvent: &msg}, 0)
+}
+
+// handleDeleteChat removes a message: the sender's own, or anybody's for
+// sessions with manage_chat in the channel.
+func (s *Server) handleDeleteChat(handler *ControlHandler, sessionID uint32, req *pb.DeleteChatRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	ch, ok := s.chatChannel(st, session, req.ChannelID, conn)
+	if !ok {
+		return
+	}
+	msg, stored, ok := s.findChatMessage(st, ch, req.ID)
+	if !ok {
+		sendError(conn, 31, "message not found")
+		return
+	}
+	event := &pb.ChatDeleteEvent{ChannelID: ch.ID, ID: msg.ID}
+	if msg.SenderID != session.UserID {
+		if errMsg := rbac.RequireChannelPermission(session.Subject(), s.channelTree(st).Channel(ch.ID), model.PermManageChat); errMsg != "" {
+			sendError(conn, 30, errMsg)
+			return
+		}
+		event.DeletedBy = session.Username
+	}
+
+	if stored {
+		if err := st.DeleteChatMessage(ch.ID, msg.ID); err != nil {
+			slog.Error("delete chat message failed", "channel", ch.ID, "id", msg.ID, "err", err)
+			sendError(conn, 31, "failed to delete message")
+			return
+		}
+	} else {
+		s.chat.remove(ch.ID, msg.ID)
+	}
+	if event.DeletedBy != "" {
+		slog.Info("chat message deleted", "channel", ch.ID, "id", msg.ID, "sender", msg.SenderName, "by", session.Username)
+	}
+	handler.broadcastToChannel(ch.ID, &pb.ControlMessage{ChatDeleteEvent: event}, 0)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/NicolasHaas/gospeak/pkg/model"
+	"github.com/NicolasHaas/gospeak/pkg/protocol"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+	"github.com/NicolasHaas/gospeak/pkg/store"
+)
+
+// DefaultChatRetention is how long channel chat is kept when neither the
+// channel nor Config.ChatRetention says otherwise.
+const DefaultChatRetention = 30 * 24 * time.Hour
+
+// Page sizes of ChatHistoryRequest.
+const (
+	chatHistoryPage    = 50
+	maxChatHistoryPage = 100
+)
+
+// maxChatRetention caps the retention a channel can ask for.
+const maxChatRetention = 100 * 365 * 24 * time.Hour
+
+// chatPruneInterval is how often messages past their retention are deleted.
+const chatPruneInterval = time.Hour
+
+// chatRetention returns how long the channel's chat is kept; 0 means it is
+// not kept at all.
+func (s *Server) chatRetention(ch *model.Channel) time.Duration {
+	switch {
+	case ch == nil || ch.ChatRetention < 0:
+		return 0
+	case ch.ChatRetention > 0:
+		return ch.ChatRetention
+	}
+	return max(s.cfg.ChatRetention, 0)
+}
+
+// storeChatMessage keeps a chat message for the channel's history and sets
+// its ID. Messages of channels without history, or that fail to store, go
+// to the recent window instead.
+func (s *Server) storeChatMessage(st store.DataStore, ch *model.Channel, msg *pb.ChatMessage) {
+	if s.chatRetention(ch) > 0 {
+		m := &model.ChatMessage{
+			ChannelID: msg.ChannelID,
+			UserID:    msg.SenderID,
+			Username:  msg.SenderName,
+			Text:      msg.Text,
+			CreatedAt: time.Unix(msg.Timestamp, 0).UTC(),
+		}
+		err := st.AddChatMessage(m)
+		if err == nil {
+			s.chat.seen(m.ID)
+			msg.ID = m.ID
+			return
+		}
+		slog.Error("store chat message failed", "channel", msg.ChannelID, "err", err)
+	}
+	s.chat.add(msg)
+}
+
+// handleChatHistoryRequest sends a page of a channel's chat history, oldest
+// message first. Only members of the channel may read it.
+func (s *Server) handleChatHistoryRequest(sessionID uint32, req *pb.ChatHistoryRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if s.channels.ChannelOf(session.ID) != req.ChannelID {
+		sendError(conn, 30, "join the channel to read its history")
+		return
+	}
+	ch, err := st.GetChannel(req.ChannelID)
+	if err != nil || ch == nil {
+		sendError(conn, 10, "channel not found")
+		return
+	}
+
+	resp := &pb.ChatHistoryResponse{ChannelID: ch.ID, Messages: []pb.ChatMessage{}}
+	if retention := s.chatRetention(ch); retention > 0 {
+		limit := int(req.Limit)
+		if limit <= 0 {
+			limit = chatHistoryPage
+		}
+		limit = min(limit, maxChatHistoryPage)
+
+		// One extra message tells whether there is an older page
+		msgs, err := st.ListChatMessages(ch.ID, req.Before, limit+1)
+		if err != nil {
+			slog.Error("list chat messages failed", "channel", ch.ID, "err", err)
+			sendError(conn, 31, "failed to read chat history")
+			return
+		}
+		cutoff := time.Now().Add(-retention)
+		msgs = slices.DeleteFunc(msgs, func(m model.ChatMessage) bool { return m.CreatedAt.Before(cutoff) })
+		if len(msgs) > limit {
+			msgs = msgs[:limit]
+			resp.NextBefore = msgs[limit-1].ID
+		}
+		for i := len(msgs) - 1; i >= 0; i-- {
+			resp.Messages = append(resp.Messages, chatMessageToPB(msgs[i]))
+		}
+	}
+	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{ChatHistoryResp: resp})
+}
+
+// pruneChatHistory deletes the messages past their channel's retention.
+func (s *Server) pruneChatHistory(st store.DataStore) {
+	channels, err := st.ListChannels()
+	if err != nil {
+		slog.Error("chat prune: list channels failed", "err", err)
+		return
+	}
+	now := time.Now()
+	for i := range channels {
+		ch := &channels[i]
+		// A channel without history may still hold messages from before
+		// it was turned off
+		before := now
+		if retention := s.chatRetention(ch); retention > 0 {
+			before = now.Add(-retention)
+		}
+		n, err := st.PruneChatMessages(ch.ID, before)
+		if err != nil {
+			slog.Error("chat prune failed", "channel", ch.ID, "err", err)
+			continue
+		}
+		if n > 0 {
+			slog.Debug("pruned chat history", "channel", ch.ID, "messages", n)
+		}
+	}
+}
+
+// startChatPruner prunes chat history now and then every chatPruneInterval
+// until the server shuts down.
+func (s *Server) startChatPruner(st store.DataStore) {
+	s.pruneChatHistory(st)
+	go func() {
+		ticker := time.NewTicker(chatPruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.pruneChatHistory(st)
+			}
+		}
+	}()
+}
+
+func chatMessageToPB(m model.ChatMessage) pb.ChatMessage {
+	msg := pb.ChatMessage{
+		ChannelID:  m.ChannelID,
+		SenderID:   m.UserID,
+		SenderName: m.Username,
+		Text:       m.Text,
+		Timestamp:  m.CreatedAt.Unix(),
+		ID:         m.ID,
+	}
+	if !m.EditedAt.IsZero() {
+		msg.Edited = m.EditedAt.Unix()
+	}
+	return msg
+}
+
+// chatRetentionToPB encodes a channel's retention in whole seconds; -1
+// means no history.
+func chatRetentionToPB(d time.Duration) int64 {
+	if d < 0 {
+		return -1
+	}
+	return int64(d / time.Second)
+}
+
+func chatRetentionFromPB(secs int64) time.Duration {
+	if secs < 0 {
+		return -time.Second
+	}
+	if secs > int64(maxChatRetention/time.Second) {
+		return maxChatRetention
+	}
+	return time.Duration(secs) * time.Second
+}
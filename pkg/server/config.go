@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/NicolasHaas/gospeak/pkg/model"
 	"github.com/NicolasHaas/gospeak/pkg/store"
@@ -16,7 +17,59 @@ type ChannelYAML struct {
 	Description      string        `yaml:"description,omitempty"`
 	MaxUsers         int           `yaml:"max_users,omitempty"`
 	AllowSubChannels bool          `yaml:"allow_sub_channels,omitempty"`
-	Channels         []ChannelYAML `yaml:"channels,omitempty"` // nested sub-channels
+	Codec            *CodecYAML    `yaml:"codec,omitempty"`          // omitted = default codec
+	E2EE             bool          `yaml:"e2ee,omitempty"`           // end-to-end encrypted voice
+	ChatRetention    string        `yaml:"chat_retention,omitempty"` // e.g. "72h" or "off"; omitted = server default
+	Channels         []ChannelYAML `yaml:"channels,omitempty"`       // nested sub-channels
+}
+
+// CodecYAML represents a channel's voice codec settings in YAML config.
+type CodecYAML struct {
+	Bitrate     int    `yaml:"bitrate,omitempty"`     // bits per second
+	FrameMs     int    `yaml:"frame_ms,omitempty"`    // 10, 20, 40 or 60
+	Application string `yaml:"application,omitempty"` // voice or music
+	Stereo      bool   `yaml:"stereo,omitempty"`
+}
+
+func (c *CodecYAML) settings() model.CodecSettings {
+	if c == nil {
+		return model.CodecSettings{}
+	}
+	return model.CodecSettings{Bitrate: c.Bitrate, FrameMs: c.FrameMs, Application: c.Application, Stereo: c.Stereo}
+}
+
+func codecYAML(c model.CodecSettings) *CodecYAML {
+	if c == (model.CodecSettings{}) {
+		return nil
+	}
+	return &CodecYAML{Bitrate: c.Bitrate, FrameMs: c.FrameMs, Application: c.Application, Stereo: c.Stereo}
+}
+
+// chatRetentionOff is the ChatRetention value of a channel without history.
+const chatRetentionOff = "off"
+
+func parseChatRetention(v string) (time.Duration, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case chatRetentionOff:
+		return -time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 || d > maxChatRetention {
+		return 0, fmt.Errorf("invalid chat_retention %q: want a positive duration or %q", v, chatRetentionOff)
+	}
+	return d, nil
+}
+
+func chatRetentionYAML(d time.Duration) string {
+	switch {
+	case d < 0:
+		return chatRetentionOff
+	case d == 0:
+		return ""
+	}
+	return d.String()
 }
 
 // ChannelsConfig is the top-level YAML config for channels.
@@ -37,6 +90,78 @@ type UsersExport struct {
 	Users []UserYAML `yaml:"users"`
 }
 
+// RoleYAML represents a custom role in YAML config.
+type RoleYAML struct {
+	Name        string   `yaml:"name"`
+	Priority    int      `yaml:"priority"`
+	Permissions []string `yaml:"permissions"`
+}
+
+// RolesConfig is the top-level YAML config for custom roles.
+type RolesConfig struct {
+	Roles []RoleYAML `yaml:"roles"`
+}
+
+// LoadRolesFromYAML reads a roles YAML file and creates/updates the roles in the store.
+func LoadRolesFromYAML(path string, st store.DataStore) error {
+	data, err := os.ReadFile(path) //nolint:gosec // path from user-provided CLI config
+	if err != nil {
+		return fmt.Errorf("read roles config: %w", err)
+	}
+	return ImportRolesFromYAML(data, st)
+}
+
+// ImportRolesFromYAML parses YAML role definitions and saves them to the store.
+// The whole file is validated before anything is saved. Roles missing from
+// the file are kept, since users and tokens may still reference them.
+func ImportRolesFromYAML(data []byte, st store.DataStore) error {
+	var cfg RolesConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse roles config: %w", err)
+	}
+
+	defs := make([]model.RoleDefinition, 0, len(cfg.Roles))
+	seen := make(map[string]bool, len(cfg.Roles))
+	for _, r := range cfg.Roles {
+		def := model.RoleDefinition{Name: r.Name, Priority: r.Priority}
+		if err := def.Validate(); err != nil {
+			return fmt.Errorf("role %q: %w", r.Name, err)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("role %q: defined more than once", r.Name)
+		}
+		seen[r.Name] = true
+		for _, name := range r.Permissions {
+			perm, ok := model.ParsePermission(name)
+			if !ok {
+				return fmt.Errorf("role %q: unknown permission %q", r.Name, name)
+			}
+			def.Permissions = append(def.Permissions, perm)
+		}
+		defs = append(defs, def)
+	}
+
+	for i := range defs {
+		if err := st.SaveRole(&defs[i]); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("imported roles from YAML", "count", len(defs))
+	return nil
+}
+
+// RegisterStoredRoles makes the custom roles persisted in the store known to
+// role parsing and permission checks.
+func RegisterStoredRoles(st store.DataStore) error {
+	defs, err := st.ListRoles()
+	if err != nil {
+		return err
+	}
+	model.RegisterCustomRoles(defs)
+	return nil
+}
+
 // LoadChannelsFromYAML reads a channels YAML file and creates/updates channels in the store.
 func LoadChannelsFromYAML(path string, st store.DataStore) error {
 	data, err := os.ReadFile(path) //nolint:gosec // path from user-provided CLI config
@@ -74,6 +199,10 @@ func ensureChannel(st store.DataStore, ch ChannelYAML, parentID int64) error {
 	if existing != nil {
 		channelID = existing.ID
 	} else {
+		retention, err := parseChatRetention(ch.ChatRetention)
+		if err != nil {
+			return err
+		}
 		channel := &model.Channel{
 			Name:             ch.Name,
 			Description:      ch.Description,
@@ -81,6 +210,9 @@ func ensureChannel(st store.DataStore, ch ChannelYAML, parentID int64) error {
 			ParentID:         parentID,
 			IsTemp:           false,
 			AllowSubChannels: ch.AllowSubChannels,
+			Codec:            ch.Codec.settings(),
+			E2EE:             ch.E2EE,
+			ChatRetention:    retention,
 		}
 		if err := st.CreateChannel(channel); err != nil {
 			return err
@@ -128,6 +260,9 @@ func buildChannelTree(channels []model.Channel, parentID int64) []ChannelYAML {
 				Description:      ch.Description,
 				MaxUsers:         ch.MaxUsers,
 				AllowSubChannels: ch.AllowSubChannels,
+				Codec:            codecYAML(ch.Codec),
+				E2EE:             ch.E2EE,
+				ChatRetention:    chatRetentionYAML(ch.ChatRetention),
 				Channels:         buildChannelTree(channels, ch.ID),
 			}
 			result = append(result, entry)
@@ -6,6 +6,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -29,15 +30,20 @@ type ControlHandler struct {
 	// Rate limiting for temp sub-channel creation: userID -> last creation time
 	tempChanMu    sync.Mutex
 	tempChanTimes map[int64]time.Time
+
+	// Rate limiting for channel password attempts: userID -> last failed attempt
+	passwordMu        sync.Mutex
+	passwordFailTimes map[int64]time.Time
 }
 
 // newControlHandler creates a control handler.
 func newControlHandler(srv *Server, st store.DataStore) *ControlHandler {
 	return &ControlHandler{
-		server:        srv,
-		store:         st,
-		connMap:       make(map[uint32]net.Conn),
-		tempChanTimes: make(map[int64]time.Time),
+		server:            srv,
+		store:             st,
+		connMap:           make(map[uint32]net.Conn),
+		tempChanTimes:     make(map[int64]time.Time),
+		passwordFailTimes: make(map[int64]time.Time),
 	}
 }
 
@@ -91,7 +97,9 @@ func (s *Server) StartControl(st store.DataStore) error {
 	s.controlConn = ln
 
 	handler := newControlHandler(s, st)
-	slog.Info("control plane listening", "addr", s.cfg.ControlAddr)
+	s.control = handler
+	slog.Info("control plane listening", "addr", s.cfg.ControlAddr,
+		"cert_sha256", crypto.CertFingerprint(cert.Certificate[0]))
 
 	go func() {
 		for {
@@ -121,6 +129,21 @@ func (s *Server) handleControlConn(handler *ControlHandler, conn net.Conn, st st
 	s.metrics.ActiveConnections.Add(1)
 	slog.Debug("new control connection", "remote", remoteAddr)
 
+	// Reject banned addresses before reading any credentials
+	if ip := remoteIP(conn.RemoteAddr()); ip != "" {
+		banned, err := st.IsIPBanned(ip)
+		if err != nil {
+			slog.Error("ip ban check failed", "remote", remoteAddr, "err", err)
+			sendError(conn, 3, "internal error")
+			return
+		}
+		if banned {
+			slog.Info("rejected banned address", "remote", remoteAddr)
+			sendError(conn, 4, "you are banned from this server")
+			return
+		}
+	}
+
 	// First message must be AuthRequest
 	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 	msg, err := protocol.ReadControlMessage(conn)
@@ -145,6 +168,7 @@ func (s *Server) handleControlConn(handler *ControlHandler, conn net.Conn, st st
 	}
 
 	var tokenRole model.Role
+	var tokenScope int64 // channel the token is limited to (0 = server-wide)
 	var autoToken string // set when server generates a token for token-less join
 
 	if authReq.Token == "" {
@@ -157,13 +181,14 @@ func (s *Server) handleControlConn(handler *ControlHandler, conn net.Conn, st st
 		tokenRole = model.RoleUser
 	} else {
 		tokenHash := crypto.HashToken(authReq.Token)
-		var err error
-		tokenRole, err = st.ValidateToken(tokenHash)
+		token, err := st.ValidateToken(tokenHash)
 		if err != nil {
 			s.metrics.FailedAuths.Add(1)
 			sendError(conn, 2, "authentication failed: "+err.Error())
 			return
 		}
+		tokenRole = token.Role
+		tokenScope = token.ChannelScope
 	}
 
 	// Create or get user — existing users keep their stored role
@@ -188,7 +213,7 @@ func (s *Server) handleControlConn(handler *ControlHandler, conn net.Conn, st st
 			rawToken, err := crypto.GenerateToken()
 			if err == nil {
 				hash := crypto.HashToken(rawToken)
-				_ = st.CreateToken(hash, model.RoleUser, 0, 0, 0, st.ZeroTime()) // unlimited, no expiry
+				_ = st.CreateToken(hash, "auto: "+user.Username, model.RoleUser, 0, 0, 0, st.ZeroTime()) // unlimited, no expiry
 				autoToken = rawToken
 				slog.Debug("auto-generated token for token-less user", "user", user.Username)
 			}
@@ -209,59 +234,116 @@ func (s *Server) handleControlConn(handler *ControlHandler, conn net.Conn, st st
 		return
 	}
 
-	// Create session (voice key is shared server-wide for SFU model)
-	session := s.sessions.Create(user.ID, user.Username, sessionRole)
-	sessionID := session.ID
+	// Resume the dropped session named in the request, or create a new one
+	var sessionID uint32
+	var resumedChannel int64
+	resumed := false
+	if authReq.ResumeToken != "" {
+		if session, ok := s.resumeSession(handler, authReq.ResumeToken, user.ID); ok {
+			sessionID = session.ID
+			resumedChannel = session.ChannelID
+			resumed = true
+			// Role and scope come from this login, not the old one
+			s.sessions.UpdateRole(sessionID, sessionRole)
+			s.sessions.SetChannelScope(sessionID, tokenScope)
+		}
+	}
+	if !resumed {
+		session := s.sessions.Create(user.ID, user.Username, sessionRole)
+		sessionID = session.ID
+		if tokenScope != 0 {
+			// Scoped (guest) tokens restrict this session to one channel tree
+			s.sessions.SetChannelScope(sessionID, tokenScope)
+		}
+	}
+	if len(authReq.IdentityKey) == identityKeySize {
+		s.sessions.SetIdentityKey(sessionID, authReq.IdentityKey)
+	}
+	s.sessions.SetStateDeltas(sessionID, slices.Contains(authReq.Features, pb.FeatureStateDeltas))
+
+	// From here on one writer goroutine sends everything, in order
+	queue := newSendQueue(conn, sessionID, s.cfg.SendQueueSize, s.cfg.SendQueueOverflow, s.metrics)
+	s.metrics.sendQueues.Store(sessionID, queue)
+	defer func() {
+		_ = queue.Close()
+		queue.wait()
+		s.metrics.sendQueues.Delete(sessionID)
+	}()
+	conn = queue
+
+	// Later messages use the encoding negotiated here; the response itself
+	// is still JSON, so clients can read it before they know the choice
+	enc := negotiateEncoding(authReq.Encodings)
+	conn = protocol.WithEncoding(conn, enc)
 
-	handler.setConn(sessionID, conn)
 	defer func() {
-		// Cleanup on disconnect
-		chID := s.channels.Leave(sessionID)
 		handler.removeConn(sessionID)
-		s.sessions.Remove(sessionID)
 		s.metrics.ActiveConnections.Add(-1)
-		s.metrics.TotalDisconnects.Add(1)
-		slog.Info("client disconnected", "user", user.Username, "session", sessionID)
-
-		if chID > 0 {
-			handler.broadcastToChannel(chID, &pb.ControlMessage{
-				ChannelLeftEvent: &pb.ChannelLeftEvent{
-					ChannelID: chID,
-					UserID:    user.ID,
-					Username:  user.Username,
-				},
-			}, sessionID)
 
-			// Auto-delete temp channels when empty
-			s.cleanupTempChannel(chID, st)
+		// Keep the session for a while so the client can resume it
+		parked := s.ctx.Err() == nil && s.resumes.Park(sessionID, s.cfg.ResumeWindow, func() {
+			if s.ctx.Err() == nil {
+				s.endSession(handler, sessionID, st)
+			}
+		})
+		if parked {
+			slog.Info("client connection lost, session kept for resume", "user", user.Username, "session", sessionID)
+			return
 		}
-
-		// Broadcast updated state to all remaining clients
-		s.broadcastServerState(st, handler)
+		s.endSession(handler, sessionID, st)
 	}()
 
-	// Build channel list
-	channels, _ := st.ListChannels()
-	channelInfos := s.buildChannelInfos(channels)
+	unread := unreadCounts(st, user.ID)
+
+	// The response is queued before the connection is registered, so no
+	// broadcast overtakes it, and under the state lock, so the connection
+	// joins the state broadcasts at the version its channel list shows
+	s.state.mu.Lock()
+	s.syncStateLocked(st, handler)
 
 	// Send auth response
 	authResp := &pb.ControlMessage{
 		AuthResponse: &pb.AuthResponse{
-			SessionID:     sessionID,
-			Username:      user.Username,
-			Role:          sessionRole.String(),
-			EncryptionKey: s.voiceKey,
-			Channels:      channelInfos,
-			AutoToken:     autoToken,
+			SessionID:    sessionID,
+			Username:     user.Username,
+			Role:         sessionRole.String(),
+			Channels:     s.state.last.view(tokenScope).channelInfos(),
+			StateVersion: s.state.version,
+			AutoToken:    autoToken,
+			Roles:        roleNames(),
+			ResumeToken:  s.resumes.Issue(sessionID, user.ID),
+			Resumed:      resumed,
+			ChannelID:    resumedChannel,
+			UserID:       user.ID,
+			Unread:       unread,
+			MOTD:         s.cfg.MOTD,
 		},
 	}
-	if err := protocol.WriteControlMessage(conn, authResp); err != nil {
+	if enc != protocol.EncodingJSON {
+		authResp.AuthResponse.Encoding = enc.String()
+	}
+	err = protocol.WriteControlMessageAs(conn, authResp, protocol.EncodingJSON)
+	if err == nil {
+		handler.setConn(sessionID, conn)
+	}
+	s.state.mu.Unlock()
+	if err != nil {
 		slog.Error("auth response write failed", "err", err)
 		return
 	}
+	// Whisper targets naming this user reach the new session now
+	s.syncWhisperKeys(handler)
 
-	slog.Info("client authenticated", "user", user.Username, "role", sessionRole, "session", sessionID)
+	slog.Info("client authenticated", "user", user.Username, "role", sessionRole, "session", sessionID, "resumed", resumed, "encoding", enc)
 	s.metrics.SuccessfulAuths.Add(1)
+	if resumed {
+		// Keys may have rotated while the session was parked
+		if resumedChannel != 0 {
+			s.deliverChannelKey(handler, conn, resumedChannel)
+		}
+		// Others learn the new voice session ID; no leave/join is announced
+		s.broadcastServerState(st, handler)
+	}
 
 	// Message loop
 	for {
@@ -280,10 +362,76 @@ func (s *Server) handleControlConn(handler *ControlHandler, conn net.Conn, st st
 			return
 		}
 
+		if msg.DisconnectReq != nil {
+			// Deliberate disconnect: end the session without a resume window
+			s.resumes.Revoke(sessionID)
+			return
+		}
+
 		s.handleMessage(handler, sessionID, msg, st, conn)
 	}
 }
 
+// resumeSession moves a dropped session onto a new connection under a new
+// session ID. If the old connection is still open (the client noticed the
+// drop before the server did), it is closed.
+func (s *Server) resumeSession(handler *ControlHandler, token string, userID int64) (SessionSnapshot, bool) {
+	oldID, parked, ok := s.resumes.Resume(token, userID)
+	if !ok {
+		return SessionSnapshot{}, false
+	}
+	session, ok := s.sessions.Takeover(oldID)
+	if !ok {
+		return SessionSnapshot{}, false // ended concurrently
+	}
+	s.channels.Replace(oldID, session.ID)
+	s.whispers.Move(oldID, session.ID)
+
+	if !parked {
+		handler.mu.RLock()
+		oldConn, open := handler.connMap[oldID]
+		handler.mu.RUnlock()
+		if open {
+			_ = oldConn.Close()
+		}
+	}
+	slog.Info("session resumed", "user", session.Username, "old_session", oldID, "session", session.ID)
+	return session, true
+}
+
+// endSession removes a session for good: it leaves its channel and the
+// remaining clients are told. Sessions already taken over by a resume are
+// left alone.
+func (s *Server) endSession(handler *ControlHandler, sessionID uint32, st store.DataStore) {
+	session, ok := s.sessions.Remove(sessionID)
+	if !ok {
+		return
+	}
+	chID := s.channels.Leave(sessionID)
+	s.whispers.RemoveSession(sessionID)
+	s.resumes.Revoke(sessionID)
+	s.metrics.TotalDisconnects.Add(1)
+	slog.Info("client disconnected", "user", session.Username, "session", sessionID)
+
+	if chID > 0 {
+		handler.broadcastToChannel(chID, &pb.ControlMessage{
+			ChannelLeftEvent: &pb.ChannelLeftEvent{
+				ChannelID: chID,
+				UserID:    session.UserID,
+				Username:  session.Username,
+			},
+		}, sessionID)
+		s.rotateChannelKey(handler, chID)
+
+		// Auto-delete temp channels when empty
+		s.cleanupTempChannel(chID, st)
+	}
+
+	// Broadcast updated state to all remaining clients; this also takes the
+	// session's whisper keys away
+	s.broadcastServerState(st, handler)
+}
+
 // handleMessage dispatches a control message to the appropriate handler.
 func (s *Server) handleMessage(handler *ControlHandler, sessionID uint32, msg *pb.ControlMessage, st store.DataStore, conn net.Conn) {
 	switch {
@@ -293,8 +441,11 @@ func (s *Server) handleMessage(handler *ControlHandler, sessionID uint32, msg *p
 	case msg.LeaveChannelRequest != nil:
 		s.handleLeaveChannel(handler, sessionID, st, conn)
 
+	case msg.ServerStateReq != nil:
+		s.handleServerStateRequest(handler, sessionID, st, conn)
+
 	case msg.ChannelListRequest != nil:
-		s.handleChannelList(st, conn)
+		s.handleChannelList(sessionID, st, conn)
 
 	case msg.UserStateUpdate != nil:
 		s.handleUserState(handler, sessionID, msg.UserStateUpdate, st)
@@ -305,17 +456,74 @@ func (s *Server) handleMessage(handler *ControlHandler, sessionID uint32, msg *p
 	case msg.DeleteChannelReq != nil:
 		s.handleDeleteChannel(sessionID, msg.DeleteChannelReq, st, conn, handler)
 
+	case msg.EditChannelReq != nil:
+		s.handleEditChannel(sessionID, msg.EditChannelReq, st, conn, handler)
+
 	case msg.CreateTokenReq != nil:
 		s.handleCreateToken(sessionID, msg.CreateTokenReq, st, conn)
 
+	case msg.ListTokensReq != nil:
+		s.handleListTokens(sessionID, st, conn)
+
+	case msg.RevokeTokenReq != nil:
+		s.handleRevokeToken(sessionID, msg.RevokeTokenReq, st, conn)
+
 	case msg.KickUserReq != nil:
 		s.handleKickUser(handler, sessionID, msg.KickUserReq, conn)
 
 	case msg.BanUserReq != nil:
 		s.handleBanUser(handler, sessionID, msg.BanUserReq, st, conn)
 
+	case msg.ListBansReq != nil:
+		s.handleListBans(sessionID, st, conn)
+
+	case msg.ServerMuteReq != nil:
+		s.handleServerMute(handler, sessionID, msg.ServerMuteReq, st, conn)
+
+	case msg.PrioritySpeakerReq != nil:
+		s.handlePrioritySpeaker(handler, sessionID, msg.PrioritySpeakerReq, st, conn)
+
+	case msg.MoveUserReq != nil:
+		s.handleMoveUser(handler, sessionID, msg.MoveUserReq, st, conn)
+
+	case msg.WhisperTargetReq != nil:
+		s.handleWhisperTarget(handler, sessionID, msg.WhisperTargetReq, st, conn)
+
+	case msg.GroupKeyMsg != nil:
+		s.handleGroupKey(handler, sessionID, msg.GroupKeyMsg)
+
+	case msg.UnbanReq != nil:
+		s.handleUnban(sessionID, msg.UnbanReq, st, conn)
+
+	case msg.ListChannelACLReq != nil:
+		s.handleListChannelACL(sessionID, msg.ListChannelACLReq.ChannelID, st, conn)
+
+	case msg.SetChannelACLReq != nil:
+		s.handleSetChannelACL(sessionID, msg.SetChannelACLReq, st, conn, handler)
+
+	case msg.DeleteChannelACLReq != nil:
+		s.handleDeleteChannelACL(sessionID, msg.DeleteChannelACLReq, st, conn, handler)
+
 	case msg.ChatMsg != nil:
-		s.handleChatMessage(handler, sessionID, msg.ChatMsg)
+		s.handleChatMessage(handler, sessionID, msg.ChatMsg, st, conn)
+
+	case msg.ChatHistoryReq != nil:
+		s.handleChatHistoryRequest(sessionID, msg.ChatHistoryReq, st, conn)
+
+	case msg.EditChatReq != nil:
+		s.handleEditChat(handler, sessionID, msg.EditChatReq, st, conn)
+
+	case msg.DeleteChatReq != nil:
+		s.handleDeleteChat(handler, sessionID, msg.DeleteChatReq, st, conn)
+
+	case msg.DirectMsg != nil:
+		s.handleDirectMessage(handler, sessionID, msg.DirectMsg, st, conn)
+
+	case msg.UnreadMsgsReq != nil:
+		s.handleUnreadMessages(sessionID, msg.UnreadMsgsReq, st, conn)
+
+	case msg.BroadcastReq != nil:
+		s.handleServerBroadcast(handler, sessionID, msg.BroadcastReq, conn)
 
 	case msg.SetUserRoleReq != nil:
 		s.handleSetUserRole(handler, sessionID, msg.SetUserRoleReq, st, conn)
@@ -346,14 +554,64 @@ func (s *Server) handleJoinChannel(handler *ControlHandler, sessionID uint32, re
 		return
 	}
 
+	// Check token scope
+	if session.ChannelScope != 0 {
+		channels, _ := st.ListChannels()
+		if !parentsOf(channels).inScope(session.ChannelScope, ch.ID) {
+			sendError(conn, 12, "channel is outside your token scope")
+			return
+		}
+	}
+
+	// Check channel ACLs
+	tree := s.channelTree(st)
+	if errMsg := rbac.RequireChannelPermission(session.Subject(), tree.Channel(ch.ID), model.PermJoinChannel); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+
+	// Check channel password; admins and scoped-token holders bypass it
+	if ch.HasPassword() && session.Role != model.RoleAdmin && session.ChannelScope == 0 {
+		if req.Password == "" {
+			sendError(conn, 13, "channel password required")
+			return
+		}
+		// Argon2id is expensive: allow one failed attempt per second per user
+		handler.passwordMu.Lock()
+		last, failed := handler.passwordFailTimes[session.UserID]
+		handler.passwordMu.Unlock()
+		if failed && time.Since(last) < time.Second {
+			sendError(conn, 13, "too many password attempts, please wait")
+			return
+		}
+		if !crypto.VerifyPassword(req.Password, ch.PasswordHash) {
+			handler.passwordMu.Lock()
+			handler.passwordFailTimes[session.UserID] = time.Now()
+			handler.passwordMu.Unlock()
+			sendError(conn, 13, "incorrect channel password")
+			return
+		}
+	}
+
 	// Check max users
 	if ch.MaxUsers > 0 && s.channels.MembersCount(ch.ID) >= ch.MaxUsers {
 		sendError(conn, 11, "channel is full")
 		return
 	}
+	if ch.E2EE && len(session.IdentityKey) == 0 {
+		sendError(conn, 14, "channel requires end-to-end encryption support")
+		return
+	}
+
+	s.joinChannel(handler, session, ch, tree, st, conn)
+}
 
+// joinChannel moves a session into a channel and emits the left/joined
+// events and state updates. Callers have already checked permissions.
+func (s *Server) joinChannel(handler *ControlHandler, session SessionSnapshot, ch *model.Channel, tree *rbac.ChannelTree, st store.DataStore, conn net.Conn) {
 	prevCh := s.channels.Join(session.ID, ch.ID)
 	s.sessions.SetChannel(session.ID, ch.ID)
+	s.sessions.SetSpeakDenied(session.ID, !rbac.Check(session.Subject(), tree.Channel(ch.ID), model.PermSpeak))
 
 	// Notify old channel
 	if prevCh > 0 {
@@ -364,25 +622,18 @@ func (s *Server) handleJoinChannel(handler *ControlHandler, sessionID uint32, re
 				Username:  session.Username,
 			},
 		}, session.ID)
+		s.rotateChannelKey(handler, prevCh)
 	}
+	s.deliverChannelKey(handler, conn, ch.ID)
 
 	// Notify new channel
 	handler.broadcastToChannel(ch.ID, &pb.ControlMessage{
 		ChannelJoinedEvent: &pb.ChannelJoinedEvent{
 			ChannelID: ch.ID,
-			User: pb.UserInfo{
-				ID:       session.UserID,
-				Username: session.Username,
-				Role:     session.Role.String(),
-				Muted:    session.Muted,
-				Deafened: session.Deafened,
-			},
+			User:      userInfo(session),
 		},
 	}, session.ID)
 
-	// Send full server state to the joining user
-	s.sendServerState(st, conn)
-
 	// Broadcast updated state to ALL clients so everyone sees the new member
 	s.broadcastServerState(st, handler)
 }
@@ -404,6 +655,7 @@ func (s *Server) handleLeaveChannel(handler *ControlHandler, sessionID uint32, s
 				Username:  session.Username,
 			},
 		}, session.ID)
+		s.rotateChannelKey(handler, chID)
 
 		// Auto-delete temp channels when empty
 		s.cleanupTempChannel(chID, st)
@@ -413,9 +665,14 @@ func (s *Server) handleLeaveChannel(handler *ControlHandler, sessionID uint32, s
 	s.broadcastServerState(st, handler)
 }
 
-func (s *Server) handleChannelList(st store.DataStore, conn net.Conn) {
+func (s *Server) handleChannelList(sessionID uint32, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
 	channels, _ := st.ListChannels()
-	infos := s.buildChannelInfos(channels)
+	infos := s.buildChannelInfos(channels, session.ChannelScope)
 	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
 		ChannelListResponse: &pb.ChannelListResponse{Channels: infos},
 	})
@@ -441,6 +698,9 @@ func (s *Server) handleCreateChannel(sessionID uint32, req *pb.CreateChannelRequ
 		return
 	}
 
+	codec := codecFromPB(req.Codec)
+	e2ee := req.E2EE
+	retention := chatRetentionFromPB(req.ChatRetention)
 	if req.ParentID > 0 && req.IsTemp {
 		// Temp sub-channel creation: any user can create if parent AllowSubChannels
 		parent, err := st.GetChannel(req.ParentID)
@@ -452,6 +712,20 @@ func (s *Server) handleCreateChannel(sessionID uint32, req *pb.CreateChannelRequ
 			sendError(conn, 31, "parent channel does not allow sub-channels")
 			return
 		}
+		codec = parent.Codec // codec choice is reserved to channel managers
+		e2ee = parent.E2EE
+		retention = parent.ChatRetention
+		if errMsg := rbac.RequireChannelPermission(session.Subject(), s.channelTree(st).Channel(parent.ID), model.PermCreateSubChannel); errMsg != "" {
+			sendError(conn, 30, errMsg)
+			return
+		}
+		if session.ChannelScope != 0 {
+			channels, _ := st.ListChannels()
+			if !parentsOf(channels).inScope(session.ChannelScope, parent.ID) {
+				sendError(conn, 12, "channel is outside your token scope")
+				return
+			}
+		}
 		// Rate limit: 1 temp channel per user per 10 seconds
 		handler.tempChanMu.Lock()
 		last, ok := handler.tempChanTimes[session.UserID]
@@ -463,8 +737,9 @@ func (s *Server) handleCreateChannel(sessionID uint32, req *pb.CreateChannelRequ
 		handler.tempChanTimes[session.UserID] = time.Now()
 		handler.tempChanMu.Unlock()
 	} else {
-		// Permanent channel: require PermCreateChannel (admin/mod)
-		if errMsg := rbac.RequirePermission(session.Role, model.PermCreateChannel); errMsg != "" {
+		// Permanent channel: require PermCreateChannel (admin/mod), honoring
+		// overrides on the parent when creating below an existing channel
+		if errMsg := rbac.RequireChannelPermission(session.Subject(), s.channelTree(st).Channel(req.ParentID), model.PermCreateChannel); errMsg != "" {
 			sendError(conn, 30, errMsg)
 			return
 		}
@@ -482,6 +757,21 @@ func (s *Server) handleCreateChannel(sessionID uint32, req *pb.CreateChannelRequ
 		ParentID:         req.ParentID,
 		IsTemp:           req.IsTemp,
 		AllowSubChannels: req.AllowSubChannels,
+		Codec:            codec,
+		E2EE:             e2ee,
+		ChatRetention:    retention,
+	}
+	if req.Password != "" {
+		if len(req.Password) > model.MaxChannelPasswordLength {
+			sendError(conn, 31, "channel password too long")
+			return
+		}
+		hash, err := crypto.EncodePassword(req.Password)
+		if err != nil {
+			sendError(conn, 31, "failed to hash channel password")
+			return
+		}
+		ch.PasswordHash = hash
 	}
 	if err := st.CreateChannel(ch); err != nil {
 		sendError(conn, 31, "failed to create channel: "+err.Error())
@@ -501,7 +791,7 @@ func (s *Server) handleDeleteChannel(sessionID uint32, req *pb.DeleteChannelRequ
 		sendError(conn, 3, "session not found")
 		return
 	}
-	if errMsg := rbac.RequirePermission(session.Role, model.PermDeleteChannel); errMsg != "" {
+	if errMsg := rbac.RequireChannelPermission(session.Subject(), s.channelTree(st).Channel(req.ChannelID), model.PermDeleteChannel); errMsg != "" {
 		sendError(conn, 30, errMsg)
 		return
 	}
@@ -517,12 +807,110 @@ func (s *Server) handleDeleteChannel(sessionID uint32, req *pb.DeleteChannelRequ
 		s.channels.Leave(sid)
 		s.sessions.SetChannel(sid, 0)
 	}
+	s.keys.Remove(req.ChannelID)
+	s.chat.forget(req.ChannelID)
 
 	slog.Info("channel deleted", "id", req.ChannelID, "by", session.Username)
 	s.metrics.ChannelsDeleted.Add(1)
 	s.broadcastServerState(st, handler)
 }
 
+func (s *Server) handleEditChannel(sessionID uint32, req *pb.EditChannelRequest, st store.DataStore, conn net.Conn, handler *ControlHandler) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	tree := s.channelTree(st)
+	if errMsg := rbac.RequireChannelPermission(session.Subject(), tree.Channel(req.ChannelID), model.PermEditChannel); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+
+	ch, err := st.GetChannel(req.ChannelID)
+	if err != nil || ch == nil {
+		sendError(conn, 10, "channel not found")
+		return
+	}
+
+	// Moving a channel changes the overrides it inherits, so the new parent
+	// must be editable too (the root needs the role-wide permission)
+	if req.ParentID != ch.ParentID {
+		if errMsg := rbac.RequireChannelPermission(session.Subject(), tree.Channel(req.ParentID), model.PermEditChannel); errMsg != "" {
+			sendError(conn, 30, errMsg)
+			return
+		}
+	}
+
+	// Scoped sessions may only edit inside their subtree and cannot move
+	// channels (or the scope root itself) out of it.
+	if session.ChannelScope != 0 {
+		channels, _ := st.ListChannels()
+		parents := parentsOf(channels)
+		if ch.ID == session.ChannelScope ||
+			!parents.inScope(session.ChannelScope, ch.ID) ||
+			!parents.inScope(session.ChannelScope, req.ParentID) {
+			sendError(conn, 12, "channel is outside your token scope")
+			return
+		}
+	}
+
+	// Members without an identity key could not decrypt after the switch;
+	// refuse it as a join or move would be refused
+	if req.E2EE && !ch.E2EE {
+		for _, sid := range s.channels.Members(ch.ID) {
+			if member, ok := s.sessions.GetSnapshot(sid); ok && len(member.IdentityKey) == 0 {
+				sendError(conn, 14, "a member's client does not support end-to-end encryption")
+				return
+			}
+		}
+	}
+
+	desc := sanitizeText(strings.TrimSpace(req.Description))
+	if len(desc) > 256 {
+		desc = desc[:256]
+	}
+
+	ch.Name = sanitizeText(strings.TrimSpace(req.Name))
+	ch.Description = desc
+	ch.MaxUsers = int(req.MaxUsers)
+	ch.ParentID = req.ParentID
+	ch.AllowSubChannels = req.AllowSubChannels
+	ch.Codec = codecFromPB(req.Codec)
+	rekey := ch.E2EE != req.E2EE
+	ch.E2EE = req.E2EE
+	ch.ChatRetention = chatRetentionFromPB(req.ChatRetention)
+	switch {
+	case req.ClearPassword:
+		ch.PasswordHash = ""
+	case req.Password != "":
+		if len(req.Password) > model.MaxChannelPasswordLength {
+			sendError(conn, 31, "channel password too long")
+			return
+		}
+		hash, err := crypto.EncodePassword(req.Password)
+		if err != nil {
+			sendError(conn, 31, "failed to hash channel password")
+			return
+		}
+		ch.PasswordHash = hash
+	}
+	if err := st.UpdateChannel(ch); err != nil {
+		sendError(conn, 31, "failed to edit channel: "+err.Error())
+		return
+	}
+
+	slog.Info("channel edited", "id", ch.ID, "name", ch.Name, "parent", ch.ParentID, "by", session.Username)
+	s.refreshSpeakPermissions(st) // reparenting changes inherited overrides
+	// Clients refuse a server key for an E2EE channel until the state shows
+	// the switch, so the state goes out before the new key
+	s.broadcastServerState(st, handler)
+	if rekey {
+		// Switch the members to a key of the new kind
+		s.rotateChannelKey(handler, ch.ID)
+	}
+}
+
 func (s *Server) handleCreateToken(sessionID uint32, req *pb.CreateTokenRequest, st store.DataStore, conn net.Conn) {
 	session, ok := s.sessions.GetSnapshot(sessionID)
 	if !ok {
@@ -546,18 +934,110 @@ func (s *Server) handleCreateToken(sessionID uint32, req *pb.CreateTokenRequest,
 	}
 
 	hash := crypto.HashToken(rawToken)
-	role := model.ParseRole(req.Role)
+	role, ok := model.ParseRole(req.Role)
+	if !ok {
+		sendError(conn, 31, "unknown role: "+req.Role)
+		return
+	}
+	if !rbac.CanGrant(session.Role, role) {
+		sendError(conn, 31, "cannot create a token for a role higher than your own")
+		return
+	}
+	label := strings.TrimSpace(req.Label)
 
-	if err := st.CreateToken(hash, role, req.ChannelScope, session.UserID, int(req.MaxUses), expiresAt); err != nil {
+	if err := st.CreateToken(hash, label, role, req.ChannelScope, session.UserID, int(req.MaxUses), expiresAt); err != nil {
 		sendError(conn, 31, "failed to store token: "+err.Error())
 		return
 	}
 
-	slog.Info("token created", "role", role, "by", session.Username)
+	shortID := model.TokenShortID(hash)
+	slog.Info("token created", "id", shortID, "label", label, "role", role, "by", session.Username)
 	s.metrics.TokensCreated.Add(1)
 
 	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
-		CreateTokenResp: &pb.CreateTokenResponse{Token: rawToken},
+		CreateTokenResp: &pb.CreateTokenResponse{Token: rawToken, ShortID: shortID},
+	})
+}
+
+func (s *Server) handleListTokens(sessionID uint32, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermManageTokens); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+
+	s.sendTokenList(st, conn)
+}
+
+func (s *Server) handleRevokeToken(sessionID uint32, req *pb.RevokeTokenRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermManageTokens); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+
+	if err := st.RevokeToken(req.TokenID); err != nil {
+		sendError(conn, 31, "failed to revoke token: "+err.Error())
+		return
+	}
+
+	slog.Info("token revoked", "id", req.TokenID, "by", session.Username)
+	s.sendTokenList(st, conn)
+}
+
+// sendTokenList sends the full token list to a single connection.
+// Only metadata is exposed; token hashes never leave the server.
+func (s *Server) sendTokenList(st store.DataStore, conn net.Conn) {
+	tokens, err := st.ListTokens()
+	if err != nil {
+		sendError(conn, 31, "failed to list tokens: "+err.Error())
+		return
+	}
+
+	names := make(map[int64]string)
+	infos := make([]pb.TokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		name, ok := names[t.CreatedBy]
+		if !ok {
+			name = "server"
+			if t.CreatedBy != 0 {
+				if u, err := st.GetUserByID(t.CreatedBy); err == nil && u != nil {
+					name = u.Username
+				}
+			}
+			names[t.CreatedBy] = name
+		}
+		info := pb.TokenInfo{
+			ID:            t.ID,
+			ShortID:       t.ShortID,
+			Label:         t.Label,
+			Role:          t.Role.String(),
+			ChannelScope:  t.ChannelScope,
+			CreatedBy:     t.CreatedBy,
+			CreatedByName: name,
+			MaxUses:       int32(t.MaxUses),  //nolint:gosec // set from an int32 in CreateTokenRequest
+			UseCount:      int32(t.UseCount), //nolint:gosec // one per login; cannot reach 2^31 in practice
+			CreatedAt:     t.CreatedAt.Unix(),
+		}
+		if !t.ExpiresAt.IsZero() {
+			info.ExpiresAt = t.ExpiresAt.Unix()
+		}
+		if t.IsRevoked() {
+			info.RevokedAt = t.RevokedAt.Unix()
+		}
+		infos = append(infos, info)
+	}
+
+	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
+		ListTokensResp: &pb.ListTokensResponse{Tokens: infos},
 	})
 }
 
@@ -587,6 +1067,7 @@ func (s *Server) handleKickUser(handler *ControlHandler, sessionID uint32, req *
 	handler.mu.RLock()
 	targetConn, ok := handler.connMap[target.ID]
 	handler.mu.RUnlock()
+	s.resumes.Revoke(target.ID)
 	if ok {
 		sendError(targetConn, 99, "you have been kicked: "+reason)
 		_ = targetConn.Close()
@@ -596,67 +1077,644 @@ func (s *Server) handleKickUser(handler *ControlHandler, sessionID uint32, req *
 	s.metrics.KickCount.Add(1)
 }
 
-func (s *Server) handleBanUser(handler *ControlHandler, sessionID uint32, req *pb.BanUserRequest, st store.DataStore, conn net.Conn) {
+// maxWhisperEntries bounds the users plus channels named in one whisper target.
+const maxWhisperEntries = 32
+
+func (s *Server) handleWhisperTarget(handler *ControlHandler, sessionID uint32, req *pb.WhisperTargetRequest, st store.DataStore, conn net.Conn) {
 	session, ok := s.sessions.GetSnapshot(sessionID)
 	if !ok {
 		sendError(conn, 3, "session not found")
 		return
 	}
-	if errMsg := rbac.RequirePermission(session.Role, model.PermBanUser); errMsg != "" {
-		sendError(conn, 30, errMsg)
+	if req.TargetID == protocol.TargetChannel || req.TargetID > protocol.MaxWhisperTarget {
+		sendError(conn, 31, fmt.Sprintf("whisper target id must be between 1 and %d", protocol.MaxWhisperTarget))
 		return
 	}
+	targetID := uint8(req.TargetID) //nolint:gosec // bounds-checked above
 
-	reason := sanitizeText(strings.TrimSpace(req.Reason))
-	if len(reason) > 256 {
-		reason = reason[:256]
+	if len(req.UserIDs) == 0 && len(req.ChannelIDs) == 0 {
+		s.whispers.Clear(session.ID, targetID)
+		s.syncWhisperKeys(handler)
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermWhisper); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+	if len(req.UserIDs)+len(req.ChannelIDs) > maxWhisperEntries {
+		sendError(conn, 31, fmt.Sprintf("whisper target may name at most %d users and channels", maxWhisperEntries))
+		return
 	}
 
-	var expiresAt time.Time
-	if req.DurationSeconds > 0 {
-		expiresAt = time.Now().Add(time.Duration(req.DurationSeconds) * time.Second)
+	target := WhisperTarget{
+		UserIDs:    make(map[int64]bool, len(req.UserIDs)),
+		ChannelIDs: make(map[int64]bool, len(req.ChannelIDs)),
 	}
 
-	if err := st.CreateBan(req.UserID, "", reason, session.UserID, expiresAt); err != nil {
-		sendError(conn, 31, "failed to create ban")
+	// Scoped sessions must not reach users outside their channel tree
+	if len(req.UserIDs) > 0 && session.ChannelScope != 0 {
+		sendError(conn, 12, "whispering to users is not available with a scoped token")
 		return
 	}
+	for _, userID := range req.UserIDs {
+		if u, err := st.GetUserByID(userID); err != nil || u == nil {
+			sendError(conn, 31, "user not found")
+			return
+		}
+		target.UserIDs[userID] = true
+	}
 
-	// Also kick them if online
-	if target, ok := s.sessions.GetByUserIDSnapshot(req.UserID); ok {
-		handler.mu.RLock()
-		targetConn, ok := handler.connMap[target.ID]
-		handler.mu.RUnlock()
-		if ok {
-			sendError(targetConn, 99, "you have been banned: "+reason)
-			_ = targetConn.Close()
+	channels, err := st.ListChannels()
+	if err != nil {
+		sendError(conn, 31, "failed to list channels")
+		return
+	}
+	parents := parentsOf(channels)
+	tree := s.channelTree(st)
+	denied := func(ch *model.Channel) (int32, string) {
+		return s.whisperDenied(session, ch, parents, tree)
+	}
+	for _, channelID := range req.ChannelIDs {
+		var ch *model.Channel
+		for i := range channels {
+			if channels[i].ID == channelID {
+				ch = &channels[i]
+				break
+			}
+		}
+		if ch == nil {
+			sendError(conn, 10, "channel not found")
+			return
+		}
+		if code, errMsg := denied(ch); code != 0 {
+			sendError(conn, code, errMsg)
+			return
+		}
+		target.ChannelIDs[channelID] = true
+	}
+
+	// Expand sub-channels now; ones created later need a new registration.
+	// Sub-channels the session may not whisper into are skipped rather than
+	// failing the request.
+	if req.IncludeSubChannels {
+		for _, ch := range channels {
+			if code, _ := denied(&ch); !target.ChannelIDs[ch.ID] && code == 0 {
+				for _, root := range req.ChannelIDs {
+					if parents.inScope(root, ch.ID) {
+						target.ChannelIDs[ch.ID] = true
+						break
+					}
+				}
+			}
 		}
 	}
 
-	slog.Info("user banned", "user_id", req.UserID, "by", session.Username)
-	s.metrics.BanCount.Add(1)
+	s.whispers.Set(session.ID, targetID, target)
+	slog.Debug("whisper target set", "session", session.ID, "target", targetID,
+		"users", len(target.UserIDs), "channels", len(target.ChannelIDs))
+	s.syncWhisperKeys(handler)
 }
 
-// channelUsers returns UserInfo for all sessions in a channel.
+// whisperDenied mirrors handleJoinChannel: whispering into a channel needs
+// the right to join it, and its password unless the session is already
+// inside or may bypass it. It returns the error code and message, or 0.
+func (s *Server) whisperDenied(session SessionSnapshot, ch *model.Channel, parents channelParents, tree *rbac.ChannelTree) (int32, string) {
+	if !parents.inScope(session.ChannelScope, ch.ID) {
+		return 12, "channel is outside your token scope"
+	}
+	for _, perm := range []model.Permission{model.PermWhisper, model.PermJoinChannel} {
+		if errMsg := rbac.RequireChannelPermission(session.Subject(), tree.Channel(ch.ID), perm); errMsg != "" {
+			return 30, errMsg
+		}
+	}
+	if ch.HasPassword() && ch.ID != s.channels.ChannelOf(session.ID) && session.Role != model.RoleAdmin && session.ChannelScope == 0 {
+		return 13, "channel password required"
+	}
+	return 0, ""
+}
+
+// refreshWhisperTargets re-runs the registration checks of every whisper
+// target, so leaving a password-protected channel, a new password or
+// override, or a role change takes effect on targets registered before.
+// Channels that fail are dropped from the target; sessions that lost the
+// whisper permission lose all their targets.
+func (s *Server) refreshWhisperTargets(st store.DataStore) {
+	if !s.whispers.Any() {
+		return
+	}
+	channels, err := st.ListChannels()
+	if err != nil {
+		slog.Error("whisper target refresh failed", "err", err)
+		return
+	}
+	byID := make(map[int64]*model.Channel, len(channels))
+	for i := range channels {
+		byID[channels[i].ID] = &channels[i]
+	}
+	parents := parentsOf(channels)
+	tree := s.channelTree(st)
+
+	s.whispers.Prune(func(sessionID uint32) bool {
+		session, ok := s.sessions.GetSnapshot(sessionID)
+		return ok && rbac.RequirePermission(session.Role, model.PermWhisper) == ""
+	}, func(sessionID uint32, channelID int64) bool {
+		session, ok := s.sessions.GetSnapshot(sessionID)
+		ch := byID[channelID]
+		if !ok || ch == nil {
+			return false
+		}
+		code, _ := s.whisperDenied(session, ch, parents, tree)
+		return code == 0
+	})
+}
+
+// moderationTarget looks up an online user for a moderator action. Users
+// whose role outranks the moderator's cannot be targeted.
+func (s *Server) moderationTarget(session SessionSnapshot, userID int64, conn net.Conn) (SessionSnapshot, bool) {
+	target, ok := s.sessions.GetByUserIDSnapshot(userID)
+	if !ok {
+		sendError(conn, 32, "user not online")
+		return target, false
+	}
+	if target.Role.Priority() > session.Role.Priority() {
+		sendError(conn, 30, "permission denied: target has a higher role")
+		return target, false
+	}
+	return target, true
+}
+
+func (s *Server) handleServerMute(handler *ControlHandler, sessionID uint32, req *pb.ServerMuteRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermMuteUser); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+	target, ok := s.moderationTarget(session, req.UserID, conn)
+	if !ok {
+		return
+	}
+
+	s.sessions.SetServerMute(target.ID, req.Muted, req.Deafened)
+	slog.Info("user server-muted", "target", target.Username, "muted", req.Muted, "deafened", req.Deafened, "by", session.Username)
+	s.broadcastServerState(st, handler)
+}
+
+func (s *Server) handlePrioritySpeaker(handler *ControlHandler, sessionID uint32, req *pb.PrioritySpeakerRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermPrioritySpeaker); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+	target, ok := s.moderationTarget(session, req.UserID, conn)
+	if !ok {
+		return
+	}
+	if s.channels.ChannelOf(target.ID) == 0 {
+		sendError(conn, 31, "user is not in a channel")
+		return
+	}
+
+	s.sessions.SetPrioritySpeaker(target.ID, req.Enabled)
+	slog.Info("priority speaker changed", "target", target.Username, "enabled", req.Enabled, "by", session.Username)
+	s.broadcastServerState(st, handler)
+}
+
+func (s *Server) handleMoveUser(handler *ControlHandler, sessionID uint32, req *pb.MoveUserRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermMoveUser); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+	target, ok := s.moderationTarget(session, req.UserID, conn)
+	if !ok {
+		return
+	}
+	ch, err := st.GetChannel(req.ChannelID)
+	if err != nil || ch == nil {
+		sendError(conn, 10, "channel not found")
+		return
+	}
+	if s.channels.ChannelOf(target.ID) == ch.ID {
+		return // already there
+	}
+
+	// Both the moderator and the target must be allowed into the channel's
+	// part of the tree; passwords and join overrides are bypassed.
+	channels, _ := st.ListChannels()
+	parents := parentsOf(channels)
+	if !parents.inScope(session.ChannelScope, ch.ID) || !parents.inScope(target.ChannelScope, ch.ID) {
+		sendError(conn, 12, "channel is outside the token scope")
+		return
+	}
+	if ch.MaxUsers > 0 && s.channels.MembersCount(ch.ID) >= ch.MaxUsers {
+		sendError(conn, 11, "channel is full")
+		return
+	}
+	if ch.E2EE && len(target.IdentityKey) == 0 {
+		sendError(conn, 14, "user's client does not support end-to-end encryption")
+		return
+	}
+
+	handler.mu.RLock()
+	targetConn, ok := handler.connMap[target.ID]
+	handler.mu.RUnlock()
+	if !ok {
+		sendError(conn, 32, "user not online")
+		return
+	}
+
+	prevCh := s.channels.ChannelOf(target.ID)
+	s.joinChannel(handler, target, ch, s.channelTree(st), st, targetConn)
+
+	// The joined event is not echoed to its subject, so tell the moved
+	// client explicitly which channel it is in now.
+	_ = protocol.WriteControlMessage(targetConn, &pb.ControlMessage{
+		ChannelJoinedEvent: &pb.ChannelJoinedEvent{ChannelID: ch.ID, User: userInfo(target)},
+	})
+	if prevCh > 0 {
+		s.cleanupTempChannel(prevCh, st)
+	}
+
+	slog.Info("user moved", "target", target.Username, "channel", ch.ID, "by", session.Username)
+}
+
+func (s *Server) handleBanUser(handler *ControlHandler, sessionID uint32, req *pb.BanUserRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermBanUser); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+
+	reason := sanitizeText(strings.TrimSpace(req.Reason))
+	if len(reason) > 256 {
+		reason = reason[:256]
+	}
+
+	var expiresAt time.Time
+	if req.DurationSeconds > 0 {
+		expiresAt = time.Now().Add(time.Duration(req.DurationSeconds) * time.Second)
+	}
+
+	ip, err := model.NormalizeBanIP(req.IP)
+	if err != nil {
+		sendError(conn, 31, err.Error())
+		return
+	}
+
+	// Resolve the target's live connection (if online) for kicking and address bans
+	victims := make(map[uint32]net.Conn)
+	if target, ok := s.sessions.GetByUserIDSnapshot(req.UserID); ok && req.UserID != 0 {
+		handler.mu.RLock()
+		if targetConn, ok := handler.connMap[target.ID]; ok {
+			victims[target.ID] = targetConn
+			if ip == "" && req.BanIP {
+				ip = remoteIP(targetConn.RemoteAddr())
+			}
+		}
+		handler.mu.RUnlock()
+	}
+	if req.UserID == 0 && ip == "" {
+		sendError(conn, 31, "ban requires a user or an IP address")
+		return
+	}
+	ban := model.Ban{IP: ip}
+	if ban.MatchesIP(net.ParseIP(remoteIP(conn.RemoteAddr()))) {
+		sendError(conn, 31, "ban would cover your own address")
+		return
+	}
+
+	if err := st.CreateBan(req.UserID, ip, reason, session.UserID, expiresAt); err != nil {
+		sendError(conn, 31, "failed to create ban")
+		return
+	}
+
+	// Kick the target and everyone else connected from a banned address
+	if ip != "" {
+		handler.mu.RLock()
+		for sid, c := range handler.connMap {
+			if ban.MatchesIP(net.ParseIP(remoteIP(c.RemoteAddr()))) {
+				victims[sid] = c
+			}
+		}
+		handler.mu.RUnlock()
+	}
+	for sid, c := range victims {
+		s.resumes.Revoke(sid)
+		sendError(c, 99, "you have been banned: "+reason)
+		_ = c.Close()
+	}
+
+	slog.Info("ban created", "user_id", req.UserID, "ip", ip, "by", session.Username)
+	s.metrics.BanCount.Add(1)
+}
+
+func (s *Server) handleListBans(sessionID uint32, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermBanUser); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+
+	s.sendBanList(st, conn)
+}
+
+func (s *Server) handleUnban(sessionID uint32, req *pb.UnbanRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermBanUser); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+
+	if err := st.Unban(req.BanID); err != nil {
+		sendError(conn, 31, "failed to lift ban: "+err.Error())
+		return
+	}
+
+	slog.Info("ban lifted", "id", req.BanID, "by", session.Username)
+	s.sendBanList(st, conn)
+}
+
+// sendBanList sends all active bans to a single connection.
+func (s *Server) sendBanList(st store.DataStore, conn net.Conn) {
+	bans, err := st.ListBans()
+	if err != nil {
+		sendError(conn, 31, "failed to list bans: "+err.Error())
+		return
+	}
+
+	names := make(map[int64]string)
+	username := func(id int64) string {
+		if id == 0 {
+			return ""
+		}
+		name, ok := names[id]
+		if !ok {
+			if u, err := st.GetUserByID(id); err == nil && u != nil {
+				name = u.Username
+			}
+			names[id] = name
+		}
+		return name
+	}
+
+	infos := make([]pb.BanInfo, 0, len(bans))
+	for _, b := range bans {
+		info := pb.BanInfo{
+			ID:           b.ID,
+			UserID:       b.UserID,
+			Username:     username(b.UserID),
+			IP:           b.IP,
+			Reason:       b.Reason,
+			BannedBy:     b.BannedBy,
+			BannedByName: username(b.BannedBy),
+			CreatedAt:    b.CreatedAt.Unix(),
+		}
+		if !b.ExpiresAt.IsZero() {
+			info.ExpiresAt = b.ExpiresAt.Unix()
+		}
+		infos = append(infos, info)
+	}
+
+	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
+		ListBansResp: &pb.ListBansResponse{Bans: infos},
+	})
+}
+
+// authorizeChannelACL checks that the session may manage the ACL of a channel:
+// it must exist, be within the session's scope and grant PermEditChannel.
+func (s *Server) authorizeChannelACL(sessionID uint32, channelID int64, st store.DataStore, conn net.Conn) (SessionSnapshot, bool) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return session, false
+	}
+	channels, err := st.ListChannels()
+	if err != nil {
+		sendError(conn, 31, "failed to list channels")
+		return session, false
+	}
+	found := false
+	for _, ch := range channels {
+		if ch.ID == channelID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		sendError(conn, 10, "channel not found")
+		return session, false
+	}
+	if !parentsOf(channels).inScope(session.ChannelScope, channelID) {
+		sendError(conn, 12, "channel is outside your token's scope")
+		return session, false
+	}
+	if errMsg := rbac.RequireChannelPermission(session.Subject(), s.channelTree(st).Channel(channelID), model.PermEditChannel); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return session, false
+	}
+	return session, true
+}
+
+func (s *Server) handleListChannelACL(sessionID uint32, channelID int64, st store.DataStore, conn net.Conn) {
+	if _, ok := s.authorizeChannelACL(sessionID, channelID, st, conn); !ok {
+		return
+	}
+	s.sendChannelACL(channelID, st, conn)
+}
+
+func (s *Server) handleSetChannelACL(sessionID uint32, req *pb.SetChannelACLRequest, st store.DataStore, conn net.Conn, handler *ControlHandler) {
+	session, ok := s.authorizeChannelACL(sessionID, req.ChannelID, st, conn)
+	if !ok {
+		return
+	}
+
+	perm, ok := model.ParsePermission(req.Permission)
+	if !ok {
+		sendError(conn, 31, "unknown permission: "+req.Permission)
+		return
+	}
+	entry := &model.ChannelACL{ChannelID: req.ChannelID, UserID: req.UserID, Permission: perm, Allow: req.Allow}
+	if req.UserID != 0 {
+		u, err := st.GetUserByID(req.UserID)
+		if err != nil || u == nil {
+			sendError(conn, 31, "user not found")
+			return
+		}
+	} else {
+		role, ok := model.ParseRole(req.Role)
+		if !ok || req.Role == "" {
+			sendError(conn, 31, "unknown role: "+req.Role)
+			return
+		}
+		entry.Role = role
+	}
+
+	if err := st.SetChannelACL(entry); err != nil {
+		sendError(conn, 31, "failed to set channel permission: "+err.Error())
+		return
+	}
+
+	slog.Info("channel acl set", "channel", req.ChannelID, "user", req.UserID, "role", req.Role,
+		"permission", perm, "allow", req.Allow, "by", session.Username)
+	s.refreshSpeakPermissions(st)
+	s.refreshWhisperTargets(st)
+	s.syncWhisperKeys(handler)
+	s.sendChannelACL(req.ChannelID, st, conn)
+}
+
+func (s *Server) handleDeleteChannelACL(sessionID uint32, req *pb.DeleteChannelACLRequest, st store.DataStore, conn net.Conn, handler *ControlHandler) {
+	acls, err := st.ListChannelACLs()
+	if err != nil {
+		sendError(conn, 31, "failed to list channel permissions")
+		return
+	}
+	var channelID int64
+	for _, acl := range acls {
+		if acl.ID == req.EntryID {
+			channelID = acl.ChannelID
+			break
+		}
+	}
+	if channelID == 0 {
+		sendError(conn, 31, "channel permission entry not found")
+		return
+	}
+	session, ok := s.authorizeChannelACL(sessionID, channelID, st, conn)
+	if !ok {
+		return
+	}
+
+	if err := st.DeleteChannelACL(req.EntryID); err != nil {
+		sendError(conn, 31, "failed to delete channel permission: "+err.Error())
+		return
+	}
+
+	slog.Info("channel acl deleted", "id", req.EntryID, "channel", channelID, "by", session.Username)
+	s.refreshSpeakPermissions(st)
+	s.refreshWhisperTargets(st)
+	s.syncWhisperKeys(handler)
+	s.sendChannelACL(channelID, st, conn)
+}
+
+// sendChannelACL sends the overrides defined directly on a channel to a single connection.
+func (s *Server) sendChannelACL(channelID int64, st store.DataStore, conn net.Conn) {
+	acls, err := st.ListChannelACLs()
+	if err != nil {
+		sendError(conn, 31, "failed to list channel permissions: "+err.Error())
+		return
+	}
+
+	entries := make([]pb.ChannelACLEntry, 0)
+	for _, acl := range acls {
+		if acl.ChannelID != channelID {
+			continue
+		}
+		entry := pb.ChannelACLEntry{
+			ID:         acl.ID,
+			ChannelID:  acl.ChannelID,
+			UserID:     acl.UserID,
+			Permission: acl.Permission.String(),
+			Allow:      acl.Allow,
+		}
+		if acl.IsUserEntry() {
+			if u, err := st.GetUserByID(acl.UserID); err == nil && u != nil {
+				entry.Username = u.Username
+			}
+		} else {
+			entry.Role = acl.Role.String()
+		}
+		entries = append(entries, entry)
+	}
+
+	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
+		ListChannelACLResp: &pb.ListChannelACLResponse{ChannelID: channelID, Entries: entries},
+	})
+}
+
+// channelTree loads the channel hierarchy together with all ACL overrides.
+// On store errors the tree is built from whatever could be read, so checks
+// degrade to the global role matrix rather than failing.
+func (s *Server) channelTree(st store.DataStore) *rbac.ChannelTree {
+	channels, err := st.ListChannels()
+	if err != nil {
+		slog.Error("failed to list channels for acl check", "err", err)
+	}
+	acls, err := st.ListChannelACLs()
+	if err != nil {
+		slog.Error("failed to list channel acls", "err", err)
+	}
+	return rbac.NewChannelTree(channels, acls)
+}
+
+// refreshSpeakPermissions re-evaluates PermSpeak for every session in a
+// channel. It runs after anything that can change the outcome: ACL edits,
+// role changes and channel reparenting.
+func (s *Server) refreshSpeakPermissions(st store.DataStore) {
+	tree := s.channelTree(st)
+	for _, snap := range s.sessions.Snapshots() {
+		if snap.ChannelID == 0 {
+			continue
+		}
+		denied := !rbac.Check(snap.Subject(), tree.Channel(snap.ChannelID), model.PermSpeak)
+		if denied != snap.SpeakDenied {
+			s.sessions.SetSpeakDenied(snap.ID, denied)
+		}
+	}
+}
+
+// userInfo converts a session snapshot into its wire representation.
+func userInfo(sess SessionSnapshot) pb.UserInfo {
+	return pb.UserInfo{
+		ID:              sess.UserID,
+		Username:        sess.Username,
+		Role:            sess.Role.String(),
+		Muted:           sess.Muted,
+		Deafened:        sess.Deafened,
+		ServerMuted:     sess.ServerMuted,
+		ServerDeafened:  sess.ServerDeafened,
+		PrioritySpeaker: sess.PrioritySpeaker,
+		SessionID:       sess.ID,
+	}
+}
+
+// channelUsers returns UserInfo for all sessions in a channel.
 func (s *Server) channelUsers(channelID int64) []pb.UserInfo {
 	members := s.channels.Members(channelID)
 	users := make([]pb.UserInfo, 0, len(members))
 	for _, sid := range members {
 		sess, ok := s.sessions.GetSnapshot(sid)
 		if ok {
-			users = append(users, pb.UserInfo{
-				ID:       sess.UserID,
-				Username: sess.Username,
-				Role:     sess.Role.String(),
-				Muted:    sess.Muted,
-				Deafened: sess.Deafened,
-			})
+			users = append(users, userInfo(sess))
 		}
 	}
 	return users
 }
 
-func (s *Server) handleChatMessage(handler *ControlHandler, sessionID uint32, chat *pb.ChatMessage) {
+func (s *Server) handleChatMessage(handler *ControlHandler, sessionID uint32, chat *pb.ChatMessage, st store.DataStore, conn net.Conn) {
 	session, ok := s.sessions.GetSnapshot(sessionID)
 	if !ok {
 		return
@@ -665,6 +1723,14 @@ func (s *Server) handleChatMessage(handler *ControlHandler, sessionID uint32, ch
 	if chID == 0 {
 		return // not in a channel
 	}
+	ch, err := st.GetChannel(chID)
+	if err != nil || ch == nil {
+		return
+	}
+	if errMsg := rbac.RequireChannelPermission(session.Subject(), s.channelTree(st).Channel(chID), model.PermTextChat); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
 
 	// Validate and sanitize message
 	text := sanitizeText(strings.TrimSpace(chat.Text))
@@ -681,6 +1747,7 @@ func (s *Server) handleChatMessage(handler *ControlHandler, sessionID uint32, ch
 			Timestamp:  time.Now().Unix(),
 		},
 	}
+	s.storeChatMessage(st, ch, event.ChatEvent)
 
 	// Broadcast to all channel members including sender (for confirmation)
 	handler.broadcastToChannel(chID, event, 0)
@@ -704,10 +1771,14 @@ func (s *Server) handleSetUserRole(handler *ControlHandler, sessionID uint32, re
 		return
 	}
 
-	newRole := model.ParseRole(req.NewRole)
+	newRole, ok := model.ParseRole(req.NewRole)
+	if !ok || req.NewRole == "" {
+		sendError(conn, 31, "unknown role: "+req.NewRole)
+		return
+	}
 
 	// Prevent escalation: cannot grant a role higher than your own
-	if newRole > session.Role {
+	if !rbac.CanGrant(session.Role, newRole) {
 		sendError(conn, 31, "cannot grant a role higher than your own")
 		return
 	}
@@ -719,6 +1790,7 @@ func (s *Server) handleSetUserRole(handler *ControlHandler, sessionID uint32, re
 	// Update the session if the target user is online
 	if target, ok := s.sessions.GetByUserIDSnapshot(req.TargetUserID); ok {
 		s.sessions.UpdateRole(target.ID, newRole)
+		s.refreshSpeakPermissions(st)
 	}
 
 	slog.Info("user role changed", "target_user", req.TargetUserID, "new_role", newRole, "by", session.Username)
@@ -731,45 +1803,89 @@ func (s *Server) handleSetUserRole(handler *ControlHandler, sessionID uint32, re
 	s.broadcastServerState(st, handler)
 }
 
-// sendServerState sends the full server state to a single connection.
-func (s *Server) sendServerState(st store.DataStore, conn net.Conn) {
-	channels, _ := st.ListChannels()
-	infos := s.buildChannelInfos(channels)
-	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
-		ServerStateEvent: &pb.ServerStateEvent{Channels: infos},
-	})
+// buildChannelInfos converts model channels to protocol channel infos.
+// A non-zero scope hides every channel outside the scoped channel tree and
+// presents the scope root as a top-level channel.
+func (s *Server) buildChannelInfos(channels []model.Channel, scope int64) []pb.ChannelInfo {
+	infos := make([]pb.ChannelInfo, 0, len(channels))
+	parents := parentsOf(channels)
+	for _, ch := range channels {
+		if !parents.inScope(scope, ch.ID) {
+			continue
+		}
+		info := channelInfo(ch, scope)
+		info.Users = s.channelUsers(ch.ID)
+		infos = append(infos, info)
+	}
+	return infos
 }
 
-// broadcastServerState sends updated server state to ALL connected sessions.
-func (s *Server) broadcastServerState(st store.DataStore, handler *ControlHandler) {
-	channels, _ := st.ListChannels()
-	infos := s.buildChannelInfos(channels)
-	msg := &pb.ControlMessage{
-		ServerStateEvent: &pb.ServerStateEvent{Channels: infos},
+// channelInfo converts a channel without its users, as seen from scope.
+func channelInfo(ch model.Channel, scope int64) pb.ChannelInfo {
+	parentID := ch.ParentID
+	if ch.ID == scope {
+		parentID = 0 // parent is hidden from scoped sessions
+	}
+	return pb.ChannelInfo{
+		ID:               ch.ID,
+		Name:             ch.Name,
+		Description:      ch.Description,
+		MaxUsers:         int32(ch.MaxUsers), //nolint:gosec // MaxUsers is bounded by UI/config; overflow impossible in practice
+		ParentID:         parentID,
+		IsTemp:           ch.IsTemp,
+		AllowSubChannels: ch.AllowSubChannels,
+		HasPassword:      ch.HasPassword() && scope == 0, // scoped sessions bypass passwords
+		Codec:            codecToPB(ch.Codec),
+		E2EE:             ch.E2EE,
+		ChatRetention:    chatRetentionToPB(ch.ChatRetention),
 	}
-	handler.mu.RLock()
-	for _, conn := range handler.connMap {
-		_ = protocol.WriteControlMessage(conn, msg)
+}
+
+func codecToPB(c model.CodecSettings) pb.CodecSettings {
+	return pb.CodecSettings{
+		Bitrate:     int32(c.Bitrate), //nolint:gosec // validated to at most 510000
+		FrameMs:     int32(c.FrameMs), //nolint:gosec // validated to at most 60
+		Application: c.Application,
+		Stereo:      c.Stereo,
 	}
-	handler.mu.RUnlock()
 }
 
-// buildChannelInfos converts model channels to protocol channel infos.
-func (s *Server) buildChannelInfos(channels []model.Channel) []pb.ChannelInfo {
-	infos := make([]pb.ChannelInfo, len(channels))
-	for i, ch := range channels {
-		infos[i] = pb.ChannelInfo{
-			ID:               ch.ID,
-			Name:             ch.Name,
-			Description:      ch.Description,
-			MaxUsers:         int32(ch.MaxUsers), //nolint:gosec // MaxUsers is bounded by UI/config; overflow impossible in practice
-			ParentID:         ch.ParentID,
-			IsTemp:           ch.IsTemp,
-			AllowSubChannels: ch.AllowSubChannels,
-			Users:            s.channelUsers(ch.ID),
+func codecFromPB(c pb.CodecSettings) model.CodecSettings {
+	return model.CodecSettings{
+		Bitrate:     int(c.Bitrate),
+		FrameMs:     int(c.FrameMs),
+		Application: c.Application,
+		Stereo:      c.Stereo,
+	}
+}
+
+// channelParents maps each channel to its parent. Build it once per channel
+// list and reuse it for every scope check on that list.
+type channelParents map[int64]int64
+
+// parentsOf indexes the parents of a channel list.
+func parentsOf(channels []model.Channel) channelParents {
+	parents := make(channelParents, len(channels))
+	for _, ch := range channels {
+		parents[ch.ID] = ch.ParentID
+	}
+	return parents
+}
+
+// inScope reports whether channelID is the scope channel or one of its
+// sub-channels. A zero scope allows every channel.
+func (p channelParents) inScope(scope, channelID int64) bool {
+	if scope == 0 {
+		return true
+	}
+	// Walk up the tree; the depth bound guards against parent cycles.
+	for depth := 0; channelID != 0 && depth <= len(p); depth++ {
+		if channelID == scope {
+			return true
 		}
+		channelID = p[channelID]
 	}
-	return infos
+	return false
 }
 
 // cleanupTempChannel schedules a temp channel for deletion after a 5-minute grace period.
@@ -793,10 +1909,47 @@ func (s *Server) cleanupTempChannel(channelID int64, st store.DataStore) {
 			slog.Error("failed to delete empty temp channel", "id", channelID, "err", err)
 			return
 		}
+		s.chat.forget(channelID)
 		slog.Debug("auto-deleted empty temp channel after 5m", "name", ch.Name, "id", channelID)
 	}()
 }
 
+// roleNames lists the built-in and custom role names, lowest priority first.
+func roleNames() []string {
+	names := []string{model.RoleUser.String()}
+	custom := model.CustomRoles()
+	i := 0
+	for ; i < len(custom) && custom[i].Priority <= model.PriorityModerator; i++ {
+		names = append(names, custom[i].Name)
+	}
+	names = append(names, model.RoleModerator.String())
+	for ; i < len(custom); i++ {
+		names = append(names, custom[i].Name)
+	}
+	return append(names, model.RoleAdmin.String())
+}
+
+// remoteIP extracts the IP address of a connection's remote end, or "" if unknown.
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.IPAddr:
+		if a.IP == nil {
+			return ""
+		}
+		return a.IP.String()
+	}
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
 func sendError(conn net.Conn, code int32, message string) {
 	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
 		ErrorResponse: &pb.ErrorResponse{Code: code, Message: message},
@@ -811,6 +1964,17 @@ func isClosedErr(err error) bool {
 		err.Error() == "tls: use of closed connection"
 }
 
+// negotiateEncoding picks the first control encoding the client offers that
+// the server supports, or JSON.
+func negotiateEncoding(offered []string) protocol.Encoding {
+	for _, name := range offered {
+		if enc, ok := protocol.ParseEncoding(name); ok {
+			return enc
+		}
+	}
+	return protocol.EncodingJSON
+}
+
 // isValidUsername checks that a username is 1-32 alphanumeric/underscore/hyphen characters.
 func isValidUsername(name string) bool {
 	return model.ValidateUsername(name) == nil
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/NicolasHaas/gospeak/pkg/model"
+	"github.com/NicolasHaas/gospeak/pkg/protocol"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+	"github.com/NicolasHaas/gospeak/pkg/rbac"
+	"github.com/NicolasHaas/gospeak/pkg/store"
+)
+
+// maxStoredDirectMessages caps the messages waiting for one offline user.
+const maxStoredDirectMessages = 500
+
+// sendToUser sends a control message to every connected session of a user
+// and returns how many there were.
+func (ch *ControlHandler) sendToUser(userID int64, msg *pb.ControlMessage) int {
+	var sessions []uint32
+	for _, sess := range ch.server.sessions.Snapshots() {
+		if sess.UserID == userID {
+			sessions = append(sessions, sess.ID)
+		}
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	sent := 0
+	for _, sid := range sessions {
+		if conn, ok := ch.connMap[sid]; ok {
+			if err := protocol.WriteControlMessage(conn, msg); err != nil {
+				slog.Error("direct message write failed", "session", sid, "err", err)
+			}
+			sent++
+		}
+	}
+	return sent
+}
+
+// handleDirectMessage delivers a private message to all sessions of its
+// recipient, or stores it if they are offline. The sender's sessions get
+// the message back as confirmation.
+func (s *Server) handleDirectMessage(handler *ControlHandler, sessionID uint32, dm *pb.DirectMessage, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	if errMsg := rbac.RequirePermission(session.Role, model.PermTextChat); errMsg != "" {
+		sendError(conn, 30, errMsg)
+		return
+	}
+	// Scoped sessions must not reach users outside their channel tree
+	if session.ChannelScope != 0 {
+		sendError(conn, 12, "direct messages are not available with a scoped token")
+		return
+	}
+	if dm.RecipientID == session.UserID {
+		sendError(conn, 31, "cannot message yourself")
+		return
+	}
+	recipient, err := st.GetUserByID(dm.RecipientID)
+	if err != nil || recipient == nil {
+		sendError(conn, 31, "user not found")
+		return
+	}
+
+	text := sanitizeText(strings.TrimSpace(dm.Text))
+	if len(text) == 0 || len(text) > 2000 {
+		return // empty or too long, silently drop
+	}
+
+	msg := &pb.DirectMessage{
+		SenderID:    session.UserID,
+		SenderName:  session.Username,
+		RecipientID: recipient.ID,
+		Text:        text,
+		Timestamp:   time.Now().Unix(),
+	}
+	if handler.sendToUser(recipient.ID, &pb.ControlMessage{DirectMsgEvent: msg}) == 0 {
+		counts, err := st.CountDirectMessages(recipient.ID)
+		if err != nil {
+			sendError(conn, 31, "failed to store message")
+			return
+		}
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		if total >= maxStoredDirectMessages {
+			sendError(conn, 31, fmt.Sprintf("%s has too many unread messages", recipient.Username))
+			return
+		}
+		stored := &model.DirectMessage{
+			SenderID:    msg.SenderID,
+			SenderName:  msg.SenderName,
+			RecipientID: msg.RecipientID,
+			Text:        msg.Text,
+			CreatedAt:   time.Unix(msg.Timestamp, 0).UTC(),
+		}
+		if err := st.AddDirectMessage(stored); err != nil {
+			slog.Error("store direct message failed", "err", err)
+			sendError(conn, 31, "failed to store message")
+			return
+		}
+		msg.ID = stored.ID
+		msg.Stored = true
+	}
+	handler.sendToUser(session.UserID, &pb.ControlMessage{DirectMsgEvent: msg})
+	s.metrics.ChatMessagesSent.Add(1)
+}
+
+// handleUnreadMessages sends the stored direct messages from one user and
+// removes them.
+func (s *Server) handleUnreadMessages(sessionID uint32, req *pb.UnreadMessagesRequest, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	// WriteControlMessage only queues the response, so the messages are kept
+	// until the client names the last one it received in a later request.
+	if req.Ack > 0 {
+		if err := st.DeleteDirectMessages(session.UserID, req.UserID, req.Ack); err != nil {
+			slog.Error("delete direct messages failed", "err", err)
+		}
+	}
+	msgs, err := st.ListDirectMessages(session.UserID, req.UserID)
+	if err != nil {
+		slog.Error("list direct messages failed", "err", err)
+		sendError(conn, 31, "failed to read messages")
+		return
+	}
+	resp := &pb.UnreadMessagesResponse{UserID: req.UserID, Messages: []pb.DirectMessage{}}
+	for _, m := range msgs {
+		resp.Messages = append(resp.Messages, pb.DirectMessage{
+			ID:          m.ID,
+			SenderID:    m.SenderID,
+			SenderName:  m.SenderName,
+			RecipientID: m.RecipientID,
+			Text:        m.Text,
+			Timestamp:   m.CreatedAt.Unix(),
+			Stored:      true,
+		})
+	}
+	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{UnreadMsgsResp: resp})
+}
+
+// unreadCounts lists the stored direct messages of a user by sender, for
+// the AuthResponse.
+func unreadCounts(st store.DataStore, userID int64) []pb.UnreadCount {
+	counts, err := st.CountDirectMessages(userID)
+	if err != nil {
+		slog.Error("count direct messages failed", "user", userID, "err", err)
+		return nil
+	}
+	var unread []pb.UnreadCount
+	for senderID, n := range counts {
+		name := fmt.Sprintf("#%d", senderID)
+		if u, err := st.GetUserByID(senderID); err == nil && u != nil {
+			name = u.Username
+		}
+		unread = append(unread, pb.UnreadCount{UserID: senderID, Username: name, Count: int32(n)}) //nolint:gosec // at most maxStoredDirectMessages
+	}
+	slices.SortFunc(unread, func(a, b pb.UnreadCount) int { return cmp.Compare(a.UserID, b.UserID) })
+	return unread
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"cmp"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/NicolasHaas/gospeak/pkg/crypto"
+	"github.com/NicolasHaas/gospeak/pkg/protocol"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+)
+
+// identityKeySize is the size of an X25519 public key.
+const identityKeySize = 32
+
+// VoiceKey is one generation of a voice key.
+type VoiceKey struct {
+	Epoch uint32
+	Key   []byte // nil after Remove and in E2EE channels
+	// Leader generates the key of an E2EE channel epoch (session ID).
+	Leader uint32
+}
+
+// whisperKeyID names the key of one whisper target of a session. Whispers
+// cross channels, so they cannot use the key of the sender's channel.
+type whisperKeyID struct {
+	session uint32
+	target  uint8
+}
+
+// whisperKey is the current key of a whisper target and the sessions it
+// was handed to.
+type whisperKey struct {
+	VoiceKey
+	holders map[uint32]bool
+}
+
+// KeyManager owns the voice keys: one per channel plus one per whisper
+// target. Keys are created on first use and replaced by Rotate. Epochs only
+// ever grow, so clients can tell a new key from a stale one. For end-to-end
+// encrypted channels only the epoch and its leader are tracked; the key
+// itself never reaches the server.
+type KeyManager struct {
+	mu       sync.Mutex
+	keys     map[int64]VoiceKey // channelID -> current key
+	whispers map[whisperKeyID]*whisperKey
+
+	// syncMu serializes syncWhisperKeys, so whisper key messages reach
+	// every session in the order they were decided.
+	syncMu sync.Mutex
+}
+
+// NewKeyManager creates a new key manager.
+func NewKeyManager() *KeyManager {
+	return &KeyManager{
+		keys:     make(map[int64]VoiceKey),
+		whispers: make(map[whisperKeyID]*whisperKey),
+	}
+}
+
+// Current returns the key of a channel, creating it if there is none.
+func (km *KeyManager) Current(channelID int64) (VoiceKey, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if k := km.keys[channelID]; k.Key != nil {
+		return k, nil
+	}
+	return km.rotateLocked(channelID)
+}
+
+// Rotate replaces the key of a channel with a fresh one of the next epoch.
+func (km *KeyManager) Rotate(channelID int64) (VoiceKey, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	return km.rotateLocked(channelID)
+}
+
+func (km *KeyManager) rotateLocked(channelID int64) (VoiceKey, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return VoiceKey{}, err
+	}
+	k, ok := km.keys[channelID]
+	if ok {
+		k.Epoch++
+	}
+	k.Key = key
+	k.Leader = 0
+	km.keys[channelID] = k
+	return k, nil
+}
+
+// Advance starts a new epoch of an end-to-end encrypted channel whose key
+// leader generates.
+func (km *KeyManager) Advance(channelID int64, leader uint32) VoiceKey {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	k, ok := km.keys[channelID]
+	if ok {
+		k.Epoch++
+	}
+	k.Key = nil
+	k.Leader = leader
+	km.keys[channelID] = k
+	return k
+}
+
+// Peek returns the current epoch of a channel without creating a key.
+func (km *KeyManager) Peek(channelID int64) (VoiceKey, bool) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	k, ok := km.keys[channelID]
+	return k, ok
+}
+
+// Remove drops the key of a deleted channel. Its epoch is kept, so a key
+// created later under the same ID is still newer than any handed out.
+func (km *KeyManager) Remove(channelID int64) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	if k, ok := km.keys[channelID]; ok {
+		k.Key = nil
+		k.Leader = 0
+		km.keys[channelID] = k
+	}
+}
+
+// syncWhisper makes holders the sessions that hold the key of a whisper
+// target. If a session that held the key is no longer among them, the key is
+// replaced and send lists every holder; otherwise send lists only those
+// that do not have the key yet. revoke lists the sessions that lost it.
+func (km *KeyManager) syncWhisper(id whisperKeyID, holders map[uint32]bool) (k VoiceKey, send, revoke []uint32, err error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	wk, ok := km.whispers[id]
+	if !ok {
+		wk = &whisperKey{}
+	}
+	for sid := range wk.holders {
+		if !holders[sid] {
+			revoke = append(revoke, sid)
+		}
+	}
+	if wk.Key == nil || len(revoke) > 0 {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return VoiceKey{}, nil, nil, err
+		}
+		if wk.Key != nil {
+			wk.Epoch++
+		}
+		wk.Key = key
+		wk.holders = nil
+	}
+	for sid := range holders {
+		if !wk.holders[sid] {
+			send = append(send, sid)
+		}
+	}
+	wk.holders = holders
+	km.whispers[id] = wk
+	return wk.VoiceKey, send, revoke, nil
+}
+
+// pruneWhispers drops the keys of whisper targets that keep rejects and
+// returns the sessions that held them.
+func (km *KeyManager) pruneWhispers(keep func(whisperKeyID) bool) map[whisperKeyID][]uint32 {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	pruned := make(map[whisperKeyID][]uint32)
+	for id, wk := range km.whispers {
+		if keep(id) {
+			continue
+		}
+		delete(km.whispers, id)
+		for sid := range wk.holders {
+			pruned[id] = append(pruned[id], sid)
+		}
+	}
+	return pruned
+}
+
+func voiceKeyMessage(channelID int64, k VoiceKey) *pb.ControlMessage {
+	return &pb.ControlMessage{
+		VoiceKeyEvent: &pb.VoiceKeyEvent{ChannelID: channelID, Epoch: k.Epoch, Key: k.Key},
+	}
+}
+
+// sendVoiceKey sends the current key of a channel to one connection.
+func (s *Server) sendVoiceKey(conn net.Conn, channelID int64) {
+	k, err := s.keys.Current(channelID)
+	if err != nil {
+		slog.Error("voice key generation failed", "channel", channelID, "err", err)
+		return
+	}
+	_ = protocol.WriteControlMessage(conn, voiceKeyMessage(channelID, k))
+}
+
+// deliverChannelKey gives a session that just joined a channel its key. An
+// E2EE channel gets a new epoch instead, so the members share a key with
+// the newcomer but not with anyone who left.
+func (s *Server) deliverChannelKey(handler *ControlHandler, conn net.Conn, channelID int64) {
+	if ch, err := handler.store.GetChannel(channelID); err == nil && ch != nil && ch.E2EE {
+		s.rekeyE2EE(handler, channelID)
+		return
+	}
+	s.sendVoiceKey(conn, channelID)
+}
+
+// rotateChannelKey replaces the key of a channel after a member left and
+// hands the new key to the remaining members, so the one who left cannot
+// decrypt the channel any longer.
+func (s *Server) rotateChannelKey(handler *ControlHandler, channelID int64) {
+	if ch, err := handler.store.GetChannel(channelID); err == nil && ch != nil && ch.E2EE {
+		s.rekeyE2EE(handler, channelID)
+		return
+	}
+	k, err := s.keys.Rotate(channelID)
+	if err != nil {
+		slog.Error("voice key rotation failed", "channel", channelID, "err", err)
+		return
+	}
+	handler.broadcastToChannel(channelID, voiceKeyMessage(channelID, k), 0)
+}
+
+// rekeyE2EE starts a new epoch of an end-to-end encrypted channel. Every
+// member learns who holds the key; the member with the lowest session ID
+// generates it and sends it to the others in a GroupKeyMessage. Sessions
+// parked for resume are left out; they get a new epoch when they resume.
+func (s *Server) rekeyE2EE(handler *ControlHandler, channelID int64) {
+	var members []pb.GroupMember
+	for _, sid := range s.channels.Members(channelID) {
+		handler.mu.RLock()
+		_, connected := handler.connMap[sid]
+		handler.mu.RUnlock()
+		sess, ok := s.sessions.GetSnapshot(sid)
+		if !ok || !connected || len(sess.IdentityKey) == 0 {
+			continue
+		}
+		members = append(members, pb.GroupMember{SessionID: sid, Username: sess.Username, IdentityKey: sess.IdentityKey})
+	}
+	slices.SortFunc(members, func(a, b pb.GroupMember) int { return cmp.Compare(a.SessionID, b.SessionID) })
+
+	var leader uint32
+	if len(members) > 0 {
+		leader = members[0].SessionID
+	}
+	k := s.keys.Advance(channelID, leader)
+	handler.broadcastToChannel(channelID, &pb.ControlMessage{
+		VoiceKeyEvent: &pb.VoiceKeyEvent{ChannelID: channelID, Epoch: k.Epoch, Leader: leader, Members: members},
+	}, 0)
+}
+
+// handleGroupKey relays an E2EE channel key from the epoch leader to the
+// members it was wrapped for. The wrapped keys are opaque to the server.
+func (s *Server) handleGroupKey(handler *ControlHandler, sessionID uint32, msg *pb.GroupKeyMessage) {
+	k, ok := s.keys.Peek(msg.ChannelID)
+	if !ok || k.Key != nil || k.Leader != sessionID || k.Epoch != msg.Epoch ||
+		s.channels.ChannelOf(sessionID) != msg.ChannelID {
+		return // superseded by a newer epoch, or not the leader's to send
+	}
+
+	handler.mu.RLock()
+	defer handler.mu.RUnlock()
+	for _, wk := range msg.Keys {
+		if wk.SessionID == sessionID || s.channels.ChannelOf(wk.SessionID) != msg.ChannelID {
+			continue
+		}
+		if conn, ok := handler.connMap[wk.SessionID]; ok {
+			_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
+				GroupKeyMsg: &pb.GroupKeyMessage{
+					ChannelID: msg.ChannelID,
+					Epoch:     msg.Epoch,
+					Sender:    sessionID,
+					Keys:      []pb.WrappedKey{wk},
+				},
+			})
+		}
+	}
+}
+
+// syncWhisperKeys hands the key of every whisper target to its sender and
+// the sessions it currently reaches, and to nobody else. It runs whenever
+// channel membership, the online sessions or the whisper targets change. A
+// session that is no longer reached makes the key rotate, so it cannot
+// decrypt later whispers, and is told to forget the old key.
+func (s *Server) syncWhisperKeys(handler *ControlHandler) {
+	s.keys.syncMu.Lock()
+	defer s.keys.syncMu.Unlock()
+
+	handler.mu.RLock()
+	defer handler.mu.RUnlock()
+	send := func(sids []uint32, msg *pb.ControlMessage) {
+		for _, sid := range sids {
+			if conn, ok := handler.connMap[sid]; ok {
+				_ = protocol.WriteControlMessage(conn, msg)
+			}
+		}
+	}
+	forget := func(id whisperKeyID) *pb.ControlMessage {
+		return &pb.ControlMessage{
+			VoiceKeyEvent: &pb.VoiceKeyEvent{Sender: id.session, Target: uint32(id.target)},
+		}
+	}
+
+	registered := make(map[whisperKeyID]bool)
+	for sessionID, targets := range s.whispers.All() {
+		for targetID, target := range targets {
+			id := whisperKeyID{session: sessionID, target: targetID}
+			registered[id] = true
+
+			// Sessions parked for resume get the key under their new ID
+			holders := make(map[uint32]bool)
+			for _, sid := range append(s.whisperRecipients(target), sessionID) {
+				if _, connected := handler.connMap[sid]; connected {
+					holders[sid] = true
+				}
+			}
+			k, to, revoke, err := s.keys.syncWhisper(id, holders)
+			if err != nil {
+				slog.Error("whisper key generation failed", "session", sessionID, "target", targetID, "err", err)
+				continue
+			}
+			send(to, &pb.ControlMessage{
+				VoiceKeyEvent: &pb.VoiceKeyEvent{Sender: sessionID, Target: uint32(targetID), Epoch: k.Epoch, Key: k.Key},
+			})
+			send(revoke, forget(id))
+		}
+	}
+	for id, holders := range s.keys.pruneWhispers(func(id whisperKeyID) bool { return registered[id] }) {
+		send(holders, forget(id))
+	}
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"encoding/json"
 	"log/slog"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -37,6 +38,12 @@ type Metrics struct {
 	TokensCreated atomic.Int64 // invite tokens created
 	KickCount     atomic.Int64 // users kicked
 	BanCount      atomic.Int64 // users banned
+
+	// Control plane send queues
+	SendQueueDrops     atomic.Int64 // control messages dropped because a send queue was full
+	SendQueueOverflows atomic.Int64 // clients disconnected because their send queue was full
+
+	sendQueues sync.Map // session ID -> *sendQueue, for per-session metrics
 }
 
 // NewMetrics creates a new Metrics instance with the start time set to now.
@@ -71,6 +78,9 @@ type MetricsSnapshot struct {
 	TokensCreated int64 `json:"tokens_created"`
 	KickCount     int64 `json:"kick_count"`
 	BanCount      int64 `json:"ban_count"`
+
+	SendQueueDrops     int64 `json:"send_queue_drops"`
+	SendQueueOverflows int64 `json:"send_queue_overflows"`
 }
 
 // Snapshot returns a read-consistent snapshot of all metrics.
@@ -95,6 +105,8 @@ func (m *Metrics) Snapshot() MetricsSnapshot {
 		TokensCreated:       m.TokensCreated.Load(),
 		KickCount:           m.KickCount.Load(),
 		BanCount:            m.BanCount.Load(),
+		SendQueueDrops:      m.SendQueueDrops.Load(),
+		SendQueueOverflows:  m.SendQueueOverflows.Load(),
 	}
 }
 
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"cmp"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
 	"time"
 )
 
@@ -103,4 +105,40 @@ func (s *Server) handleMetrics(w http.ResponseWriter, _ *http.Request) {
 		m.KickCount.Load())
 	write("gospeak_bans_total", "Users banned.", "counter",
 		m.BanCount.Load())
+
+	write("gospeak_send_queue_drops_total", "Control messages dropped because a send queue was full.", "counter",
+		m.SendQueueDrops.Load())
+	write("gospeak_send_queue_overflows_total", "Clients disconnected because their send queue was full.", "counter",
+		m.SendQueueOverflows.Load())
+
+	// Per-session send queues, labelled with session ID and username
+	var queues []*sendQueue
+	m.sendQueues.Range(func(_, v any) bool {
+		queues = append(queues, v.(*sendQueue))
+		return true
+	})
+	slices.SortFunc(queues, func(a, b *sendQueue) int { return cmp.Compare(a.session, b.session) })
+	labels := make([]string, len(queues))
+	for i, q := range queues {
+		var username string
+		if sess, ok := s.sessions.GetSnapshot(q.session); ok {
+			username = sess.Username
+		}
+		labels[i] = fmt.Sprintf("{session=\"%d\",user=%q}", q.session, username)
+	}
+	writeSessions := func(name, help, mtype string, value func(q *sendQueue) int64) {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		_, _ = fmt.Fprintf(w, "# TYPE %s %s\n", name, mtype)
+		for i, q := range queues {
+			_, _ = fmt.Fprintf(w, "%s%s %d\n", name, labels[i], value(q))
+		}
+	}
+	writeSessions("gospeak_session_send_queue_length", "Control messages waiting to be sent to a session.", "gauge",
+		func(q *sendQueue) int64 { return int64(q.length()) })
+	writeSessions("gospeak_session_send_queue_peak", "Most control messages ever queued for a session.", "gauge",
+		func(q *sendQueue) int64 { return q.peak.Load() })
+	writeSessions("gospeak_session_messages_sent_total", "Control messages sent to a session.", "counter",
+		func(q *sendQueue) int64 { return q.sent.Load() })
+	writeSessions("gospeak_session_messages_dropped_total", "Control messages for a session dropped on a full queue.", "counter",
+		func(q *sendQueue) int64 { return q.dropped.Load() })
 }
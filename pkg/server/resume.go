@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/NicolasHaas/gospeak/pkg/crypto"
+)
+
+// resumeEntry is the resume state of one session. timer is set while the
+// session is parked, i.e. its connection dropped and it awaits a resume.
+type resumeEntry struct {
+	sessionID uint32
+	userID    int64
+	timer     *time.Timer
+}
+
+// ResumeManager hands out resume tokens and keeps dropped sessions alive for
+// a short window, so a client that reconnects quickly gets its session back
+// without other users seeing it leave and rejoin.
+type ResumeManager struct {
+	mu        sync.Mutex
+	tokens    map[string]*resumeEntry // resume token -> entry
+	bySession map[uint32]string       // sessionID -> resume token
+}
+
+// NewResumeManager creates a new resume manager.
+func NewResumeManager() *ResumeManager {
+	return &ResumeManager{
+		tokens:    make(map[string]*resumeEntry),
+		bySession: make(map[uint32]string),
+	}
+}
+
+// Issue creates the resume token of a session. It returns "" if no random
+// token could be generated; the session is then not resumable.
+func (rm *ResumeManager) Issue(sessionID uint32, userID int64) string {
+	token, err := crypto.GenerateToken()
+	if err != nil {
+		return ""
+	}
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	rm.tokens[token] = &resumeEntry{sessionID: sessionID, userID: userID}
+	rm.bySession[sessionID] = token
+	return token
+}
+
+// Revoke makes a session non-resumable, e.g. when it was kicked or the user
+// disconnected on purpose. A parked session is ended right away.
+func (rm *ResumeManager) Revoke(sessionID uint32) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	token, ok := rm.bySession[sessionID]
+	if !ok {
+		return
+	}
+	if e := rm.tokens[token]; e.timer != nil {
+		e.timer.Reset(0) // expire now
+		return
+	}
+	delete(rm.tokens, token)
+	delete(rm.bySession, sessionID)
+}
+
+// Park keeps a session whose connection dropped for window. expire runs if
+// it was not resumed by then. Park returns false if the session is not
+// resumable; the caller ends it right away.
+func (rm *ResumeManager) Park(sessionID uint32, window time.Duration, expire func()) bool {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	token, ok := rm.bySession[sessionID]
+	if !ok || window <= 0 {
+		return false
+	}
+	e := rm.tokens[token]
+	e.timer = time.AfterFunc(window, func() {
+		rm.mu.Lock()
+		if rm.tokens[token] != e {
+			rm.mu.Unlock()
+			return // resumed or already expired
+		}
+		delete(rm.tokens, token)
+		delete(rm.bySession, sessionID)
+		rm.mu.Unlock()
+		expire()
+	})
+	return true
+}
+
+// Resume claims the session of a resume token for userID. The token is
+// consumed. parked reports whether the session's connection had already
+// dropped; otherwise the old connection is still open and must be closed.
+func (rm *ResumeManager) Resume(token string, userID int64) (sessionID uint32, parked bool, ok bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	e, found := rm.tokens[token]
+	if !found || e.userID != userID {
+		return 0, false, false
+	}
+	delete(rm.tokens, token)
+	delete(rm.bySession, e.sessionID)
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	return e.sessionID, e.timer != nil, true
+}
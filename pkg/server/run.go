@@ -21,13 +21,6 @@ func (s *Server) Run() error {
 	st := s.store
 	defer func() { _ = st.Close() }()
 
-	// Generate shared voice encryption key
-	voiceKey, err := crypto.GenerateKey()
-	if err != nil {
-		return fmt.Errorf("server: generate voice key: %w", err)
-	}
-	s.voiceKey = voiceKey
-
 	// Ensure default "Lobby" channel exists
 	channels, _ := st.ListChannels()
 	if len(channels) == 0 {
@@ -37,6 +30,16 @@ func (s *Server) Run() error {
 		slog.Info("created default Lobby channel")
 	}
 
+	// Load custom roles before anything resolves role names
+	if s.cfg.RolesFile != "" {
+		if err := LoadRolesFromYAML(s.cfg.RolesFile, st); err != nil {
+			return fmt.Errorf("server: %w", err)
+		}
+	}
+	if err := RegisterStoredRoles(st); err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+
 	// Load channels from YAML config if provided
 	if s.cfg.ChannelsFile != "" {
 		if err := LoadChannelsFromYAML(s.cfg.ChannelsFile, st); err != nil {
@@ -65,6 +68,9 @@ func (s *Server) Run() error {
 	// Start Prometheus metrics HTTP endpoint
 	s.StartMetricsHTTP()
 
+	// Drop chat history past its retention, now and then hourly
+	s.startChatPruner(st)
+
 	// Start periodic metrics logging (every 60s)
 	s.metrics.StartPeriodicLog(60*time.Second, s.ctx.Done())
 
@@ -73,6 +79,16 @@ func (s *Server) Run() error {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	<-sigCh
 
+	if grace := s.cfg.ShutdownGrace; grace > 0 {
+		n := s.Broadcast(fmt.Sprintf("The server is shutting down in %s.", grace))
+		slog.Info("shutting down after grace period", "grace", grace, "sessions", n)
+		select {
+		case <-time.After(grace):
+		case <-sigCh:
+			slog.Info("second signal, skipping grace period")
+		}
+	}
+
 	slog.Info("shutting down...")
 	s.Shutdown()
 	return nil
@@ -105,7 +121,7 @@ func (s *Server) ensureAdminToken(st store.DataStore) error {
 	}
 
 	hash := crypto.HashToken(rawToken)
-	if err := st.CreateToken(hash, model.RoleAdmin, 0, 0, 0 /* unlimited uses, no expiry */, st.ZeroTime()); err != nil {
+	if err := st.CreateToken(hash, "initial admin", model.RoleAdmin, 0, 0, 0 /* unlimited uses, no expiry */, st.ZeroTime()); err != nil {
 		return fmt.Errorf("server: store admin token: %w", err)
 	}
 
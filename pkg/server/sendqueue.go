@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Send queue overflow policies (Config.SendQueueOverflow).
+const (
+	OverflowDisconnect = "disconnect" // close the connection; the client can resume
+	OverflowDrop       = "drop"       // drop state deltas (see writeStateDelta); disconnect for anything else
+)
+
+// DefaultSendQueueSize is the number of control messages queued per client
+// when Config.SendQueueSize is not set.
+const DefaultSendQueueSize = 256
+
+// sendTimeout bounds the write of a single queued message. A client that
+// takes longer is disconnected.
+const sendTimeout = 10 * time.Second
+
+var errSendQueueFull = errors.New("server: send queue full")
+
+// sendQueue is the outbound side of a control connection. Each Write is one
+// whole frame (see protocol.WriteControlMessage); it is queued and a single
+// writer goroutine sends the frames in order. Frames written from different
+// goroutines therefore never interleave, and a slow client holds up nobody
+// but itself. Everything besides Write goes to the wrapped connection.
+type sendQueue struct {
+	net.Conn
+	session uint32
+	drop    bool // overflow policy: drop droppable frames instead of disconnecting
+
+	mu     sync.Mutex // guards closed and sends on frames
+	closed bool
+	frames chan []byte
+	done   chan struct{}
+
+	peak    atomic.Int64 // most frames ever queued at once
+	sent    atomic.Int64
+	dropped atomic.Int64
+	metrics *Metrics
+}
+
+// newSendQueue wraps conn and starts its writer goroutine. size <= 0 means
+// DefaultSendQueueSize.
+func newSendQueue(conn net.Conn, session uint32, size int, overflow string, metrics *Metrics) *sendQueue {
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	q := &sendQueue{
+		Conn:    conn,
+		session: session,
+		drop:    overflow == OverflowDrop,
+		frames:  make(chan []byte, size),
+		done:    make(chan struct{}),
+		metrics: metrics,
+	}
+	go q.run()
+	return q
+}
+
+// Write queues a copy of p as one frame. It never blocks; when the queue is
+// full the client is disconnected.
+func (q *sendQueue) Write(p []byte) (int, error) {
+	return q.write(p, false)
+}
+
+// droppableFrames writes frames the client can recover from missing. When
+// the queue is full they are dropped under OverflowDrop instead of
+// disconnecting the client.
+type droppableFrames struct{ q *sendQueue }
+
+func (d droppableFrames) Write(p []byte) (int, error) {
+	return d.q.write(p, true)
+}
+
+func (q *sendQueue) write(p []byte, droppable bool) (int, error) {
+	frame := append([]byte(nil), p...)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, net.ErrClosed
+	}
+	select {
+	case q.frames <- frame:
+		if n := int64(len(q.frames)); n > q.peak.Load() {
+			q.peak.Store(n)
+		}
+		return len(p), nil
+	default:
+	}
+
+	q.dropped.Add(1)
+	q.metrics.SendQueueDrops.Add(1)
+	if q.drop && droppable {
+		slog.Debug("send queue full, message dropped", "session", q.session)
+		return 0, errSendQueueFull
+	}
+	slog.Warn("send queue full, disconnecting slow client", "session", q.session)
+	q.metrics.SendQueueOverflows.Add(1)
+	q.closeLocked()
+	_ = q.Conn.Close() // unblocks the reader; queued frames are lost
+	return 0, errSendQueueFull
+}
+
+// Close stops accepting frames. The writer sends what is queued, then
+// closes the connection. Close does not wait for it; see wait.
+func (q *sendQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeLocked()
+	return nil
+}
+
+func (q *sendQueue) closeLocked() {
+	if !q.closed {
+		q.closed = true
+		close(q.frames)
+	}
+}
+
+// wait blocks until the writer has finished and the connection is closed.
+func (q *sendQueue) wait() {
+	<-q.done
+}
+
+// length returns the number of frames waiting to be sent.
+func (q *sendQueue) length() int {
+	return len(q.frames)
+}
+
+func (q *sendQueue) run() {
+	defer close(q.done)
+	defer func() { _ = q.Conn.Close() }()
+	for frame := range q.frames {
+		_ = q.Conn.SetWriteDeadline(time.Now().Add(sendTimeout))
+		if _, err := q.Conn.Write(frame); err != nil {
+			if !isClosedErr(err) {
+				slog.Warn("control write failed, disconnecting", "session", q.session, "err", err)
+			}
+			_ = q.Close()
+			return
+		}
+		q.sent.Add(1)
+	}
+}
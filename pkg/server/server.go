@@ -23,15 +23,33 @@ import (
 
 // Config holds server configuration.
 type Config struct {
-	ControlAddr  string // TCP/TLS bind address (e.g. ":9600")
-	VoiceAddr    string // UDP bind address (e.g. ":9601")
-	DBPath       string // SQLite database path
-	CertFile     string // TLS certificate file path
-	KeyFile      string // TLS private key file path
-	DataDir      string // directory for generated certs and data
-	AllowNoToken bool   // allow users to join without a token (open server)
-	ChannelsFile string // YAML file defining channels to create on startup
-	MetricsAddr  string // HTTP bind address for /metrics endpoint (empty = disabled)
+	ControlAddr  string        // TCP/TLS bind address (e.g. ":9600")
+	VoiceAddr    string        // UDP bind address (e.g. ":9601")
+	DBPath       string        // SQLite database path
+	CertFile     string        // TLS certificate file path
+	KeyFile      string        // TLS private key file path
+	DataDir      string        // directory for generated certs and data
+	AllowNoToken bool          // allow users to join without a token (open server)
+	ChannelsFile string        // YAML file defining channels to create on startup
+	RolesFile    string        // YAML file defining custom roles
+	MetricsAddr  string        // HTTP bind address for /metrics endpoint (empty = disabled)
+	ResumeWindow time.Duration // how long a dropped session can be resumed (0 = disabled)
+
+	// How long channel chat is kept unless the channel sets its own
+	// retention (0 = not kept)
+	ChatRetention time.Duration
+
+	// Message of the day sent to every client on login (empty = none)
+	MOTD string
+
+	// How long to keep serving after SIGINT/SIGTERM; connected users are
+	// told the server is going down (0 = stop at once)
+	ShutdownGrace time.Duration
+
+	// Control messages queued per client, and what happens when a client
+	// falls that far behind: OverflowDisconnect or OverflowDrop
+	SendQueueSize     int
+	SendQueueOverflow string
 
 	// CLI-only actions (run and exit)
 	ExportUsers    bool // export all users as YAML and exit
@@ -47,11 +65,17 @@ type Dependencies struct {
 // DefaultConfig returns a config with sensible defaults.
 func DefaultConfig() Config {
 	return Config{
-		ControlAddr: ":9600",
-		VoiceAddr:   ":9601",
-		MetricsAddr: ":9602",
-		DBPath:      "gospeak.db",
-		DataDir:     ".",
+		ControlAddr:  ":9600",
+		VoiceAddr:    ":9601",
+		MetricsAddr:  ":9602",
+		DBPath:       "gospeak.db",
+		DataDir:      ".",
+		ResumeWindow: 30 * time.Second,
+
+		ChatRetention: DefaultChatRetention,
+
+		SendQueueSize:     DefaultSendQueueSize,
+		SendQueueOverflow: OverflowDisconnect,
 	}
 }
 
@@ -138,11 +162,16 @@ type Server struct {
 	cfg         Config
 	sessions    *SessionManager
 	channels    *ChannelManager
+	whispers    *WhisperManager
+	resumes     *ResumeManager
+	keys        *KeyManager
+	state       *stateTracker
+	chat        *recentChat
 	metrics     *Metrics
 	store       store.DataStore
+	control     *ControlHandler // set by StartControl
 	controlConn net.Listener
 	voiceConn   *net.UDPConn
-	voiceKey    []byte // shared AES-128 key for all voice encryption
 	ctx         context.Context
 	cancel      context.CancelFunc
 }
@@ -154,6 +183,11 @@ func New(cfg Config, deps Dependencies) *Server {
 		cfg:      cfg,
 		sessions: NewSessionManager(),
 		channels: NewChannelManager(),
+		whispers: NewWhisperManager(),
+		resumes:  NewResumeManager(),
+		keys:     NewKeyManager(),
+		state:    &stateTracker{},
+		chat:     newRecentChat(),
 		metrics:  NewMetrics(),
 		store:    deps.Store,
 		ctx:      ctx,
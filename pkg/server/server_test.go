@@ -1,13 +1,23 @@
 package server
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/NicolasHaas/gospeak/pkg/crypto"
 	"github.com/NicolasHaas/gospeak/pkg/model"
+	"github.com/NicolasHaas/gospeak/pkg/protocol"
 	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+	"github.com/NicolasHaas/gospeak/pkg/rbac"
 	"github.com/NicolasHaas/gospeak/pkg/store"
 )
 
@@ -22,6 +32,36 @@ func (c *nopConn) SetDeadline(_ time.Time) error      { return nil }
 func (c *nopConn) SetReadDeadline(_ time.Time) error  { return nil }
 func (c *nopConn) SetWriteDeadline(_ time.Time) error { return nil }
 
+// recordConn is a nopConn with a fixed remote address that records writes.
+type recordConn struct {
+	nopConn
+	addr net.Addr
+	out  bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+func (c *recordConn) RemoteAddr() net.Addr        { return c.addr }
+
+// scriptConn is a recordConn that reads a fixed sequence of control
+// messages, then EOF.
+type scriptConn struct {
+	recordConn
+	in bytes.Buffer
+}
+
+func newScriptConn(t *testing.T, msgs ...*pb.ControlMessage) *scriptConn {
+	t.Helper()
+	c := &scriptConn{recordConn: recordConn{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}}}
+	for _, m := range msgs {
+		if err := protocol.WriteControlMessage(&c.in, m); err != nil {
+			t.Fatalf("WriteControlMessage: %v", err)
+		}
+	}
+	return c
+}
+
+func (c *scriptConn) Read(p []byte) (int, error) { return c.in.Read(p) }
+
 func newTestServer(t *testing.T) (*Server, store.DataStore, *ControlHandler) {
 	t.Helper()
 	st := store.NewMemory()
@@ -86,3 +126,1682 @@ func TestHandleUserState(t *testing.T) {
 		t.Fatalf("HandleUserState: expected muted/deafened true, got muted=%t deafened=%t", snap.Muted, snap.Deafened)
 	}
 }
+
+func TestHandleJoinChannelScope(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+
+	lobby := model.NewChannel()
+	if err := st.CreateChannel(lobby); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	guests := &model.Channel{Name: "Guests"}
+	if err := st.CreateChannel(guests); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	sub := &model.Channel{Name: "Table 1", ParentID: guests.ID}
+	if err := st.CreateChannel(sub); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+
+	session := srv.sessions.Create(1, "guest", model.RoleUser)
+	srv.sessions.SetChannelScope(session.ID, guests.ID)
+
+	srv.handleJoinChannel(handler, session.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, conn)
+	if got := srv.channels.ChannelOf(session.ID); got != 0 {
+		t.Fatalf("JoinChannel: expected out-of-scope join to be rejected, joined %d", got)
+	}
+
+	srv.handleJoinChannel(handler, session.ID, &pb.JoinChannelRequest{ChannelID: sub.ID}, st, conn)
+	if got := srv.channels.ChannelOf(session.ID); got != sub.ID {
+		t.Fatalf("JoinChannel: expected channel %d got %d", sub.ID, got)
+	}
+
+	channels, err := st.ListChannels()
+	if err != nil {
+		t.Fatalf("ListChannels: %v", err)
+	}
+	infos := srv.buildChannelInfos(channels, guests.ID)
+	if len(infos) != 2 {
+		t.Fatalf("buildChannelInfos: expected 2 scoped channels got %d", len(infos))
+	}
+	for _, info := range infos {
+		if info.ID == lobby.ID {
+			t.Fatalf("buildChannelInfos: out-of-scope channel %d visible", lobby.ID)
+		}
+		if info.ID == guests.ID && info.ParentID != 0 {
+			t.Fatalf("buildChannelInfos: scope root should be top-level, got parent %d", info.ParentID)
+		}
+	}
+}
+
+func TestHandleRevokeTokenPermissions(t *testing.T) {
+	srv, st, _ := newTestServer(t)
+	conn := &nopConn{}
+
+	if err := st.CreateToken("hash-1", "guest", model.RoleUser, 0, 0, 0, st.ZeroTime()); err != nil {
+		t.Fatalf("CreateToken: %v", err)
+	}
+	tokens, err := st.ListTokens()
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("ListTokens: tokens=%v err=%v", tokens, err)
+	}
+
+	user := srv.sessions.Create(1, "bob", model.RoleUser)
+	srv.handleRevokeToken(user.ID, &pb.RevokeTokenRequest{TokenID: tokens[0].ID}, st, conn)
+	if _, err := st.ValidateToken("hash-1"); err != nil {
+		t.Fatalf("RevokeToken: non-admin revoke should be rejected, got %v", err)
+	}
+
+	admin := srv.sessions.Create(2, "alice", model.RoleAdmin)
+	srv.handleRevokeToken(admin.ID, &pb.RevokeTokenRequest{TokenID: tokens[0].ID}, st, conn)
+	if _, err := st.ValidateToken("hash-1"); err == nil {
+		t.Fatalf("RevokeToken: expected token to be revoked")
+	}
+}
+
+func TestHandleControlConnIPBan(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	if err := st.CreateBan(0, "203.0.113.0/24", "ban evasion", 1, st.ZeroTime()); err != nil {
+		t.Fatalf("CreateBan: %v", err)
+	}
+
+	conn := &recordConn{addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.9"), Port: 40000}}
+	srv.handleControlConn(handler, conn, st)
+
+	msg, err := protocol.ReadControlMessage(&conn.out)
+	if err != nil {
+		t.Fatalf("ReadControlMessage: %v", err)
+	}
+	if msg.ErrorResponse == nil || msg.ErrorResponse.Code != 4 {
+		t.Fatalf("handleControlConn: expected ban error, got %+v", msg)
+	}
+}
+
+func TestHandleBanUserIP(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	admin := srv.sessions.Create(1, "alice", model.RoleAdmin)
+	adminConn := &recordConn{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 40000}}
+
+	srv.handleBanUser(handler, admin.ID, &pb.BanUserRequest{IP: "192.0.2.0/24", Reason: "self"}, st, adminConn)
+	if banned, _ := st.IsIPBanned("192.0.2.10"); banned {
+		t.Fatalf("BanUser: ban covering the issuer's own address should be rejected")
+	}
+
+	srv.handleBanUser(handler, admin.ID, &pb.BanUserRequest{IP: "198.51.100.0/24", Reason: "spam"}, st, adminConn)
+	banned, err := st.IsIPBanned("198.51.100.77")
+	if err != nil {
+		t.Fatalf("IsIPBanned: %v", err)
+	}
+	if !banned {
+		t.Fatalf("BanUser: expected CIDR ban to be stored")
+	}
+
+	bans, err := st.ListBans()
+	if err != nil || len(bans) != 1 {
+		t.Fatalf("ListBans: bans=%v err=%v", bans, err)
+	}
+	srv.handleUnban(admin.ID, &pb.UnbanRequest{BanID: bans[0].ID}, st, adminConn)
+	if banned, _ := st.IsIPBanned("198.51.100.77"); banned {
+		t.Fatalf("Unban: address still banned")
+	}
+}
+
+func TestHandleEditChannel(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+
+	games := &model.Channel{Name: "Games"}
+	if err := st.CreateChannel(games); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	sub := &model.Channel{Name: "Shooters", ParentID: games.ID}
+	if err := st.CreateChannel(sub); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+
+	user := srv.sessions.Create(1, "bob", model.RoleUser)
+	srv.handleEditChannel(user.ID, &pb.EditChannelRequest{ChannelID: games.ID, Name: "Renamed"}, st, conn, handler)
+	if ch, _ := st.GetChannel(games.ID); ch.Name != "Games" {
+		t.Fatalf("EditChannel: non-admin edit should be rejected, name is %q", ch.Name)
+	}
+
+	// A member keeps their place while the channel is edited
+	member := srv.sessions.Create(2, "carol", model.RoleUser)
+	srv.handleJoinChannel(handler, member.ID, &pb.JoinChannelRequest{ChannelID: games.ID}, st, conn)
+
+	admin := srv.sessions.Create(3, "alice", model.RoleAdmin)
+	srv.handleEditChannel(admin.ID, &pb.EditChannelRequest{ChannelID: games.ID, Name: "Gaming", Description: "All games", MaxUsers: 5}, st, conn, handler)
+	ch, err := st.GetChannel(games.ID)
+	if err != nil {
+		t.Fatalf("GetChannel: %v", err)
+	}
+	if ch.Name != "Gaming" || ch.Description != "All games" || ch.MaxUsers != 5 {
+		t.Fatalf("EditChannel: unexpected channel %+v", ch)
+	}
+	if got := srv.channels.ChannelOf(member.ID); got != games.ID {
+		t.Fatalf("EditChannel: member moved to %d", got)
+	}
+
+	// Reparenting a channel under its own child is rejected
+	srv.handleEditChannel(admin.ID, &pb.EditChannelRequest{ChannelID: games.ID, Name: "Gaming", ParentID: sub.ID}, st, conn, handler)
+	if ch, _ := st.GetChannel(games.ID); ch.ParentID != 0 {
+		t.Fatalf("EditChannel: cycle should be rejected, parent is %d", ch.ParentID)
+	}
+
+	// An edit override on one channel does not allow moving it elsewhere
+	private := &model.Channel{Name: "Private"}
+	if err := st.CreateChannel(private); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	if err := st.SetChannelACL(&model.ChannelACL{ChannelID: sub.ID, UserID: 1, Permission: model.PermEditChannel, Allow: true}); err != nil {
+		t.Fatalf("SetChannelACL: %v", err)
+	}
+	srv.handleEditChannel(user.ID, &pb.EditChannelRequest{ChannelID: sub.ID, Name: "Shooters", ParentID: private.ID}, st, conn, handler)
+	if ch, _ := st.GetChannel(sub.ID); ch.ParentID != games.ID {
+		t.Fatalf("EditChannel: moved under a channel without edit rights, parent is %d", ch.ParentID)
+	}
+	srv.handleEditChannel(user.ID, &pb.EditChannelRequest{ChannelID: sub.ID, Name: "FPS", ParentID: games.ID}, st, conn, handler)
+	if ch, _ := st.GetChannel(sub.ID); ch.Name != "FPS" {
+		t.Fatalf("EditChannel: override holder could not edit in place, name is %q", ch.Name)
+	}
+	if err := st.SetChannelACL(&model.ChannelACL{ChannelID: private.ID, UserID: 1, Permission: model.PermEditChannel, Allow: true}); err != nil {
+		t.Fatalf("SetChannelACL: %v", err)
+	}
+	srv.handleEditChannel(user.ID, &pb.EditChannelRequest{ChannelID: sub.ID, Name: "FPS", ParentID: private.ID}, st, conn, handler)
+	if ch, _ := st.GetChannel(sub.ID); ch.ParentID != private.ID {
+		t.Fatalf("EditChannel: move between editable channels rejected, parent is %d", ch.ParentID)
+	}
+}
+
+func TestHandleJoinChannelPassword(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+
+	hash, err := crypto.EncodePassword("hunter2")
+	if err != nil {
+		t.Fatalf("EncodePassword: %v", err)
+	}
+	private := &model.Channel{Name: "Private", PasswordHash: hash}
+	if err := st.CreateChannel(private); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+
+	user := srv.sessions.Create(1, "bob", model.RoleUser)
+	srv.handleJoinChannel(handler, user.ID, &pb.JoinChannelRequest{ChannelID: private.ID}, st, conn)
+	if got := srv.channels.ChannelOf(user.ID); got != 0 {
+		t.Fatalf("JoinChannel: joined without password")
+	}
+	srv.handleJoinChannel(handler, user.ID, &pb.JoinChannelRequest{ChannelID: private.ID, Password: "wrong"}, st, conn)
+	if got := srv.channels.ChannelOf(user.ID); got != 0 {
+		t.Fatalf("JoinChannel: joined with wrong password")
+	}
+
+	// Failed attempts are throttled, so a second user tries the right password
+	other := srv.sessions.Create(2, "carol", model.RoleUser)
+	srv.handleJoinChannel(handler, other.ID, &pb.JoinChannelRequest{ChannelID: private.ID, Password: "hunter2"}, st, conn)
+	if got := srv.channels.ChannelOf(other.ID); got != private.ID {
+		t.Fatalf("JoinChannel: expected channel %d got %d", private.ID, got)
+	}
+
+	admin := srv.sessions.Create(3, "alice", model.RoleAdmin)
+	srv.handleJoinChannel(handler, admin.ID, &pb.JoinChannelRequest{ChannelID: private.ID}, st, conn)
+	if got := srv.channels.ChannelOf(admin.ID); got != private.ID {
+		t.Fatalf("JoinChannel: admin should bypass password, got %d", got)
+	}
+
+	scoped := srv.sessions.Create(4, "guest", model.RoleUser)
+	srv.sessions.SetChannelScope(scoped.ID, private.ID)
+	srv.handleJoinChannel(handler, scoped.ID, &pb.JoinChannelRequest{ChannelID: private.ID}, st, conn)
+	if got := srv.channels.ChannelOf(scoped.ID); got != private.ID {
+		t.Fatalf("JoinChannel: scoped token should bypass password, got %d", got)
+	}
+
+	infos := srv.buildChannelInfos([]model.Channel{*private}, 0)
+	if len(infos) != 1 || !infos[0].HasPassword {
+		t.Fatalf("buildChannelInfos: expected has_password, got %+v", infos)
+	}
+}
+
+func TestHandleChannelACL(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+
+	parent := &model.Channel{Name: "Stage"}
+	if err := st.CreateChannel(parent); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	child := &model.Channel{Name: "Backstage", ParentID: parent.ID}
+	if err := st.CreateChannel(child); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+
+	bob, err := st.CreateUser("bob", model.RoleUser)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	admin := srv.sessions.Create(100, "alice", model.RoleAdmin)
+	user := srv.sessions.Create(bob.ID, "bob", model.RoleUser)
+
+	// Non-admins cannot manage overrides
+	srv.handleSetChannelACL(user.ID, &pb.SetChannelACLRequest{ChannelID: parent.ID, Role: "user", Permission: "speak"}, st, conn, handler)
+	if acls, _ := st.ListChannelACLs(); len(acls) != 0 {
+		t.Fatalf("SetChannelACL: user created %d entries", len(acls))
+	}
+
+	// Unknown names are rejected
+	srv.handleSetChannelACL(admin.ID, &pb.SetChannelACLRequest{ChannelID: parent.ID, Role: "user", Permission: "fly"}, st, conn, handler)
+	srv.handleSetChannelACL(admin.ID, &pb.SetChannelACLRequest{ChannelID: parent.ID, Role: "guest", Permission: "speak"}, st, conn, handler)
+	if acls, _ := st.ListChannelACLs(); len(acls) != 0 {
+		t.Fatalf("SetChannelACL: invalid entries stored: %+v", acls)
+	}
+
+	// Deny speak on the parent; it is inherited by the sub-channel
+	srv.handleSetChannelACL(admin.ID, &pb.SetChannelACLRequest{ChannelID: parent.ID, Role: "user", Permission: "speak"}, st, conn, handler)
+	srv.handleJoinChannel(handler, user.ID, &pb.JoinChannelRequest{ChannelID: child.ID}, st, conn)
+	snap, _ := srv.sessions.GetSnapshot(user.ID)
+	if snap.ChannelID != child.ID || !snap.SpeakDenied {
+		t.Fatalf("JoinChannel: expected speak denied in %d, got %+v", child.ID, snap)
+	}
+
+	// Deny text chat; the message must not reach anyone
+	srv.handleSetChannelACL(admin.ID, &pb.SetChannelACLRequest{ChannelID: child.ID, Role: "user", Permission: "text_chat"}, st, conn, handler)
+	listener := &recordConn{}
+	handler.setConn(admin.ID, listener)
+	srv.handleJoinChannel(handler, admin.ID, &pb.JoinChannelRequest{ChannelID: child.ID}, st, conn)
+	listener.out.Reset()
+	srv.handleChatMessage(handler, user.ID, &pb.ChatMessage{Text: "hello"}, st, conn)
+	if listener.out.Len() != 0 {
+		t.Fatalf("ChatMessage: denied message was broadcast")
+	}
+
+	// A user entry allowing speak beats the role deny, and applies immediately
+	srv.handleSetChannelACL(admin.ID, &pb.SetChannelACLRequest{ChannelID: parent.ID, UserID: bob.ID, Permission: "speak", Allow: true}, st, conn, handler)
+	if snap, _ := srv.sessions.GetSnapshot(user.ID); snap.SpeakDenied {
+		t.Fatalf("SetChannelACL: speak still denied after user allow")
+	}
+
+	// Deny join on the parent blocks both channels for the role
+	srv.handleSetChannelACL(admin.ID, &pb.SetChannelACLRequest{ChannelID: parent.ID, Role: "moderator", Permission: "join_channel"}, st, conn, handler)
+	mod := srv.sessions.Create(101, "carol", model.RoleModerator)
+	srv.handleJoinChannel(handler, mod.ID, &pb.JoinChannelRequest{ChannelID: child.ID}, st, conn)
+	if got := srv.channels.ChannelOf(mod.ID); got != 0 {
+		t.Fatalf("JoinChannel: moderator joined denied channel %d", got)
+	}
+
+	// Deleting the entry lifts the restriction
+	acls, err := st.ListChannelACLs()
+	if err != nil {
+		t.Fatalf("ListChannelACLs: %v", err)
+	}
+	for _, acl := range acls {
+		if acl.Permission == model.PermJoinChannel {
+			srv.handleDeleteChannelACL(admin.ID, &pb.DeleteChannelACLRequest{EntryID: acl.ID}, st, conn, handler)
+		}
+	}
+	srv.handleJoinChannel(handler, mod.ID, &pb.JoinChannelRequest{ChannelID: child.ID}, st, conn)
+	if got := srv.channels.ChannelOf(mod.ID); got != child.ID {
+		t.Fatalf("JoinChannel: expected channel %d after delete, got %d", child.ID, got)
+	}
+}
+
+func TestCustomRoles(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+	t.Cleanup(func() { model.RegisterCustomRoles(nil) })
+
+	bad := []byte("roles:\n  - name: dj\n    permissions: [speak, fly]\n")
+	if err := ImportRolesFromYAML(bad, st); err == nil {
+		t.Fatalf("ImportRolesFromYAML: expected error for unknown permission")
+	}
+	if roles, _ := st.ListRoles(); len(roles) != 0 {
+		t.Fatalf("ImportRolesFromYAML: invalid file saved %d roles", len(roles))
+	}
+
+	good := []byte(`roles:
+  - name: dj
+    priority: 10
+    permissions: [join_channel, speak, text_chat, kick_user]
+  - name: boss
+    priority: 90
+    permissions: [join_channel, speak, manage_roles]
+`)
+	if err := ImportRolesFromYAML(good, st); err != nil {
+		t.Fatalf("ImportRolesFromYAML: %v", err)
+	}
+	if err := RegisterStoredRoles(st); err != nil {
+		t.Fatalf("RegisterStoredRoles: %v", err)
+	}
+	dj, ok := model.ParseRole("dj")
+	if !ok {
+		t.Fatalf("ParseRole(dj): not registered")
+	}
+	if !rbac.HasPermission(dj, model.PermKickUser) || rbac.HasPermission(dj, model.PermBanUser) {
+		t.Fatalf("HasPermission: dj permissions not applied")
+	}
+
+	// Tokens can carry custom roles; unknown names are rejected, not downgraded
+	admin := srv.sessions.Create(1, "alice", model.RoleAdmin)
+	srv.handleCreateToken(admin.ID, &pb.CreateTokenRequest{Role: "dj"}, st, conn)
+	srv.handleCreateToken(admin.ID, &pb.CreateTokenRequest{Role: "superuser"}, st, conn)
+	tokens, err := st.ListTokens()
+	if err != nil {
+		t.Fatalf("ListTokens: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].Role != dj {
+		t.Fatalf("CreateToken: want one dj token, got %+v", tokens)
+	}
+
+	// Role changes honour priority: boss may grant dj but not admin
+	bob, err := st.CreateUser("bob", model.RoleUser)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	bossRole, _ := model.ParseRole("boss")
+	boss := srv.sessions.Create(2, "carol", bossRole)
+	srv.handleSetUserRole(handler, boss.ID, &pb.SetUserRoleRequest{TargetUserID: bob.ID, NewRole: "admin"}, st, conn)
+	srv.handleSetUserRole(handler, boss.ID, &pb.SetUserRoleRequest{TargetUserID: bob.ID, NewRole: "nobody"}, st, conn)
+	if u, _ := st.GetUserByID(bob.ID); u.Role != model.RoleUser {
+		t.Fatalf("SetUserRole: role changed to %v", u.Role)
+	}
+	srv.handleSetUserRole(handler, boss.ID, &pb.SetUserRoleRequest{TargetUserID: bob.ID, NewRole: "dj"}, st, conn)
+	if u, _ := st.GetUserByID(bob.ID); u.Role != dj {
+		t.Fatalf("SetUserRole: want dj, got %v", u.Role)
+	}
+}
+
+func TestHandleServerMuteAndMove(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+
+	lobby := &model.Channel{Name: "Lobby"}
+	afk := &model.Channel{Name: "AFK", MaxUsers: 1}
+	for _, ch := range []*model.Channel{lobby, afk} {
+		if err := st.CreateChannel(ch); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+	}
+
+	mod := srv.sessions.Create(1, "mod", model.RoleModerator)
+	user := srv.sessions.Create(2, "bob", model.RoleUser)
+	admin := srv.sessions.Create(3, "alice", model.RoleAdmin)
+	userConn := &recordConn{}
+	handler.setConn(user.ID, userConn)
+	srv.handleJoinChannel(handler, user.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, conn)
+
+	// Users cannot server-mute; the user cannot lift a server mute themselves
+	srv.handleServerMute(handler, user.ID, &pb.ServerMuteRequest{UserID: 1, Muted: true}, st, conn)
+	if snap, _ := srv.sessions.GetSnapshot(mod.ID); snap.ServerMuted {
+		t.Fatalf("ServerMute: user was able to mute a moderator")
+	}
+	srv.handleServerMute(handler, mod.ID, &pb.ServerMuteRequest{UserID: 2, Muted: true, Deafened: true}, st, conn)
+	srv.handleUserState(handler, user.ID, &pb.UserStateUpdate{Muted: false, Deafened: false}, st)
+	snap, _ := srv.sessions.GetSnapshot(user.ID)
+	if !snap.ServerMuted || !snap.ServerDeafened {
+		t.Fatalf("ServerMute: want server mute/deafen kept after self-unmute, got %+v", snap)
+	}
+	if users := srv.channelUsers(lobby.ID); len(users) != 1 || !users[0].ServerMuted {
+		t.Fatalf("channelUsers: server mute not reported: %+v", users)
+	}
+
+	// Moderators cannot act on admins
+	srv.handleServerMute(handler, mod.ID, &pb.ServerMuteRequest{UserID: 3, Muted: true}, st, conn)
+	if snap, _ := srv.sessions.GetSnapshot(admin.ID); snap.ServerMuted {
+		t.Fatalf("ServerMute: moderator muted an admin")
+	}
+
+	// Move goes through the join path and tells the moved client
+	userConn.out.Reset()
+	srv.handleMoveUser(handler, mod.ID, &pb.MoveUserRequest{UserID: 2, ChannelID: afk.ID}, st, conn)
+	if got := srv.channels.ChannelOf(user.ID); got != afk.ID {
+		t.Fatalf("MoveUser: want channel %d, got %d", afk.ID, got)
+	}
+	if snap, _ := srv.sessions.GetSnapshot(user.ID); snap.ChannelID != afk.ID {
+		t.Fatalf("MoveUser: session channel not updated: %d", snap.ChannelID)
+	}
+	var sawJoin bool
+	for userConn.out.Len() > 0 {
+		msg, err := protocol.ReadControlMessage(&userConn.out)
+		if err != nil {
+			t.Fatalf("ReadControlMessage: %v", err)
+		}
+		if ev := msg.ChannelJoinedEvent; ev != nil && ev.ChannelID == afk.ID && ev.User.ID == 2 {
+			sawJoin = true
+		}
+	}
+	if !sawJoin {
+		t.Fatalf("MoveUser: moved client was not notified")
+	}
+
+	// The target channel is now full
+	srv.handleMoveUser(handler, mod.ID, &pb.MoveUserRequest{UserID: 3, ChannelID: afk.ID}, st, conn)
+	if got := srv.channels.ChannelOf(admin.ID); got != 0 {
+		t.Fatalf("MoveUser: moved into full channel / over higher role, got %d", got)
+	}
+}
+
+func TestHandleWhisperTarget(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+
+	lobby := &model.Channel{Name: "Lobby"}
+	squad := &model.Channel{Name: "Squad"}
+	if err := st.CreateChannel(lobby); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	if err := st.CreateChannel(squad); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	alpha := &model.Channel{Name: "Alpha", ParentID: squad.ID}
+	if err := st.CreateChannel(alpha); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	medic, err := st.CreateUser("medic", model.RoleUser)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	commander := srv.sessions.Create(100, "commander", model.RoleUser)
+	lobbyMate := srv.sessions.Create(101, "mate", model.RoleUser)
+	squadLead := srv.sessions.Create(102, "lead", model.RoleUser)
+	alphaMember := srv.sessions.Create(103, "alpha", model.RoleUser)
+	medicSess := srv.sessions.Create(medic.ID, "medic", model.RoleUser)
+	srv.channels.Join(commander.ID, lobby.ID)
+	srv.channels.Join(lobbyMate.ID, lobby.ID)
+	srv.channels.Join(squadLead.ID, squad.ID)
+	srv.channels.Join(alphaMember.ID, alpha.ID)
+	srv.channels.Join(medicSess.ID, lobby.ID)
+
+	recipients := func(target uint8) map[uint32]bool {
+		got := make(map[uint32]bool)
+		pkt := &protocol.VoicePacket{SessionID: commander.ID, Target: target}
+		for _, sid := range srv.voiceRecipients(pkt, lobby.ID) {
+			got[sid] = true
+		}
+		return got
+	}
+
+	// Unregistered targets reach nobody; normal talk reaches the channel
+	if got := recipients(1); len(got) != 0 {
+		t.Fatalf("voiceRecipients: unregistered target reached %v", got)
+	}
+	if got := recipients(protocol.TargetChannel); !got[lobbyMate.ID] || got[squadLead.ID] {
+		t.Fatalf("voiceRecipients: channel talk reached %v", got)
+	}
+
+	srv.handleWhisperTarget(handler, commander.ID, &pb.WhisperTargetRequest{
+		TargetID: 1, UserIDs: []int64{medic.ID}, ChannelIDs: []int64{squad.ID}, IncludeSubChannels: true,
+	}, st, conn)
+	got := recipients(1)
+	if !got[squadLead.ID] || !got[alphaMember.ID] || !got[medicSess.ID] || got[lobbyMate.ID] {
+		t.Fatalf("voiceRecipients: whisper reached %v", got)
+	}
+
+	// Invalid IDs are rejected; an empty request clears the target
+	srv.handleWhisperTarget(handler, commander.ID, &pb.WhisperTargetRequest{TargetID: protocol.MaxWhisperTarget + 1, ChannelIDs: []int64{squad.ID}}, st, conn)
+	if _, ok := srv.whispers.Get(commander.ID, protocol.MaxWhisperTarget+1); ok {
+		t.Fatalf("WhisperTarget: out-of-range id registered")
+	}
+	srv.handleWhisperTarget(handler, commander.ID, &pb.WhisperTargetRequest{TargetID: 1}, st, conn)
+	if got := recipients(1); len(got) != 0 {
+		t.Fatalf("voiceRecipients: cleared target reached %v", got)
+	}
+
+	// Channel ACLs can deny whispering into a channel
+	if err := st.SetChannelACL(&model.ChannelACL{ChannelID: squad.ID, Role: model.RoleUser, Permission: model.PermWhisper}); err != nil {
+		t.Fatalf("SetChannelACL: %v", err)
+	}
+	srv.handleWhisperTarget(handler, commander.ID, &pb.WhisperTargetRequest{TargetID: 2, ChannelIDs: []int64{squad.ID}}, st, conn)
+	if _, ok := srv.whispers.Get(commander.ID, 2); ok {
+		t.Fatalf("WhisperTarget: registered despite channel deny")
+	}
+
+	// Whispering into a channel needs the right to join it
+	if err := st.SetChannelACL(&model.ChannelACL{ChannelID: lobby.ID, Role: model.RoleUser, Permission: model.PermJoinChannel}); err != nil {
+		t.Fatalf("SetChannelACL: %v", err)
+	}
+	srv.handleWhisperTarget(handler, squadLead.ID, &pb.WhisperTargetRequest{TargetID: 3, ChannelIDs: []int64{lobby.ID}}, st, conn)
+	if _, ok := srv.whispers.Get(squadLead.ID, 3); ok {
+		t.Fatalf("WhisperTarget: registered despite join deny")
+	}
+
+	// Password-protected channels need the session inside, or an admin
+	hash, err := crypto.EncodePassword("hunter2")
+	if err != nil {
+		t.Fatalf("EncodePassword: %v", err)
+	}
+	vault := &model.Channel{Name: "Vault", PasswordHash: hash}
+	if err := st.CreateChannel(vault); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	srv.handleWhisperTarget(handler, commander.ID, &pb.WhisperTargetRequest{TargetID: 4, ChannelIDs: []int64{vault.ID}}, st, conn)
+	if _, ok := srv.whispers.Get(commander.ID, 4); ok {
+		t.Fatalf("WhisperTarget: registered into a password-protected channel")
+	}
+	srv.channels.Join(medicSess.ID, vault.ID)
+	srv.handleWhisperTarget(handler, medicSess.ID, &pb.WhisperTargetRequest{TargetID: 4, ChannelIDs: []int64{vault.ID}}, st, conn)
+	if _, ok := srv.whispers.Get(medicSess.ID, 4); !ok {
+		t.Fatalf("WhisperTarget: member refused in own password-protected channel")
+	}
+	admin := srv.sessions.Create(104, "admin", model.RoleAdmin)
+	srv.handleWhisperTarget(handler, admin.ID, &pb.WhisperTargetRequest{TargetID: 4, ChannelIDs: []int64{vault.ID}}, st, conn)
+	if _, ok := srv.whispers.Get(admin.ID, 4); !ok {
+		t.Fatalf("WhisperTarget: admin refused despite password bypass")
+	}
+
+	// Leaving the password-protected channel takes the target away again
+	srv.handleLeaveChannel(handler, medicSess.ID, st, conn)
+	if _, ok := srv.whispers.Get(medicSess.ID, 4); ok {
+		t.Fatalf("WhisperTarget: kept whispering into a password-protected channel after leaving")
+	}
+	if _, ok := srv.whispers.Get(admin.ID, 4); !ok {
+		t.Fatalf("WhisperTarget: admin target dropped by an unrelated leave")
+	}
+
+	// So does an override added after registration
+	bay := &model.Channel{Name: "Bay"}
+	if err := st.CreateChannel(bay); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	srv.handleWhisperTarget(handler, commander.ID, &pb.WhisperTargetRequest{TargetID: 5, UserIDs: []int64{medic.ID}, ChannelIDs: []int64{bay.ID}}, st, conn)
+	if target, ok := srv.whispers.Get(commander.ID, 5); !ok || !target.ChannelIDs[bay.ID] {
+		t.Fatalf("WhisperTarget: bay target not registered: %+v", target)
+	}
+	srv.handleSetChannelACL(admin.ID, &pb.SetChannelACLRequest{ChannelID: bay.ID, Role: "user", Permission: "whisper"}, st, conn, handler)
+	if target, ok := srv.whispers.Get(commander.ID, 5); !ok || target.ChannelIDs[bay.ID] || !target.UserIDs[medic.ID] {
+		t.Fatalf("WhisperTarget: want bay dropped and the user kept, got %+v (ok=%v)", target, ok)
+	}
+}
+
+func TestHandlePrioritySpeaker(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+
+	lobby := &model.Channel{Name: "Lobby"}
+	afk := &model.Channel{Name: "AFK"}
+	for _, ch := range []*model.Channel{lobby, afk} {
+		if err := st.CreateChannel(ch); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+	}
+
+	mod := srv.sessions.Create(1, "mod", model.RoleModerator)
+	user := srv.sessions.Create(2, "bob", model.RoleUser)
+
+	// Target must be in a channel
+	srv.handlePrioritySpeaker(handler, mod.ID, &pb.PrioritySpeakerRequest{UserID: 2, Enabled: true}, st, conn)
+	if snap, _ := srv.sessions.GetSnapshot(user.ID); snap.PrioritySpeaker {
+		t.Fatalf("PrioritySpeaker: flagged a user outside any channel")
+	}
+
+	srv.handleJoinChannel(handler, user.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, conn)
+	srv.handleJoinChannel(handler, mod.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, conn)
+
+	// Users cannot grant priority speaker
+	srv.handlePrioritySpeaker(handler, user.ID, &pb.PrioritySpeakerRequest{UserID: 1, Enabled: true}, st, conn)
+	if snap, _ := srv.sessions.GetSnapshot(mod.ID); snap.PrioritySpeaker {
+		t.Fatalf("PrioritySpeaker: user was able to grant priority speaker")
+	}
+
+	srv.handlePrioritySpeaker(handler, mod.ID, &pb.PrioritySpeakerRequest{UserID: 2, Enabled: true}, st, conn)
+	users := srv.channelUsers(lobby.ID)
+	var found bool
+	for _, u := range users {
+		if u.ID == 2 {
+			found = true
+			if !u.PrioritySpeaker || u.SessionID != user.ID {
+				t.Fatalf("channelUsers: priority speaker not reported: %+v", u)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("channelUsers: user missing from %+v", users)
+	}
+
+	// Changing channel clears the flag
+	srv.handleJoinChannel(handler, user.ID, &pb.JoinChannelRequest{ChannelID: afk.ID}, st, conn)
+	if snap, _ := srv.sessions.GetSnapshot(user.ID); snap.PrioritySpeaker {
+		t.Fatalf("PrioritySpeaker: flag kept after channel change")
+	}
+}
+
+func TestChannelCodecSettings(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	conn := &nopConn{}
+	admin := srv.sessions.Create(1, "alice", model.RoleAdmin)
+	user := srv.sessions.Create(2, "bob", model.RoleUser)
+
+	music := pb.CodecSettings{Bitrate: 128000, FrameMs: 20, Application: model.CodecApplicationMusic, Stereo: true}
+	srv.handleCreateChannel(admin.ID, &pb.CreateChannelRequest{Name: "Music", AllowSubChannels: true, Codec: music}, st, conn, handler)
+	ch, err := st.GetChannelByNameAndParent("Music", 0)
+	if err != nil || ch == nil {
+		t.Fatalf("GetChannelByNameAndParent: ch=%v err=%v", ch, err)
+	}
+	if got := codecToPB(ch.Codec); got != music {
+		t.Fatalf("CreateChannel: want codec %+v, got %+v", music, got)
+	}
+
+	// Temp sub-channels inherit the parent's codec whatever the creator asks for
+	srv.handleCreateChannel(user.ID, &pb.CreateChannelRequest{Name: "Jam", ParentID: ch.ID, IsTemp: true, Codec: pb.CodecSettings{Bitrate: 6000}}, st, conn, handler)
+	jam, err := st.GetChannelByNameAndParent("Jam", ch.ID)
+	if err != nil || jam == nil {
+		t.Fatalf("GetChannelByNameAndParent: ch=%v err=%v", jam, err)
+	}
+	if jam.Codec != ch.Codec {
+		t.Fatalf("CreateChannel: temp channel codec %+v, want parent's %+v", jam.Codec, ch.Codec)
+	}
+
+	// Invalid settings are rejected on edit, including frames too large
+	// for a voice packet
+	if model.CodecMaxFrameBytes != protocol.MaxOpusFrame {
+		t.Fatalf("model.CodecMaxFrameBytes = %d, want protocol.MaxOpusFrame (%d)", model.CodecMaxFrameBytes, protocol.MaxOpusFrame)
+	}
+	for _, codec := range []pb.CodecSettings{{FrameMs: 30}, {Bitrate: model.CodecMaxBitrate, FrameMs: 60}} {
+		srv.handleEditChannel(admin.ID, &pb.EditChannelRequest{ChannelID: ch.ID, Name: "Music", Codec: codec}, st, conn, handler)
+		if got, _ := st.GetChannel(ch.ID); got.Codec != ch.Codec {
+			t.Fatalf("EditChannel: invalid codec %+v applied: %+v", codec, got.Codec)
+		}
+	}
+
+	// A low-bandwidth setting is delivered in ChannelInfo
+	low := pb.CodecSettings{Bitrate: 12000, FrameMs: 60}
+	srv.handleEditChannel(admin.ID, &pb.EditChannelRequest{ChannelID: ch.ID, Name: "Music", Codec: low}, st, conn, handler)
+	channels, _ := st.ListChannels()
+	for _, info := range srv.buildChannelInfos(channels, 0) {
+		if info.ID == ch.ID && info.Codec != low {
+			t.Fatalf("ChannelInfo: want codec %+v, got %+v", low, info.Codec)
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	srv.cfg.AllowNoToken = true
+
+	ch := &model.Channel{Name: "Lobby"}
+	if err := st.CreateChannel(ch); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	bob := srv.sessions.Create(2, "bob", model.RoleUser)
+	srv.channels.Join(bob.ID, ch.ID)
+	bobConn := &recordConn{addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 40000}}
+	handler.setConn(bob.ID, bobConn)
+
+	auth := func(resumeToken string, more ...*pb.ControlMessage) *pb.AuthResponse {
+		t.Helper()
+		msgs := append([]*pb.ControlMessage{{AuthRequest: &pb.AuthRequest{Username: "alice", ResumeToken: resumeToken}}}, more...)
+		conn := newScriptConn(t, msgs...)
+		srv.handleControlConn(handler, conn, st)
+		msg, err := protocol.ReadControlMessage(&conn.out)
+		if err != nil || msg.AuthResponse == nil {
+			t.Fatalf("handleControlConn: expected auth response, got %+v err=%v", msg, err)
+		}
+		return msg.AuthResponse
+	}
+
+	// The connection drops after joining; the session is kept
+	first := auth("", &pb.ControlMessage{JoinChannelRequest: &pb.JoinChannelRequest{ChannelID: ch.ID}})
+	if first.ResumeToken == "" || first.Resumed {
+		t.Fatalf("auth: want a resume token for a new session, got %+v", first)
+	}
+	if n := srv.channels.MembersCount(ch.ID); n != 2 {
+		t.Fatalf("dropped session left the channel: %d members", n)
+	}
+
+	// Resuming restores the channel under a new session ID without a leave event
+	bobConn.out.Reset()
+	second := auth(first.ResumeToken)
+	if !second.Resumed || second.ChannelID != ch.ID || second.SessionID == first.SessionID {
+		t.Fatalf("auth: resume failed: %+v", second)
+	}
+	if srv.channels.ChannelOf(second.SessionID) != ch.ID || srv.channels.ChannelOf(first.SessionID) != 0 {
+		t.Fatalf("resume: channel membership not moved to the new session")
+	}
+	for bobConn.out.Len() > 0 {
+		msg, err := protocol.ReadControlMessage(&bobConn.out)
+		if err != nil {
+			t.Fatalf("ReadControlMessage: %v", err)
+		}
+		if msg.ChannelLeftEvent != nil || msg.ChannelJoinedEvent != nil {
+			t.Fatalf("resume: other users saw %+v", msg)
+		}
+	}
+	handler.setConn(bob.ID, &nopConn{}) // expiring sessions broadcast from timer goroutines
+
+	// A token works once
+	third := auth(first.ResumeToken)
+	if third.Resumed {
+		t.Fatalf("auth: resume token accepted twice")
+	}
+	srv.resumes.Revoke(third.SessionID)
+
+	// A deliberate disconnect ends the session at once
+	auth(second.ResumeToken, &pb.ControlMessage{DisconnectReq: &pb.DisconnectRequest{}})
+	if n := srv.channels.MembersCount(ch.ID); n != 1 {
+		t.Fatalf("disconnect: want only bob left in the channel, got %d members", n)
+	}
+
+	// Unresumed sessions end when the window expires
+	srv.cfg.ResumeWindow = 10 * time.Millisecond
+	auth("", &pb.ControlMessage{JoinChannelRequest: &pb.JoinChannelRequest{ChannelID: ch.ID}})
+	deadline := time.Now().Add(2 * time.Second)
+	for srv.channels.MembersCount(ch.ID) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("resume window: parked session never expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// controlMessages drains the messages written to conn.
+func controlMessages(t *testing.T, conn *recordConn) []*pb.ControlMessage {
+	t.Helper()
+	var msgs []*pb.ControlMessage
+	for conn.out.Len() > 0 {
+		msg, err := protocol.ReadControlMessage(&conn.out)
+		if err != nil {
+			t.Fatalf("ReadControlMessage: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// voiceKeyEvents drains a recorded connection and returns the voice keys sent to it.
+func voiceKeyEvents(t *testing.T, conn *recordConn) []*pb.VoiceKeyEvent {
+	t.Helper()
+	var keys []*pb.VoiceKeyEvent
+	for _, msg := range controlMessages(t, conn) {
+		if msg.VoiceKeyEvent != nil {
+			keys = append(keys, msg.VoiceKeyEvent)
+		}
+	}
+	return keys
+}
+
+func TestVoiceKeyRotation(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	lobby := &model.Channel{Name: "Lobby"}
+	afk := &model.Channel{Name: "AFK"}
+	for _, ch := range []*model.Channel{lobby, afk} {
+		if err := st.CreateChannel(ch); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+	}
+	alice := srv.sessions.Create(1, "alice", model.RoleUser)
+	bob := srv.sessions.Create(2, "bob", model.RoleUser)
+	aliceConn, bobConn := &recordConn{}, &recordConn{}
+	handler.setConn(alice.ID, aliceConn)
+	handler.setConn(bob.ID, bobConn)
+
+	// Joining hands out the channel's current key
+	srv.handleJoinChannel(handler, alice.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, aliceConn)
+	srv.handleJoinChannel(handler, bob.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, bobConn)
+	aliceKeys, bobKeys := voiceKeyEvents(t, aliceConn), voiceKeyEvents(t, bobConn)
+	if len(aliceKeys) != 1 || len(bobKeys) != 1 || aliceKeys[0].ChannelID != lobby.ID {
+		t.Fatalf("join: want one lobby key each, got %+v / %+v", aliceKeys, bobKeys)
+	}
+	if !bytes.Equal(aliceKeys[0].Key, bobKeys[0].Key) || aliceKeys[0].Epoch != bobKeys[0].Epoch {
+		t.Fatalf("join: members got different keys")
+	}
+	first := aliceKeys[0]
+
+	// Leaving rotates the key for those who stay, not for the leaver
+	srv.handleJoinChannel(handler, bob.ID, &pb.JoinChannelRequest{ChannelID: afk.ID}, st, bobConn)
+	aliceKeys, bobKeys = voiceKeyEvents(t, aliceConn), voiceKeyEvents(t, bobConn)
+	if len(aliceKeys) != 1 || aliceKeys[0].Epoch != first.Epoch+1 || bytes.Equal(aliceKeys[0].Key, first.Key) {
+		t.Fatalf("leave: want a new lobby key for alice, got %+v", aliceKeys)
+	}
+	if len(bobKeys) != 1 || bobKeys[0].ChannelID != afk.ID {
+		t.Fatalf("leave: want only the AFK key for bob, got %+v", bobKeys)
+	}
+
+	// A session ending (e.g. kicked or banned) rotates its channel key
+	srv.handleJoinChannel(handler, bob.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, bobConn)
+	voiceKeyEvents(t, aliceConn)
+	srv.endSession(handler, bob.ID, st)
+	var sawChannel bool
+	for _, k := range voiceKeyEvents(t, aliceConn) {
+		sawChannel = sawChannel || (k.ChannelID == lobby.ID && k.Epoch > first.Epoch+1)
+	}
+	if !sawChannel {
+		t.Fatalf("endSession: channel key not rotated")
+	}
+
+	// Deleted channels start over with a newer epoch
+	before, _ := srv.keys.Current(afk.ID)
+	srv.keys.Remove(afk.ID)
+	if after, _ := srv.keys.Current(afk.ID); after.Epoch <= before.Epoch || bytes.Equal(after.Key, before.Key) {
+		t.Fatalf("Remove: want a newer key, got epoch %d after %d", after.Epoch, before.Epoch)
+	}
+}
+
+func TestWhisperKeys(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	lobby := &model.Channel{Name: "Lobby"}
+	squad := &model.Channel{Name: "Squad"}
+	for _, ch := range []*model.Channel{lobby, squad} {
+		if err := st.CreateChannel(ch); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+	}
+	medic, err := st.CreateUser("medic", model.RoleUser)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	commander := srv.sessions.Create(100, "commander", model.RoleUser)
+	lead := srv.sessions.Create(101, "lead", model.RoleUser)
+	bystander := srv.sessions.Create(102, "bystander", model.RoleUser)
+	medicSess := srv.sessions.Create(medic.ID, "medic", model.RoleUser)
+	conns := make(map[uint32]*recordConn)
+	for _, sess := range []*model.Session{commander, lead, bystander, medicSess} {
+		conns[sess.ID] = &recordConn{}
+		handler.setConn(sess.ID, conns[sess.ID])
+	}
+	srv.handleJoinChannel(handler, commander.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, conns[commander.ID])
+	srv.handleJoinChannel(handler, bystander.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, conns[bystander.ID])
+	srv.handleJoinChannel(handler, lead.ID, &pb.JoinChannelRequest{ChannelID: squad.ID}, st, conns[lead.ID])
+
+	// whisperKeys drains every connection and returns the whisper keys each got
+	whisperKeys := func() map[uint32][]*pb.VoiceKeyEvent {
+		got := make(map[uint32][]*pb.VoiceKeyEvent)
+		for sid, conn := range conns {
+			for _, k := range voiceKeyEvents(t, conn) {
+				if k.Target != 0 {
+					got[sid] = append(got[sid], k)
+				}
+			}
+		}
+		return got
+	}
+	whisperKeys()
+
+	// The key goes to the sender and the sessions the target reaches only
+	srv.handleWhisperTarget(handler, commander.ID, &pb.WhisperTargetRequest{
+		TargetID: 1, UserIDs: []int64{medic.ID}, ChannelIDs: []int64{squad.ID},
+	}, st, conns[commander.ID])
+	got := whisperKeys()
+	first := got[commander.ID]
+	if len(first) != 1 || first[0].Sender != commander.ID || first[0].Target != 1 || len(first[0].Key) == 0 {
+		t.Fatalf("register: want the key for the sender, got %+v", got)
+	}
+	for _, sid := range []uint32{lead.ID, medicSess.ID} {
+		if len(got[sid]) != 1 || !bytes.Equal(got[sid][0].Key, first[0].Key) {
+			t.Fatalf("register: want the key for session %d, got %+v", sid, got[sid])
+		}
+	}
+	if len(got[bystander.ID]) != 0 {
+		t.Fatalf("register: key handed to a session outside the target: %+v", got[bystander.ID])
+	}
+
+	// A newcomer gets the current key; nobody else hears of it
+	srv.handleJoinChannel(handler, bystander.ID, &pb.JoinChannelRequest{ChannelID: squad.ID}, st, conns[bystander.ID])
+	got = whisperKeys()
+	if len(got) != 1 || len(got[bystander.ID]) != 1 || got[bystander.ID][0].Epoch != first[0].Epoch {
+		t.Fatalf("join: want the current key for the newcomer only, got %+v", got)
+	}
+
+	// A recipient leaving rotates the key and tells the leaver to forget it
+	srv.handleJoinChannel(handler, lead.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, conns[lead.ID])
+	got = whisperKeys()
+	if len(got[lead.ID]) != 1 || len(got[lead.ID][0].Key) != 0 {
+		t.Fatalf("leave: want the leaver to forget the key, got %+v", got[lead.ID])
+	}
+	for _, sid := range []uint32{commander.ID, bystander.ID, medicSess.ID} {
+		if len(got[sid]) != 1 || got[sid][0].Epoch != first[0].Epoch+1 || bytes.Equal(got[sid][0].Key, first[0].Key) {
+			t.Fatalf("leave: want a new key for session %d, got %+v", sid, got[sid])
+		}
+	}
+
+	// So does a targeted user going offline
+	srv.endSession(handler, medicSess.ID, st)
+	delete(conns, medicSess.ID)
+	got = whisperKeys()
+	for _, sid := range []uint32{commander.ID, bystander.ID} {
+		if len(got[sid]) != 1 || got[sid][0].Epoch != first[0].Epoch+2 {
+			t.Fatalf("endSession: want a new key for session %d, got %+v", sid, got[sid])
+		}
+	}
+
+	// Clearing the target takes the key away from everyone
+	srv.handleWhisperTarget(handler, commander.ID, &pb.WhisperTargetRequest{TargetID: 1}, st, conns[commander.ID])
+	got = whisperKeys()
+	for _, sid := range []uint32{commander.ID, bystander.ID} {
+		if len(got[sid]) != 1 || len(got[sid][0].Key) != 0 {
+			t.Fatalf("clear: want session %d to forget the key, got %+v", sid, got[sid])
+		}
+	}
+}
+
+func TestE2EEChannel(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	secret := &model.Channel{Name: "Secret", E2EE: true}
+	if err := st.CreateChannel(secret); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	// Session IDs are random; the lowest one leads an epoch
+	leader := srv.sessions.Create(1, "alice", model.RoleUser)
+	member := srv.sessions.Create(2, "bob", model.RoleUser)
+	if member.ID < leader.ID {
+		leader, member = member, leader
+	}
+	legacy := srv.sessions.Create(3, "legacy", model.RoleUser)
+	srv.sessions.SetIdentityKey(leader.ID, bytes.Repeat([]byte{1}, identityKeySize))
+	srv.sessions.SetIdentityKey(member.ID, bytes.Repeat([]byte{2}, identityKeySize))
+	leaderConn, memberConn, legacyConn := &recordConn{}, &recordConn{}, &recordConn{}
+	handler.setConn(leader.ID, leaderConn)
+	handler.setConn(member.ID, memberConn)
+	handler.setConn(legacy.ID, legacyConn)
+
+	// Clients without an identity key cannot take part
+	srv.handleJoinChannel(handler, legacy.ID, &pb.JoinChannelRequest{ChannelID: secret.ID}, st, legacyConn)
+	if got := srv.channels.ChannelOf(legacy.ID); got != 0 {
+		t.Fatalf("JoinChannel: joined E2EE channel without identity key")
+	}
+	if msgs := controlMessages(t, legacyConn); len(msgs) == 0 || msgs[0].ErrorResponse == nil || msgs[0].ErrorResponse.Code != 14 {
+		t.Fatalf("JoinChannel: want error 14, got %+v", msgs)
+	}
+
+	// Every join starts a new epoch; the server never hands out the key
+	srv.handleJoinChannel(handler, member.ID, &pb.JoinChannelRequest{ChannelID: secret.ID}, st, memberConn)
+	srv.handleJoinChannel(handler, leader.ID, &pb.JoinChannelRequest{ChannelID: secret.ID}, st, leaderConn)
+	memberKeys, leaderKeys := voiceKeyEvents(t, memberConn), voiceKeyEvents(t, leaderConn)
+	if len(memberKeys) != 2 || len(leaderKeys) != 1 {
+		t.Fatalf("join: want 2 and 1 rekeys, got %+v / %+v", memberKeys, leaderKeys)
+	}
+	rekey := leaderKeys[0]
+	if len(rekey.Key) != 0 || rekey.Leader != leader.ID || len(rekey.Members) != 2 || rekey.Epoch != memberKeys[0].Epoch+1 {
+		t.Fatalf("join: unexpected rekey %+v", rekey)
+	}
+	if rekey.Members[1].SessionID != member.ID || !bytes.Equal(rekey.Members[1].IdentityKey, bytes.Repeat([]byte{2}, identityKeySize)) {
+		t.Fatalf("join: members carry wrong identity keys: %+v", rekey.Members)
+	}
+
+	// Only the leader's keys for the current epoch are relayed, and only to
+	// the member each was wrapped for
+	wrapped := []pb.WrappedKey{{SessionID: member.ID, Key: []byte("for member")}, {SessionID: legacy.ID, Key: []byte("for legacy")}}
+	srv.handleGroupKey(handler, member.ID, &pb.GroupKeyMessage{ChannelID: secret.ID, Epoch: rekey.Epoch, Keys: wrapped})
+	srv.handleGroupKey(handler, leader.ID, &pb.GroupKeyMessage{ChannelID: secret.ID, Epoch: rekey.Epoch - 1, Keys: wrapped})
+	if msgs := controlMessages(t, memberConn); len(msgs) != 0 {
+		t.Fatalf("GroupKey: relayed from non-leader or stale epoch: %+v", msgs)
+	}
+	srv.handleGroupKey(handler, leader.ID, &pb.GroupKeyMessage{ChannelID: secret.ID, Epoch: rekey.Epoch, Keys: wrapped})
+	msgs := controlMessages(t, memberConn)
+	if len(msgs) != 1 || msgs[0].GroupKeyMsg == nil || msgs[0].GroupKeyMsg.Sender != leader.ID ||
+		len(msgs[0].GroupKeyMsg.Keys) != 1 || string(msgs[0].GroupKeyMsg.Keys[0].Key) != "for member" {
+		t.Fatalf("GroupKey: want the member's key from the leader, got %+v", msgs)
+	}
+	for _, msg := range controlMessages(t, legacyConn) {
+		if msg.GroupKeyMsg != nil {
+			t.Fatalf("GroupKey: relayed to a non-member: %+v", msg.GroupKeyMsg)
+		}
+	}
+
+	// Leaving starts a new epoch without the leaver
+	srv.handleLeaveChannel(handler, member.ID, st, memberConn)
+	leaderKeys = voiceKeyEvents(t, leaderConn)
+	if len(leaderKeys) != 1 || leaderKeys[0].Epoch != rekey.Epoch+1 || len(leaderKeys[0].Members) != 1 {
+		t.Fatalf("leave: want a rekey for the leader alone, got %+v", leaderKeys)
+	}
+
+	// Turning E2EE on is refused while a member has no identity key
+	plain := &model.Channel{Name: "Open"}
+	if err := st.CreateChannel(plain); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	admin := srv.sessions.Create(4, "admin", model.RoleAdmin)
+	adminConn := &recordConn{}
+	srv.channels.Join(legacy.ID, plain.ID)
+	edit := &pb.EditChannelRequest{ChannelID: plain.ID, Name: "Open", E2EE: true}
+	srv.handleEditChannel(admin.ID, edit, st, adminConn, handler)
+	if got, _ := st.GetChannel(plain.ID); got.E2EE {
+		t.Fatalf("EditChannel: enabled E2EE with a member lacking an identity key")
+	}
+	if msgs := controlMessages(t, adminConn); len(msgs) == 0 || msgs[0].ErrorResponse == nil || msgs[0].ErrorResponse.Code != 14 {
+		t.Fatalf("EditChannel: want error 14, got %+v", msgs)
+	}
+	srv.channels.Leave(legacy.ID)
+	srv.handleEditChannel(admin.ID, edit, st, adminConn, handler)
+	if got, _ := st.GetChannel(plain.ID); !got.E2EE {
+		t.Fatalf("EditChannel: E2EE not enabled once the channel was clear")
+	}
+}
+
+func TestControlEncodingNegotiation(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	srv.cfg.AllowNoToken = true
+
+	ch := &model.Channel{Name: "Lobby"}
+	if err := st.CreateChannel(ch); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+
+	// The request is JSON; once the client offered protobuf, everything
+	// after the JSON response is protobuf in both directions
+	conn := newScriptConn(t, &pb.ControlMessage{AuthRequest: &pb.AuthRequest{Username: "alice", Encodings: []string{"cbor", "protobuf"}}})
+	join := &pb.ControlMessage{JoinChannelRequest: &pb.JoinChannelRequest{ChannelID: ch.ID}}
+	bye := &pb.ControlMessage{DisconnectReq: &pb.DisconnectRequest{}}
+	for _, m := range []*pb.ControlMessage{join, bye} {
+		if err := protocol.WriteControlMessageAs(&conn.in, m, protocol.EncodingProtobuf); err != nil {
+			t.Fatalf("WriteControlMessageAs: %v", err)
+		}
+	}
+	srv.handleControlConn(handler, conn, st)
+
+	msg, err := protocol.ReadControlMessageAs(&conn.out, protocol.EncodingJSON)
+	if err != nil || msg.AuthResponse == nil || msg.AuthResponse.Encoding != "protobuf" {
+		t.Fatalf("auth: want a JSON response choosing protobuf, got %+v err=%v", msg, err)
+	}
+	var joined bool
+	for conn.out.Len() > 0 {
+		msg, err := protocol.ReadControlMessageAs(&conn.out, protocol.EncodingProtobuf)
+		if err != nil {
+			t.Fatalf("ReadControlMessageAs: %v", err)
+		}
+		if msg.ServerStateEvent != nil {
+			for _, c := range msg.ServerStateEvent.Channels {
+				joined = joined || (c.ID == ch.ID && len(c.Users) == 1 && c.Users[0].Username == "alice")
+			}
+		}
+	}
+	if !joined {
+		t.Fatalf("join sent as protobuf was not handled")
+	}
+
+	// Clients that offer nothing stay on JSON
+	conn = newScriptConn(t, &pb.ControlMessage{AuthRequest: &pb.AuthRequest{Username: "bob"}}, bye)
+	srv.handleControlConn(handler, conn, st)
+	if msg, err := protocol.ReadControlMessage(&conn.out); err != nil || msg.AuthResponse == nil || msg.AuthResponse.Encoding != "" {
+		t.Fatalf("auth: want a plain JSON response, got %+v err=%v", msg, err)
+	}
+}
+
+func TestServerStateDeltas(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	lobby := &model.Channel{Name: "Lobby"}
+	guests := &model.Channel{Name: "Guests"}
+	for _, ch := range []*model.Channel{lobby, guests} {
+		if err := st.CreateChannel(ch); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+	}
+	sub := &model.Channel{Name: "Sub", ParentID: guests.ID}
+	if err := st.CreateChannel(sub); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+
+	alice := srv.sessions.Create(1, "alice", model.RoleUser)
+	guest := srv.sessions.Create(2, "guest", model.RoleUser)
+	legacy := srv.sessions.Create(3, "legacy", model.RoleUser)
+	srv.sessions.SetStateDeltas(alice.ID, true)
+	srv.sessions.SetStateDeltas(guest.ID, true)
+	srv.sessions.SetChannelScope(guest.ID, guests.ID)
+	aliceConn, guestConn, legacyConn := &recordConn{}, &recordConn{}, &recordConn{}
+	handler.setConn(alice.ID, aliceConn)
+	handler.setConn(guest.ID, guestConn)
+	handler.setConn(legacy.ID, legacyConn)
+
+	lastDelta := func(conn *recordConn) *pb.ServerStateDelta {
+		t.Helper()
+		var delta *pb.ServerStateDelta
+		for _, msg := range controlMessages(t, conn) {
+			if msg.ServerStateEvent != nil {
+				t.Fatalf("full state sent to a client that takes deltas")
+			}
+			if msg.ServerStateDelta != nil {
+				delta = msg.ServerStateDelta
+			}
+		}
+		if delta == nil {
+			t.Fatalf("no delta sent")
+		}
+		return delta
+	}
+
+	// The first broadcast adds everything; scoped sessions see their tree only
+	srv.broadcastServerState(st, handler)
+	if d := lastDelta(aliceConn); d.Version != 1 || len(d.ChannelUpdates) != 3 {
+		t.Fatalf("initial delta: got %+v", d)
+	}
+	if d := lastDelta(guestConn); d.Version != 1 || len(d.ChannelUpdates) != 2 || d.ChannelUpdates[0].ID != guests.ID || d.ChannelUpdates[0].ParentID != 0 {
+		t.Fatalf("initial scoped delta: got %+v", d)
+	}
+	msgs := controlMessages(t, legacyConn)
+	if len(msgs) != 1 || msgs[0].ServerStateEvent == nil || msgs[0].ServerStateEvent.Version != 1 || len(msgs[0].ServerStateEvent.Channels) != 3 {
+		t.Fatalf("initial full state: got %+v", msgs)
+	}
+
+	// A join is one user update; sessions that cannot see it still move on
+	// to the new version
+	srv.handleJoinChannel(handler, alice.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, aliceConn)
+	d := lastDelta(aliceConn)
+	if d.Version != 2 || len(d.ChannelUpdates) != 0 || len(d.UserUpdates) != 1 ||
+		d.UserUpdates[0].ChannelID != lobby.ID || d.UserUpdates[0].User.SessionID != alice.ID {
+		t.Fatalf("join delta: got %+v", d)
+	}
+	if d := lastDelta(guestConn); d.Version != 2 || len(d.ChannelUpdates)+len(d.UserUpdates) != 0 {
+		t.Fatalf("join delta out of scope: got %+v", d)
+	}
+	_ = controlMessages(t, legacyConn)
+
+	// Nothing changed, nothing sent
+	srv.broadcastServerState(st, handler)
+	if aliceConn.out.Len()+guestConn.out.Len()+legacyConn.out.Len() != 0 {
+		t.Fatalf("broadcast without a change sent an update")
+	}
+
+	if err := st.DeleteChannel(sub.ID); err != nil {
+		t.Fatalf("DeleteChannel: %v", err)
+	}
+	srv.broadcastServerState(st, handler)
+	if d := lastDelta(guestConn); d.Version != 3 || len(d.ChannelRemovals) != 1 || d.ChannelRemovals[0] != sub.ID {
+		t.Fatalf("delete delta: got %+v", d)
+	}
+
+	// A client that missed a delta asks for the full state
+	srv.handleMessage(handler, guest.ID, &pb.ControlMessage{ServerStateReq: &pb.ServerStateRequest{}}, st, guestConn)
+	msgs = controlMessages(t, guestConn)
+	if len(msgs) != 1 || msgs[0].ServerStateEvent == nil || msgs[0].ServerStateEvent.Version != 3 ||
+		len(msgs[0].ServerStateEvent.Channels) != 1 || msgs[0].ServerStateEvent.Channels[0].ID != guests.ID {
+		t.Fatalf("resync: got %+v", msgs)
+	}
+}
+
+// blockConn is a recordConn whose writes wait for release.
+type blockConn struct {
+	recordConn
+	release chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newBlockConn() *blockConn {
+	return &blockConn{release: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (c *blockConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.release:
+		return c.recordConn.Write(p)
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *blockConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	srv, _, _ := newTestServer(t)
+	sess := srv.sessions.Create(1, "alice", model.RoleUser)
+	ping := &pb.ControlMessage{Ping: &pb.Ping{}}
+
+	delta := &pb.ControlMessage{ServerStateDelta: &pb.ServerStateDelta{Version: 1}}
+
+	// Drop policy: the writer holds one frame, two more fit, the fourth
+	// (a state delta) is dropped
+	conn := newBlockConn()
+	q := newSendQueue(conn, sess.ID, 2, OverflowDrop, srv.metrics)
+	srv.metrics.sendQueues.Store(sess.ID, q)
+	for i := range 4 {
+		err := writeStateDelta(q, delta)
+		if i < 3 && err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		if i == 0 {
+			for q.length() != 0 {
+				time.Sleep(time.Millisecond) // wait for the writer to take it
+			}
+		}
+		if i == 3 && !errors.Is(err, errSendQueueFull) {
+			t.Fatalf("write to full queue: want errSendQueueFull, got %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	srv.handleMetrics(rec, nil)
+	for _, want := range []string{
+		fmt.Sprintf(`gospeak_session_send_queue_length{session="%d",user="alice"} 2`, sess.ID),
+		fmt.Sprintf(`gospeak_session_messages_dropped_total{session="%d",user="alice"} 1`, sess.ID),
+		"gospeak_send_queue_drops_total 1",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics: missing %q", want)
+		}
+	}
+
+	close(conn.release)
+	_ = q.Close()
+	q.wait()
+	if n := len(controlMessages(t, &conn.recordConn)); n != 3 || q.sent.Load() != 3 {
+		t.Fatalf("drop policy: want 3 messages sent, got %d", n)
+	}
+
+	// Drop policy: anything but a state delta still disconnects
+	conn = newBlockConn()
+	q = newSendQueue(conn, sess.ID, 1, OverflowDrop, srv.metrics)
+	for range 3 {
+		_ = protocol.WriteControlMessage(q, ping)
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("drop policy: connection not closed on a full queue of pings")
+	}
+	q.wait()
+
+	// Disconnect policy: overflowing closes the connection
+	conn = newBlockConn()
+	q = newSendQueue(conn, sess.ID, 1, OverflowDisconnect, srv.metrics)
+	for range 3 {
+		_ = protocol.WriteControlMessage(q, ping)
+	}
+	select {
+	case <-conn.closed:
+	case <-time.After(time.Second):
+		t.Fatalf("disconnect policy: connection not closed")
+	}
+	if err := protocol.WriteControlMessage(q, ping); err == nil {
+		t.Fatalf("write after overflow succeeded")
+	}
+	q.wait()
+	if srv.metrics.SendQueueOverflows.Load() != 2 {
+		t.Fatalf("overflows not counted")
+	}
+}
+
+func TestChatHistory(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	lobby := &model.Channel{Name: "Lobby"}
+	quiet := &model.Channel{Name: "Quiet", ChatRetention: -time.Second}
+	for _, ch := range []*model.Channel{lobby, quiet} {
+		if err := st.CreateChannel(ch); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+	}
+
+	alice := srv.sessions.Create(1, "alice", model.RoleUser)
+	bob := srv.sessions.Create(2, "bob", model.RoleUser)
+	aliceConn, bobConn := &recordConn{}, &recordConn{}
+	handler.setConn(alice.ID, aliceConn)
+	handler.setConn(bob.ID, bobConn)
+	srv.handleJoinChannel(handler, alice.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, aliceConn)
+
+	// An old message past the retention is not served
+	if err := st.AddChatMessage(&model.ChatMessage{ChannelID: lobby.ID, Username: "ghost", Text: "old", CreatedAt: time.Now().Add(-DefaultChatRetention - time.Hour)}); err != nil {
+		t.Fatalf("AddChatMessage: %v", err)
+	}
+	for _, text := range []string{"one", "two", "three"} {
+		srv.handleChatMessage(handler, alice.ID, &pb.ChatMessage{Text: text}, st, aliceConn)
+	}
+	var ids []int64
+	for _, msg := range controlMessages(t, aliceConn) {
+		if msg.ChatEvent != nil {
+			ids = append(ids, msg.ChatEvent.ID)
+		}
+	}
+	if len(ids) != 3 || ids[0] == 0 || ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Fatalf("chat event IDs: got %v", ids)
+	}
+
+	history := func(conn *recordConn) *pb.ChatHistoryResponse {
+		t.Helper()
+		var resp *pb.ChatHistoryResponse
+		for _, msg := range controlMessages(t, conn) {
+			if msg.ErrorResponse != nil {
+				t.Fatalf("history request failed: %+v", msg.ErrorResponse)
+			}
+			if msg.ChatHistoryResp != nil {
+				resp = msg.ChatHistoryResp
+			}
+		}
+		if resp == nil {
+			t.Fatalf("no history response")
+		}
+		return resp
+	}
+
+	// Only members may read the history
+	_ = controlMessages(t, bobConn)
+	srv.handleChatHistoryRequest(bob.ID, &pb.ChatHistoryRequest{ChannelID: lobby.ID}, st, bobConn)
+	msgs := controlMessages(t, bobConn)
+	if len(msgs) != 1 || msgs[0].ErrorResponse == nil || msgs[0].ErrorResponse.Code != 30 {
+		t.Fatalf("history of a foreign channel: got %+v", msgs)
+	}
+
+	// A late joiner pages back from the newest message, oldest first
+	srv.handleJoinChannel(handler, bob.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, bobConn)
+	srv.handleChatHistoryRequest(bob.ID, &pb.ChatHistoryRequest{ChannelID: lobby.ID, Limit: 2}, st, bobConn)
+	resp := history(bobConn)
+	if len(resp.Messages) != 2 || resp.Messages[0].Text != "two" || resp.Messages[1].Text != "three" ||
+		resp.Messages[1].ID != ids[2] || resp.Messages[0].SenderName != "alice" || resp.NextBefore != ids[1] {
+		t.Fatalf("first page: got %+v", resp)
+	}
+	srv.handleChatHistoryRequest(bob.ID, &pb.ChatHistoryRequest{ChannelID: lobby.ID, Before: resp.NextBefore, Limit: 2}, st, bobConn)
+	resp = history(bobConn)
+	if len(resp.Messages) != 1 || resp.Messages[0].Text != "one" || resp.NextBefore != 0 {
+		t.Fatalf("last page: got %+v", resp)
+	}
+
+	// Pruning drops the expired message
+	srv.pruneChatHistory(st)
+	stored, err := st.ListChatMessages(lobby.ID, 0, 10)
+	if err != nil || len(stored) != 3 {
+		t.Fatalf("after prune: got %d messages (%v)", len(stored), err)
+	}
+
+	// Channels without history neither keep nor serve messages, but still
+	// number them
+	srv.handleJoinChannel(handler, bob.ID, &pb.JoinChannelRequest{ChannelID: quiet.ID}, st, bobConn)
+	srv.handleChatMessage(handler, bob.ID, &pb.ChatMessage{Text: "hush"}, st, bobConn)
+	for _, msg := range controlMessages(t, bobConn) {
+		if msg.ChatEvent != nil && msg.ChatEvent.ID == 0 {
+			t.Fatalf("message without an ID: %+v", msg.ChatEvent)
+		}
+	}
+	if kept, err := st.ListChatMessages(quiet.ID, 0, 10); err != nil || len(kept) != 0 {
+		t.Fatalf("message kept in a channel without history: %+v (%v)", kept, err)
+	}
+	srv.handleChatHistoryRequest(bob.ID, &pb.ChatHistoryRequest{ChannelID: quiet.ID}, st, bobConn)
+	if resp := history(bobConn); len(resp.Messages) != 0 {
+		t.Fatalf("history of a channel without history: got %+v", resp)
+	}
+}
+
+func TestDirectMessages(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	users := map[string]*model.User{}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		u, err := st.CreateUser(name, model.RoleUser)
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		users[name] = u
+	}
+	alice := srv.sessions.Create(users["alice"].ID, "alice", model.RoleUser)
+	carol := srv.sessions.Create(users["carol"].ID, "carol", model.RoleUser)
+	aliceConn, carolConn := &recordConn{}, &recordConn{}
+	handler.setConn(alice.ID, aliceConn)
+	handler.setConn(carol.ID, carolConn)
+
+	events := func(conn *recordConn) []*pb.DirectMessage {
+		t.Helper()
+		var dms []*pb.DirectMessage
+		for _, msg := range controlMessages(t, conn) {
+			if msg.ErrorResponse != nil {
+				t.Fatalf("unexpected error: %+v", msg.ErrorResponse)
+			}
+			if msg.DirectMsgEvent != nil {
+				dms = append(dms, msg.DirectMsgEvent)
+			}
+		}
+		return dms
+	}
+
+	// Online recipients get the message right away; the sender gets it back
+	srv.handleDirectMessage(handler, alice.ID, &pb.DirectMessage{RecipientID: users["carol"].ID, Text: " hi carol "}, st, aliceConn)
+	got := events(carolConn)
+	if len(got) != 1 || got[0].Text != "hi carol" || got[0].SenderID != users["alice"].ID || got[0].SenderName != "alice" || got[0].Stored {
+		t.Fatalf("delivered message: got %+v", got)
+	}
+	if echo := events(aliceConn); len(echo) != 1 || echo[0].RecipientID != users["carol"].ID || echo[0].Stored {
+		t.Fatalf("sender echo: got %+v", echo)
+	}
+
+	// Offline recipients get it stored
+	for _, text := range []string{"hi bob", "call me"} {
+		srv.handleDirectMessage(handler, alice.ID, &pb.DirectMessage{RecipientID: users["bob"].ID, Text: text}, st, aliceConn)
+	}
+	if echo := events(aliceConn); len(echo) != 2 || !echo[0].Stored || echo[0].ID == 0 {
+		t.Fatalf("stored echo: got %+v", echo)
+	}
+
+	// Guests on a channel-scoped token can neither message nor probe users
+	guest := srv.sessions.Create(users["bob"].ID, "bob", model.RoleUser)
+	srv.sessions.SetChannelScope(guest.ID, 1)
+	for _, to := range []int64{users["carol"].ID, 999} {
+		srv.handleDirectMessage(handler, guest.ID, &pb.DirectMessage{RecipientID: to, Text: "psst"}, st, aliceConn)
+		msgs := controlMessages(t, aliceConn)
+		if len(msgs) != 1 || msgs[0].ErrorResponse == nil || msgs[0].ErrorResponse.Code != 12 {
+			t.Fatalf("scoped message to %d: got %+v", to, msgs)
+		}
+	}
+	if got := events(carolConn); len(got) != 0 {
+		t.Fatalf("scoped message delivered: %+v", got)
+	}
+	srv.sessions.Remove(guest.ID)
+
+	for _, bad := range []int64{users["alice"].ID, 999} {
+		srv.handleDirectMessage(handler, alice.ID, &pb.DirectMessage{RecipientID: bad, Text: "x"}, st, aliceConn)
+		msgs := controlMessages(t, aliceConn)
+		if len(msgs) != 1 || msgs[0].ErrorResponse == nil || msgs[0].ErrorResponse.Code != 31 {
+			t.Fatalf("message to %d: got %+v", bad, msgs)
+		}
+	}
+
+	// bob comes online, sees the count and reads the messages once
+	want := []pb.UnreadCount{{UserID: users["alice"].ID, Username: "alice", Count: 2}}
+	if got := unreadCounts(st, users["bob"].ID); !slices.Equal(got, want) {
+		t.Fatalf("unreadCounts: got %+v, want %+v", got, want)
+	}
+	bob := srv.sessions.Create(users["bob"].ID, "bob", model.RoleUser)
+	bobConn := &recordConn{}
+	handler.setConn(bob.ID, bobConn)
+	srv.handleUnreadMessages(bob.ID, &pb.UnreadMessagesRequest{UserID: users["alice"].ID}, st, bobConn)
+	msgs := controlMessages(t, bobConn)
+	if len(msgs) != 1 || msgs[0].UnreadMsgsResp == nil || len(msgs[0].UnreadMsgsResp.Messages) != 2 ||
+		msgs[0].UnreadMsgsResp.Messages[0].Text != "hi bob" || msgs[0].UnreadMsgsResp.Messages[1].Text != "call me" {
+		t.Fatalf("unread messages: got %+v", msgs)
+	}
+	// Nothing is dropped until bob acknowledges what he received
+	if got := unreadCounts(st, users["bob"].ID); !slices.Equal(got, want) {
+		t.Fatalf("unread before ack: got %+v, want %+v", got, want)
+	}
+	first := msgs[0].UnreadMsgsResp.Messages[0].ID
+	srv.handleUnreadMessages(bob.ID, &pb.UnreadMessagesRequest{UserID: users["alice"].ID, Ack: first}, st, bobConn)
+	msgs = controlMessages(t, bobConn)
+	if len(msgs) != 1 || msgs[0].UnreadMsgsResp == nil || len(msgs[0].UnreadMsgsResp.Messages) != 1 ||
+		msgs[0].UnreadMsgsResp.Messages[0].Text != "call me" {
+		t.Fatalf("unread after partial ack: got %+v", msgs)
+	}
+	last := msgs[0].UnreadMsgsResp.Messages[0].ID
+	srv.handleUnreadMessages(bob.ID, &pb.UnreadMessagesRequest{UserID: users["alice"].ID, Ack: last}, st, bobConn)
+	msgs = controlMessages(t, bobConn)
+	if len(msgs) != 1 || msgs[0].UnreadMsgsResp == nil || len(msgs[0].UnreadMsgsResp.Messages) != 0 {
+		t.Fatalf("unread after ack: got %+v", msgs)
+	}
+	if unread := unreadCounts(st, users["bob"].ID); len(unread) != 0 {
+		t.Fatalf("unread after reading: got %+v", unread)
+	}
+}
+
+func TestServerBroadcast(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+	srv.cfg.AllowNoToken = true
+	srv.cfg.MOTD = "Welcome!"
+
+	// Not started yet: nobody to tell
+	if n := srv.Broadcast("hello"); n != 0 {
+		t.Fatalf("Broadcast before start: sent to %d sessions", n)
+	}
+	srv.control = handler
+
+	ch := &model.Channel{Name: "Lobby"}
+	if err := st.CreateChannel(ch); err != nil {
+		t.Fatalf("CreateChannel: %v", err)
+	}
+	admin := srv.sessions.Create(1, "admin", model.RoleAdmin)
+	user := srv.sessions.Create(2, "bob", model.RoleUser)
+	srv.channels.Join(user.ID, ch.ID) // the admin is in no channel
+	adminConn, userConn := &recordConn{}, &recordConn{}
+	handler.setConn(admin.ID, adminConn)
+	handler.setConn(user.ID, userConn)
+
+	announcements := func(conn *recordConn) []pb.ServerBroadcastEvent {
+		t.Helper()
+		var got []pb.ServerBroadcastEvent
+		for _, msg := range controlMessages(t, conn) {
+			if msg.BroadcastEvent != nil {
+				got = append(got, *msg.BroadcastEvent)
+			}
+		}
+		return got
+	}
+
+	srv.handleServerBroadcast(handler, user.ID, &pb.ServerBroadcastRequest{Text: "hi"}, userConn)
+	msgs := controlMessages(t, userConn)
+	if len(msgs) != 1 || msgs[0].ErrorResponse == nil || msgs[0].ErrorResponse.Code != 30 {
+		t.Fatalf("broadcast by user: got %+v", msgs)
+	}
+
+	srv.handleServerBroadcast(handler, admin.ID, &pb.ServerBroadcastRequest{Text: " Restarting in 5 minutes "}, adminConn)
+	for _, conn := range []*recordConn{adminConn, userConn} {
+		got := announcements(conn)
+		if len(got) != 1 || got[0].Text != "Restarting in 5 minutes" || got[0].SenderName != "admin" {
+			t.Fatalf("admin broadcast: got %+v", got)
+		}
+	}
+
+	if n := srv.Broadcast("Shutting down"); n != 2 {
+		t.Fatalf("Broadcast: sent to %d sessions, want 2", n)
+	}
+	if got := announcements(userConn); len(got) != 1 || got[0].Text != "Shutting down" || got[0].SenderName != "" {
+		t.Fatalf("server broadcast: got %+v", got)
+	}
+
+	// New users get the message of the day
+	conn := newScriptConn(t, &pb.ControlMessage{AuthRequest: &pb.AuthRequest{Username: "carol"}})
+	srv.handleControlConn(handler, conn, st)
+	if msg, err := protocol.ReadControlMessage(&conn.out); err != nil || msg.AuthResponse == nil || msg.AuthResponse.MOTD != "Welcome!" {
+		t.Fatalf("auth: want the MOTD, got %+v err=%v", msg, err)
+	}
+}
+
+func TestChatEditDelete(t *testing.T) {
+	srv, st, handler := newTestServer(t)
+
+	lobby := &model.Channel{Name: "Lobby"}
+	quiet := &model.Channel{Name: "Quiet", ChatRetention: -time.Second}
+	for _, ch := range []*model.Channel{lobby, quiet} {
+		if err := st.CreateChannel(ch); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+	}
+	alice := srv.sessions.Create(1, "alice", model.RoleUser)
+	bob := srv.sessions.Create(2, "bob", model.RoleUser)
+	mod := srv.sessions.Create(3, "mod", model.RoleModerator)
+	aliceConn, bobConn, modConn := &recordConn{}, &recordConn{}, &recordConn{}
+	for sess, conn := range map[*model.Session]*recordConn{alice: aliceConn, bob: bobConn, mod: modConn} {
+		handler.setConn(sess.ID, conn)
+	}
+
+	errorCode := func(conn *recordConn) int32 {
+		t.Helper()
+		msgs := controlMessages(t, conn)
+		if len(msgs) != 1 || msgs[0].ErrorResponse == nil {
+			t.Fatalf("want an error, got %+v", msgs)
+		}
+		return msgs[0].ErrorResponse.Code
+	}
+
+	// Stored history and the recent window behave the same
+	for _, ch := range []*model.Channel{lobby, quiet} {
+		for _, sess := range []*model.Session{alice, bob, mod} {
+			srv.handleJoinChannel(handler, sess.ID, &pb.JoinChannelRequest{ChannelID: ch.ID}, st, &nopConn{})
+		}
+		_ = controlMessages(t, bobConn)
+		var ids []int64
+		for _, text := range []string{"helo", "spam"} {
+			srv.handleChatMessage(handler, alice.ID, &pb.ChatMessage{Text: text}, st, aliceConn)
+		}
+		for _, msg := range controlMessages(t, bobConn) {
+			if msg.ChatEvent != nil {
+				ids = append(ids, msg.ChatEvent.ID)
+			}
+		}
+		if len(ids) != 2 {
+			t.Fatalf("%s: chat events: got IDs %v", ch.Name, ids)
+		}
+		_ = controlMessages(t, aliceConn)
+		_ = controlMessages(t, modConn)
+
+		// Only the sender edits
+		srv.handleEditChat(handler, bob.ID, &pb.EditChatRequest{ChannelID: ch.ID, ID: ids[0], Text: "hacked"}, st, bobConn)
+		if code := errorCode(bobConn); code != 30 {
+			t.Fatalf("%s: edit by other user: got code %d", ch.Name, code)
+		}
+		srv.handleEditChat(handler, alice.ID, &pb.EditChatRequest{ChannelID: ch.ID, ID: ids[0], Text: "hello"}, st, aliceConn)
+		msgs := controlMessages(t, bobConn)
+		if len(msgs) != 1 || msgs[0].ChatEditEvent == nil || msgs[0].ChatEditEvent.Text != "hello" ||
+			msgs[0].ChatEditEvent.ID != ids[0] || msgs[0].ChatEditEvent.Edited == 0 {
+			t.Fatalf("%s: edit event: got %+v", ch.Name, msgs)
+		}
+		if got, stored, ok := srv.findChatMessage(st, ch, ids[0]); !ok || got.Text != "hello" || stored != (ch == lobby) {
+			t.Fatalf("%s: edited message: got %+v stored=%v ok=%v", ch.Name, got, stored, ok)
+		}
+
+		// Users delete their own messages, moderators anybody's
+		srv.handleDeleteChat(handler, bob.ID, &pb.DeleteChatRequest{ChannelID: ch.ID, ID: ids[1]}, st, bobConn)
+		if code := errorCode(bobConn); code != 30 {
+			t.Fatalf("%s: delete by other user: got code %d", ch.Name, code)
+		}
+		srv.handleDeleteChat(handler, mod.ID, &pb.DeleteChatRequest{ChannelID: ch.ID, ID: ids[1]}, st, modConn)
+		want := pb.ChatDeleteEvent{ChannelID: ch.ID, ID: ids[1], DeletedBy: "mod"}
+		if msgs := controlMessages(t, aliceConn); len(msgs) != 2 || msgs[1].ChatDeleteEvent == nil || *msgs[1].ChatDeleteEvent != want {
+			t.Fatalf("%s: delete event: got %+v", ch.Name, msgs)
+		}
+		_ = controlMessages(t, bobConn)
+		srv.handleDeleteChat(handler, alice.ID, &pb.DeleteChatRequest{ChannelID: ch.ID, ID: ids[0]}, st, aliceConn)
+		want = pb.ChatDeleteEvent{ChannelID: ch.ID, ID: ids[0]}
+		if msgs := controlMessages(t, bobConn); len(msgs) != 1 || msgs[0].ChatDeleteEvent == nil || *msgs[0].ChatDeleteEvent != want {
+			t.Fatalf("%s: own delete event: got %+v", ch.Name, msgs)
+		}
+		_ = controlMessages(t, aliceConn)
+		srv.handleEditChat(handler, alice.ID, &pb.EditChatRequest{ChannelID: ch.ID, ID: ids[0], Text: "again"}, st, aliceConn)
+		if code := errorCode(aliceConn); code != 31 {
+			t.Fatalf("%s: edit of a deleted message: got code %d", ch.Name, code)
+		}
+		_ = controlMessages(t, modConn)
+	}
+	if kept, err := st.ListChatMessages(lobby.ID, 0, 10); err != nil || len(kept) != 0 {
+		t.Fatalf("lobby history after deletes: %+v (%v)", kept, err)
+	}
+
+	// A moderator scoped to another channel cannot touch or probe lobby chat
+	srv.handleJoinChannel(handler, alice.ID, &pb.JoinChannelRequest{ChannelID: lobby.ID}, st, &nopConn{})
+	srv.handleChatMessage(handler, alice.ID, &pb.ChatMessage{Text: "mine"}, st, aliceConn)
+	var id int64
+	for _, msg := range controlMessages(t, aliceConn) {
+		if msg.ChatEvent != nil {
+			id = msg.ChatEvent.ID
+		}
+	}
+	scoped := srv.sessions.Create(4, "scoped", model.RoleModerator)
+	srv.sessions.SetChannelScope(scoped.ID, quiet.ID)
+	scopedConn := &recordConn{}
+	handler.setConn(scoped.ID, scopedConn)
+	for _, probe := range []int64{id, id + 100} {
+		srv.handleDeleteChat(handler, scoped.ID, &pb.DeleteChatRequest{ChannelID: lobby.ID, ID: probe}, st, scopedConn)
+		if code := errorCode(scopedConn); code != 12 {
+			t.Fatalf("scoped delete of %d: got code %d", probe, code)
+		}
+		srv.handleEditChat(handler, scoped.ID, &pb.EditChatRequest{ChannelID: lobby.ID, ID: probe, Text: "x"}, st, scopedConn)
+		if code := errorCode(scopedConn); code != 12 {
+			t.Fatalf("scoped edit of %d: got code %d", probe, code)
+		}
+	}
+	if _, _, ok := srv.findChatMessage(st, lobby, id); !ok {
+		t.Fatalf("scoped moderator deleted a message outside the scope")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"sync"
 
 	"github.com/NicolasHaas/gospeak/pkg/model"
+	"github.com/NicolasHaas/gospeak/pkg/rbac"
 )
 
 // SessionManager manages active client sessions.
@@ -17,14 +18,49 @@ type SessionManager struct {
 
 // SessionSnapshot is an immutable view of a session.
 type SessionSnapshot struct {
-	ID        uint32
-	UserID    int64
-	Username  string
-	Role      model.Role
-	ChannelID int64
-	UDPAddr   *net.UDPAddr
-	Muted     bool
-	Deafened  bool
+	ID           uint32
+	UserID       int64
+	Username     string
+	Role         model.Role
+	ChannelScope int64
+	ChannelID    int64
+	IdentityKey  []byte
+	StateDeltas  bool
+	UDPAddr      *net.UDPAddr
+	Muted        bool
+	Deafened     bool
+	SpeakDenied  bool
+
+	ServerMuted     bool
+	ServerDeafened  bool
+	PrioritySpeaker bool
+}
+
+// Subject returns the identity used for channel permission checks.
+func (s SessionSnapshot) Subject() rbac.Subject {
+	return rbac.Subject{UserID: s.UserID, Role: s.Role}
+}
+
+// snapshotOf copies a session into an immutable snapshot. Caller holds sm.mu.
+func snapshotOf(s *model.Session) SessionSnapshot {
+	return SessionSnapshot{
+		ID:           s.ID,
+		UserID:       s.UserID,
+		Username:     s.Username,
+		Role:         s.Role,
+		ChannelScope: s.ChannelScope,
+		ChannelID:    s.ChannelID,
+		IdentityKey:  s.IdentityKey,
+		StateDeltas:  s.StateDeltas,
+		UDPAddr:      cloneUDPAddr(s.UDPAddr),
+		Muted:        s.Muted,
+		Deafened:     s.Deafened,
+		SpeakDenied:  s.SpeakDenied,
+
+		ServerMuted:     s.ServerMuted,
+		ServerDeafened:  s.ServerDeafened,
+		PrioritySpeaker: s.PrioritySpeaker,
+	}
 }
 
 // NewSessionManager creates a new session manager.
@@ -39,29 +75,48 @@ func (sm *SessionManager) Create(userID int64, username string, role model.Role)
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	// Generate random session ID
-	var id uint32
+	sess := &model.Session{
+		ID:       sm.newIDLocked(),
+		UserID:   userID,
+		Username: username,
+		Role:     role,
+	}
+	sm.sessions[sess.ID] = sess
+	return sess
+}
+
+// newIDLocked generates an unused random session ID. Caller holds sm.mu.
+func (sm *SessionManager) newIDLocked() uint32 {
 	for {
 		b := make([]byte, 4)
 		if _, err := rand.Read(b); err != nil {
 			panic("crypto/rand failure: " + err.Error())
 		}
-		id = binary.BigEndian.Uint32(b)
+		id := binary.BigEndian.Uint32(b)
 		if id != 0 {
 			if _, exists := sm.sessions[id]; !exists {
-				break
+				return id
 			}
 		}
 	}
+}
 
-	sess := &model.Session{
-		ID:       id,
-		UserID:   userID,
-		Username: username,
-		Role:     role,
+// Takeover moves the state of session oldID to a new session ID and removes
+// the old one. A resumed client gets a fresh ID because voice nonces are
+// only unique per session ID. The UDP address is not carried over.
+func (sm *SessionManager) Takeover(oldID uint32) (SessionSnapshot, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	old, ok := sm.sessions[oldID]
+	if !ok {
+		return SessionSnapshot{}, false
 	}
-	sm.sessions[id] = sess
-	return sess
+	sess := *old
+	sess.ID = sm.newIDLocked()
+	sess.UDPAddr = nil
+	delete(sm.sessions, oldID)
+	sm.sessions[sess.ID] = &sess
+	return snapshotOf(&sess), true
 }
 
 // GetSnapshot returns an immutable snapshot of the session by session ID.
@@ -72,16 +127,18 @@ func (sm *SessionManager) GetSnapshot(sessionID uint32) (SessionSnapshot, bool)
 	if !ok {
 		return SessionSnapshot{}, false
 	}
-	return SessionSnapshot{
-		ID:        s.ID,
-		UserID:    s.UserID,
-		Username:  s.Username,
-		Role:      s.Role,
-		ChannelID: s.ChannelID,
-		UDPAddr:   cloneUDPAddr(s.UDPAddr),
-		Muted:     s.Muted,
-		Deafened:  s.Deafened,
-	}, true
+	return snapshotOf(s), true
+}
+
+// Snapshots returns snapshots of all active sessions.
+func (sm *SessionManager) Snapshots() []SessionSnapshot {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	snaps := make([]SessionSnapshot, 0, len(sm.sessions))
+	for _, s := range sm.sessions {
+		snaps = append(snaps, snapshotOf(s))
+	}
+	return snaps
 }
 
 // GetByUserIDSnapshot retrieves a session snapshot by user ID.
@@ -90,26 +147,23 @@ func (sm *SessionManager) GetByUserIDSnapshot(userID int64) (SessionSnapshot, bo
 	defer sm.mu.RUnlock()
 	for _, s := range sm.sessions {
 		if s.UserID == userID {
-			return SessionSnapshot{
-				ID:        s.ID,
-				UserID:    s.UserID,
-				Username:  s.Username,
-				Role:      s.Role,
-				ChannelID: s.ChannelID,
-				UDPAddr:   cloneUDPAddr(s.UDPAddr),
-				Muted:     s.Muted,
-				Deafened:  s.Deafened,
-			}, true
+			return snapshotOf(s), true
 		}
 	}
 	return SessionSnapshot{}, false
 }
 
-// Remove removes a session.
-func (sm *SessionManager) Remove(id uint32) {
+// Remove removes a session and returns its last state. ok is false if the
+// session did not exist (anymore).
+func (sm *SessionManager) Remove(id uint32) (SessionSnapshot, bool) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	s, ok := sm.sessions[id]
+	if !ok {
+		return SessionSnapshot{}, false
+	}
 	delete(sm.sessions, id)
+	return snapshotOf(s), true
 }
 
 // SetUDPAddr sets the UDP address for a session (called after first voice packet).
@@ -131,15 +185,76 @@ func (sm *SessionManager) UpdateUserState(id uint32, muted, deafened bool) {
 	}
 }
 
-// SetChannel sets the channel ID for a session.
+// SetServerMute updates the moderator-controlled mute/deafen for a session.
+// It is kept separate from UpdateUserState so the user cannot clear it.
+func (sm *SessionManager) SetServerMute(id uint32, muted, deafened bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.sessions[id]; ok {
+		s.ServerMuted = muted
+		s.ServerDeafened = deafened
+	}
+}
+
+// SetChannel sets the channel ID for a session. Changing channel clears the
+// per-channel priority speaker flag.
 func (sm *SessionManager) SetChannel(id uint32, channelID int64) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 	if s, ok := sm.sessions[id]; ok {
+		if s.ChannelID != channelID {
+			s.PrioritySpeaker = false
+		}
 		s.ChannelID = channelID
 	}
 }
 
+// SetPrioritySpeaker marks a session as priority speaker in its current channel.
+func (sm *SessionManager) SetPrioritySpeaker(id uint32, enabled bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.sessions[id]; ok {
+		s.PrioritySpeaker = enabled
+	}
+}
+
+// SetChannelScope limits a session to a channel and its sub-channels (0 = server-wide).
+func (sm *SessionManager) SetChannelScope(id uint32, channelID int64) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.sessions[id]; ok {
+		s.ChannelScope = channelID
+	}
+}
+
+// SetIdentityKey records the client's X25519 public key. The slice is not
+// modified afterwards, so snapshots share it.
+func (sm *SessionManager) SetIdentityKey(id uint32, key []byte) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.sessions[id]; ok {
+		s.IdentityKey = key
+	}
+}
+
+// SetStateDeltas records whether the client takes ServerStateDelta events.
+func (sm *SessionManager) SetStateDeltas(id uint32, deltas bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.sessions[id]; ok {
+		s.StateDeltas = deltas
+	}
+}
+
+// SetSpeakDenied records whether channel ACLs forbid the session from speaking.
+func (sm *SessionManager) SetSpeakDenied(id uint32, denied bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if s, ok := sm.sessions[id]; ok {
+		s.SpeakDenied = denied
+	}
+}
+
 // UpdateRole updates the role for a session.
 func (sm *SessionManager) UpdateRole(id uint32, role model.Role) {
 	sm.mu.Lock()
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"cmp"
+	"log/slog"
+	"net"
+	"reflect"
+	"slices"
+	"sync"
+
+	"github.com/NicolasHaas/gospeak/pkg/model"
+	"github.com/NicolasHaas/gospeak/pkg/protocol"
+	pb "github.com/NicolasHaas/gospeak/pkg/protocol/pb"
+	"github.com/NicolasHaas/gospeak/pkg/store"
+)
+
+// stateTracker versions the state clients see: the channel tree and who is
+// in which channel. It keeps the state last sent so a change can go out as
+// a ServerStateDelta, and its version goes up by one per change, so clients
+// notice a missed delta. mu also keeps the updates in order on every
+// connection; take it before handler.mu.
+type stateTracker struct {
+	mu      sync.Mutex
+	version uint64
+	last    serverState
+}
+
+// serverState is the channel tree and the channel of every session in it.
+type serverState struct {
+	channels []model.Channel
+	users    map[uint32]pb.UserPresence // sessionID -> channel and user
+}
+
+// stateView is the server state as the sessions of one channel scope see
+// it. Channels are in store order and without users.
+type stateView struct {
+	channels []pb.ChannelInfo
+	users    map[uint32]pb.UserPresence
+}
+
+// currentState reads the channel tree and the channel members.
+func (s *Server) currentState(st store.DataStore) (serverState, error) {
+	channels, err := st.ListChannels()
+	if err != nil {
+		return serverState{}, err
+	}
+	users := make(map[uint32]pb.UserPresence)
+	for _, ch := range channels {
+		for _, u := range s.channelUsers(ch.ID) {
+			users[u.SessionID] = pb.UserPresence{ChannelID: ch.ID, User: u}
+		}
+	}
+	return serverState{channels: channels, users: users}, nil
+}
+
+// view cuts the state to a channel scope (0 = everything).
+func (ss serverState) view(scope int64) stateView {
+	v := stateView{users: make(map[uint32]pb.UserPresence)}
+	visible := make(map[int64]bool)
+	parents := parentsOf(ss.channels)
+	for _, ch := range ss.channels {
+		if parents.inScope(scope, ch.ID) {
+			visible[ch.ID] = true
+			v.channels = append(v.channels, channelInfo(ch, scope))
+		}
+	}
+	for sid, p := range ss.users {
+		if visible[p.ChannelID] {
+			v.users[sid] = p
+		}
+	}
+	return v
+}
+
+// channelInfos returns the view as sent in a ServerStateEvent, with the
+// users inside their channels.
+func (v stateView) channelInfos() []pb.ChannelInfo {
+	infos := slices.Clone(v.channels)
+	index := make(map[int64]int, len(infos))
+	for i, ch := range infos {
+		index[ch.ID] = i
+		infos[i].Users = []pb.UserInfo{}
+	}
+	for _, p := range v.users {
+		if i, ok := index[p.ChannelID]; ok {
+			infos[i].Users = append(infos[i].Users, p.User)
+		}
+	}
+	for i := range infos {
+		slices.SortFunc(infos[i].Users, func(a, b pb.UserInfo) int {
+			return cmp.Or(cmp.Compare(a.Username, b.Username), cmp.Compare(a.SessionID, b.SessionID))
+		})
+	}
+	return infos
+}
+
+// diffViews returns the delta from prev to next without its version, or nil
+// if they are the same.
+func diffViews(prev, next stateView) *pb.ServerStateDelta {
+	d := &pb.ServerStateDelta{}
+	old := make(map[int64]pb.ChannelInfo, len(prev.channels))
+	for _, ch := range prev.channels {
+		old[ch.ID] = ch
+	}
+	for _, ch := range next.channels {
+		if o, ok := old[ch.ID]; !ok || !reflect.DeepEqual(o, ch) {
+			d.ChannelUpdates = append(d.ChannelUpdates, ch)
+		}
+		delete(old, ch.ID)
+	}
+	for _, ch := range prev.channels {
+		if _, ok := old[ch.ID]; ok {
+			d.ChannelRemovals = append(d.ChannelRemovals, ch.ID)
+		}
+	}
+
+	for sid, p := range next.users {
+		if o, ok := prev.users[sid]; !ok || o != p {
+			d.UserUpdates = append(d.UserUpdates, p)
+		}
+	}
+	for sid := range prev.users {
+		if _, ok := next.users[sid]; !ok {
+			d.UserRemovals = append(d.UserRemovals, sid)
+		}
+	}
+	slices.SortFunc(d.UserUpdates, func(a, b pb.UserPresence) int { return cmp.Compare(a.User.SessionID, b.User.SessionID) })
+	slices.Sort(d.UserRemovals)
+
+	if len(d.ChannelUpdates) == 0 && len(d.ChannelRemovals) == 0 && len(d.UserUpdates) == 0 && len(d.UserRemovals) == 0 {
+		return nil
+	}
+	return d
+}
+
+// syncStateLocked brings the tracked state up to date. If it changed, the
+// version goes up and every connection learns what changed within its
+// channel scope: clients with FeatureStateDeltas get a delta, the others
+// the full state. Caller holds s.state.mu.
+func (s *Server) syncStateLocked(st store.DataStore, handler *ControlHandler) {
+	next, err := s.currentState(st)
+	if err != nil {
+		slog.Error("server state read failed", "err", err)
+		return
+	}
+	prev := s.state.last
+	delta := diffViews(prev.view(0), next.view(0))
+	if delta == nil {
+		return
+	}
+	s.state.last = next
+	s.state.version++
+	version := s.state.version
+
+	// Messages are built once per scope
+	type update struct{ delta, full *pb.ControlMessage }
+	delta.Version = version
+	updates := map[int64]*update{0: {delta: &pb.ControlMessage{ServerStateDelta: delta}}}
+
+	handler.mu.RLock()
+	defer handler.mu.RUnlock()
+	for sid, conn := range handler.connMap {
+		sess, ok := s.sessions.GetSnapshot(sid)
+		if !ok {
+			continue
+		}
+		scope := sess.ChannelScope
+		u := updates[scope]
+		if u == nil {
+			u = &update{}
+			updates[scope] = u
+		}
+		if !sess.StateDeltas {
+			if u.full == nil {
+				u.full = &pb.ControlMessage{ServerStateEvent: &pb.ServerStateEvent{
+					Channels: next.view(scope).channelInfos(),
+					Version:  version,
+				}}
+			}
+			_ = protocol.WriteControlMessage(conn, u.full)
+			continue
+		}
+		if u.delta == nil {
+			d := diffViews(prev.view(scope), next.view(scope))
+			if d == nil {
+				d = &pb.ServerStateDelta{} // nothing in scope changed, but the version did
+			}
+			d.Version = version
+			u.delta = &pb.ControlMessage{ServerStateDelta: d}
+		}
+		_ = writeStateDelta(conn, u.delta)
+	}
+}
+
+// writeStateDelta sends a state delta to conn. Only deltas may be dropped
+// when a send queue overflows under OverflowDrop: the client sees the gap
+// in the version of the next delta and asks for the full state. Full
+// states, replies and events are never dropped.
+func writeStateDelta(conn net.Conn, msg *pb.ControlMessage) error {
+	enc := protocol.EncodingJSON
+	if ec, ok := conn.(*protocol.EncodedConn); ok {
+		conn, enc = ec.Conn, ec.Encoding
+	}
+	if q, ok := conn.(*sendQueue); ok {
+		return protocol.WriteControlMessageAs(droppableFrames{q}, msg, enc)
+	}
+	return protocol.WriteControlMessageAs(conn, msg, enc)
+}
+
+// broadcastServerState sends what changed since the last broadcast to ALL
+// connected sessions. Scoped sessions learn only about the channels within
+// their token scope.
+func (s *Server) broadcastServerState(st store.DataStore, handler *ControlHandler) {
+	s.state.mu.Lock()
+	s.syncStateLocked(st, handler)
+	s.state.mu.Unlock()
+	// Whoever joined, left or went offline, and any change of roles or
+	// passwords, may change where whispers go and who holds their keys
+	s.refreshWhisperTargets(st)
+	s.syncWhisperKeys(handler)
+}
+
+// sendServerState sends the full server state, limited to the given channel
+// scope, to a single connection.
+func (s *Server) sendServerState(handler *ControlHandler, st store.DataStore, conn net.Conn, scope int64) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+	s.syncStateLocked(st, handler)
+	_ = protocol.WriteControlMessage(conn, &pb.ControlMessage{
+		ServerStateEvent: &pb.ServerStateEvent{
+			Channels: s.state.last.view(scope).channelInfos(),
+			Version:  s.state.version,
+		},
+	})
+}
+
+// handleServerStateRequest answers a client that missed a delta with the
+// full state.
+func (s *Server) handleServerStateRequest(handler *ControlHandler, sessionID uint32, st store.DataStore, conn net.Conn) {
+	session, ok := s.sessions.GetSnapshot(sessionID)
+	if !ok {
+		sendError(conn, 3, "session not found")
+		return
+	}
+	s.sendServerState(handler, st, conn, session.ChannelScope)
+}
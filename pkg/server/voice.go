@@ -35,6 +35,45 @@ func (s *Server) StartVoice() error {
 	return nil
 }
 
+// voiceRecipients resolves the sessions a voice packet is forwarded to: the
+// members of the sender's channel for normal talk, or the resolved users and
+// channels of a registered whisper target. Unknown targets yield no recipients.
+func (s *Server) voiceRecipients(pkt *protocol.VoicePacket, channelID int64) []uint32 {
+	if pkt.Target == protocol.TargetChannel {
+		return s.channels.Members(channelID)
+	}
+
+	target, ok := s.whispers.Get(pkt.SessionID, pkt.Target)
+	if !ok {
+		return nil
+	}
+	return s.whisperRecipients(target)
+}
+
+// whisperRecipients resolves a whisper target to the sessions it reaches:
+// the members of its channels and the sessions of its online users.
+func (s *Server) whisperRecipients(target WhisperTarget) []uint32 {
+	seen := make(map[uint32]bool)
+	var recipients []uint32
+	add := func(sid uint32) {
+		if !seen[sid] {
+			seen[sid] = true
+			recipients = append(recipients, sid)
+		}
+	}
+	for chID := range target.ChannelIDs {
+		for _, sid := range s.channels.Members(chID) {
+			add(sid)
+		}
+	}
+	for userID := range target.UserIDs {
+		if sess, ok := s.sessions.GetByUserIDSnapshot(userID); ok {
+			add(sess.ID)
+		}
+	}
+	return recipients
+}
+
 // voiceLoop reads UDP voice packets and forwards them to channel members.
 // This is an SFU (Selective Forwarding Unit) - no decryption, no mixing.
 func (s *Server) voiceLoop() {
@@ -88,8 +127,8 @@ func (s *Server) voiceLoop() {
 			continue // source mismatch, drop (prevents UDP session hijack)
 		}
 
-		// Don't forward if muted
-		if session.Muted {
+		// Don't forward if self- or server-muted, or not allowed to speak in this channel
+		if session.Muted || session.ServerMuted || session.SpeakDenied {
 			s.metrics.VoicePacketsDropped.Add(1)
 			continue
 		}
@@ -101,8 +140,7 @@ func (s *Server) voiceLoop() {
 			continue // not in this channel, discard
 		}
 
-		channelID := actualChannel
-		members := s.channels.Members(channelID)
+		members := s.voiceRecipients(pkt, actualChannel)
 
 		rawPacket := buf[:n] // forward raw bytes, no decryption
 
@@ -115,7 +153,7 @@ func (s *Server) voiceLoop() {
 			if !ok || memberSession.UDPAddr == nil {
 				continue
 			}
-			if memberSession.Deafened {
+			if memberSession.Deafened || memberSession.ServerDeafened {
 				continue // don't send to deafened users
 			}
 
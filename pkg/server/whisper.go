@@ -0,0 +1,126 @@
+package server
+
+import (
+	"sync"
+)
+
+// WhisperTarget is a resolved whisper destination: a set of users and a set of
+// channels whose members receive the sender's voice.
+type WhisperTarget struct {
+	UserIDs    map[int64]bool
+	ChannelIDs map[int64]bool // sub-channels are expanded at registration time
+}
+
+// WhisperManager stores the whisper targets registered by each session.
+type WhisperManager struct {
+	mu      sync.RWMutex
+	targets map[uint32]map[uint8]WhisperTarget // sessionID -> target ID -> target
+}
+
+// NewWhisperManager creates a new whisper manager.
+func NewWhisperManager() *WhisperManager {
+	return &WhisperManager{
+		targets: make(map[uint32]map[uint8]WhisperTarget),
+	}
+}
+
+// Set registers or replaces a whisper target for a session.
+func (wm *WhisperManager) Set(sessionID uint32, targetID uint8, target WhisperTarget) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if _, ok := wm.targets[sessionID]; !ok {
+		wm.targets[sessionID] = make(map[uint8]WhisperTarget)
+	}
+	wm.targets[sessionID][targetID] = target
+}
+
+// Clear removes a single whisper target of a session.
+func (wm *WhisperManager) Clear(sessionID uint32, targetID uint8) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	delete(wm.targets[sessionID], targetID)
+	if len(wm.targets[sessionID]) == 0 {
+		delete(wm.targets, sessionID)
+	}
+}
+
+// Get returns a session's whisper target.
+func (wm *WhisperManager) Get(sessionID uint32, targetID uint8) (WhisperTarget, bool) {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	target, ok := wm.targets[sessionID][targetID]
+	return target, ok
+}
+
+// All returns the whisper targets of every session.
+func (wm *WhisperManager) All() map[uint32]map[uint8]WhisperTarget {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	all := make(map[uint32]map[uint8]WhisperTarget, len(wm.targets))
+	for sid, targets := range wm.targets {
+		all[sid] = make(map[uint8]WhisperTarget, len(targets))
+		for id, target := range targets {
+			all[sid][id] = target
+		}
+	}
+	return all
+}
+
+// Any reports whether any session has a whisper target.
+func (wm *WhisperManager) Any() bool {
+	wm.mu.RLock()
+	defer wm.mu.RUnlock()
+	return len(wm.targets) > 0
+}
+
+// Prune drops what sessions may no longer whisper to: every target of a
+// session for which mayWhisper is false, and each target channel for which
+// mayReach is false. Targets left without users and channels are removed.
+func (wm *WhisperManager) Prune(mayWhisper func(sessionID uint32) bool, mayReach func(sessionID uint32, channelID int64) bool) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for sid, targets := range wm.targets {
+		if !mayWhisper(sid) {
+			delete(wm.targets, sid)
+			continue
+		}
+		for id, target := range targets {
+			kept := make(map[int64]bool, len(target.ChannelIDs))
+			for chID := range target.ChannelIDs {
+				if mayReach(sid, chID) {
+					kept[chID] = true
+				}
+			}
+			if len(kept) == len(target.ChannelIDs) {
+				continue
+			}
+			// A new map, as snapshots from All still share the old one
+			target.ChannelIDs = kept
+			if len(target.UserIDs) == 0 && len(target.ChannelIDs) == 0 {
+				delete(targets, id)
+			} else {
+				targets[id] = target
+			}
+		}
+		if len(targets) == 0 {
+			delete(wm.targets, sid)
+		}
+	}
+}
+
+// Move transfers all whisper targets of a session to a new session ID.
+func (wm *WhisperManager) Move(oldID, newID uint32) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if targets, ok := wm.targets[oldID]; ok {
+		delete(wm.targets, oldID)
+		wm.targets[newID] = targets
+	}
+}
+
+// RemoveSession drops all whisper targets of a session.
+func (wm *WhisperManager) RemoveSession(sessionID uint32) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	delete(wm.targets, sessionID)
+}
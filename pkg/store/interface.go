@@ -38,7 +38,13 @@ type DataStore interface {
 	// CreateChannel creates a new channel with basic fields.
 	CreateChannel(channel *model.Channel) error
 
-	// DeleteChannel deletes a channel by ID.
+	// UpdateChannel overwrites an existing channel's mutable fields (name,
+	// description, max users, parent, flags). Reparenting is rejected if it
+	// would create a cycle.
+	UpdateChannel(channel *model.Channel) error
+
+	// DeleteChannel deletes a channel by ID, along with its overrides and
+	// chat history.
 	DeleteChannel(id int64) error
 
 	// ListChannels returns all channels.
@@ -50,25 +56,106 @@ type DataStore interface {
 	// GetChannelByNameAndParent retrieves a channel by name and parent ID.
 	GetChannelByNameAndParent(name string, parentID int64) (*model.Channel, error)
 
+	// ---- Chat history ----
+
+	// AddChatMessage stores a chat message and sets its ID. IDs increase
+	// with every message. A zero CreatedAt is set to the current time.
+	AddChatMessage(msg *model.ChatMessage) error
+
+	// ListChatMessages returns up to limit messages of a channel with an ID
+	// below beforeID (0 = from the newest), newest first.
+	ListChatMessages(channelID, beforeID int64, limit int) ([]model.ChatMessage, error)
+
+	// GetChatMessage returns a message of a channel, or nil if there is
+	// none with that ID.
+	GetChatMessage(channelID, id int64) (*model.ChatMessage, error)
+
+	// UpdateChatMessage replaces the text of a message and records when it
+	// was edited.
+	UpdateChatMessage(channelID, id int64, text string, editedAt time.Time) error
+
+	// DeleteChatMessage removes a message from a channel's history.
+	DeleteChatMessage(channelID, id int64) error
+
+	// PruneChatMessages deletes the messages of a channel created before the
+	// given time and returns how many were deleted.
+	PruneChatMessages(channelID int64, before time.Time) (int64, error)
+
+	// ---- Direct messages ----
+
+	// AddDirectMessage stores a direct message for its recipient and sets
+	// its ID. A zero CreatedAt is set to the current time.
+	AddDirectMessage(msg *model.DirectMessage) error
+
+	// ListDirectMessages returns the stored messages from senderID to
+	// recipientID, oldest first.
+	ListDirectMessages(recipientID, senderID int64) ([]model.DirectMessage, error)
+
+	// DeleteDirectMessages removes the messages from senderID to
+	// recipientID up to and including ID upTo.
+	DeleteDirectMessages(recipientID, senderID, upTo int64) error
+
+	// CountDirectMessages returns how many stored messages recipientID has
+	// from each sender.
+	CountDirectMessages(recipientID int64) (map[int64]int, error)
+
+	// ---- Channel ACLs ----
+
+	// SetChannelACL creates or replaces the override for the entry's
+	// (channel, user or role, permission) target and sets its ID.
+	SetChannelACL(entry *model.ChannelACL) error
+
+	// DeleteChannelACL removes an override by ID.
+	DeleteChannelACL(id int64) error
+
+	// ListChannelACLs returns all overrides, ordered by channel and ID.
+	ListChannelACLs() ([]model.ChannelACL, error)
+
+	// ---- Custom roles ----
+
+	// SaveRole creates a custom role or updates the priority and permissions
+	// of an existing role with the same name. It sets the role's ID; IDs of
+	// existing roles never change so stored user and token roles stay valid.
+	SaveRole(def *model.RoleDefinition) error
+
+	// ListRoles returns all custom roles, ordered by ID.
+	ListRoles() ([]model.RoleDefinition, error)
+
 	// ---- Tokens ----
 
 	// HasTokens returns true if any tokens exist in the database.
 	HasTokens() (bool, error)
 
-	// CreateToken stores a new token (hash only).
-	CreateToken(hash string, role model.Role, channelScope int64, createdBy int64, maxUses int, expiresAt time.Time) error
+	// CreateToken stores a new token (hash only) with an optional label.
+	CreateToken(hash, label string, role model.Role, channelScope int64, createdBy int64, maxUses int, expiresAt time.Time) error
+
+	// ValidateToken checks if a token hash is valid and returns the token record
+	// (role, channel scope, usage). It increments the use count atomically.
+	ValidateToken(hash string) (*model.Token, error)
+
+	// ListTokens returns all tokens, including expired and revoked ones, newest first.
+	ListTokens() ([]model.Token, error)
 
-	// ValidateToken checks if a token hash is valid and returns the associated role.
-	// It increments the use count atomically.
-	ValidateToken(hash string) (model.Role, error)
+	// RevokeToken marks a token as revoked so it can no longer authenticate.
+	RevokeToken(id int64) error
 
 	// ---- Bans ----
 
-	// CreateBan adds a ban record.
+	// CreateBan adds a ban record. ip may be a single address or a CIDR range;
+	// at least one of userID and ip must be set.
 	CreateBan(userID int64, ip, reason string, bannedBy int64, expiresAt time.Time) error
 
 	// IsUserBanned checks if a user ID is currently banned.
 	IsUserBanned(userID int64) (bool, error)
+
+	// IsIPBanned checks if an address is covered by an active IP or CIDR ban.
+	IsIPBanned(ip string) (bool, error)
+
+	// ListBans returns all active (non-expired) bans, newest first.
+	ListBans() ([]model.Ban, error)
+
+	// Unban removes a ban record by ID.
+	Unban(id int64) error
 }
 
 // Compile-time check: *Store implements DataStore.
@@ -2,9 +2,11 @@ package store
 
 import (
 	"fmt"
+	"net"
 	"sort"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/NicolasHaas/gospeak/pkg/model"
 )
@@ -20,23 +22,32 @@ type MemoryStore struct {
 	nextChannelID int64
 	nextTokenID   int64
 	nextBanID     int64
+	nextACLID     int64
+	nextChatID    int64
+	nextDMID      int64
 
 	usersByID       map[int64]*model.User
 	usersByUsername map[string]*model.User
 	channelsByID    map[int64]*model.Channel
 	tokensByHash    map[string]*memoryToken
 	bansByID        map[int64]*model.Ban
+	aclsByID        map[int64]*model.ChannelACL
+	rolesByName     map[string]*model.RoleDefinition
+	chatByChannel   map[int64][]model.ChatMessage // oldest first
+	directMessages  []model.DirectMessage         // oldest first
 }
 
 type memoryToken struct {
 	id           int64
 	hash         string
+	label        string
 	role         model.Role
 	channelScope int64
 	createdBy    int64
 	maxUses      int
 	useCount     int
 	expiresAt    time.Time
+	revokedAt    time.Time
 	createdAt    time.Time
 }
 
@@ -56,11 +67,17 @@ func NewMemoryWithClock(now func() time.Time) *MemoryStore {
 		nextChannelID:   1,
 		nextTokenID:     1,
 		nextBanID:       1,
+		nextACLID:       1,
+		nextChatID:      1,
+		nextDMID:        1,
 		usersByID:       make(map[int64]*model.User),
 		usersByUsername: make(map[string]*model.User),
 		channelsByID:    make(map[int64]*model.Channel),
 		tokensByHash:    make(map[string]*memoryToken),
 		bansByID:        make(map[int64]*model.Ban),
+		aclsByID:        make(map[int64]*model.ChannelACL),
+		rolesByName:     make(map[string]*model.RoleDefinition),
+		chatByChannel:   make(map[int64][]model.ChatMessage),
 	}
 }
 
@@ -171,11 +188,43 @@ func (s *MemoryStore) CreateChannel(channel *model.Channel) error {
 	return nil
 }
 
+// UpdateChannel overwrites an existing channel's mutable fields.
+func (s *MemoryStore) UpdateChannel(channel *model.Channel) error {
+	if err := channel.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.channelsByID[channel.ID]
+	if !ok {
+		return fmt.Errorf("store: update channel: %w", model.ErrChannelNotFound)
+	}
+	channels := make([]model.Channel, 0, len(s.channelsByID))
+	for _, ch := range s.channelsByID {
+		channels = append(channels, *ch)
+	}
+	if err := model.CheckReparent(channels, channel.ID, channel.ParentID); err != nil {
+		return fmt.Errorf("store: update channel: %w", err)
+	}
+
+	updated := *channel
+	updated.CreatedAt = existing.CreatedAt
+	s.channelsByID[channel.ID] = &updated
+	return nil
+}
+
 // DeleteChannel deletes a channel by ID.
 func (s *MemoryStore) DeleteChannel(id int64) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.channelsByID, id)
+	for aclID, acl := range s.aclsByID {
+		if acl.ChannelID == id {
+			delete(s.aclsByID, aclID)
+		}
+	}
+	delete(s.chatByChannel, id)
 	return nil
 }
 
@@ -221,6 +270,239 @@ func (s *MemoryStore) GetChannelByNameAndParent(name string, parentID int64) (*m
 	return nil, nil
 }
 
+// AddChatMessage stores a chat message and sets its ID.
+func (s *MemoryStore) AddChatMessage(msg *model.ChatMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = s.now().UTC().Truncate(time.Second)
+	}
+	msg.ID = s.nextChatID
+	s.nextChatID++
+	s.chatByChannel[msg.ChannelID] = append(s.chatByChannel[msg.ChannelID], *msg)
+	return nil
+}
+
+// ListChatMessages returns up to limit messages of a channel with an ID
+// below beforeID (0 = from the newest), newest first.
+func (s *MemoryStore) ListChatMessages(channelID, beforeID int64, limit int) ([]model.ChatMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	stored := s.chatByChannel[channelID]
+	var msgs []model.ChatMessage
+	for i := len(stored) - 1; i >= 0 && len(msgs) < limit; i-- {
+		if beforeID <= 0 || stored[i].ID < beforeID {
+			msgs = append(msgs, stored[i])
+		}
+	}
+	return msgs, nil
+}
+
+// GetChatMessage returns a message of a channel, or nil if there is none
+// with that ID.
+func (s *MemoryStore) GetChatMessage(channelID, id int64) (*model.ChatMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, m := range s.chatByChannel[channelID] {
+		if m.ID == id {
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+// UpdateChatMessage replaces the text of a message and records when it was
+// edited.
+func (s *MemoryStore) UpdateChatMessage(channelID, id int64, text string, editedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.chatByChannel[channelID] {
+		if m.ID == id {
+			s.chatByChannel[channelID][i].Text = text
+			s.chatByChannel[channelID][i].EditedAt = editedAt.UTC().Truncate(time.Second)
+		}
+	}
+	return nil
+}
+
+// DeleteChatMessage removes a message from a channel's history.
+func (s *MemoryStore) DeleteChatMessage(channelID, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.chatByChannel[channelID]
+	for i, m := range stored {
+		if m.ID == id {
+			s.chatByChannel[channelID] = append(stored[:i], stored[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// PruneChatMessages deletes the messages of a channel created before the
+// given time.
+func (s *MemoryStore) PruneChatMessages(channelID int64, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.chatByChannel[channelID]
+	if len(stored) == 0 {
+		return 0, nil
+	}
+	kept := stored[:0]
+	for _, m := range stored {
+		if !m.CreatedAt.Before(before) {
+			kept = append(kept, m)
+		}
+	}
+	s.chatByChannel[channelID] = kept
+	return int64(len(stored) - len(kept)), nil
+}
+
+// AddDirectMessage stores a direct message and sets its ID.
+func (s *MemoryStore) AddDirectMessage(msg *model.DirectMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = s.now().UTC().Truncate(time.Second)
+	}
+	msg.ID = s.nextDMID
+	s.nextDMID++
+	s.directMessages = append(s.directMessages, *msg)
+	return nil
+}
+
+// ListDirectMessages returns the stored messages from senderID to
+// recipientID, oldest first.
+func (s *MemoryStore) ListDirectMessages(recipientID, senderID int64) ([]model.DirectMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var msgs []model.DirectMessage
+	for _, m := range s.directMessages {
+		if m.RecipientID == recipientID && m.SenderID == senderID {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+// DeleteDirectMessages removes the messages from senderID to recipientID up
+// to and including ID upTo.
+func (s *MemoryStore) DeleteDirectMessages(recipientID, senderID, upTo int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.directMessages[:0]
+	for _, m := range s.directMessages {
+		if m.RecipientID != recipientID || m.SenderID != senderID || m.ID > upTo {
+			kept = append(kept, m)
+		}
+	}
+	s.directMessages = kept
+	return nil
+}
+
+// CountDirectMessages returns how many stored messages recipientID has from
+// each sender.
+func (s *MemoryStore) CountDirectMessages(recipientID int64) (map[int64]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[int64]int)
+	for _, m := range s.directMessages {
+		if m.RecipientID == recipientID {
+			counts[m.SenderID]++
+		}
+	}
+	return counts, nil
+}
+
+// SetChannelACL creates or replaces the override for the entry's target.
+func (s *MemoryStore) SetChannelACL(entry *model.ChannelACL) error {
+	if entry.IsUserEntry() {
+		entry.Role = model.RoleUser
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, acl := range s.aclsByID {
+		if acl.ChannelID == entry.ChannelID && acl.UserID == entry.UserID &&
+			acl.Role == entry.Role && acl.Permission == entry.Permission {
+			acl.Allow = entry.Allow
+			entry.ID = acl.ID
+			return nil
+		}
+	}
+	entry.ID = s.nextACLID
+	s.nextACLID++
+	copyACL := *entry
+	s.aclsByID[entry.ID] = &copyACL
+	return nil
+}
+
+// DeleteChannelACL removes an override by ID.
+func (s *MemoryStore) DeleteChannelACL(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.aclsByID[id]; !ok {
+		return fmt.Errorf("store: channel acl not found")
+	}
+	delete(s.aclsByID, id)
+	return nil
+}
+
+// ListChannelACLs returns all overrides, ordered by channel and ID.
+func (s *MemoryStore) ListChannelACLs() ([]model.ChannelACL, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	acls := make([]model.ChannelACL, 0, len(s.aclsByID))
+	for _, acl := range s.aclsByID {
+		acls = append(acls, *acl)
+	}
+	sort.Slice(acls, func(i, j int) bool {
+		if acls[i].ChannelID != acls[j].ChannelID {
+			return acls[i].ChannelID < acls[j].ChannelID
+		}
+		return acls[i].ID < acls[j].ID
+	})
+	return acls, nil
+}
+
+// SaveRole creates or updates a custom role by name and sets its ID.
+func (s *MemoryStore) SaveRole(def *model.RoleDefinition) error {
+	if err := def.Validate(); err != nil {
+		return fmt.Errorf("store: save role: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.rolesByName[def.Name]; ok {
+		existing.Priority = def.Priority
+		existing.Permissions = append([]model.Permission(nil), def.Permissions...)
+		def.ID = existing.ID
+		return nil
+	}
+	def.ID = model.RoleCustomBase
+	for _, r := range s.rolesByName {
+		if r.ID >= def.ID {
+			def.ID = r.ID + 1
+		}
+	}
+	copyDef := *def
+	copyDef.Permissions = append([]model.Permission(nil), def.Permissions...)
+	s.rolesByName[def.Name] = &copyDef
+	return nil
+}
+
+// ListRoles returns all custom roles, ordered by ID.
+func (s *MemoryStore) ListRoles() ([]model.RoleDefinition, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	defs := make([]model.RoleDefinition, 0, len(s.rolesByName))
+	for _, r := range s.rolesByName {
+		def := *r
+		def.Permissions = append([]model.Permission(nil), r.Permissions...)
+		defs = append(defs, def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].ID < defs[j].ID })
+	return defs, nil
+}
+
 // HasTokens returns true if any tokens exist in the database.
 func (s *MemoryStore) HasTokens() (bool, error) {
 	s.mu.RLock()
@@ -228,8 +510,11 @@ func (s *MemoryStore) HasTokens() (bool, error) {
 	return len(s.tokensByHash) > 0, nil
 }
 
-// CreateToken stores a new token (hash only).
-func (s *MemoryStore) CreateToken(hash string, role model.Role, channelScope int64, createdBy int64, maxUses int, expiresAt time.Time) error {
+// CreateToken stores a new token (hash only) with an optional label.
+func (s *MemoryStore) CreateToken(hash, label string, role model.Role, channelScope int64, createdBy int64, maxUses int, expiresAt time.Time) error {
+	if utf8.RuneCountInString(label) > model.MaxTokenLabelLength {
+		return fmt.Errorf("store: create token: label too long")
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if _, exists := s.tokensByHash[hash]; exists {
@@ -244,6 +529,7 @@ func (s *MemoryStore) CreateToken(hash string, role model.Role, channelScope int
 	s.tokensByHash[hash] = &memoryToken{
 		id:           s.nextTokenID,
 		hash:         hash,
+		label:        label,
 		role:         role,
 		channelScope: channelScope,
 		createdBy:    createdBy,
@@ -256,29 +542,83 @@ func (s *MemoryStore) CreateToken(hash string, role model.Role, channelScope int
 	return nil
 }
 
-// ValidateToken checks if a token hash is valid and returns the associated role.
+// ValidateToken checks if a token hash is valid and returns the token record.
 // It increments the use count atomically.
-func (s *MemoryStore) ValidateToken(hash string) (model.Role, error) {
+func (s *MemoryStore) ValidateToken(hash string) (*model.Token, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	token, ok := s.tokensByHash[hash]
 	if !ok {
-		return 0, fmt.Errorf("store: invalid token")
+		return nil, fmt.Errorf("store: invalid token")
 	}
 
+	if !token.revokedAt.IsZero() {
+		return nil, fmt.Errorf("store: token revoked")
+	}
 	if !token.expiresAt.IsZero() && s.now().UTC().After(token.expiresAt) {
-		return 0, fmt.Errorf("store: token expired")
+		return nil, fmt.Errorf("store: token expired")
 	}
 	if token.maxUses > 0 && token.useCount >= token.maxUses {
-		return 0, fmt.Errorf("store: token exhausted")
+		return nil, fmt.Errorf("store: token exhausted")
 	}
 
 	token.useCount++
-	return token.role, nil
+	return token.toModel(), nil
+}
+
+// ListTokens returns all tokens, including expired and revoked ones, newest first.
+func (s *MemoryStore) ListTokens() ([]model.Token, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make([]model.Token, 0, len(s.tokensByHash))
+	for _, token := range s.tokensByHash {
+		tokens = append(tokens, *token.toModel())
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].ID > tokens[j].ID
+	})
+	return tokens, nil
+}
+
+// RevokeToken marks a token as revoked so it can no longer authenticate.
+func (s *MemoryStore) RevokeToken(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, token := range s.tokensByHash {
+		if token.id == id && token.revokedAt.IsZero() {
+			token.revokedAt = s.now().UTC()
+			return nil
+		}
+	}
+	return fmt.Errorf("store: token not found or already revoked")
+}
+
+func (t *memoryToken) toModel() *model.Token {
+	return &model.Token{
+		ID:           t.id,
+		ShortID:      model.TokenShortID(t.hash),
+		Label:        t.label,
+		Hash:         t.hash,
+		Role:         t.role,
+		ChannelScope: t.channelScope,
+		CreatedBy:    t.createdBy,
+		MaxUses:      t.maxUses,
+		UseCount:     t.useCount,
+		ExpiresAt:    t.expiresAt,
+		RevokedAt:    t.revokedAt,
+		CreatedAt:    t.createdAt,
+	}
 }
 
 // CreateBan adds a ban record.
 func (s *MemoryStore) CreateBan(userID int64, ip, reason string, bannedBy int64, expiresAt time.Time) error {
+	ip, err := model.NormalizeBanIP(ip)
+	if err != nil {
+		return fmt.Errorf("store: create ban: %w", err)
+	}
+	if userID == 0 && ip == "" {
+		return fmt.Errorf("store: create ban: user id or ip required")
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	ban := &model.Ban{
@@ -304,12 +644,55 @@ func (s *MemoryStore) IsUserBanned(userID int64) (bool, error) {
 		if ban.UserID != userID {
 			continue
 		}
-		if ban.ExpiresAt.IsZero() || ban.ExpiresAt.After(now) {
+		if ban.IsActive(now) {
 			return true, nil
 		}
 	}
 	return false, nil
 }
 
+// IsIPBanned checks if an address is covered by an active IP or CIDR ban.
+func (s *MemoryStore) IsIPBanned(ip string) (bool, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false, fmt.Errorf("store: check ip ban: invalid address %q", ip)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := s.now().UTC()
+	for _, ban := range s.bansByID {
+		if ban.IsActive(now) && ban.MatchesIP(addr) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListBans returns all active (non-expired) bans, newest first.
+func (s *MemoryStore) ListBans() ([]model.Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := s.now().UTC()
+	bans := make([]model.Ban, 0, len(s.bansByID))
+	for _, ban := range s.bansByID {
+		if ban.IsActive(now) {
+			bans = append(bans, *ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].ID > bans[j].ID })
+	return bans, nil
+}
+
+// Unban removes a ban record by ID.
+func (s *MemoryStore) Unban(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.bansByID[id]; !ok {
+		return fmt.Errorf("store: ban not found")
+	}
+	delete(s.bansByID, id)
+	return nil
+}
+
 // Compile-time check: *MemoryStore implements DataStore.
 var _ DataStore = (*MemoryStore)(nil)
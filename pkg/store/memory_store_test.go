@@ -32,16 +32,19 @@ func TestStoreBasicFlow(t *testing.T) {
 			t.Fatalf("GenerateToken: unexpected error: %v", err)
 		}
 		hash := crypto.HashToken(rawToken)
-		if err := st.CreateToken(hash, model.RoleUser, 0, user.ID, 1, time.Now().Add(time.Hour)); err != nil {
+		if err := st.CreateToken(hash, "", model.RoleUser, 0, user.ID, 1, time.Now().Add(time.Hour)); err != nil {
 			t.Fatalf("CreateToken: unexpected error: %v", err)
 		}
 
-		role, err := st.ValidateToken(hash)
+		token, err := st.ValidateToken(hash)
 		if err != nil {
 			t.Fatalf("ValidateToken: unexpected error: %v", err)
 		}
-		if role != model.RoleUser {
-			t.Fatalf("ValidateToken: role mismatch want=%d got=%d", model.RoleUser, role)
+		if token.Role != model.RoleUser {
+			t.Fatalf("ValidateToken: role mismatch want=%d got=%d", model.RoleUser, token.Role)
+		}
+		if token.CreatedBy != user.ID {
+			t.Fatalf("ValidateToken: created_by mismatch want=%d got=%d", user.ID, token.CreatedBy)
 		}
 	})
 }
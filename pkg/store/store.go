@@ -5,7 +5,11 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"math"
+	"net"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	_ "modernc.org/sqlite"
 
@@ -116,6 +120,7 @@ func (s *Store) migrate() error {
 		version      int
 		statements   []string
 		ignoreErrors bool
+		transaction  bool // all statements and the version bump succeed or fail together
 	}{
 		{
 			version:    1,
@@ -130,12 +135,128 @@ func (s *Store) migrate() error {
 			},
 			ignoreErrors: true,
 		},
+		{
+			version: 3,
+			statements: []string{
+				"ALTER TABLE tokens ADD COLUMN label TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE tokens ADD COLUMN revoked_at TEXT",
+			},
+			ignoreErrors: true,
+		},
+		{
+			version: 4,
+			statements: []string{
+				"ALTER TABLE channels ADD COLUMN password_hash TEXT NOT NULL DEFAULT ''",
+			},
+			ignoreErrors: true,
+		},
+		{
+			version: 5,
+			statements: []string{
+				`CREATE TABLE IF NOT EXISTS channel_acls (
+					id         INTEGER PRIMARY KEY AUTOINCREMENT,
+					channel_id INTEGER NOT NULL,
+					user_id    INTEGER NOT NULL DEFAULT 0,
+					role       INTEGER NOT NULL DEFAULT 0,
+					permission INTEGER NOT NULL,
+					allow      INTEGER NOT NULL DEFAULT 0,
+					UNIQUE (channel_id, user_id, role, permission)
+				)`,
+			},
+		},
+		{
+			version: 6,
+			statements: []string{
+				`CREATE TABLE IF NOT EXISTS roles (
+					id          INTEGER PRIMARY KEY,
+					name        TEXT    NOT NULL UNIQUE,
+					priority    INTEGER NOT NULL DEFAULT 0,
+					permissions TEXT    NOT NULL DEFAULT ''
+				)`,
+			},
+		},
+		{
+			version: 7,
+			statements: []string{
+				"ALTER TABLE channels ADD COLUMN codec_bitrate INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE channels ADD COLUMN codec_frame_ms INTEGER NOT NULL DEFAULT 0",
+				"ALTER TABLE channels ADD COLUMN codec_application TEXT NOT NULL DEFAULT ''",
+				"ALTER TABLE channels ADD COLUMN codec_stereo INTEGER NOT NULL DEFAULT 0",
+			},
+			ignoreErrors: true,
+		},
+		{
+			version: 8,
+			statements: []string{
+				"ALTER TABLE channels ADD COLUMN e2ee INTEGER NOT NULL DEFAULT 0",
+			},
+			ignoreErrors: true,
+		},
+		{
+			version: 9,
+			statements: []string{
+				"ALTER TABLE channels ADD COLUMN chat_retention INTEGER NOT NULL DEFAULT 0",
+				`CREATE TABLE IF NOT EXISTS chat_messages (
+					id         INTEGER PRIMARY KEY AUTOINCREMENT,
+					channel_id INTEGER NOT NULL,
+					user_id    INTEGER NOT NULL DEFAULT 0,
+					username   TEXT    NOT NULL,
+					text       TEXT    NOT NULL,
+					created_at TEXT    NOT NULL DEFAULT (datetime('now'))
+				)`,
+				"CREATE INDEX IF NOT EXISTS chat_messages_channel ON chat_messages (channel_id, id)",
+			},
+		},
+		{
+			version: 10,
+			statements: []string{
+				`CREATE TABLE IF NOT EXISTS direct_messages (
+					id           INTEGER PRIMARY KEY AUTOINCREMENT,
+					sender_id    INTEGER NOT NULL,
+					sender_name  TEXT    NOT NULL,
+					recipient_id INTEGER NOT NULL,
+					text         TEXT    NOT NULL,
+					created_at   TEXT    NOT NULL DEFAULT (datetime('now'))
+				)`,
+				"CREATE INDEX IF NOT EXISTS direct_messages_recipient ON direct_messages (recipient_id, sender_id, id)",
+			},
+		},
+		{
+			version: 11,
+			statements: []string{
+				"ALTER TABLE chat_messages ADD COLUMN edited_at TEXT",
+			},
+			ignoreErrors: true,
+		},
+		{
+			// Custom roles have IDs from model.RoleCustomBase up; SQLite
+			// cannot drop a CHECK constraint, so users is rebuilt
+			version: 12,
+			statements: []string{
+				`CREATE TABLE users_new (
+					id         INTEGER PRIMARY KEY AUTOINCREMENT,
+					username   TEXT    NOT NULL UNIQUE CHECK(length(username) > 0 AND length(username) <= 32),
+					role       INTEGER NOT NULL DEFAULT 0 CHECK(role >= 0),
+					created_at TEXT    NOT NULL DEFAULT (datetime('now'))
+				)`,
+				"INSERT INTO users_new (id, username, role, created_at) SELECT id, username, role, created_at FROM users",
+				"DROP TABLE users",
+				"ALTER TABLE users_new RENAME TO users",
+			},
+			transaction: true,
+		},
 	}
 
 	for _, m := range migrations {
 		if m.version <= currentVersion {
 			continue
 		}
+		if m.transaction {
+			if err := s.migrateInTx(ctx, m.version, m.statements); err != nil {
+				return err
+			}
+			continue
+		}
 		for _, stmt := range m.statements {
 			if err := s.execMigration(ctx, stmt, m.ignoreErrors); err != nil {
 				return err
@@ -179,6 +300,29 @@ func (s *Store) setSchemaVersion(ctx context.Context, version int) error {
 	return nil
 }
 
+// migrateInTx runs the statements of a migration and records its version in
+// one transaction, so a failure leaves the schema as it was.
+func (s *Store) migrateInTx(ctx context.Context, version int, statements []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("store: migrate: begin tx: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("store: migrate to %d: %w", version, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE schema_migrations SET version = ?", version); err != nil {
+		return fmt.Errorf("store: update schema version: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("store: migrate: commit: %w", err)
+	}
+	return nil
+}
+
 func (s *Store) execMigration(ctx context.Context, stmt string, ignoreErrors bool) error {
 	if _, err := s.db.ExecContext(ctx, stmt); err != nil {
 		if ignoreErrors {
@@ -320,15 +464,30 @@ func (s *Store) CreateChannel(channel *model.Channel) error {
 	if channel.AllowSubChannels {
 		allowSubInt = 1
 	}
+	stereoInt := 0
+	if channel.Codec.Stereo {
+		stereoInt = 1
+	}
+	e2eeInt := 0
+	if channel.E2EE {
+		e2eeInt = 1
+	}
 	res, err := s.db.ExecContext(
 		context.Background(),
-		"INSERT INTO channels (name, description, max_users, parent_id, is_temp, allow_sub_channels) VALUES (?, ?, ?, ?, ?, ?)",
+		"INSERT INTO channels (name, description, max_users, parent_id, is_temp, allow_sub_channels, password_hash, codec_bitrate, codec_frame_ms, codec_application, codec_stereo, e2ee, chat_retention) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		channel.Name,
 		channel.Description,
 		channel.MaxUsers,
 		channel.ParentID,
 		isTempInt,
 		allowSubInt,
+		channel.PasswordHash,
+		channel.Codec.Bitrate,
+		channel.Codec.FrameMs,
+		channel.Codec.Application,
+		stereoInt,
+		e2eeInt,
+		retentionSeconds(channel.ChatRetention),
 	)
 	if err != nil {
 		return fmt.Errorf("store: create channel: %w", err)
@@ -339,18 +498,151 @@ func (s *Store) CreateChannel(channel *model.Channel) error {
 	return nil
 }
 
-// DeleteChannel deletes a channel by ID.
+// UpdateChannel overwrites an existing channel's mutable fields.
+func (s *Store) UpdateChannel(channel *model.Channel) error {
+	if err := channel.Validate(); err != nil {
+		return err
+	}
+
+	// The cycle check must see the same tree the UPDATE changes, or two
+	// concurrent reparents could each pass and together form a loop. BEGIN
+	// IMMEDIATE takes the write lock before the read; database/sql cannot
+	// ask for that, so the transaction is driven by hand on one connection.
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("store: update channel: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.ExecContext(ctx, "PRAGMA busy_timeout=5000"); err != nil {
+		return fmt.Errorf("store: update channel: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return fmt.Errorf("store: update channel: begin tx: %w", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_, _ = conn.ExecContext(ctx, "ROLLBACK")
+		}
+	}()
+
+	channels, err := listChannels(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("store: update channel: %w", err)
+	}
+	if err := model.CheckReparent(channels, channel.ID, channel.ParentID); err != nil {
+		return fmt.Errorf("store: update channel: %w", err)
+	}
+
+	isTempInt := 0
+	if channel.IsTemp {
+		isTempInt = 1
+	}
+	allowSubInt := 0
+	if channel.AllowSubChannels {
+		allowSubInt = 1
+	}
+	stereoInt := 0
+	if channel.Codec.Stereo {
+		stereoInt = 1
+	}
+	e2eeInt := 0
+	if channel.E2EE {
+		e2eeInt = 1
+	}
+	res, err := conn.ExecContext(
+		ctx,
+		"UPDATE channels SET name = ?, description = ?, max_users = ?, parent_id = ?, is_temp = ?, allow_sub_channels = ?, password_hash = ?, codec_bitrate = ?, codec_frame_ms = ?, codec_application = ?, codec_stereo = ?, e2ee = ?, chat_retention = ? WHERE id = ?",
+		channel.Name,
+		channel.Description,
+		channel.MaxUsers,
+		channel.ParentID,
+		isTempInt,
+		allowSubInt,
+		channel.PasswordHash,
+		channel.Codec.Bitrate,
+		channel.Codec.FrameMs,
+		channel.Codec.Application,
+		stereoInt,
+		e2eeInt,
+		retentionSeconds(channel.ChatRetention),
+		channel.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("store: update channel: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("store: update channel: %w", model.ErrChannelNotFound)
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return fmt.Errorf("store: update channel: commit: %w", err)
+	}
+	committed = true
+	return nil
+}
+
+// DeleteChannel deletes a channel and its ACL overrides by ID.
 func (s *Store) DeleteChannel(id int64) error {
 	_, err := s.db.ExecContext(context.Background(), "DELETE FROM channels WHERE id = ?", id)
 	if err != nil {
 		return fmt.Errorf("store: delete channel: %w", err)
 	}
+	if _, err := s.db.ExecContext(context.Background(), "DELETE FROM channel_acls WHERE channel_id = ?", id); err != nil {
+		return fmt.Errorf("store: delete channel acls: %w", err)
+	}
+	if _, err := s.db.ExecContext(context.Background(), "DELETE FROM chat_messages WHERE channel_id = ?", id); err != nil {
+		return fmt.Errorf("store: delete chat messages: %w", err)
+	}
 	return nil
 }
 
+// retentionSeconds stores a chat retention in whole seconds; -1 means
+// history is not kept.
+func retentionSeconds(d time.Duration) int64 {
+	if d < 0 {
+		return -1
+	}
+	return int64(d / time.Second)
+}
+
+// channelColumns is the column list scanned by scanChannel.
+const channelColumns = "id, name, description, max_users, parent_id, is_temp, allow_sub_channels, password_hash, codec_bitrate, codec_frame_ms, codec_application, codec_stereo, e2ee, chat_retention, created_at"
+
+func scanChannel(row rowScanner) (*model.Channel, error) {
+	ch := &model.Channel{}
+	var createdAt string
+	var isTempInt, allowSubInt, stereoInt, e2eeInt int
+	var retention int64
+	if err := row.Scan(&ch.ID, &ch.Name, &ch.Description, &ch.MaxUsers, &ch.ParentID, &isTempInt, &allowSubInt, &ch.PasswordHash,
+		&ch.Codec.Bitrate, &ch.Codec.FrameMs, &ch.Codec.Application, &stereoInt, &e2eeInt, &retention, &createdAt); err != nil {
+		return nil, err
+	}
+	ch.ChatRetention = time.Duration(retention) * time.Second
+	ch.IsTemp = isTempInt != 0
+	ch.AllowSubChannels = allowSubInt != 0
+	ch.Codec.Stereo = stereoInt != 0
+	ch.E2EE = e2eeInt != 0
+	parsed, err := parseDBTime(createdAt)
+	if err != nil {
+		return nil, err
+	}
+	ch.CreatedAt = parsed
+	return ch, nil
+}
+
 // ListChannels returns all channels.
 func (s *Store) ListChannels() ([]model.Channel, error) {
-	rows, err := s.db.QueryContext(context.Background(), "SELECT id, name, description, max_users, parent_id, is_temp, allow_sub_channels, created_at FROM channels ORDER BY parent_id, id")
+	return listChannels(context.Background(), s.db)
+}
+
+// queryer is satisfied by *sql.DB, *sql.Conn and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+func listChannels(ctx context.Context, q queryer) ([]model.Channel, error) {
+	rows, err := q.QueryContext(ctx, "SELECT "+channelColumns+" FROM channels ORDER BY parent_id, id")
 	if err != nil {
 		return nil, fmt.Errorf("store: list channels: %w", err)
 	}
@@ -358,68 +650,361 @@ func (s *Store) ListChannels() ([]model.Channel, error) {
 
 	var channels []model.Channel
 	for rows.Next() {
-		var ch model.Channel
-		var createdAt string
-		var isTempInt, allowSubInt int
-		if err := rows.Scan(&ch.ID, &ch.Name, &ch.Description, &ch.MaxUsers, &ch.ParentID, &isTempInt, &allowSubInt, &createdAt); err != nil {
-			return nil, fmt.Errorf("store: scan channel: %w", err)
-		}
-		ch.IsTemp = isTempInt != 0
-		ch.AllowSubChannels = allowSubInt != 0
-		parsed, err := parseDBTime(createdAt)
+		ch, err := scanChannel(rows)
 		if err != nil {
 			return nil, fmt.Errorf("store: scan channel: %w", err)
 		}
-		ch.CreatedAt = parsed
-		channels = append(channels, ch)
+		channels = append(channels, *ch)
 	}
 	return channels, rows.Err()
 }
 
 // GetChannel retrieves a channel by ID.
 func (s *Store) GetChannel(id int64) (*model.Channel, error) {
-	ch := &model.Channel{}
-	var createdAt string
-	var isTempInt, allowSubInt int
-	err := s.db.QueryRowContext(context.Background(), "SELECT id, name, description, max_users, parent_id, is_temp, allow_sub_channels, created_at FROM channels WHERE id = ?", id).
-		Scan(&ch.ID, &ch.Name, &ch.Description, &ch.MaxUsers, &ch.ParentID, &isTempInt, &allowSubInt, &createdAt)
+	row := s.db.QueryRowContext(context.Background(), "SELECT "+channelColumns+" FROM channels WHERE id = ?", id)
+	ch, err := scanChannel(row)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("store: get channel: %w", err)
 	}
-	ch.IsTemp = isTempInt != 0
-	ch.AllowSubChannels = allowSubInt != 0
-	parsed, err := parseDBTime(createdAt)
-	if err != nil {
-		return nil, fmt.Errorf("store: get channel: %w", err)
-	}
-	ch.CreatedAt = parsed
 	return ch, nil
 }
 
 // GetChannelByNameAndParent retrieves a channel by name and parent ID.
 func (s *Store) GetChannelByNameAndParent(name string, parentID int64) (*model.Channel, error) {
-	ch := &model.Channel{}
-	var createdAt string
-	var isTempInt, allowSubInt int
-	err := s.db.QueryRowContext(context.Background(), "SELECT id, name, description, max_users, parent_id, is_temp, allow_sub_channels, created_at FROM channels WHERE name = ? AND parent_id = ?", name, parentID).
-		Scan(&ch.ID, &ch.Name, &ch.Description, &ch.MaxUsers, &ch.ParentID, &isTempInt, &allowSubInt, &createdAt)
+	row := s.db.QueryRowContext(context.Background(), "SELECT "+channelColumns+" FROM channels WHERE name = ? AND parent_id = ?", name, parentID)
+	ch, err := scanChannel(row)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, fmt.Errorf("store: get channel by name: %w", err)
 	}
-	ch.IsTemp = isTempInt != 0
-	ch.AllowSubChannels = allowSubInt != 0
-	parsed, err := parseDBTime(createdAt)
+	return ch, nil
+}
+
+// ---- Chat history ----
+
+// AddChatMessage stores a chat message and sets its ID. A zero CreatedAt is
+// set to the current time.
+func (s *Store) AddChatMessage(msg *model.ChatMessage) error {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	res, err := s.db.ExecContext(context.Background(),
+		"INSERT INTO chat_messages (channel_id, user_id, username, text, created_at) VALUES (?, ?, ?, ?, ?)",
+		msg.ChannelID, msg.UserID, msg.Username, msg.Text, formatDBTime(msg.CreatedAt))
 	if err != nil {
-		return nil, fmt.Errorf("store: get channel by name: %w", err)
+		return fmt.Errorf("store: add chat message: %w", err)
 	}
-	ch.CreatedAt = parsed
-	return ch, nil
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("store: add chat message: %w", err)
+	}
+	msg.ID = id
+	return nil
+}
+
+// ListChatMessages returns up to limit messages of a channel with an ID
+// below beforeID (0 = from the newest), newest first.
+func (s *Store) ListChatMessages(channelID, beforeID int64, limit int) ([]model.ChatMessage, error) {
+	if beforeID <= 0 {
+		beforeID = math.MaxInt64
+	}
+	rows, err := s.db.QueryContext(context.Background(),
+		"SELECT "+chatColumns+" FROM chat_messages WHERE channel_id = ? AND id < ? ORDER BY id DESC LIMIT ?",
+		channelID, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("store: list chat messages: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var msgs []model.ChatMessage
+	for rows.Next() {
+		m, err := scanChatMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("store: scan chat message: %w", err)
+		}
+		msgs = append(msgs, *m)
+	}
+	return msgs, rows.Err()
+}
+
+// GetChatMessage returns a message of a channel, or nil if there is none
+// with that ID.
+func (s *Store) GetChatMessage(channelID, id int64) (*model.ChatMessage, error) {
+	row := s.db.QueryRowContext(context.Background(),
+		"SELECT "+chatColumns+" FROM chat_messages WHERE channel_id = ? AND id = ?", channelID, id)
+	m, err := scanChatMessage(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("store: get chat message: %w", err)
+	}
+	return m, nil
+}
+
+// UpdateChatMessage replaces the text of a message and records when it was
+// edited.
+func (s *Store) UpdateChatMessage(channelID, id int64, text string, editedAt time.Time) error {
+	_, err := s.db.ExecContext(context.Background(),
+		"UPDATE chat_messages SET text = ?, edited_at = ? WHERE channel_id = ? AND id = ?",
+		text, formatDBTime(editedAt), channelID, id)
+	if err != nil {
+		return fmt.Errorf("store: update chat message: %w", err)
+	}
+	return nil
+}
+
+// DeleteChatMessage removes a message from a channel's history.
+func (s *Store) DeleteChatMessage(channelID, id int64) error {
+	_, err := s.db.ExecContext(context.Background(),
+		"DELETE FROM chat_messages WHERE channel_id = ? AND id = ?", channelID, id)
+	if err != nil {
+		return fmt.Errorf("store: delete chat message: %w", err)
+	}
+	return nil
+}
+
+const chatColumns = "id, channel_id, user_id, username, text, created_at, edited_at"
+
+func scanChatMessage(row rowScanner) (*model.ChatMessage, error) {
+	m := &model.ChatMessage{}
+	var createdAt string
+	var editedAt *string
+	if err := row.Scan(&m.ID, &m.ChannelID, &m.UserID, &m.Username, &m.Text, &createdAt, &editedAt); err != nil {
+		return nil, err
+	}
+	var err error
+	if m.CreatedAt, err = parseDBTime(createdAt); err != nil {
+		return nil, err
+	}
+	if editedAt != nil {
+		if m.EditedAt, err = parseDBTime(*editedAt); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// PruneChatMessages deletes the messages of a channel created before the
+// given time and returns how many were deleted.
+func (s *Store) PruneChatMessages(channelID int64, before time.Time) (int64, error) {
+	res, err := s.db.ExecContext(context.Background(),
+		"DELETE FROM chat_messages WHERE channel_id = ? AND created_at < ?", channelID, formatDBTime(before))
+	if err != nil {
+		return 0, fmt.Errorf("store: prune chat messages: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// ---- Direct messages ----
+
+// AddDirectMessage stores a direct message for its recipient and sets its
+// ID. A zero CreatedAt is set to the current time.
+func (s *Store) AddDirectMessage(msg *model.DirectMessage) error {
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	}
+	res, err := s.db.ExecContext(context.Background(),
+		"INSERT INTO direct_messages (sender_id, sender_name, recipient_id, text, created_at) VALUES (?, ?, ?, ?, ?)",
+		msg.SenderID, msg.SenderName, msg.RecipientID, msg.Text, formatDBTime(msg.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("store: add direct message: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("store: add direct message: %w", err)
+	}
+	msg.ID = id
+	return nil
+}
+
+// ListDirectMessages returns the stored messages from senderID to
+// recipientID, oldest first.
+func (s *Store) ListDirectMessages(recipientID, senderID int64) ([]model.DirectMessage, error) {
+	rows, err := s.db.QueryContext(context.Background(),
+		"SELECT id, sender_id, sender_name, recipient_id, text, created_at FROM direct_messages WHERE recipient_id = ? AND sender_id = ? ORDER BY id",
+		recipientID, senderID)
+	if err != nil {
+		return nil, fmt.Errorf("store: list direct messages: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var msgs []model.DirectMessage
+	for rows.Next() {
+		var m model.DirectMessage
+		var createdAt string
+		if err := rows.Scan(&m.ID, &m.SenderID, &m.SenderName, &m.RecipientID, &m.Text, &createdAt); err != nil {
+			return nil, fmt.Errorf("store: scan direct message: %w", err)
+		}
+		if m.CreatedAt, err = parseDBTime(createdAt); err != nil {
+			return nil, fmt.Errorf("store: scan direct message: %w", err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// DeleteDirectMessages removes the messages from senderID to recipientID up
+// to and including ID upTo.
+func (s *Store) DeleteDirectMessages(recipientID, senderID, upTo int64) error {
+	_, err := s.db.ExecContext(context.Background(),
+		"DELETE FROM direct_messages WHERE recipient_id = ? AND sender_id = ? AND id <= ?", recipientID, senderID, upTo)
+	if err != nil {
+		return fmt.Errorf("store: delete direct messages: %w", err)
+	}
+	return nil
+}
+
+// CountDirectMessages returns how many stored messages recipientID has from
+// each sender.
+func (s *Store) CountDirectMessages(recipientID int64) (map[int64]int, error) {
+	rows, err := s.db.QueryContext(context.Background(),
+		"SELECT sender_id, COUNT(*) FROM direct_messages WHERE recipient_id = ? GROUP BY sender_id", recipientID)
+	if err != nil {
+		return nil, fmt.Errorf("store: count direct messages: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var senderID int64
+		var n int
+		if err := rows.Scan(&senderID, &n); err != nil {
+			return nil, fmt.Errorf("store: scan direct message count: %w", err)
+		}
+		counts[senderID] = n
+	}
+	return counts, rows.Err()
+}
+
+// ---- Channel ACLs ----
+
+// SetChannelACL creates or replaces the override for the entry's target.
+func (s *Store) SetChannelACL(entry *model.ChannelACL) error {
+	if entry.IsUserEntry() {
+		entry.Role = model.RoleUser // role is ignored for user entries; normalize for the unique key
+	}
+	allowInt := 0
+	if entry.Allow {
+		allowInt = 1
+	}
+	err := s.db.QueryRowContext(context.Background(),
+		`INSERT INTO channel_acls (channel_id, user_id, role, permission, allow) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (channel_id, user_id, role, permission) DO UPDATE SET allow = excluded.allow
+		 RETURNING id`,
+		entry.ChannelID, entry.UserID, int(entry.Role), int(entry.Permission), allowInt).Scan(&entry.ID)
+	if err != nil {
+		return fmt.Errorf("store: set channel acl: %w", err)
+	}
+	return nil
+}
+
+// DeleteChannelACL removes an override by ID.
+func (s *Store) DeleteChannelACL(id int64) error {
+	res, err := s.db.ExecContext(context.Background(), "DELETE FROM channel_acls WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("store: delete channel acl: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("store: channel acl not found")
+	}
+	return nil
+}
+
+// ListChannelACLs returns all overrides, ordered by channel and ID.
+func (s *Store) ListChannelACLs() ([]model.ChannelACL, error) {
+	rows, err := s.db.QueryContext(context.Background(),
+		"SELECT id, channel_id, user_id, role, permission, allow FROM channel_acls ORDER BY channel_id, id")
+	if err != nil {
+		return nil, fmt.Errorf("store: list channel acls: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var acls []model.ChannelACL
+	for rows.Next() {
+		var a model.ChannelACL
+		var roleInt, permInt, allowInt int
+		if err := rows.Scan(&a.ID, &a.ChannelID, &a.UserID, &roleInt, &permInt, &allowInt); err != nil {
+			return nil, fmt.Errorf("store: scan channel acl: %w", err)
+		}
+		a.Role = model.Role(roleInt)
+		a.Permission = model.Permission(permInt)
+		a.Allow = allowInt != 0
+		acls = append(acls, a)
+	}
+	return acls, rows.Err()
+}
+
+// ---- Custom roles ----
+
+// SaveRole creates or updates a custom role by name and sets its ID.
+func (s *Store) SaveRole(def *model.RoleDefinition) error {
+	if err := def.Validate(); err != nil {
+		return fmt.Errorf("store: save role: %w", err)
+	}
+	var id int64
+	err := s.db.QueryRowContext(context.Background(),
+		`INSERT INTO roles (id, name, priority, permissions)
+		 VALUES ((SELECT COALESCE(MAX(id), ?) + 1 FROM roles), ?, ?, ?)
+		 ON CONFLICT (name) DO UPDATE SET priority = excluded.priority, permissions = excluded.permissions
+		 RETURNING id`,
+		int64(model.RoleCustomBase)-1, def.Name, def.Priority, formatPermissions(def.Permissions)).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("store: save role: %w", err)
+	}
+	def.ID = model.Role(id)
+	return nil
+}
+
+// ListRoles returns all custom roles, ordered by ID.
+func (s *Store) ListRoles() ([]model.RoleDefinition, error) {
+	rows, err := s.db.QueryContext(context.Background(),
+		"SELECT id, name, priority, permissions FROM roles ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("store: list roles: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var defs []model.RoleDefinition
+	for rows.Next() {
+		var def model.RoleDefinition
+		var id int64
+		var perms string
+		if err := rows.Scan(&id, &def.Name, &def.Priority, &perms); err != nil {
+			return nil, fmt.Errorf("store: scan role: %w", err)
+		}
+		def.ID = model.Role(id)
+		def.Permissions = parsePermissions(perms)
+		defs = append(defs, def)
+	}
+	return defs, rows.Err()
+}
+
+// formatPermissions stores permissions by name so the column stays readable
+// and independent of the Permission constants' order.
+func formatPermissions(perms []model.Permission) string {
+	names := make([]string, len(perms))
+	for i, p := range perms {
+		names[i] = p.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// parsePermissions is the inverse of formatPermissions; unknown names are skipped.
+func parsePermissions(s string) []model.Permission {
+	var perms []model.Permission
+	for _, name := range strings.Split(s, ",") {
+		if p, ok := model.ParsePermission(name); ok {
+			perms = append(perms, p)
+		}
+	}
+	return perms
 }
 
 // ---- Tokens ----
@@ -434,83 +1019,149 @@ func (s *Store) HasTokens() (bool, error) {
 	return count > 0, nil
 }
 
-// CreateToken stores a new token (hash only).
-func (s *Store) CreateToken(hash string, role model.Role, channelScope int64, createdBy int64, maxUses int, expiresAt time.Time) error {
+// CreateToken stores a new token (hash only) with an optional label.
+func (s *Store) CreateToken(hash, label string, role model.Role, channelScope int64, createdBy int64, maxUses int, expiresAt time.Time) error {
+	if utf8.RuneCountInString(label) > model.MaxTokenLabelLength {
+		return fmt.Errorf("store: create token: label too long")
+	}
 	var expStr *string
 	if !expiresAt.IsZero() {
 		s := formatDBTime(expiresAt)
 		expStr = &s
 	}
 	_, err := s.db.ExecContext(context.Background(),
-		"INSERT INTO tokens (hash, role, channel_scope, created_by, max_uses, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
-		hash, int(role), channelScope, createdBy, maxUses, expStr)
+		"INSERT INTO tokens (hash, label, role, channel_scope, created_by, max_uses, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		hash, label, int(role), channelScope, createdBy, maxUses, expStr)
 	if err != nil {
 		return fmt.Errorf("store: create token: %w", err)
 	}
 	return nil
 }
 
-// ValidateToken checks if a token hash is valid and returns the associated role.
+const tokenColumns = "id, hash, label, role, channel_scope, created_by, max_uses, use_count, expires_at, revoked_at, created_at"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row rowScanner) (*model.Token, error) {
+	t := &model.Token{}
+	var roleInt int
+	var expiresAt, revokedAt *string
+	var createdAt string
+	if err := row.Scan(&t.ID, &t.Hash, &t.Label, &roleInt, &t.ChannelScope, &t.CreatedBy, &t.MaxUses, &t.UseCount, &expiresAt, &revokedAt, &createdAt); err != nil {
+		return nil, err
+	}
+	t.ShortID = model.TokenShortID(t.Hash)
+	t.Role = model.Role(roleInt)
+	var err error
+	if expiresAt != nil {
+		if t.ExpiresAt, err = parseDBTime(*expiresAt); err != nil {
+			return nil, err
+		}
+	}
+	if revokedAt != nil {
+		if t.RevokedAt, err = parseDBTime(*revokedAt); err != nil {
+			return nil, err
+		}
+	}
+	if t.CreatedAt, err = parseDBTime(createdAt); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ValidateToken checks if a token hash is valid and returns the token record.
 // It increments the use count atomically.
-func (s *Store) ValidateToken(hash string) (model.Role, error) {
+func (s *Store) ValidateToken(hash string) (*model.Token, error) {
 	ctx := context.Background()
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("store: begin tx: %w", err)
+		return nil, fmt.Errorf("store: begin tx: %w", err)
 	}
 	defer func() { _ = tx.Rollback() }()
 
-	var roleInt int
-	var maxUses, useCount int
-	var expiresAt *string
-	err = tx.QueryRowContext(ctx,
-		"SELECT role, max_uses, use_count, expires_at FROM tokens WHERE hash = ?", hash).
-		Scan(&roleInt, &maxUses, &useCount, &expiresAt)
+	t, err := scanToken(tx.QueryRowContext(ctx, "SELECT "+tokenColumns+" FROM tokens WHERE hash = ?", hash))
 	if err == sql.ErrNoRows {
-		return 0, fmt.Errorf("store: invalid token")
+		return nil, fmt.Errorf("store: invalid token")
 	}
 	if err != nil {
-		return 0, fmt.Errorf("store: validate token: %w", err)
+		return nil, fmt.Errorf("store: validate token: %w", err)
 	}
 
-	// Check expiration
-	if expiresAt != nil {
-		exp, err := parseDBTime(*expiresAt)
-		if err != nil {
-			return 0, fmt.Errorf("store: validate token: %w", err)
-		}
-		if time.Now().After(exp) {
-			return 0, fmt.Errorf("store: token expired")
-		}
+	if t.IsRevoked() {
+		return nil, fmt.Errorf("store: token revoked")
 	}
-
-	// Check uses
-	if maxUses > 0 && useCount >= maxUses {
-		return 0, fmt.Errorf("store: token exhausted")
+	if t.IsExpired() {
+		return nil, fmt.Errorf("store: token expired")
+	}
+	if t.IsExhausted() {
+		return nil, fmt.Errorf("store: token exhausted")
 	}
 
 	// Increment use count
 	if _, err := tx.ExecContext(ctx, "UPDATE tokens SET use_count = use_count + 1 WHERE hash = ?", hash); err != nil {
-		return 0, fmt.Errorf("store: increment use: %w", err)
+		return nil, fmt.Errorf("store: increment use: %w", err)
 	}
 
 	if err := tx.Commit(); err != nil {
-		return 0, fmt.Errorf("store: commit: %w", err)
+		return nil, fmt.Errorf("store: commit: %w", err)
+	}
+
+	t.UseCount++
+	return t, nil
+}
+
+// ListTokens returns all tokens, including expired and revoked ones, newest first.
+func (s *Store) ListTokens() ([]model.Token, error) {
+	rows, err := s.db.QueryContext(context.Background(), "SELECT "+tokenColumns+" FROM tokens ORDER BY id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("store: list tokens: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var tokens []model.Token
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("store: scan token: %w", err)
+		}
+		tokens = append(tokens, *t)
 	}
+	return tokens, rows.Err()
+}
 
-	return model.Role(roleInt), nil
+// RevokeToken marks a token as revoked so it can no longer authenticate.
+func (s *Store) RevokeToken(id int64) error {
+	res, err := s.db.ExecContext(context.Background(),
+		"UPDATE tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", formatDBTime(time.Now()), id)
+	if err != nil {
+		return fmt.Errorf("store: revoke token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("store: token not found or already revoked")
+	}
+	return nil
 }
 
 // ---- Bans ----
 
 // CreateBan adds a ban record.
 func (s *Store) CreateBan(userID int64, ip, reason string, bannedBy int64, expiresAt time.Time) error {
+	ip, err := model.NormalizeBanIP(ip)
+	if err != nil {
+		return fmt.Errorf("store: create ban: %w", err)
+	}
+	if userID == 0 && ip == "" {
+		return fmt.Errorf("store: create ban: user id or ip required")
+	}
 	var expStr *string
 	if !expiresAt.IsZero() {
 		es := formatDBTime(expiresAt)
 		expStr = &es
 	}
-	_, err := s.db.ExecContext(context.Background(),
+	_, err = s.db.ExecContext(context.Background(),
 		"INSERT INTO bans (user_id, ip, reason, banned_by, expires_at) VALUES (?, ?, ?, ?, ?)",
 		userID, ip, reason, bannedBy, expStr)
 	if err != nil {
@@ -530,3 +1181,70 @@ func (s *Store) IsUserBanned(userID int64) (bool, error) {
 	}
 	return count > 0, nil
 }
+
+// IsIPBanned checks if an address is covered by an active IP or CIDR ban.
+func (s *Store) IsIPBanned(ip string) (bool, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false, fmt.Errorf("store: check ip ban: invalid address %q", ip)
+	}
+	rows, err := s.db.QueryContext(context.Background(),
+		"SELECT ip FROM bans WHERE ip != '' AND (expires_at IS NULL OR expires_at > datetime('now'))")
+	if err != nil {
+		return false, fmt.Errorf("store: check ip ban: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var ban model.Ban
+		if err := rows.Scan(&ban.IP); err != nil {
+			return false, fmt.Errorf("store: scan ban: %w", err)
+		}
+		if ban.MatchesIP(addr) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// ListBans returns all active (non-expired) bans, newest first.
+func (s *Store) ListBans() ([]model.Ban, error) {
+	rows, err := s.db.QueryContext(context.Background(),
+		"SELECT id, user_id, ip, reason, banned_by, expires_at, created_at FROM bans WHERE expires_at IS NULL OR expires_at > datetime('now') ORDER BY id DESC")
+	if err != nil {
+		return nil, fmt.Errorf("store: list bans: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	var bans []model.Ban
+	for rows.Next() {
+		var b model.Ban
+		var expiresAt *string
+		var createdAt string
+		if err := rows.Scan(&b.ID, &b.UserID, &b.IP, &b.Reason, &b.BannedBy, &expiresAt, &createdAt); err != nil {
+			return nil, fmt.Errorf("store: scan ban: %w", err)
+		}
+		if expiresAt != nil {
+			if b.ExpiresAt, err = parseDBTime(*expiresAt); err != nil {
+				return nil, fmt.Errorf("store: scan ban: %w", err)
+			}
+		}
+		if b.CreatedAt, err = parseDBTime(createdAt); err != nil {
+			return nil, fmt.Errorf("store: scan ban: %w", err)
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+// Unban removes a ban record by ID.
+func (s *Store) Unban(id int64) error {
+	res, err := s.db.ExecContext(context.Background(), "DELETE FROM bans WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("store: unban: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("store: ban not found")
+	}
+	return nil
+}
@@ -3,8 +3,11 @@ package store_test
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -410,6 +413,24 @@ func TestCreateChannelFull(t *testing.T) {
 			},
 			expecErr: false,
 		},
+		"codec_settings": {
+			inputChannel: &model.Channel{
+				Name:  channelName,
+				Codec: model.CodecSettings{Bitrate: 16000, FrameMs: 60, Application: model.CodecApplicationVoice},
+			},
+			expectedResponse: &model.Channel{
+				Name:  channelName,
+				Codec: model.CodecSettings{Bitrate: 16000, FrameMs: 60, Application: model.CodecApplicationVoice},
+			},
+			expecErr: false,
+		},
+		"invalid_codec": {
+			inputChannel: &model.Channel{
+				Name:  channelName,
+				Codec: model.CodecSettings{Bitrate: 1},
+			},
+			expecErr: true,
+		},
 		"invalid_name": {
 			inputChannel: &model.Channel{
 				Name:             generateRandomSafeString(t, 65),
@@ -472,6 +493,120 @@ func TestCreateChannelFull(t *testing.T) {
 	}
 }
 
+func TestUpdateChannel(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		root := &model.Channel{Name: "Games"}
+		if err := st.CreateChannel(root); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+		child := &model.Channel{Name: "Shooters", ParentID: root.ID}
+		if err := st.CreateChannel(child); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+		other := &model.Channel{Name: "Music"}
+		if err := st.CreateChannel(other); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+
+		edited := *child
+		edited.Name = "FPS"
+		edited.Description = "Fast games"
+		edited.MaxUsers = 8
+		edited.ParentID = other.ID
+		edited.AllowSubChannels = true
+		edited.PasswordHash = "argon2id$00$00"
+		edited.Codec = model.CodecSettings{Bitrate: 128000, FrameMs: 40, Application: model.CodecApplicationMusic, Stereo: true}
+		edited.E2EE = true
+		if err := st.UpdateChannel(&edited); err != nil {
+			t.Fatalf("UpdateChannel: %v", err)
+		}
+
+		got, err := st.GetChannel(child.ID)
+		if err != nil || got == nil {
+			t.Fatalf("GetChannel: ch=%v err=%v", got, err)
+		}
+		if diff := cmp.Diff(edited, *got, cmpopts.IgnoreFields(model.Channel{}, "CreatedAt")); diff != "" {
+			t.Errorf("UpdateChannel mismatch (-want +got):\n%s", diff)
+		}
+
+		cycle := *root
+		cycle.ParentID = other.ID
+		if err := st.UpdateChannel(&cycle); err != nil {
+			t.Fatalf("UpdateChannel: moving root under sibling: %v", err)
+		}
+		cycle = *other
+		cycle.ParentID = root.ID
+		if err := st.UpdateChannel(&cycle); !errors.Is(err, model.ErrChannelCycle) {
+			t.Fatalf("UpdateChannel: want ErrChannelCycle, got %v", err)
+		}
+
+		invalid := *other
+		invalid.Name = ""
+		if err := st.UpdateChannel(&invalid); !errors.Is(err, model.ErrChannelNameEmpty) {
+			t.Fatalf("UpdateChannel: want ErrChannelNameEmpty, got %v", err)
+		}
+		invalid = *other
+		invalid.Codec.FrameMs = 30
+		if err := st.UpdateChannel(&invalid); !errors.Is(err, model.ErrChannelCodec) {
+			t.Fatalf("UpdateChannel: want ErrChannelCodec, got %v", err)
+		}
+
+		missing := model.Channel{ID: 999, Name: "Ghost"}
+		if err := st.UpdateChannel(&missing); !errors.Is(err, model.ErrChannelNotFound) {
+			t.Fatalf("UpdateChannel: want ErrChannelNotFound, got %v", err)
+		}
+	})
+}
+
+func TestUpdateChannelConcurrentReparent(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		// Moving a under b and b under a at once must never leave a loop
+		for i := 0; i < 20; i++ {
+			a := &model.Channel{Name: fmt.Sprintf("A%d", i)}
+			b := &model.Channel{Name: fmt.Sprintf("B%d", i)}
+			for _, ch := range []*model.Channel{a, b} {
+				if err := st.CreateChannel(ch); err != nil {
+					t.Fatalf("CreateChannel: %v", err)
+				}
+			}
+			moveA, moveB := *a, *b
+			moveA.ParentID, moveB.ParentID = b.ID, a.ID
+
+			var wg sync.WaitGroup
+			errs := make([]error, 2)
+			for j, ch := range []*model.Channel{&moveA, &moveB} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs[j] = st.UpdateChannel(ch)
+				}()
+			}
+			wg.Wait()
+
+			for _, err := range errs {
+				if err != nil && !errors.Is(err, model.ErrChannelCycle) {
+					t.Fatalf("UpdateChannel: %v", err)
+				}
+			}
+			gotA, err := st.GetChannel(a.ID)
+			if err != nil {
+				t.Fatalf("GetChannel: %v", err)
+			}
+			gotB, err := st.GetChannel(b.ID)
+			if err != nil {
+				t.Fatalf("GetChannel: %v", err)
+			}
+			if gotA.ParentID == b.ID && gotB.ParentID == a.ID {
+				t.Fatalf("UpdateChannel: concurrent reparents formed a cycle (errs %v)", errs)
+			}
+		}
+	})
+}
+
 func TestDeleteChannel(t *testing.T) {
 	t.Parallel()
 
@@ -708,7 +843,7 @@ func TestHasTokens(t *testing.T) {
 
 				hash := crypto.HashToken(rawToken)
 
-				if err := store.CreateToken(hash, model.RoleUser, 1, 1, 1, time.Now().Add(time.Hour)); err != nil {
+				if err := store.CreateToken(hash, "", model.RoleUser, 1, 1, 1, time.Now().Add(time.Hour)); err != nil {
 					t.Fatalf("CreateToken: failed to create token: %v", err)
 				}
 			}
@@ -757,7 +892,7 @@ func TestCreateToken(t *testing.T) {
 				t.Fatalf("failed to open test connection: %v", err)
 			}
 
-			if err := store.CreateToken(tc.hash, tc.role, tc.channelScope, tc.createdBy, tc.maxUses, tc.expiresAt); err != nil {
+			if err := store.CreateToken(tc.hash, "", tc.role, tc.channelScope, tc.createdBy, tc.maxUses, tc.expiresAt); err != nil {
 				t.Fatalf("CreateToken: failed to create token: %v", err)
 			}
 
@@ -853,7 +988,7 @@ func TestValidateToken(t *testing.T) {
 				t.Fatalf("failed to open test connection: %v", err)
 			}
 
-			if err := store.CreateToken(tc.token.hash, tc.token.role, tc.token.channelScope, tc.token.createdBy, tc.token.maxUses, tc.token.expiresAt); err != nil {
+			if err := store.CreateToken(tc.token.hash, "", tc.token.role, tc.token.channelScope, tc.token.createdBy, tc.token.maxUses, tc.token.expiresAt); err != nil {
 				t.Fatalf("CreateToken: failed to create token: %v", err)
 			}
 
@@ -862,7 +997,7 @@ func TestValidateToken(t *testing.T) {
 			if err != nil && tc.expectValidation {
 				t.Fatalf("ValidateToken_1: unexpected error: %v", err)
 			}
-			role, err := store.ValidateToken(tc.token.hash)
+			token, err := store.ValidateToken(tc.token.hash)
 			if !tc.expectValidation {
 				if err == nil {
 					t.Fatalf("ValidateToken_2: expected error, got nil")
@@ -873,13 +1008,114 @@ func TestValidateToken(t *testing.T) {
 				t.Fatalf("ValidateToken: unexpected error: %v", err)
 			}
 
-			if tc.token.role != role {
-				t.Fatalf("ValidateToken: role mismatch want=%d got=%d", int(tc.token.role), int(role))
+			if tc.token.role != token.Role {
+				t.Fatalf("ValidateToken: role mismatch want=%d got=%d", int(tc.token.role), int(token.Role))
+			}
+			if tc.token.channelScope != token.ChannelScope {
+				t.Fatalf("ValidateToken: channel scope mismatch want=%d got=%d", tc.token.channelScope, token.ChannelScope)
+			}
+			if token.UseCount != 2 {
+				t.Fatalf("ValidateToken: use count mismatch want=2 got=%d", token.UseCount)
 			}
 		})
 	}
 }
 
+func TestListTokens(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		first := crypto.HashToken("68FFA106C3C303C9BAB815240986C321")
+		second := crypto.HashToken("1D0C2A53F8B34E6F9A0E7C21B5D84F10")
+		if err := st.CreateToken(first, "for alice", model.RoleUser, 0, 1, 5, st.ZeroTime()); err != nil {
+			t.Fatalf("CreateToken: %v", err)
+		}
+		if err := st.CreateToken(second, "", model.RoleModerator, 3, 2, 0, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("CreateToken: %v", err)
+		}
+
+		tokens, err := st.ListTokens()
+		if err != nil {
+			t.Fatalf("ListTokens: %v", err)
+		}
+		if len(tokens) != 2 {
+			t.Fatalf("ListTokens: want 2 tokens, got %d", len(tokens))
+		}
+
+		// Newest first
+		if tokens[0].ShortID != model.TokenShortID(second) || tokens[1].ShortID != model.TokenShortID(first) {
+			t.Fatalf("ListTokens: unexpected order %q, %q", tokens[0].ShortID, tokens[1].ShortID)
+		}
+		if tokens[1].Label != "for alice" || tokens[1].MaxUses != 5 || tokens[1].CreatedBy != 1 {
+			t.Fatalf("ListTokens: unexpected first token %+v", tokens[1])
+		}
+		if tokens[0].Role != model.RoleModerator || tokens[0].ChannelScope != 3 || tokens[0].ExpiresAt.IsZero() {
+			t.Fatalf("ListTokens: unexpected second token %+v", tokens[0])
+		}
+		for _, tok := range tokens {
+			if len(tok.ShortID) != model.TokenShortIDLength {
+				t.Fatalf("ListTokens: short ID %q has wrong length", tok.ShortID)
+			}
+			if tok.IsRevoked() {
+				t.Fatalf("ListTokens: token %d unexpectedly revoked", tok.ID)
+			}
+		}
+	})
+}
+
+func TestCreateTokenLabelTooLong(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		label := strings.Repeat("x", model.MaxTokenLabelLength+1)
+		err := st.CreateToken(crypto.HashToken("68FFA106C3C303C9BAB815240986C321"), label, model.RoleUser, 0, 1, 0, st.ZeroTime())
+		if err == nil {
+			t.Fatalf("CreateToken: expected error for oversized label")
+		}
+	})
+}
+
+func TestRevokeToken(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		hash := crypto.HashToken("68FFA106C3C303C9BAB815240986C321")
+		if err := st.CreateToken(hash, "", model.RoleUser, 0, 1, 0, st.ZeroTime()); err != nil {
+			t.Fatalf("CreateToken: %v", err)
+		}
+		if _, err := st.ValidateToken(hash); err != nil {
+			t.Fatalf("ValidateToken before revoke: %v", err)
+		}
+
+		tokens, err := st.ListTokens()
+		if err != nil || len(tokens) != 1 {
+			t.Fatalf("ListTokens: tokens=%v err=%v", tokens, err)
+		}
+		id := tokens[0].ID
+
+		if err := st.RevokeToken(id); err != nil {
+			t.Fatalf("RevokeToken: %v", err)
+		}
+		if _, err := st.ValidateToken(hash); err == nil {
+			t.Fatalf("ValidateToken: expected revoked token to be rejected")
+		}
+		if err := st.RevokeToken(id); err == nil {
+			t.Fatalf("RevokeToken: expected error revoking twice")
+		}
+		if err := st.RevokeToken(id + 100); err == nil {
+			t.Fatalf("RevokeToken: expected error for unknown token")
+		}
+
+		tokens, err = st.ListTokens()
+		if err != nil {
+			t.Fatalf("ListTokens: %v", err)
+		}
+		if !tokens[0].IsRevoked() || tokens[0].UseCount != 1 {
+			t.Fatalf("ListTokens: want revoked token with 1 use, got %+v", tokens[0])
+		}
+	})
+}
+
 func TestCreateBan(t *testing.T) {
 	t.Parallel()
 
@@ -1007,3 +1243,375 @@ func TestIsUserBanned(t *testing.T) {
 		})
 	}
 }
+
+func TestIsIPBanned(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		if err := st.CreateBan(0, "198.51.100.7", "ban evasion", 2, st.ZeroTime()); err != nil {
+			t.Fatalf("CreateBan: %v", err)
+		}
+		if err := st.CreateBan(0, "203.0.113.0/24", "abuse from range", 2, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("CreateBan: %v", err)
+		}
+		if err := st.CreateBan(0, "192.0.2.1", "expired", 2, time.Now().Add(-time.Hour)); err != nil {
+			t.Fatalf("CreateBan: %v", err)
+		}
+
+		tests := map[string]bool{
+			"198.51.100.7":       true,
+			"198.51.100.8":       false,
+			"203.0.113.42":       true,
+			"192.0.2.1":          false,
+			"::ffff:203.0.113.9": true,
+		}
+		for ip, want := range tests {
+			got, err := st.IsIPBanned(ip)
+			if err != nil {
+				t.Fatalf("IsIPBanned(%s): %v", ip, err)
+			}
+			if got != want {
+				t.Errorf("IsIPBanned(%s) = %t, want %t", ip, got, want)
+			}
+		}
+
+		if _, err := st.IsIPBanned("not-an-ip"); err == nil {
+			t.Fatalf("IsIPBanned: expected error for invalid address")
+		}
+	})
+}
+
+func TestCreateBanInvalid(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		if err := st.CreateBan(0, "", "nobody", 2, st.ZeroTime()); err == nil {
+			t.Fatalf("CreateBan: expected error without user or ip")
+		}
+		if err := st.CreateBan(0, "10.0.0.0/99", "bad range", 2, st.ZeroTime()); err == nil {
+			t.Fatalf("CreateBan: expected error for invalid CIDR")
+		}
+	})
+}
+
+func TestListBansAndUnban(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		if err := st.CreateBan(1, "", "spam", 2, st.ZeroTime()); err != nil {
+			t.Fatalf("CreateBan: %v", err)
+		}
+		if err := st.CreateBan(0, "203.0.113.5/24", "range", 2, time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("CreateBan: %v", err)
+		}
+		if err := st.CreateBan(3, "", "old", 2, time.Now().Add(-time.Hour)); err != nil {
+			t.Fatalf("CreateBan: %v", err)
+		}
+
+		bans, err := st.ListBans()
+		if err != nil {
+			t.Fatalf("ListBans: %v", err)
+		}
+		if len(bans) != 2 {
+			t.Fatalf("ListBans: want 2 active bans, got %d", len(bans))
+		}
+		if bans[0].IP != "203.0.113.0/24" || bans[0].ExpiresAt.IsZero() {
+			t.Fatalf("ListBans: unexpected newest ban %+v", bans[0])
+		}
+		if bans[1].UserID != 1 || bans[1].Reason != "spam" || bans[1].BannedBy != 2 || !bans[1].ExpiresAt.IsZero() {
+			t.Fatalf("ListBans: unexpected oldest ban %+v", bans[1])
+		}
+
+		if err := st.Unban(bans[1].ID); err != nil {
+			t.Fatalf("Unban: %v", err)
+		}
+		banned, err := st.IsUserBanned(1)
+		if err != nil {
+			t.Fatalf("IsUserBanned: %v", err)
+		}
+		if banned {
+			t.Fatalf("IsUserBanned: user still banned after Unban")
+		}
+		if err := st.Unban(bans[1].ID); err == nil {
+			t.Fatalf("Unban: expected error for missing ban")
+		}
+	})
+}
+
+func TestChannelACLs(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		ch := &model.Channel{Name: "Stage"}
+		if err := st.CreateChannel(ch); err != nil {
+			t.Fatalf("CreateChannel: %v", err)
+		}
+
+		roleDeny := &model.ChannelACL{ChannelID: ch.ID, Role: model.RoleUser, Permission: model.PermSpeak, Allow: false}
+		if err := st.SetChannelACL(roleDeny); err != nil {
+			t.Fatalf("SetChannelACL: %v", err)
+		}
+		userAllow := &model.ChannelACL{ChannelID: ch.ID, UserID: 42, Permission: model.PermSpeak, Allow: true}
+		if err := st.SetChannelACL(userAllow); err != nil {
+			t.Fatalf("SetChannelACL: %v", err)
+		}
+
+		// Setting the same target again replaces the entry instead of adding one
+		replaced := &model.ChannelACL{ChannelID: ch.ID, Role: model.RoleUser, Permission: model.PermSpeak, Allow: true}
+		if err := st.SetChannelACL(replaced); err != nil {
+			t.Fatalf("SetChannelACL: %v", err)
+		}
+		if replaced.ID != roleDeny.ID {
+			t.Fatalf("SetChannelACL: want upsert of id %d, got %d", roleDeny.ID, replaced.ID)
+		}
+
+		acls, err := st.ListChannelACLs()
+		if err != nil {
+			t.Fatalf("ListChannelACLs: %v", err)
+		}
+		want := []model.ChannelACL{*replaced, *userAllow}
+		if diff := cmp.Diff(want, acls); diff != "" {
+			t.Errorf("ListChannelACLs mismatch (-want +got):\n%s", diff)
+		}
+
+		if err := st.DeleteChannelACL(userAllow.ID); err != nil {
+			t.Fatalf("DeleteChannelACL: %v", err)
+		}
+		if err := st.DeleteChannelACL(userAllow.ID); err == nil {
+			t.Fatalf("DeleteChannelACL: expected error for missing entry")
+		}
+
+		// Deleting the channel drops its overrides
+		if err := st.DeleteChannel(ch.ID); err != nil {
+			t.Fatalf("DeleteChannel: %v", err)
+		}
+		acls, err = st.ListChannelACLs()
+		if err != nil {
+			t.Fatalf("ListChannelACLs: %v", err)
+		}
+		if len(acls) != 0 {
+			t.Fatalf("ListChannelACLs: want no entries after channel delete, got %v", acls)
+		}
+	})
+}
+
+func TestRoles(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		dj := &model.RoleDefinition{Name: "dj", Priority: 10, Permissions: []model.Permission{model.PermJoinChannel, model.PermSpeak}}
+		if err := st.SaveRole(dj); err != nil {
+			t.Fatalf("SaveRole: %v", err)
+		}
+		if dj.ID != model.RoleCustomBase {
+			t.Fatalf("SaveRole: want first ID %d, got %d", model.RoleCustomBase, dj.ID)
+		}
+		guest := &model.RoleDefinition{Name: "guest", Permissions: []model.Permission{model.PermJoinChannel}}
+		if err := st.SaveRole(guest); err != nil {
+			t.Fatalf("SaveRole: %v", err)
+		}
+
+		// Saving an existing name updates it in place and keeps the ID
+		updated := &model.RoleDefinition{Name: "dj", Priority: 20, Permissions: []model.Permission{model.PermSpeak, model.PermKickUser}}
+		if err := st.SaveRole(updated); err != nil {
+			t.Fatalf("SaveRole: %v", err)
+		}
+		if updated.ID != dj.ID {
+			t.Fatalf("SaveRole: want ID %d kept, got %d", dj.ID, updated.ID)
+		}
+
+		for _, bad := range []model.RoleDefinition{
+			{Name: "admin"},
+			{Name: "Bad Name"},
+			{Name: "boss", Priority: model.PriorityAdmin},
+		} {
+			if err := st.SaveRole(&bad); err == nil {
+				t.Errorf("SaveRole(%q, %d): expected error", bad.Name, bad.Priority)
+			}
+		}
+
+		roles, err := st.ListRoles()
+		if err != nil {
+			t.Fatalf("ListRoles: %v", err)
+		}
+		want := []model.RoleDefinition{*updated, *guest}
+		if diff := cmp.Diff(want, roles); diff != "" {
+			t.Errorf("ListRoles mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestCustomRoleUsers(t *testing.T) {
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		dj := &model.RoleDefinition{Name: "dj", Priority: 10, Permissions: []model.Permission{model.PermSpeak}}
+		if err := st.SaveRole(dj); err != nil {
+			t.Fatalf("SaveRole: %v", err)
+		}
+		model.RegisterCustomRoles([]model.RoleDefinition{*dj})
+		t.Cleanup(func() { model.RegisterCustomRoles(nil) })
+
+		// First login with a custom-role token
+		alice, err := st.CreateUser("alice", dj.ID)
+		if err != nil {
+			t.Fatalf("CreateUser with custom role: %v", err)
+		}
+		// SetUserRole to a custom role
+		bob, err := st.CreateUser("bob", model.RoleUser)
+		if err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+		if err := st.UpdateUserRole(bob.ID, dj.ID); err != nil {
+			t.Fatalf("UpdateUserRole to custom role: %v", err)
+		}
+		for _, id := range []int64{alice.ID, bob.ID} {
+			u, err := st.GetUserByID(id)
+			if err != nil || u == nil || u.Role != dj.ID {
+				t.Fatalf("GetUserByID(%d): got %+v (%v), want role %d", id, u, err, dj.ID)
+			}
+		}
+	})
+}
+
+func TestChatMessages(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		ch := &model.Channel{Name: "Lobby", ChatRetention: 72 * time.Hour}
+		other := &model.Channel{Name: "Quiet", ChatRetention: -time.Second}
+		for _, c := range []*model.Channel{ch, other} {
+			if err := st.CreateChannel(c); err != nil {
+				t.Fatalf("CreateChannel: %v", err)
+			}
+		}
+		got, err := st.GetChannel(other.ID)
+		if err != nil || got.ChatRetention >= 0 {
+			t.Fatalf("GetChannel: want negative retention, got %v (%v)", got, err)
+		}
+
+		base := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+		var msgs []model.ChatMessage
+		for i := range 5 {
+			m := &model.ChatMessage{ChannelID: ch.ID, UserID: 7, Username: "alice", Text: fmt.Sprintf("msg %d", i), CreatedAt: base.Add(time.Duration(i) * time.Hour)}
+			if err := st.AddChatMessage(m); err != nil {
+				t.Fatalf("AddChatMessage: %v", err)
+			}
+			msgs = append(msgs, *m)
+			if err := st.AddChatMessage(&model.ChatMessage{ChannelID: other.ID, Username: "bob", Text: "elsewhere"}); err != nil {
+				t.Fatalf("AddChatMessage: %v", err)
+			}
+		}
+
+		// Pages go backwards from the newest message
+		page, err := st.ListChatMessages(ch.ID, 0, 2)
+		if err != nil {
+			t.Fatalf("ListChatMessages: %v", err)
+		}
+		if diff := cmp.Diff([]model.ChatMessage{msgs[4], msgs[3]}, page); diff != "" {
+			t.Fatalf("ListChatMessages mismatch (-want +got):\n%s", diff)
+		}
+		page, err = st.ListChatMessages(ch.ID, page[1].ID, 10)
+		if err != nil {
+			t.Fatalf("ListChatMessages: %v", err)
+		}
+		if diff := cmp.Diff([]model.ChatMessage{msgs[2], msgs[1], msgs[0]}, page); diff != "" {
+			t.Fatalf("ListChatMessages mismatch (-want +got):\n%s", diff)
+		}
+
+		n, err := st.PruneChatMessages(ch.ID, base.Add(2*time.Hour))
+		if err != nil || n != 2 {
+			t.Fatalf("PruneChatMessages: want 2 deleted, got %d (%v)", n, err)
+		}
+		page, err = st.ListChatMessages(ch.ID, 0, 10)
+		if err != nil {
+			t.Fatalf("ListChatMessages: %v", err)
+		}
+		if diff := cmp.Diff([]model.ChatMessage{msgs[4], msgs[3], msgs[2]}, page); diff != "" {
+			t.Fatalf("ListChatMessages after prune mismatch (-want +got):\n%s", diff)
+		}
+
+		// Edits keep the message in place; deletes remove it
+		edited := base.Add(5 * time.Hour)
+		if err := st.UpdateChatMessage(ch.ID, msgs[3].ID, "fixed", edited); err != nil {
+			t.Fatalf("UpdateChatMessage: %v", err)
+		}
+		want := msgs[3]
+		want.Text, want.EditedAt = "fixed", edited
+		if got, err := st.GetChatMessage(ch.ID, msgs[3].ID); err != nil || got == nil || !cmp.Equal(*got, want) {
+			t.Fatalf("GetChatMessage after edit: got %+v (%v), want %+v", got, err, want)
+		}
+		if got, err := st.GetChatMessage(other.ID, msgs[3].ID); err != nil || got != nil {
+			t.Fatalf("GetChatMessage in other channel: got %+v (%v)", got, err)
+		}
+		if err := st.DeleteChatMessage(ch.ID, msgs[4].ID); err != nil {
+			t.Fatalf("DeleteChatMessage: %v", err)
+		}
+		page, err = st.ListChatMessages(ch.ID, 0, 10)
+		if err != nil {
+			t.Fatalf("ListChatMessages: %v", err)
+		}
+		if diff := cmp.Diff([]model.ChatMessage{want, msgs[2]}, page); diff != "" {
+			t.Fatalf("ListChatMessages after delete mismatch (-want +got):\n%s", diff)
+		}
+
+		// Deleting the channel drops its history
+		if err := st.DeleteChannel(other.ID); err != nil {
+			t.Fatalf("DeleteChannel: %v", err)
+		}
+		if page, err := st.ListChatMessages(other.ID, 0, 10); err != nil || len(page) != 0 {
+			t.Fatalf("ListChatMessages after delete: got %v (%v)", page, err)
+		}
+	})
+}
+
+func TestDirectMessages(t *testing.T) {
+	t.Parallel()
+
+	withStores(t, func(t *testing.T, st store.DataStore) {
+		sent := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+		var fromAlice []model.DirectMessage
+		for _, m := range []*model.DirectMessage{
+			{SenderID: 1, SenderName: "alice", RecipientID: 3, Text: "hi", CreatedAt: sent},
+			{SenderID: 2, SenderName: "bob", RecipientID: 3, Text: "yo", CreatedAt: sent},
+			{SenderID: 1, SenderName: "alice", RecipientID: 3, Text: "still there?", CreatedAt: sent.Add(time.Minute)},
+			{SenderID: 1, SenderName: "alice", RecipientID: 2, Text: "hey bob", CreatedAt: sent},
+		} {
+			if err := st.AddDirectMessage(m); err != nil {
+				t.Fatalf("AddDirectMessage: %v", err)
+			}
+			if m.SenderID == 1 && m.RecipientID == 3 {
+				fromAlice = append(fromAlice, *m)
+			}
+		}
+
+		counts, err := st.CountDirectMessages(3)
+		if err != nil {
+			t.Fatalf("CountDirectMessages: %v", err)
+		}
+		if diff := cmp.Diff(map[int64]int{1: 2, 2: 1}, counts); diff != "" {
+			t.Fatalf("CountDirectMessages mismatch (-want +got):\n%s", diff)
+		}
+
+		msgs, err := st.ListDirectMessages(3, 1)
+		if err != nil {
+			t.Fatalf("ListDirectMessages: %v", err)
+		}
+		if diff := cmp.Diff(fromAlice, msgs); diff != "" {
+			t.Fatalf("ListDirectMessages mismatch (-want +got):\n%s", diff)
+		}
+
+		// Deleting up to an ID leaves later messages and other conversations
+		if err := st.DeleteDirectMessages(3, 1, fromAlice[0].ID); err != nil {
+			t.Fatalf("DeleteDirectMessages: %v", err)
+		}
+		counts, err = st.CountDirectMessages(3)
+		if err != nil {
+			t.Fatalf("CountDirectMessages: %v", err)
+		}
+		if diff := cmp.Diff(map[int64]int{1: 1, 2: 1}, counts); diff != "" {
+			t.Fatalf("CountDirectMessages after delete mismatch (-want +got):\n%s", diff)
+		}
+		if counts, _ := st.CountDirectMessages(2); counts[1] != 1 {
+			t.Fatalf("CountDirectMessages(2): got %v", counts)
+		}
+	})
+}
@@ -2,9 +2,11 @@
 package ui
 
 import (
+	"errors"
 	"fmt"
 	"image/color"
 	"log/slog"
+	"slices"
 	"strings"
 	"time"
 
@@ -29,6 +31,13 @@ import (
 //go:embed gospeak-icon.png
 var appIconBytes []byte
 
+// lockIconSVG marks password-protected channels. Fyne's theme has no lock
+// glyph, so it is drawn here and recolored by the theme like built-in icons.
+const lockIconSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="24" height="24" viewBox="0 0 24 24">` +
+	`<path d="M18 8h-1V6c0-2.76-2.24-5-5-5S7 3.24 7 6v2H6c-1.1 0-2 .9-2 2v10c0 1.1.9 2 2 2h12c1.1 0 2-.9 2-2V10c0-1.1-.9-2-2-2zm-6 9c-1.1 0-2-.9-2-2s.9-2 2-2 2 .9 2 2-.9 2-2 2zM9 8V6c0-1.66 1.34-3 3-3s3 1.34 3 3v2H9z"/></svg>`
+
+var lockIcon = theme.NewThemedResource(fyne.NewStaticResource("lock.svg", []byte(lockIconSVG)))
+
 // App is the main GUI application.
 type App struct {
 	fyneApp fyne.App
@@ -47,13 +56,33 @@ type App struct {
 	vadIndicator  *widget.Label
 
 	// Chat UI
-	chatBox    *fyne.Container
-	chatScroll *container.Scroll
-	chatEntry  *widget.Entry
+	chatBox     *fyne.Container
+	chatScroll  *container.Scroll
+	chatEntry   *widget.Entry
+	chatOlder   *widget.Button // loads the next older page of history
+	chatIDs     []int64        // message ID of each chatBox line, 0 for notices
+	chatChannel int64          // channel the chat pane shows
+	chatBefore  int64          // cursor of the next older history page, 0 = none
+	chatTabs    *container.DocTabs
+	channelTab  *container.TabItem
+	dms         map[int64]*dmTab // direct message conversations by peer user ID
 
 	// State
 	channels []pb.ChannelInfo
 
+	// Token management (admin)
+	tokens    []pb.TokenInfo
+	tokenList *widget.List // non-nil while the token manager dialog is open
+
+	// Ban management (admin)
+	bans    []pb.BanInfo
+	banList *widget.List // non-nil while the ban manager dialog is open
+
+	// Channel permission overrides (admin)
+	aclChannelID int64
+	aclEntries   []pb.ChannelACLEntry
+	aclList      *widget.List // non-nil while the permissions dialog is open
+
 	// Bookmarks & Settings
 	bookmarks     *client.BookmarkStore
 	settings      *client.Settings
@@ -77,7 +106,13 @@ func NewApp() *App {
 		hotkeys:   client.NewGlobalHotkeys(),
 	}
 	a.bookmarks.Load() //nolint:errcheck,gosec // best-effort load
+	if identity, err := client.LoadIdentity(); err != nil {
+		slog.Warn("identity key unavailable, using a temporary one", "err", err)
+	} else {
+		a.engine.SetIdentity(identity)
+	}
 	a.engine.SetVADThreshold(a.settings.VADThreshold)
+	a.engine.SetDuckingAttenuation(a.settings.DuckingDB)
 	a.window = a.fyneApp.NewWindow("GoSpeak")
 	a.window.Resize(fyne.NewSize(800, 600))
 	a.window.SetMaster()
@@ -190,6 +225,13 @@ func (a *App) buildUI() {
 	// --- Chat panel (right side) ---
 	a.chatBox = container.NewVBox()
 	a.chatScroll = container.NewVScroll(a.chatBox)
+	a.chatOlder = widget.NewButton("Load older messages", func() {
+		if err := a.engine.RequestChatHistory(a.chatChannel, a.chatBefore); err != nil {
+			slog.Debug("request chat history error", "err", err)
+		}
+	})
+	a.chatOlder.Importance = widget.LowImportance
+	a.chatOlder.Hide()
 
 	a.chatEntry = widget.NewEntry()
 	a.chatEntry.SetPlaceHolder("Type a message... (Enter to send)")
@@ -205,11 +247,30 @@ func (a *App) buildUI() {
 		a.chatEntry.SetText("")
 	}
 
-	chatHeader := widget.NewLabelWithStyle("Chat", fyne.TextAlignCenter, fyne.TextStyle{Bold: true})
-	chatPanel := container.NewBorder(chatHeader, a.chatEntry, nil, nil, a.chatScroll)
+	chatPanel := container.NewBorder(a.chatOlder, a.chatEntry, nil, nil, a.chatScroll)
+
+	// Channel chat first, then a closable tab per direct message conversation
+	a.dms = make(map[int64]*dmTab)
+	a.channelTab = container.NewTabItem("Channel", chatPanel)
+	a.chatTabs = container.NewDocTabs(a.channelTab)
+	a.chatTabs.CloseIntercept = func(item *container.TabItem) {
+		for id, dm := range a.dms {
+			if dm.tab == item {
+				delete(a.dms, id)
+				a.chatTabs.Remove(item)
+			}
+		}
+	}
+	a.chatTabs.OnSelected = func(item *container.TabItem) {
+		for _, dm := range a.dms {
+			if dm.tab == item {
+				a.readDM(dm)
+			}
+		}
+	}
 
 	// --- Main layout ---
-	mainArea := container.NewHSplit(sidebar, chatPanel)
+	mainArea := container.NewHSplit(sidebar, a.chatTabs)
 	mainArea.SetOffset(0.3)
 
 	statusBar := container.NewHBox(a.statusLabel, layout.NewSpacer(), versionLabel)
@@ -241,6 +302,11 @@ func (a *App) bindEvents() {
 			case client.StateConnecting:
 				a.statusLabel.SetText("Connecting...")
 				a.connectBtn.Disable()
+			case client.StateReconnecting:
+				// Disconnect stays enabled to stop retrying
+				a.statusLabel.SetText("Connection lost, reconnecting...")
+				a.connectBtn.Disable()
+				a.chatEntry.Disable()
 			case client.StateConnected:
 				a.statusLabel.SetText(fmt.Sprintf("Connected as %s (%s)", a.engine.GetUsername(), a.engine.GetRole()))
 				a.connectBtn.Disable()
@@ -297,21 +363,119 @@ func (a *App) bindEvents() {
 		})
 	}
 
-	a.engine.OnChatMessage = func(channelID int64, sender, text string, ts int64) {
+	a.engine.OnMoved = func(channelID int64) {
 		fyne.Do(func() {
-			t := time.Unix(ts, 0)
-			lbl := widget.NewLabel(fmt.Sprintf("[%s] %s: %s", t.Format("15:04"), sender, text))
-			lbl.Wrapping = fyne.TextWrapWord
-			a.chatBox.Add(lbl)
+			name := fmt.Sprintf("#%d", channelID)
+			for _, ch := range a.channels {
+				if ch.ID == channelID {
+					name = ch.Name
+					break
+				}
+			}
+			a.clearChat(channelID)
+			a.addChatLine(fmt.Sprintf("[%s] You were moved to %s", time.Now().Format("15:04"), name))
+			a.chatScroll.ScrollToBottom()
+		})
+	}
+
+	a.engine.OnE2EEDowngrade = func(channelID int64) {
+		fyne.Do(func() {
+			name := fmt.Sprintf("#%d", channelID)
+			for _, ch := range a.channels {
+				if ch.ID == channelID {
+					name = ch.Name
+					break
+				}
+			}
+			dialog.ShowInformation("Security Warning", fmt.Sprintf(
+				"The server tried to replace the end-to-end encryption of %s with a key it knows.\n"+
+					"The key was refused; voice in the channel stays end-to-end encrypted.", name), a.window)
+		})
+	}
+
+	a.engine.OnChatMessage = func(msg pb.ChatMessage) {
+		fyne.Do(func() {
+			if msg.ID != 0 && slices.Contains(a.chatIDs, msg.ID) {
+				return // already shown by a history page
+			}
+			a.addChatMessage(msg)
 			// Keep at most 500 messages
 			if len(a.chatBox.Objects) > 500 {
 				a.chatBox.Objects = a.chatBox.Objects[len(a.chatBox.Objects)-500:]
+				a.chatIDs = a.chatIDs[len(a.chatIDs)-500:]
 				a.chatBox.Refresh()
 			}
 			a.chatScroll.ScrollToBottom()
 		})
 	}
 
+	a.engine.OnChatHistory = func(channelID int64, msgs []pb.ChatMessage, nextBefore int64) {
+		fyne.Do(func() {
+			if channelID != a.chatChannel {
+				return // we left the channel meanwhile
+			}
+			a.mergeChatHistory(msgs, nextBefore)
+		})
+	}
+
+	a.engine.OnChatEdit = func(msg pb.ChatMessage) {
+		fyne.Do(func() {
+			a.editChatLine(msg)
+		})
+	}
+
+	a.engine.OnChatDelete = func(channelID, id int64, deletedBy string) {
+		fyne.Do(func() {
+			a.removeChatLine(channelID, id, deletedBy)
+		})
+	}
+
+	a.engine.OnDirectMessage = func(peerID int64, msg pb.DirectMessage) {
+		fyne.Do(func() {
+			name := msg.SenderName
+			if msg.SenderID != peerID {
+				name = "" // our own message; the tab knows the peer
+			}
+			dm := a.openDM(peerID, name, false)
+			line := chatLine(pb.ChatMessage{SenderName: msg.SenderName, Text: msg.Text, Timestamp: msg.Timestamp})
+			if msg.SenderID != peerID && msg.Stored {
+				line += " (delivered when they come online)"
+			}
+			a.addDMLine(dm, line)
+			if msg.SenderID == peerID && a.chatTabs.Selected() != dm.tab {
+				dm.unread++
+				a.refreshDMTab(dm)
+			}
+		})
+	}
+
+	a.engine.OnUnreadMessages = func(unread []pb.UnreadCount) {
+		fyne.Do(func() {
+			for _, u := range unread {
+				dm := a.openDM(u.UserID, u.Username, false)
+				dm.stored = true
+				dm.unread += int(u.Count)
+				a.refreshDMTab(dm)
+			}
+		})
+	}
+
+	a.engine.OnMOTD = func(text string) {
+		fyne.Do(func() {
+			dialog.ShowInformation("Message of the Day", text, a.window)
+		})
+	}
+
+	a.engine.OnBroadcast = func(msg pb.ServerBroadcastEvent) {
+		fyne.Do(func() {
+			title := "Server Announcement"
+			if msg.SenderName != "" {
+				title = "Announcement from " + msg.SenderName
+			}
+			dialog.ShowInformation(title, msg.Text, a.window)
+		})
+	}
+
 	a.engine.OnTokenCreated = func(token string) {
 		fyne.Do(func() {
 			entry := widget.NewEntry()
@@ -323,6 +487,38 @@ func (a *App) bindEvents() {
 			), a.window)
 			d.Resize(fyne.NewSize(450, 150))
 			d.Show()
+			// Keep an open token manager in sync with the new token
+			if a.tokenList != nil {
+				_ = a.engine.ListTokens()
+			}
+		})
+	}
+
+	a.engine.OnTokenList = func(tokens []pb.TokenInfo) {
+		fyne.Do(func() {
+			a.tokens = tokens
+			if a.tokenList != nil {
+				a.tokenList.Refresh()
+			}
+		})
+	}
+
+	a.engine.OnBanList = func(bans []pb.BanInfo) {
+		fyne.Do(func() {
+			a.bans = bans
+			if a.banList != nil {
+				a.banList.Refresh()
+			}
+		})
+	}
+
+	a.engine.OnChannelACL = func(channelID int64, entries []pb.ChannelACLEntry) {
+		fyne.Do(func() {
+			if a.aclList == nil || channelID != a.aclChannelID {
+				return
+			}
+			a.aclEntries = entries
+			a.aclList.Refresh()
 		})
 	}
 
@@ -485,19 +681,11 @@ func (a *App) showConnectDialog() {
 			a.connectServer = server
 			a.connectVoice = voice
 
-			go func() {
-				if err := a.engine.Connect(server, voice, token, username); err != nil {
-					slog.Error("connect failed", "err", err)
-					fyne.Do(func() {
-						dialog.ShowError(fmt.Errorf("connection failed: %v", err), a.window)
-					})
-					return
-				}
-				// Save bookmark after successful connect if checkbox is on
-				if saveCheck.Checked {
-					a.saveCurrentBookmark(username)
-				}
-			}()
+			var fingerprint string
+			if b := a.bookmarks.FindByAddr(server); b != nil {
+				fingerprint = b.Fingerprint
+			}
+			a.connect(server, voice, token, username, fingerprint, saveCheck.Checked)
 		},
 		a.window,
 	)
@@ -505,6 +693,65 @@ func (a *App) showConnectDialog() {
 	form.Show()
 }
 
+// connect connects in the background, verifying the server certificate
+// against fingerprint (empty = trust on first use). The certificate is
+// pinned in the bookmarks for the server afterwards.
+func (a *App) connect(server, voice, token, username, fingerprint string, save bool) {
+	go func() {
+		err := a.engine.Connect(server, voice, token, username, fingerprint)
+		var mismatch *client.CertMismatchError
+		if errors.As(err, &mismatch) {
+			slog.Warn("server certificate mismatch", "server", server, "pinned", mismatch.Pinned, "got", mismatch.Got)
+			fyne.Do(func() {
+				a.showCertMismatch(mismatch, func() {
+					a.connect(server, voice, token, username, mismatch.Got, save)
+				})
+			})
+			return
+		}
+		if err != nil {
+			slog.Error("connect failed", "err", err)
+			fyne.Do(func() {
+				dialog.ShowError(fmt.Errorf("connection failed: %v", err), a.window)
+			})
+			return
+		}
+		// Pin the certificate of known servers
+		if a.bookmarks.SetFingerprint(server, a.engine.ServerFingerprint()) {
+			if err := a.bookmarks.Save(); err != nil {
+				slog.Error("failed to save bookmark", "err", err)
+			}
+		}
+		// Save bookmark after successful connect if checkbox is on
+		if save {
+			a.saveCurrentBookmark(username)
+		}
+	}()
+}
+
+// showCertMismatch warns that a server presented a different certificate
+// than the pinned one. onTrust reconnects trusting the new certificate.
+func (a *App) showCertMismatch(mismatch *client.CertMismatchError, onTrust func()) {
+	warning := widget.NewLabel("The certificate of this server does not match the one recorded when you " +
+		"first connected. Someone may be intercepting the connection (man-in-the-middle attack), " +
+		"or the server administrator replaced the certificate.\n\n" +
+		"Only continue if the administrator confirmed the new fingerprint.")
+	warning.Wrapping = fyne.TextWrapWord
+	pinned := widget.NewLabel("Expected: " + mismatch.Pinned)
+	pinned.Wrapping = fyne.TextWrapBreak
+	got := widget.NewLabel("Received: " + mismatch.Got)
+	got.Wrapping = fyne.TextWrapBreak
+
+	d := dialog.NewCustomConfirm("Server Certificate Changed", "Trust New Certificate", "Cancel",
+		container.NewVBox(warning, pinned, got), func(ok bool) {
+			if ok {
+				onTrust()
+			}
+		}, a.window)
+	d.Resize(fyne.NewSize(480, 360))
+	d.Show()
+}
+
 // ----- Admin / Settings dialogs -----
 
 func (a *App) showServerSettings() {
@@ -513,8 +760,10 @@ func (a *App) showServerSettings() {
 
 	// --- Create Invite Token (admin/mod) ---
 	if role == "admin" || role == "moderator" {
-		roleSelect := widget.NewSelect([]string{"user", "moderator", "admin"}, nil)
+		roleSelect := widget.NewSelect(a.engine.GetRoles(), nil)
 		roleSelect.SetSelected("user")
+		labelEntry := widget.NewEntry()
+		labelEntry.SetPlaceHolder("Label (optional, e.g. who it's for)")
 		maxUsesEntry := widget.NewEntry()
 		maxUsesEntry.SetText("10")
 		expiresEntry := widget.NewEntry()
@@ -525,7 +774,7 @@ func (a *App) showServerSettings() {
 			_, _ = fmt.Sscanf(maxUsesEntry.Text, "%d", &maxUses)
 			var expires int64
 			_, _ = fmt.Sscanf(expiresEntry.Text, "%d", &expires)
-			if err := a.engine.CreateToken(roleSelect.Selected, maxUses, expires); err != nil {
+			if err := a.engine.CreateToken(roleSelect.Selected, labelEntry.Text, maxUses, expires); err != nil {
 				dialog.ShowError(err, a.window)
 			}
 		})
@@ -533,11 +782,17 @@ func (a *App) showServerSettings() {
 		sections = append(sections,
 			widget.NewLabelWithStyle("Create Invite Token", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
 			container.NewHBox(widget.NewLabel("Role:"), roleSelect),
+			labelEntry,
 			container.NewHBox(widget.NewLabel("Max Uses:"), maxUsesEntry),
 			container.NewHBox(widget.NewLabel("Expires (sec):"), expiresEntry),
 			createTokenBtn,
-			widget.NewSeparator(),
 		)
+		if role == "admin" {
+			sections = append(sections, widget.NewButton("Manage Tokens...", func() {
+				a.showTokenManager()
+			}))
+		}
+		sections = append(sections, widget.NewSeparator())
 	}
 
 	// --- Create Channel (admin/mod) ---
@@ -549,6 +804,9 @@ func (a *App) showServerSettings() {
 		chMaxEntry := widget.NewEntry()
 		chMaxEntry.SetText("0")
 		chAllowSub := widget.NewCheck("Allow sub-channels", nil)
+		chE2EE := widget.NewCheck("End-to-end encrypted", nil)
+		chHistory := newRetentionSelect(0)
+		chCodec := newCodecFields(pb.CodecSettings{})
 
 		createChanBtn := widget.NewButton("Create Channel", func() {
 			name := strings.TrimSpace(chNameEntry.Text)
@@ -557,7 +815,7 @@ func (a *App) showServerSettings() {
 			}
 			var maxUsers int
 			_, _ = fmt.Sscanf(chMaxEntry.Text, "%d", &maxUsers)
-			if err := a.engine.CreateChannelAdvanced(name, chDescEntry.Text, maxUsers, 0, false, chAllowSub.Checked); err != nil {
+			if err := a.engine.CreateChannelAdvanced(name, chDescEntry.Text, maxUsers, 0, false, chAllowSub.Checked, chE2EE.Checked, retentionSeconds(chHistory), chCodec.settings()); err != nil {
 				dialog.ShowError(err, a.window)
 			}
 		})
@@ -568,11 +826,37 @@ func (a *App) showServerSettings() {
 			chDescEntry,
 			container.NewHBox(widget.NewLabel("Max Users (0=unlimited):"), chMaxEntry),
 			chAllowSub,
+			chE2EE,
+			widget.NewForm(append([]*widget.FormItem{widget.NewFormItem("Chat history", chHistory)}, chCodec.formItems()...)...),
 			createChanBtn,
 			widget.NewSeparator(),
 		)
 	}
 
+	// --- Announcement (admin) ---
+	if role == "admin" {
+		announceEntry := widget.NewMultiLineEntry()
+		announceEntry.SetPlaceHolder("e.g. Restarting in 5 minutes")
+		announceBtn := widget.NewButton("Send to Everyone", func() {
+			text := strings.TrimSpace(announceEntry.Text)
+			if text == "" {
+				return
+			}
+			if err := a.engine.SendBroadcast(text); err != nil {
+				dialog.ShowError(err, a.window)
+				return
+			}
+			announceEntry.SetText("")
+		})
+
+		sections = append(sections,
+			widget.NewLabelWithStyle("Announcement", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+			announceEntry,
+			announceBtn,
+			widget.NewSeparator(),
+		)
+	}
+
 	// --- Export / Import (admin) ---
 	if role == "admin" {
 		exportChBtn := widget.NewButton("Export Channels (YAML)", func() {
@@ -588,12 +872,18 @@ func (a *App) showServerSettings() {
 		importBtn := widget.NewButton("Import Channels (YAML)", func() {
 			a.showImportDialog()
 		})
+		bansBtn := widget.NewButton("Manage Bans...", func() {
+			a.showBanManager()
+		})
 
 		sections = append(sections,
 			widget.NewLabelWithStyle("Export / Import", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
 			exportChBtn,
 			exportUsersBtn,
 			importBtn,
+			widget.NewSeparator(),
+			widget.NewLabelWithStyle("Bans", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+			bansBtn,
 		)
 	}
 
@@ -610,6 +900,531 @@ func (a *App) showServerSettings() {
 	d.Show()
 }
 
+// showTokenManager lists all invite tokens with their usage and lets the
+// admin revoke active ones.
+func (a *App) showTokenManager() {
+	a.tokens = nil
+	a.tokenList = widget.NewList(
+		func() int { return len(a.tokens) },
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("token placeholder")
+			revokeBtn := widget.NewButtonWithIcon("Revoke", theme.DeleteIcon(), nil)
+			revokeBtn.Importance = widget.DangerImportance
+			return container.NewBorder(nil, nil, nil, revokeBtn, label)
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			if id >= len(a.tokens) {
+				return
+			}
+			t := a.tokens[id]
+			border := obj.(*fyne.Container)
+			label := border.Objects[0].(*widget.Label)
+			revokeBtn := border.Objects[1].(*widget.Button)
+
+			label.SetText(formatTokenInfo(t))
+			if t.RevokedAt != 0 {
+				revokeBtn.Disable()
+				revokeBtn.OnTapped = nil
+				return
+			}
+			revokeBtn.Enable()
+			revokeBtn.OnTapped = func() {
+				msg := fmt.Sprintf("Revoke token %s? Users can no longer authenticate with it.", t.ShortID)
+				dialog.ShowConfirm("Revoke Token", msg, func(ok bool) {
+					if !ok {
+						return
+					}
+					if err := a.engine.RevokeToken(t.ID); err != nil {
+						dialog.ShowError(err, a.window)
+					}
+				}, a.window)
+			}
+		},
+	)
+
+	refreshBtn := widget.NewButtonWithIcon("Refresh", theme.ViewRefreshIcon(), func() {
+		if err := a.engine.ListTokens(); err != nil {
+			dialog.ShowError(err, a.window)
+		}
+	})
+
+	content := container.NewBorder(nil, refreshBtn, nil, nil, a.tokenList)
+	d := dialog.NewCustom("Invite Tokens", "Close", content, a.window)
+	d.SetOnClosed(func() {
+		a.tokenList = nil
+	})
+	d.Resize(fyne.NewSize(620, 420))
+	d.Show()
+
+	if err := a.engine.ListTokens(); err != nil {
+		dialog.ShowError(err, a.window)
+	}
+}
+
+// formatTokenInfo renders a single token row for the token manager.
+func formatTokenInfo(t pb.TokenInfo) string {
+	label := t.Label
+	if label == "" {
+		label = "(no label)"
+	}
+
+	uses := fmt.Sprintf("%d/%d uses", t.UseCount, t.MaxUses)
+	if t.MaxUses == 0 {
+		uses = fmt.Sprintf("%d uses", t.UseCount)
+	}
+
+	status := "active"
+	switch {
+	case t.RevokedAt != 0:
+		status = "revoked " + time.Unix(t.RevokedAt, 0).Format("2006-01-02 15:04")
+	case t.ExpiresAt != 0 && time.Now().Unix() > t.ExpiresAt:
+		status = "expired"
+	case t.MaxUses > 0 && t.UseCount >= t.MaxUses:
+		status = "exhausted"
+	case t.ExpiresAt != 0:
+		status = "expires " + time.Unix(t.ExpiresAt, 0).Format("2006-01-02 15:04")
+	}
+
+	return fmt.Sprintf("%s  %s  [%s]  %s  by %s  (%s)", t.ShortID, label, t.Role, uses, t.CreatedByName, status)
+}
+
+// showBanManager lists active bans with reason, issuer and expiry, lets the
+// admin lift them, and allows banning an IP address or CIDR range directly.
+func (a *App) showBanManager() {
+	a.bans = nil
+	a.banList = widget.NewList(
+		func() int { return len(a.bans) },
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("ban placeholder")
+			label.Wrapping = fyne.TextWrapWord
+			unbanBtn := widget.NewButtonWithIcon("Lift", theme.ContentUndoIcon(), nil)
+			return container.NewBorder(nil, nil, nil, unbanBtn, label)
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			if id >= len(a.bans) {
+				return
+			}
+			b := a.bans[id]
+			border := obj.(*fyne.Container)
+			label := border.Objects[0].(*widget.Label)
+			unbanBtn := border.Objects[1].(*widget.Button)
+
+			label.SetText(formatBanInfo(b))
+			unbanBtn.OnTapped = func() {
+				dialog.ShowConfirm("Lift Ban", fmt.Sprintf("Lift ban on %s?", banTarget(b)), func(ok bool) {
+					if !ok {
+						return
+					}
+					if err := a.engine.Unban(b.ID); err != nil {
+						dialog.ShowError(err, a.window)
+					}
+				}, a.window)
+			}
+		},
+	)
+
+	ipEntry := widget.NewEntry()
+	ipEntry.SetPlaceHolder("IP or CIDR, e.g. 203.0.113.0/24")
+	reasonEntry := widget.NewEntry()
+	reasonEntry.SetPlaceHolder("Reason")
+	durationEntry := widget.NewEntry()
+	durationEntry.SetText("0")
+	banIPBtn := widget.NewButton("Ban IP", func() {
+		ip := strings.TrimSpace(ipEntry.Text)
+		if ip == "" {
+			return
+		}
+		var duration int64
+		_, _ = fmt.Sscanf(durationEntry.Text, "%d", &duration)
+		if err := a.engine.BanIP(ip, reasonEntry.Text, duration); err != nil {
+			dialog.ShowError(err, a.window)
+			return
+		}
+		ipEntry.SetText("")
+		reasonEntry.SetText("")
+		_ = a.engine.ListBans()
+	})
+	refreshBtn := widget.NewButtonWithIcon("Refresh", theme.ViewRefreshIcon(), func() {
+		if err := a.engine.ListBans(); err != nil {
+			dialog.ShowError(err, a.window)
+		}
+	})
+
+	addForm := container.NewVBox(
+		widget.NewLabelWithStyle("Ban IP / Range", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		ipEntry,
+		reasonEntry,
+		container.NewHBox(widget.NewLabel("Duration (sec, 0=permanent):"), durationEntry, banIPBtn, layout.NewSpacer(), refreshBtn),
+	)
+
+	content := container.NewBorder(nil, addForm, nil, nil, a.banList)
+	d := dialog.NewCustom("Bans", "Close", content, a.window)
+	d.SetOnClosed(func() {
+		a.banList = nil
+	})
+	d.Resize(fyne.NewSize(620, 480))
+	d.Show()
+
+	if err := a.engine.ListBans(); err != nil {
+		dialog.ShowError(err, a.window)
+	}
+}
+
+// aclPermissions are the permissions offered in the channel permissions dialog.
+var aclPermissions = []string{
+	"join_channel", "speak", "text_chat", "whisper", "create_sub_channel",
+	"edit_channel", "delete_channel", "create_channel",
+}
+
+// showChannelACLManager lists the permission overrides defined on a channel
+// and lets the admin add or remove allow/deny entries for roles or users.
+func (a *App) showChannelACLManager(channel pb.ChannelInfo) {
+	a.aclChannelID = channel.ID
+	a.aclEntries = nil
+	a.aclList = widget.NewList(
+		func() int { return len(a.aclEntries) },
+		func() fyne.CanvasObject {
+			label := widget.NewLabel("acl placeholder")
+			delBtn := widget.NewButtonWithIcon("", theme.DeleteIcon(), nil)
+			return container.NewBorder(nil, nil, nil, delBtn, label)
+		},
+		func(id widget.ListItemID, obj fyne.CanvasObject) {
+			if id >= len(a.aclEntries) {
+				return
+			}
+			entry := a.aclEntries[id]
+			border := obj.(*fyne.Container)
+			label := border.Objects[0].(*widget.Label)
+			delBtn := border.Objects[1].(*widget.Button)
+
+			label.SetText(formatChannelACLEntry(entry))
+			delBtn.OnTapped = func() {
+				if err := a.engine.DeleteChannelACL(entry.ID); err != nil {
+					dialog.ShowError(err, a.window)
+				}
+			}
+		},
+	)
+
+	// Subjects: every role except admin (admins ignore overrides) plus
+	// everyone currently online
+	var subjects []string
+	for _, r := range a.engine.GetRoles() {
+		if r != "admin" {
+			subjects = append(subjects, "role: "+r)
+		}
+	}
+	userIDs := make(map[string]int64)
+	for _, ch := range a.channels {
+		for _, u := range ch.Users {
+			key := "user: " + u.Username
+			if _, seen := userIDs[key]; !seen {
+				userIDs[key] = u.ID
+				subjects = append(subjects, key)
+			}
+		}
+	}
+	subjectSelect := widget.NewSelect(subjects, nil)
+	subjectSelect.SetSelected(subjects[0])
+	permSelect := widget.NewSelect(aclPermissions, nil)
+	permSelect.SetSelected(aclPermissions[0])
+	effectRadio := widget.NewRadioGroup([]string{"Allow", "Deny"}, nil)
+	effectRadio.Horizontal = true
+	effectRadio.SetSelected("Deny")
+
+	addBtn := widget.NewButtonWithIcon("Add", theme.ContentAddIcon(), func() {
+		var userID int64
+		var role string
+		if id, ok := userIDs[subjectSelect.Selected]; ok {
+			userID = id
+		} else {
+			role = strings.TrimPrefix(subjectSelect.Selected, "role: ")
+		}
+		allow := effectRadio.Selected == "Allow"
+		if err := a.engine.SetChannelACL(channel.ID, userID, role, permSelect.Selected, allow); err != nil {
+			dialog.ShowError(err, a.window)
+		}
+	})
+
+	addForm := container.NewVBox(
+		widget.NewLabel("Overrides apply to this channel and its sub-channels."),
+		container.NewGridWithColumns(2, subjectSelect, permSelect),
+		container.NewHBox(effectRadio, layout.NewSpacer(), addBtn),
+	)
+
+	content := container.NewBorder(nil, addForm, nil, nil, a.aclList)
+	d := dialog.NewCustom("Permissions: "+channel.Name, "Close", content, a.window)
+	d.SetOnClosed(func() {
+		a.aclList = nil
+	})
+	d.Resize(fyne.NewSize(520, 420))
+	d.Show()
+
+	if err := a.engine.ListChannelACL(channel.ID); err != nil {
+		dialog.ShowError(err, a.window)
+	}
+}
+
+// formatChannelACLEntry renders an override as e.g. "deny speak for role moderator".
+func formatChannelACLEntry(e pb.ChannelACLEntry) string {
+	effect := "deny"
+	if e.Allow {
+		effect = "allow"
+	}
+	subject := "role " + e.Role
+	if e.UserID != 0 {
+		subject = "user " + e.Username
+		if e.Username == "" {
+			subject = fmt.Sprintf("user #%d", e.UserID)
+		}
+	}
+	return fmt.Sprintf("%s %s for %s", effect, e.Permission, subject)
+}
+
+// banTarget describes who or what a ban applies to.
+func banTarget(b pb.BanInfo) string {
+	user := b.Username
+	if user == "" && b.UserID != 0 {
+		user = fmt.Sprintf("user #%d", b.UserID)
+	}
+	switch {
+	case user != "" && b.IP != "":
+		return user + " (" + b.IP + ")"
+	case user != "":
+		return user
+	default:
+		return b.IP
+	}
+}
+
+// formatBanInfo renders a single ban row for the ban manager.
+func formatBanInfo(b pb.BanInfo) string {
+	reason := b.Reason
+	if reason == "" {
+		reason = "(no reason)"
+	}
+	by := b.BannedByName
+	if by == "" {
+		by = "server"
+	}
+	expires := "permanent"
+	if b.ExpiresAt != 0 {
+		expires = "until " + time.Unix(b.ExpiresAt, 0).Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("%s — %s\nby %s on %s, %s", banTarget(b), reason, by,
+		time.Unix(b.CreatedAt, 0).Format("2006-01-02 15:04"), expires)
+}
+
+// codecFields holds the widgets that edit a channel's voice codec settings.
+type codecFields struct {
+	bitrate     *widget.Select
+	frame       *widget.Select
+	application *widget.RadioGroup
+	stereo      *widget.Check
+}
+
+var (
+	codecBitrates = []string{"16 kbps", "24 kbps", "32 kbps", "48 kbps", "64 kbps", "96 kbps", "128 kbps", "192 kbps", "256 kbps"}
+	codecFrames   = []string{"10 ms", "20 ms", "40 ms", "60 ms"}
+)
+
+// newCodecFields creates codec widgets prefilled from c. Zero values show
+// the server defaults.
+func newCodecFields(c pb.CodecSettings) *codecFields {
+	f := &codecFields{
+		bitrate:     widget.NewSelect(codecBitrates, nil),
+		frame:       widget.NewSelect(codecFrames, nil),
+		application: widget.NewRadioGroup([]string{"Voice", "Music"}, nil),
+		stereo:      widget.NewCheck("Stereo", nil),
+	}
+	bitrate := int(c.Bitrate)
+	if bitrate == 0 {
+		bitrate = 64000
+	}
+	frameMs := int(c.FrameMs)
+	if frameMs == 0 {
+		frameMs = 20
+	}
+	label := fmt.Sprintf("%d kbps", bitrate/1000)
+	if !slices.Contains(codecBitrates, label) {
+		// Custom bitrate from an import; keep it selectable
+		f.bitrate.Options = append(slices.Clone(codecBitrates), label)
+	}
+	f.bitrate.SetSelected(label)
+	f.frame.SetSelected(fmt.Sprintf("%d ms", frameMs))
+	f.application.Horizontal = true
+	if c.Application == "music" {
+		f.application.SetSelected("Music")
+	} else {
+		f.application.SetSelected("Voice")
+	}
+	f.stereo.SetChecked(c.Stereo)
+	return f
+}
+
+// formItems returns the codec widgets as form rows.
+func (f *codecFields) formItems() []*widget.FormItem {
+	return []*widget.FormItem{
+		widget.NewFormItem("Bitrate", f.bitrate),
+		widget.NewFormItem("Frame size", f.frame),
+		widget.NewFormItem("Tuning", f.application),
+		widget.NewFormItem("", f.stereo),
+	}
+}
+
+// settings returns the codec settings selected in the widgets.
+func (f *codecFields) settings() pb.CodecSettings {
+	var c pb.CodecSettings
+	var kbps, ms int32
+	_, _ = fmt.Sscanf(f.bitrate.Selected, "%d kbps", &kbps)
+	_, _ = fmt.Sscanf(f.frame.Selected, "%d ms", &ms)
+	c.Bitrate = kbps * 1000
+	c.FrameMs = ms
+	c.Application = "voice"
+	if f.application.Selected == "Music" {
+		c.Application = "music"
+	}
+	c.Stereo = f.stereo.Checked
+	return c
+}
+
+// chatRetentions are the chat history choices with their retention in
+// seconds, as sent in channel requests.
+var chatRetentions = []struct {
+	label string
+	secs  int64
+}{
+	{"Server default", 0},
+	{"Off", -1},
+	{"1 day", 86400},
+	{"7 days", 7 * 86400},
+	{"30 days", 30 * 86400},
+	{"90 days", 90 * 86400},
+	{"1 year", 365 * 86400},
+}
+
+// newRetentionSelect creates a chat history select set to secs.
+func newRetentionSelect(secs int64) *widget.Select {
+	var options []string
+	selected := ""
+	for _, r := range chatRetentions {
+		options = append(options, r.label)
+		if r.secs == secs || (secs < 0 && r.secs < 0) {
+			selected = r.label
+		}
+	}
+	if selected == "" {
+		// Custom retention from an import; keep it selectable
+		selected = (time.Duration(secs) * time.Second).String()
+		options = append(options, selected)
+	}
+	sel := widget.NewSelect(options, nil)
+	sel.SetSelected(selected)
+	return sel
+}
+
+// retentionSeconds returns the retention chosen in a newRetentionSelect.
+func retentionSeconds(sel *widget.Select) int64 {
+	for _, r := range chatRetentions {
+		if r.label == sel.Selected {
+			return r.secs
+		}
+	}
+	d, _ := time.ParseDuration(sel.Selected)
+	return int64(d / time.Second)
+}
+
+// showEditChannelDialog edits a channel's name, description, user limit,
+// parent, sub-channel and E2EE flags, chat history and codec without
+// recreating it.
+func (a *App) showEditChannelDialog(channel pb.ChannelInfo) {
+	nameEntry := widget.NewEntry()
+	nameEntry.SetText(channel.Name)
+	descEntry := widget.NewEntry()
+	descEntry.SetText(channel.Description)
+	maxEntry := widget.NewEntry()
+	maxEntry.SetText(fmt.Sprintf("%d", channel.MaxUsers))
+	allowSub := widget.NewCheck("Allow sub-channels", nil)
+	allowSub.SetChecked(channel.AllowSubChannels)
+	e2ee := widget.NewCheck("End-to-end encrypted", nil)
+	e2ee.SetChecked(channel.E2EE)
+	history := newRetentionSelect(channel.ChatRetention)
+	passwordEntry := widget.NewPasswordEntry()
+	if channel.HasPassword {
+		passwordEntry.SetPlaceHolder("Leave empty to keep current password")
+	} else {
+		passwordEntry.SetPlaceHolder("Leave empty for no password")
+	}
+	clearPassword := widget.NewCheck("Remove password", nil)
+	if !channel.HasPassword {
+		clearPassword.Hide()
+	}
+
+	// Parent options: root plus every channel that is not this one or below it
+	const rootOption = "(top level)"
+	excluded := map[int64]bool{channel.ID: true}
+	for changed := true; changed; {
+		changed = false
+		for _, ch := range a.channels {
+			if !excluded[ch.ID] && excluded[ch.ParentID] {
+				excluded[ch.ID] = true
+				changed = true
+			}
+		}
+	}
+	parentIDs := map[string]int64{rootOption: 0}
+	options := []string{rootOption}
+	selected := rootOption
+	for _, ch := range a.channels {
+		if excluded[ch.ID] {
+			continue
+		}
+		opt := fmt.Sprintf("%s (#%d)", ch.Name, ch.ID)
+		parentIDs[opt] = ch.ID
+		options = append(options, opt)
+		if ch.ID == channel.ParentID {
+			selected = opt
+		}
+	}
+	parentSelect := widget.NewSelect(options, nil)
+	parentSelect.SetSelected(selected)
+	codec := newCodecFields(channel.Codec)
+
+	items := []*widget.FormItem{
+		widget.NewFormItem("Name", nameEntry),
+		widget.NewFormItem("Description", descEntry),
+		widget.NewFormItem("Max Users (0=unlimited)", maxEntry),
+		widget.NewFormItem("Parent", parentSelect),
+		widget.NewFormItem("", allowSub),
+		widget.NewFormItem("", e2ee),
+		widget.NewFormItem("Chat history", history),
+		widget.NewFormItem("Password", passwordEntry),
+		widget.NewFormItem("", clearPassword),
+	}
+	items = append(items, codec.formItems()...)
+
+	d := dialog.NewForm("Edit Channel", "Save", "Cancel", items,
+		func(ok bool) {
+			if !ok {
+				return
+			}
+			name := strings.TrimSpace(nameEntry.Text)
+			if name == "" {
+				dialog.ShowError(fmt.Errorf("channel name is required"), a.window)
+				return
+			}
+			var maxUsers int
+			_, _ = fmt.Sscanf(maxEntry.Text, "%d", &maxUsers)
+			err := a.engine.EditChannel(channel.ID, name, descEntry.Text, maxUsers, parentIDs[parentSelect.Selected],
+				allowSub.Checked, passwordEntry.Text, clearPassword.Checked, e2ee.Checked, retentionSeconds(history), codec.settings())
+			if err != nil {
+				dialog.ShowError(err, a.window)
+			}
+		}, a.window)
+	d.Resize(fyne.NewSize(420, 500))
+	d.Show()
+}
+
 func (a *App) showImportDialog() {
 	yamlEntry := widget.NewMultiLineEntry()
 	yamlEntry.SetPlaceHolder("Paste YAML here...\nExample:\nchannels:\n  - name: Gaming\n    allow_sub_channels: true\n  - name: Music")
@@ -687,6 +1502,15 @@ func (a *App) showSettingsDialog() {
 		vadLabel.SetText(fmt.Sprintf("VAD Threshold: %.0f", v))
 	}
 
+	// Priority speaker ducking slider
+	duckSlider := widget.NewSlider(0, 40)
+	duckSlider.Value = a.settings.DuckingDB
+	duckSlider.Step = 1
+	duckLabel := widget.NewLabel(fmt.Sprintf("Priority Speaker Ducking: %.0f dB", a.settings.DuckingDB))
+	duckSlider.OnChanged = func(v float64) {
+		duckLabel.SetText(fmt.Sprintf("Priority Speaker Ducking: %.0f dB", v))
+	}
+
 	// Hotkey configuration
 	keyOptions := []string{"F1", "F2", "F3", "F4", "F5", "F6", "F7", "F8", "F9", "F10", "F11", "F12"}
 	muteKeySelect := widget.NewSelect(keyOptions, nil)
@@ -705,6 +1529,9 @@ func (a *App) showSettingsDialog() {
 		vadLabel,
 		vadSlider,
 		widget.NewLabel("Lower = more sensitive, Higher = less sensitive"),
+		duckLabel,
+		duckSlider,
+		widget.NewLabel("How much other voices are lowered while a priority speaker talks"),
 		widget.NewSeparator(),
 		widget.NewLabelWithStyle("Hotkeys (global, works in background)", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
 		widget.NewSeparator(),
@@ -718,8 +1545,10 @@ func (a *App) showSettingsDialog() {
 				return
 			}
 			a.engine.SetVADThreshold(vadSlider.Value)
+			a.engine.SetDuckingAttenuation(duckSlider.Value)
 
 			a.settings.VADThreshold = vadSlider.Value
+			a.settings.DuckingDB = duckSlider.Value
 			a.settings.MuteKey = muteKeySelect.Selected
 			a.settings.DeafenKey = deafenKeySelect.Selected
 			if inputSelect.Selected != "(Default)" {
@@ -804,9 +1633,12 @@ func (a *App) updateChannelListItem(id widget.ListItemID, obj fyne.CanvasObject)
 	indent.Refresh()
 
 	if item.isChannel {
-		if item.depth > 0 {
+		switch {
+		case item.channel.HasPassword:
+			icon.SetResource(lockIcon)
+		case item.depth > 0:
 			icon.SetResource(theme.FolderOpenIcon())
-		} else {
+		default:
 			icon.SetResource(theme.FolderIcon())
 		}
 		userCount := len(item.channel.Users)
@@ -814,6 +1646,9 @@ func (a *App) updateChannelListItem(id widget.ListItemID, obj fyne.CanvasObject)
 		if item.channel.IsTemp {
 			name = "~ " + name
 		}
+		if item.channel.E2EE {
+			name += " [E2EE]"
+		}
 		label.SetText(fmt.Sprintf("%s (%d)", name, userCount))
 		label.TextStyle = fyne.TextStyle{Bold: true}
 
@@ -839,6 +1674,15 @@ func (a *App) updateChannelListItem(id widget.ListItemID, obj fyne.CanvasObject)
 		if item.user.Deafened {
 			status += " [D]"
 		}
+		if item.user.ServerMuted {
+			status += " [SM]"
+		}
+		if item.user.ServerDeafened {
+			status += " [SD]"
+		}
+		if item.user.PrioritySpeaker {
+			status += " [P]"
+		}
 		roleTag := ""
 		switch item.user.Role {
 		case "admin":
@@ -859,26 +1703,305 @@ func (a *App) onChannelListSelect(id widget.ListItemID) {
 		if a.engine.GetState() != client.StateConnected {
 			return
 		}
-		if err := a.engine.JoinChannel(item.channelID); err != nil {
+		a.joinChannel(item.channel)
+		return
+	}
+
+	// Clicking on a user offers a direct message, plus admin actions for
+	// admin/mod
+	a.showUserContextMenu(item.user)
+}
+
+// joinChannel joins a channel, prompting for its password first if it has
+// one. Admins bypass channel passwords server-side and are not prompted.
+func (a *App) joinChannel(channel pb.ChannelInfo) {
+	join := func(password string) {
+		if err := a.engine.JoinChannelWithPassword(channel.ID, password); err != nil {
 			dialog.ShowError(err, a.window)
 		}
-		a.chatBox.Objects = nil
-		a.chatBox.Refresh()
+		a.clearChat(channel.ID) // the engine fetches the channel's history
+	}
+
+	if !channel.HasPassword || a.engine.GetRole() == "admin" {
+		join("")
+		return
+	}
+
+	passwordEntry := widget.NewPasswordEntry()
+	d := dialog.NewForm(
+		fmt.Sprintf("Join %s", channel.Name), "Join", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Password", passwordEntry)},
+		func(ok bool) {
+			if ok {
+				join(passwordEntry.Text)
+			}
+		}, a.window)
+	d.Resize(fyne.NewSize(350, 150))
+	d.Show()
+	a.window.Canvas().Focus(passwordEntry)
+}
+
+// clearChat empties the chat pane for a channel whose history is on its way.
+func (a *App) clearChat(channelID int64) {
+	a.chatChannel = channelID
+	a.chatBefore = 0
+	a.chatIDs = nil
+	a.chatBox.Objects = nil
+	a.chatBox.Refresh()
+	a.chatOlder.Hide()
+}
+
+// addChatLine appends a notice to the chat pane.
+func (a *App) addChatLine(text string) {
+	lbl := widget.NewLabel(text)
+	lbl.Wrapping = fyne.TextWrapWord
+	a.chatBox.Add(lbl)
+	a.chatIDs = append(a.chatIDs, 0)
+}
+
+// addChatMessage appends a message to the chat pane.
+func (a *App) addChatMessage(msg pb.ChatMessage) {
+	a.chatBox.Add(a.newChatLabel(msg))
+	a.chatIDs = append(a.chatIDs, msg.ID)
+}
+
+// editChatLine shows the new text of an edited message, if it is shown.
+func (a *App) editChatLine(msg pb.ChatMessage) {
+	if i := slices.Index(a.chatIDs, msg.ID); i >= 0 && msg.ChannelID == a.chatChannel {
+		if l, ok := a.chatBox.Objects[i].(*chatLabel); ok {
+			l.msg = msg
+			l.SetText(chatLine(msg))
+		}
+	}
+}
+
+// removeChatLine takes a deleted message off the chat pane. A message
+// removed by a moderator leaves a notice in its place.
+func (a *App) removeChatLine(channelID, id int64, deletedBy string) {
+	i := slices.Index(a.chatIDs, id)
+	if i < 0 || channelID != a.chatChannel {
+		return
+	}
+	if deletedBy != "" {
+		lbl := widget.NewLabel(fmt.Sprintf("(message removed by %s)", deletedBy))
+		lbl.Wrapping = fyne.TextWrapWord
+		a.chatBox.Objects[i] = lbl
+		a.chatIDs[i] = 0
+	} else {
+		a.chatBox.Objects = slices.Delete(a.chatBox.Objects, i, i+1)
+		a.chatIDs = slices.Delete(a.chatIDs, i, i+1)
+	}
+	a.chatBox.Refresh()
+}
+
+// chatLabel is the chat pane line of a message. A right click offers to
+// edit or delete it, where allowed; the server has the final say.
+type chatLabel struct {
+	widget.Label
+	app *App
+	msg pb.ChatMessage
+}
+
+func (a *App) newChatLabel(msg pb.ChatMessage) *chatLabel {
+	l := &chatLabel{app: a, msg: msg}
+	l.Text = chatLine(msg)
+	l.Wrapping = fyne.TextWrapWord
+	l.ExtendBaseWidget(l)
+	return l
+}
+
+// TappedSecondary shows the actions for the message.
+func (l *chatLabel) TappedSecondary(ev *fyne.PointEvent) {
+	a, msg := l.app, l.msg
+	own := msg.SenderName == a.engine.GetUsername()
+	role := a.engine.GetRole()
+
+	var items []*fyne.MenuItem
+	if own {
+		items = append(items, fyne.NewMenuItem("Edit", func() {
+			a.showEditChat(msg)
+		}))
+	}
+	if own || role == "admin" || role == "moderator" {
+		items = append(items, fyne.NewMenuItem("Delete", func() {
+			dialog.ShowConfirm("Delete Message", "Delete this message for everyone?", func(ok bool) {
+				if !ok {
+					return
+				}
+				if err := a.engine.DeleteChatMessage(msg.ChannelID, msg.ID); err != nil {
+					dialog.ShowError(err, a.window)
+				}
+			}, a.window)
+		}))
+	}
+	if len(items) == 0 {
 		return
 	}
+	canvas := fyne.CurrentApp().Driver().CanvasForObject(l)
+	widget.ShowPopUpMenuAtPosition(fyne.NewMenu("", items...), canvas, ev.AbsolutePosition)
+}
+
+func (a *App) showEditChat(msg pb.ChatMessage) {
+	entry := widget.NewEntry()
+	entry.SetText(msg.Text)
+	d := dialog.NewForm("Edit Message", "Save", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Text", entry)},
+		func(ok bool) {
+			text := strings.TrimSpace(entry.Text)
+			if !ok || text == "" || text == msg.Text {
+				return
+			}
+			if err := a.engine.EditChatMessage(msg.ChannelID, msg.ID, text); err != nil {
+				dialog.ShowError(err, a.window)
+			}
+		}, a.window)
+	d.Resize(fyne.NewSize(400, 150))
+	d.Show()
+	a.window.Canvas().Focus(entry)
+}
 
-	// Clicking on a user shows admin actions (for admin/mod)
-	if a.engine.GetRole() == "admin" || a.engine.GetRole() == "moderator" {
-		a.showUserContextMenu(item.user)
+// mergeChatHistory adds a page of history, oldest first, to the chat pane.
+// Messages already shown are skipped and the rest go in ID order, so a page
+// may overlap live messages and older pages go on top.
+func (a *App) mergeChatHistory(msgs []pb.ChatMessage, nextBefore int64) {
+	older := len(a.chatIDs) > 0
+	for _, msg := range msgs {
+		if slices.Contains(a.chatIDs, msg.ID) {
+			continue
+		}
+		// Insert before the first newer message; notices stay where they are
+		i := slices.IndexFunc(a.chatIDs, func(id int64) bool { return id > msg.ID })
+		if i < 0 {
+			older = false
+			a.addChatMessage(msg)
+			continue
+		}
+		a.chatBox.Objects = slices.Insert(a.chatBox.Objects, i, fyne.CanvasObject(a.newChatLabel(msg)))
+		a.chatIDs = slices.Insert(a.chatIDs, i, msg.ID)
+	}
+	a.chatBox.Refresh()
+
+	a.chatBefore = nextBefore
+	if nextBefore != 0 {
+		a.chatOlder.Show()
+	} else {
+		a.chatOlder.Hide()
+	}
+	if !older {
+		a.chatScroll.ScrollToBottom()
+	}
+}
+
+// dmTab is a direct message conversation in the chat tabs.
+type dmTab struct {
+	peerID int64
+	name   string
+	tab    *container.TabItem
+	box    *fyne.Container
+	scroll *container.Scroll
+	unread int
+	stored bool // the server holds messages from the peer; fetched on first view
+}
+
+// openDM returns the conversation with a user, adding its tab if needed.
+// name may be empty if unknown; the user list is searched then.
+func (a *App) openDM(peerID int64, name string, show bool) *dmTab {
+	dm, ok := a.dms[peerID]
+	if !ok {
+		if name == "" {
+			name = fmt.Sprintf("#%d", peerID)
+			for _, ch := range a.channels {
+				for _, u := range ch.Users {
+					if u.ID == peerID {
+						name = u.Username
+					}
+				}
+			}
+		}
+		dm = &dmTab{peerID: peerID, name: name, box: container.NewVBox()}
+		dm.scroll = container.NewVScroll(dm.box)
+		entry := widget.NewEntry()
+		entry.SetPlaceHolder(fmt.Sprintf("Message %s... (Enter to send)", name))
+		entry.OnSubmitted = func(text string) {
+			text = strings.TrimSpace(text)
+			if text == "" {
+				return
+			}
+			if err := a.engine.SendDirectMessage(peerID, text); err != nil {
+				dialog.ShowError(err, a.window)
+				return
+			}
+			entry.SetText("")
+		}
+		dm.tab = container.NewTabItem("@"+name, container.NewBorder(nil, entry, nil, nil, dm.scroll))
+		a.dms[peerID] = dm
+		a.chatTabs.Append(dm.tab)
+	}
+	if show {
+		a.chatTabs.Select(dm.tab)
+	}
+	return dm
+}
+
+// readDM marks a conversation read when its tab is shown, fetching the
+// messages the server kept for us.
+func (a *App) readDM(dm *dmTab) {
+	if dm.stored {
+		dm.stored = false
+		if err := a.engine.FetchUnreadMessages(dm.peerID); err != nil {
+			slog.Debug("fetch unread messages error", "err", err)
+		}
 	}
+	dm.unread = 0
+	a.refreshDMTab(dm)
+}
+
+// refreshDMTab shows the unread count in a conversation's tab title.
+func (a *App) refreshDMTab(dm *dmTab) {
+	title := "@" + dm.name
+	if dm.unread > 0 {
+		title = fmt.Sprintf("@%s (%d)", dm.name, dm.unread)
+	}
+	if dm.tab.Text != title {
+		dm.tab.Text = title
+		a.chatTabs.Refresh()
+	}
+}
+
+func (a *App) addDMLine(dm *dmTab, text string) {
+	lbl := widget.NewLabel(text)
+	lbl.Wrapping = fyne.TextWrapWord
+	dm.box.Add(lbl)
+	if len(dm.box.Objects) > 500 {
+		dm.box.Objects = dm.box.Objects[len(dm.box.Objects)-500:]
+		dm.box.Refresh()
+	}
+	dm.scroll.ScrollToBottom()
+}
+
+// chatLine formats a chat message for the chat pane.
+func chatLine(msg pb.ChatMessage) string {
+	line := fmt.Sprintf("[%s] %s: %s", time.Unix(msg.Timestamp, 0).Format("15:04"), msg.SenderName, msg.Text)
+	if msg.Edited != 0 {
+		line += " (edited)"
+	}
+	return line
 }
 
 func (a *App) showUserContextMenu(user pb.UserInfo) {
 	role := a.engine.GetRole()
 	var buttons []fyne.CanvasObject
+	var d dialog.Dialog
+
+	if user.Username != a.engine.GetUsername() {
+		buttons = append(buttons, widget.NewButton("Send Message", func() {
+			a.readDM(a.openDM(user.ID, user.Username, true))
+			d.Hide()
+		}))
+	}
 
 	if role == "admin" {
-		roleSelect := widget.NewSelect([]string{"user", "moderator", "admin"}, nil)
+		roleSelect := widget.NewSelect(a.engine.GetRoles(), nil)
 		roleSelect.SetSelected(user.Role)
 		setRoleBtn := widget.NewButton("Set Role", func() {
 			_ = a.engine.SetUserRole(user.ID, roleSelect.Selected)
@@ -899,24 +2022,67 @@ func (a *App) showUserContextMenu(user pb.UserInfo) {
 			}, a.window)
 		})
 		buttons = append(buttons, kickBtn)
+
+		serverMuteCheck := widget.NewCheck("Server mute", nil)
+		serverMuteCheck.SetChecked(user.ServerMuted)
+		serverDeafenCheck := widget.NewCheck("Server deafen", nil)
+		serverDeafenCheck.SetChecked(user.ServerDeafened)
+		applyMute := func(bool) {
+			if err := a.engine.ServerMute(user.ID, serverMuteCheck.Checked, serverDeafenCheck.Checked); err != nil {
+				dialog.ShowError(err, a.window)
+			}
+		}
+		serverMuteCheck.OnChanged = applyMute
+		serverDeafenCheck.OnChanged = applyMute
+		priorityCheck := widget.NewCheck("Priority speaker", nil)
+		priorityCheck.SetChecked(user.PrioritySpeaker)
+		priorityCheck.OnChanged = func(enabled bool) {
+			if err := a.engine.SetPrioritySpeaker(user.ID, enabled); err != nil {
+				dialog.ShowError(err, a.window)
+			}
+		}
+		buttons = append(buttons, container.NewHBox(serverMuteCheck, serverDeafenCheck, priorityCheck))
+
+		channelNames := make([]string, 0, len(a.channels))
+		channelIDs := make(map[string]int64, len(a.channels))
+		for _, item := range a.flattenChannels() {
+			if !item.isChannel {
+				continue
+			}
+			name := strings.Repeat("  ", item.depth) + item.channel.Name
+			channelNames = append(channelNames, name)
+			channelIDs[name] = item.channel.ID
+		}
+		moveSelect := widget.NewSelect(channelNames, nil)
+		moveBtn := widget.NewButton("Move", func() {
+			id, ok := channelIDs[moveSelect.Selected]
+			if !ok {
+				return
+			}
+			if err := a.engine.MoveUser(user.ID, id); err != nil {
+				dialog.ShowError(err, a.window)
+			}
+		})
+		buttons = append(buttons, container.NewHBox(widget.NewLabel("Move to:"), moveSelect, moveBtn))
 	}
 
 	if role == "admin" {
+		banIPCheck := widget.NewCheck("Also ban IP address", nil)
 		banBtn := widget.NewButton("Ban User (1h)", func() {
 			dialog.ShowConfirm("Ban User", fmt.Sprintf("Ban %s for 1 hour?", user.Username), func(ok bool) {
 				if ok {
-					_ = a.engine.BanUser(user.ID, "banned by "+a.engine.GetUsername(), 3600)
+					_ = a.engine.BanUser(user.ID, "banned by "+a.engine.GetUsername(), 3600, banIPCheck.Checked)
 				}
 			}, a.window)
 		})
-		buttons = append(buttons, banBtn)
+		buttons = append(buttons, container.NewHBox(banBtn, banIPCheck))
 	}
 
 	if len(buttons) == 0 {
 		return
 	}
 
-	d := dialog.NewCustom("User Actions", "Close", container.NewVBox(buttons...), a.window)
+	d = dialog.NewCustom("User Actions", "Close", container.NewVBox(buttons...), a.window)
 	d.Resize(fyne.NewSize(400, 250))
 	d.Show()
 }
@@ -951,14 +2117,16 @@ func (a *App) showChannelSettingsDialog(channel pb.ChannelInfo) {
 
 	// Join button (always shown)
 	joinBtn := widget.NewButton("Join Channel", func() {
-		if err := a.engine.JoinChannel(channel.ID); err != nil {
-			dialog.ShowError(err, a.window)
-		}
-		a.chatBox.Objects = nil
-		a.chatBox.Refresh()
+		a.joinChannel(channel)
 	})
 	items = append(items, joinBtn)
 
+	if channel.E2EE {
+		items = append(items, widget.NewButton("Verify Encryption...", func() {
+			a.showSafetyNumbers(channel)
+		}))
+	}
+
 	// Create sub-channel (if allowed)
 	if channel.AllowSubChannels {
 		items = append(items, widget.NewSeparator())
@@ -979,6 +2147,18 @@ func (a *App) showChannelSettingsDialog(channel pb.ChannelInfo) {
 		)
 	}
 
+	// Admin: edit channel properties in place
+	if role == "admin" {
+		items = append(items, widget.NewSeparator())
+		editBtn := widget.NewButton("Edit Channel...", func() {
+			a.showEditChannelDialog(channel)
+		})
+		permsBtn := widget.NewButton("Permissions...", func() {
+			a.showChannelACLManager(channel)
+		})
+		items = append(items, editBtn, permsBtn)
+	}
+
 	// Admin: delete channel (not Lobby)
 	if (role == "admin" || role == "moderator") && channel.Name != "Lobby" {
 		items = append(items, widget.NewSeparator())
@@ -1002,6 +2182,41 @@ func (a *App) showChannelSettingsDialog(channel pb.ChannelInfo) {
 	d.Show()
 }
 
+// showSafetyNumbers lists the holders of an E2EE channel's key with the
+// safety number shared with each. Matching numbers, compared in person or
+// over another channel, prove the server did not swap anyone's key.
+func (a *App) showSafetyNumbers(channel pb.ChannelInfo) {
+	members := a.engine.E2EEMembers(channel.ID)
+	if members == nil {
+		dialog.ShowInformation("Verify Encryption", "Join the channel to see who holds its key.", a.window)
+		return
+	}
+
+	items := []fyne.CanvasObject{
+		widget.NewLabel("Everyone who can hear this channel. Compare your safety\nnumber with each member over another channel."),
+		widget.NewSeparator(),
+	}
+	for _, m := range members {
+		if m.Self {
+			continue
+		}
+		number := widget.NewLabel(m.SafetyNumber)
+		number.TextStyle = fyne.TextStyle{Monospace: true}
+		number.Wrapping = fyne.TextWrapWord
+		items = append(items,
+			widget.NewLabelWithStyle(m.Username, fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+			number,
+		)
+	}
+	if len(members) == 1 {
+		items = append(items, widget.NewLabel("You are the only member."))
+	}
+
+	d := dialog.NewCustom("Verify Encryption: "+channel.Name, "Close", container.NewVScroll(container.NewVBox(items...)), a.window)
+	d.Resize(fyne.NewSize(420, 400))
+	d.Show()
+}
+
 func (a *App) showHelpDialog() {
 	helpText := "GoSpeak — Voice Communication\n\n" +
 		"CHANNEL LIST\n" +
@@ -1047,6 +2262,7 @@ func (a *App) saveCurrentBookmark(username string) {
 		VoiceAddr:   a.connectVoice,
 		Username:    username,
 		Token:       a.connectToken,
+		Fingerprint: a.engine.ServerFingerprint(),
 	})
 	if err := a.bookmarks.Save(); err != nil {
 		slog.Error("failed to save bookmark", "err", err)